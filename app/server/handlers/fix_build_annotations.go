@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// annotationsUrlHostAllowed reports whether u's host is in FIX_BUILD_ANNOTATIONS_URL_HOSTS,
+// either as a bare host name or with its port.
+func annotationsUrlHostAllowed(hosts []string, u *url.URL) bool {
+	return slices.Contains(hosts, strings.ToLower(u.Host)) || slices.Contains(hosts, strings.ToLower(u.Hostname()))
+}
+
+// validateAnnotationsUrl checks a payload's annotationsUrl before anything is fetched from it.
+// The host allowlist keeps the server from being used to reach internal services.
+func validateAnnotationsUrl(p FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	u, err := url.Parse(p.AnnotationsUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "annotationsUrl must be an absolute http(s) URL")
+	}
+	if len(p.Annotations) > 0 {
+		return newFixBuildError(http.StatusBadRequest, "invalid_payload", "set annotations or annotationsUrl, not both")
+	}
+	if !annotationsUrlHostAllowed(cfg.AnnotationsUrlHosts, u) {
+		return newFixBuildError(http.StatusForbidden, "annotations_host_not_allowed", "annotationsUrl host %s is not in this server's FIX_BUILD_ANNOTATIONS_URL_HOSTS", u.Host)
+	}
+	return nil
+}
+
+// errAnnotationsRedirect stops a redirect off the allowlisted hosts.
+var errAnnotationsRedirect = errors.New("redirected to a host not in FIX_BUILD_ANNOTATIONS_URL_HOSTS")
+
+// fetchAnnotations downloads the JSON array of annotations at the payload's annotationsUrl,
+// authenticated with its installation token. Redirects must stay on allowlisted hosts, and a
+// body over MaxAnnotationsBytes is refused.
+func fetchAnnotations(ctx context.Context, cfg fixBuildConfig, p FixBuildPayload) ([]FixBuildAnno, *fixBuildError) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !annotationsUrlHostAllowed(cfg.AnnotationsUrlHosts, req.URL) {
+				return errAnnotationsRedirect
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.AnnotationsUrl, nil)
+	if err != nil {
+		return nil, newFixBuildError(http.StatusBadRequest, "invalid_payload", "invalid annotationsUrl: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.InstallationToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.InstallationToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		err = redactToken(err, p.InstallationToken)
+		log.Printf("[fix_build] fetch annotations: %v", err)
+		if errors.Is(err, errAnnotationsRedirect) {
+			return nil, newFixBuildError(http.StatusForbidden, "annotations_host_not_allowed", "annotationsUrl %v", errAnnotationsRedirect)
+		}
+		return nil, newFixBuildError(http.StatusBadGateway, "annotations_fetch_failed", "fetching annotationsUrl failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, newFixBuildError(http.StatusBadGateway, "annotations_fetch_failed", "fetching annotationsUrl failed: HTTP %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, cfg.MaxAnnotationsBytes+1))
+	if err != nil {
+		return nil, newFixBuildError(http.StatusBadGateway, "annotations_fetch_failed", "reading annotationsUrl failed: %v", err)
+	}
+	if int64(len(body)) > cfg.MaxAnnotationsBytes {
+		return nil, newFixBuildError(http.StatusRequestEntityTooLarge, "annotations_too_large", "annotationsUrl body is over the server's %d MB limit (FIX_BUILD_MAX_ANNOTATIONS_MB)", cfg.MaxAnnotationsBytes>>20)
+	}
+	var annos []FixBuildAnno
+	if err := json.Unmarshal(body, &annos); err != nil {
+		return nil, newFixBuildError(http.StatusUnprocessableEntity, "invalid_annotations", "annotationsUrl must serve a JSON array of annotations: %v", err)
+	}
+	return annos, nil
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// annotationsServer serves body at /annotations.json to requests with the "tok" installation
+// token, and redirects /elsewhere to itself by another name, localhost. hits counts the
+// requests it got.
+func annotationsServer(t *testing.T, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	t.Setenv("FIX_BUILD_PROTECTED_BRANCHES", "")
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch {
+		case r.Header.Get("Authorization") != "Bearer tok":
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		case r.URL.Path == "/elsewhere":
+			_, port, _ := net.SplitHostPort(r.Host)
+			http.Redirect(w, r, "http://localhost:"+port+"/annotations.json", http.StatusFound)
+		case r.URL.Path == "/annotations.json":
+			_, _ = w.Write([]byte(body))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestFixBuildAnnotationsUrl(t *testing.T) {
+	annos := `[{"path":"pkg/a.go","start_line":3,"end_line":3,"annotation_level":"failure","message":"undefined: frobnicate"}]`
+	srv, hits := annotationsServer(t, annos)
+	u, _ := url.Parse(srv.URL)
+	t.Setenv("FIX_BUILD_ANNOTATIONS_URL_HOSTS", "example.com,"+u.Host)
+
+	payload := fakeRunnerPayload("aaa0079")
+	payload.AnnotationsUrl = srv.URL + "/annotations.json"
+	rec := postFixBuildPreview(t, payload)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var preview FixBuildPreview
+	if err := json.Unmarshal(rec.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Annotations) != 1 || preview.Annotations[0].Path != "pkg/a.go" {
+		t.Fatalf("expected the fetched annotation, got %+v", preview.Annotations)
+	}
+	if !strings.Contains(preview.Context, "undefined: frobnicate") {
+		t.Fatalf("expected the fetched annotation in the context, got:\n%s", preview.Context)
+	}
+
+	tests := []struct {
+		name   string
+		setup  func(p *FixBuildPayload)
+		status int
+		code   string
+	}{
+		{"host not allowed", func(p *FixBuildPayload) { p.AnnotationsUrl = "http://169.254.169.254/latest/meta-data" }, http.StatusForbidden, "annotations_host_not_allowed"},
+		{"redirect off the allowlist", func(p *FixBuildPayload) { p.AnnotationsUrl = srv.URL + "/elsewhere" }, http.StatusForbidden, "annotations_host_not_allowed"},
+		{"not a URL", func(p *FixBuildPayload) { p.AnnotationsUrl = "file:///etc/passwd" }, http.StatusBadRequest, "invalid_payload"},
+		{"inline annotations too", func(p *FixBuildPayload) {
+			p.AnnotationsUrl = srv.URL + "/annotations.json"
+			p.Annotations = []FixBuildAnno{{Path: "a.go", AnnotationLevel: "failure", Message: "boom"}}
+		}, http.StatusBadRequest, "invalid_payload"},
+		{"fetch fails", func(p *FixBuildPayload) { p.AnnotationsUrl = srv.URL + "/missing.json" }, http.StatusBadGateway, "annotations_fetch_failed"},
+	}
+	for _, tt := range tests {
+		p := fakeRunnerPayload("aaa0079")
+		tt.setup(&p)
+		rec := postFixBuildPreview(t, p)
+		if rec.Code != tt.status || !strings.Contains(rec.Body.String(), `"code":"`+tt.code+`"`) {
+			t.Fatalf("%s: expected %d %s, got %d: %s", tt.name, tt.status, tt.code, rec.Code, rec.Body.String())
+		}
+	}
+
+	// A disallowed host is never contacted
+	before := hits.Load()
+	p := fakeRunnerPayload("aaa0079")
+	p.AnnotationsUrl = "http://127.0.0.2:1/annotations.json"
+	if rec := postFixBuildPreview(t, p); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if hits.Load() != before {
+		t.Fatal("expected no request for a disallowed host")
+	}
+}
+
+func TestFixBuildAnnotationsUrlSizeLimit(t *testing.T) {
+	big := `[{"path":"a.go","annotation_level":"failure","message":"` + strings.Repeat("x", 1<<20) + `"}]`
+	srv, _ := annotationsServer(t, big)
+	u, _ := url.Parse(srv.URL)
+	t.Setenv("FIX_BUILD_ANNOTATIONS_URL_HOSTS", u.Hostname())
+	t.Setenv("FIX_BUILD_MAX_ANNOTATIONS_MB", "1")
+
+	p := fakeRunnerPayload("aaa1079")
+	p.AnnotationsUrl = srv.URL + "/annotations.json"
+	rec := postFixBuildPreview(t, p)
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), `"code":"annotations_too_large"`) {
+		t.Fatalf("expected 413 annotations_too_large, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
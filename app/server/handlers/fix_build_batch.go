@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// FixBuildBatchResult is one payload's outcome in a /fix_build/batch response: the result
+// /fix_build would have responded with, or its error.
+type FixBuildBatchResult struct {
+	Status int                `json:"status"`
+	Result *FixBuildResponse  `json:"result,omitempty"`
+	Error  *FixBuildErrorBody `json:"error,omitempty"`
+}
+
+// FixBuildBatchHandler handles POST /fix_build/batch: a JSON array of /fix_build payloads for
+// unrelated failures, answered with an array of their results in the same order once they've
+// all finished. Each payload is its own job, with its own work dir, and they run at once
+// within FIX_BUILD_MAX_CONCURRENCY like any other fixes. With ?failFast=true the first
+// failure cancels the payloads still running and skips the rest. Batches are always answered
+// synchronously, so payloads can't set callbackUrl.
+func FixBuildBatchHandler(rw http.ResponseWriter, r *http.Request) {
+	_, span := startRequestSpan(r)
+	w := &statusWriter{ResponseWriter: rw}
+	defer endRequestSpan(span, w)
+
+	body, ok := readFixBuildBody(w, r)
+	if !ok {
+		return
+	}
+	var payloads []FixBuildPayload
+	if err := json.Unmarshal(body, &payloads); err != nil {
+		log.Printf("[fix_build] parse batch: %v", err)
+		writeFixBuildError(w, newFixBuildError(http.StatusBadRequest, "invalid_json", "invalid JSON: the body must be an array of payloads"))
+		return
+	}
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		log.Printf("[fix_build] load config: %v", err)
+		writeFixBuildError(w, newFixBuildError(http.StatusInternalServerError, "invalid_server_config", "invalid fix_build server config: %v", err))
+		return
+	}
+	if len(payloads) == 0 {
+		writeFixBuildError(w, newFixBuildError(http.StatusBadRequest, "invalid_payload", "batch is empty"))
+		return
+	}
+	if cfg.MaxBatchSize > 0 && len(payloads) > cfg.MaxBatchSize {
+		writeFixBuildError(w, newFixBuildError(http.StatusRequestEntityTooLarge, "batch_too_large", "batch has %d payloads; the server allows at most %d (FIX_BUILD_MAX_BATCH_SIZE)", len(payloads), cfg.MaxBatchSize))
+		return
+	}
+	span.SetAttributes(attribute.Int("fix_build.batch_size", len(payloads)))
+
+	failFast, _ := strconv.ParseBool(r.URL.Query().Get("failFast"))
+	includeLogs, _ := strconv.ParseBool(r.URL.Query().Get("includeLogs"))
+	// Jobs don't stop when the caller goes away, like a sync /fix_build; this only fails fast
+	batchCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+
+	results := make([]FixBuildBatchResult, len(payloads))
+	var wg sync.WaitGroup
+	for i, payload := range payloads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, fbErr := fixBatchItem(batchCtx, span, payload, cfg)
+			if fbErr == nil {
+				results[i] = FixBuildBatchResult{Status: http.StatusOK, Result: res}
+				return
+			}
+			if failFast {
+				abort()
+			}
+			body := responseLogs(fbErr, includeLogs, payload).body()
+			results[i] = FixBuildBatchResult{Status: fbErr.Status, Error: &body}
+		}()
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+// fixBatchItem fixes one payload of a batch the way FixBuildHandler fixes a sync request. Once
+// batchCtx is done it cancels the payload's job, or skips it if it hasn't started one.
+func fixBatchItem(batchCtx context.Context, span trace.Span, payload FixBuildPayload, cfg fixBuildConfig) (*FixBuildResponse, *fixBuildError) {
+	aborted := func() *fixBuildError {
+		return newFixBuildError(http.StatusConflict, "batch_aborted", "skipped after another payload in the batch failed (failFast)")
+	}
+	if batchCtx.Err() != nil {
+		return nil, aborted()
+	}
+	if payload.CallbackUrl != "" {
+		return nil, newFixBuildError(http.StatusBadRequest, "invalid_payload", "callbackUrl isn't supported in a batch")
+	}
+	if fbErr := prepareFixBuildPayload(batchCtx, &payload, cfg); fbErr != nil {
+		return nil, fbErr
+	}
+
+	target := coalesceKey(payload)
+	lead, leader := fixBuildCoalescer.join(target, cfg.CoalesceWindow)
+	if !leader {
+		log.Printf("[fix_build] joining the fix for %s", target)
+		<-lead.done
+		return lead.res, lead.err
+	}
+	if batchCtx.Err() != nil {
+		fbErr := aborted()
+		lead.finish(nil, fbErr)
+		return nil, fbErr
+	}
+	key := deriveIdempotencyKey(payload)
+	job, ctx, cached, fbErr := beginFixBuild(lead, key, payload, cfg)
+	if fbErr != nil || cached != nil {
+		return cached, fbErr
+	}
+	stop := context.AfterFunc(batchCtx, func() {
+		if _, err := fixBuildJobs.cancel(job.Id); err == nil {
+			log.Printf("[fix_build] job %s cancelled: another payload in its batch failed", job.Id)
+		}
+	})
+	defer stop()
+	return completeFixBuild(trace.ContextWithSpan(ctx, span), lead, job, key, payload, cfg)
+}
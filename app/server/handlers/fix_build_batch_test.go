@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func postFixBuildBatch(t *testing.T, query string, payloads []FixBuildPayload) []FixBuildBatchResult {
+	t.Helper()
+	body, err := json.Marshal(payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/fix_build/batch"+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	FixBuildBatchHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var results []FixBuildBatchResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(payloads) {
+		t.Fatalf("expected %d results, got %d: %s", len(payloads), len(results), rec.Body.String())
+	}
+	return results
+}
+
+func TestFixBuildBatchMixed(t *testing.T) {
+	f := useFakeRunner(t, map[string]fakeResponse{
+		"git reset --hard bbb2083": {out: "fatal: bad object", err: &fakeExitError{code: 128}},
+	})
+	invalid := fakeRunnerPayload("bbb1083")
+	invalid.HeadSha = "not-a-sha"
+	callback := fakeRunnerPayload("bbb3083")
+	callback.CallbackUrl = "https://example.com/hook"
+
+	results := postFixBuildBatch(t, "", []FixBuildPayload{fakeRunnerPayload("bbb0083"), invalid, fakeRunnerPayload("bbb2083"), callback})
+
+	if r := results[0]; r.Status != http.StatusOK || r.Result == nil || !r.Result.Ok || r.Result.JobId == "" || r.Error != nil {
+		t.Fatalf("expected the first payload fixed, got %+v", r)
+	}
+	wants := []struct {
+		status int
+		code   string
+	}{
+		{http.StatusBadRequest, "invalid_payload"},
+		{http.StatusInternalServerError, "reset_failed"},
+		{http.StatusBadRequest, "invalid_payload"},
+	}
+	for i, want := range wants {
+		r := results[i+1]
+		if r.Status != want.status || r.Error == nil || r.Error.Code != want.code || r.Result != nil {
+			t.Fatalf("payload %d: expected %d %s, got %+v", i+2, want.status, want.code, r)
+		}
+	}
+	if !f.called("git reset --hard bbb0083") || f.called("git reset --hard bbb1083") || f.called("git reset --hard bbb3083") {
+		t.Fatal("expected only the valid payloads to be cloned")
+	}
+	if n := f.countCalls("git push"); n != 1 {
+		t.Fatalf("expected one push, for the fixed payload, got %d", n)
+	}
+}
+
+func TestFixBuildBatchFailFast(t *testing.T) {
+	useFakeRunner(t, map[string]fakeResponse{
+		"git reset --hard bbb4083": {out: "fatal: bad object", err: &fakeExitError{code: 128}},
+		// Holds until its job is cancelled
+		"plandex tell": {hold: make(chan struct{})},
+	})
+
+	results := postFixBuildBatch(t, "?failFast=true", []FixBuildPayload{fakeRunnerPayload("bbb4083"), fakeRunnerPayload("bbb5083")})
+
+	if r := results[0]; r.Status != http.StatusInternalServerError || r.Error == nil || r.Error.Code != "reset_failed" {
+		t.Fatalf("expected the failing payload's error, got %+v", r)
+	}
+	// Depending on how far it got, the other payload was cancelled or never started
+	if r := results[1]; r.Status != http.StatusConflict || r.Error == nil || (r.Error.Code != "cancelled" && r.Error.Code != "batch_aborted") {
+		t.Fatalf("expected the other payload stopped, got %+v", r)
+	}
+}
+
+func TestFixBuildBatchRejectsBadBatches(t *testing.T) {
+	t.Setenv("FIX_BUILD_MAX_BATCH_SIZE", "2")
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"not an array", `{"repo":{"owner":"acme","name":"widgets"}}`, http.StatusBadRequest},
+		{"empty", `[]`, http.StatusBadRequest},
+		{"too large", `[{},{},{}]`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/fix_build/batch", bytes.NewReader([]byte(tt.body)))
+		req.Header.Set("Content-Type", "application/json")
+		FixBuildBatchHandler(rec, req)
+		if rec.Code != tt.status {
+			t.Fatalf("%s: expected %d, got %d: %s", tt.name, tt.status, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errGithubUnavailable is returned without calling GitHub while the breaker is open.
+var errGithubUnavailable = errors.New("GitHub API calls suspended after repeated failures")
+
+// githubRetryDelays are the base waits between attempts at a GitHub call that failed
+// transiently, each jittered; a var so tests can shorten them.
+var githubRetryDelays = []time.Duration{500 * time.Millisecond, 2 * time.Second}
+
+// maxGithubRetryWait caps how long a call waits out a rate limit itself; longer limits fail
+// the call and leave the breaker open until the limit resets.
+const maxGithubRetryWait = 10 * time.Second
+
+// breakerConfig opens the breaker after Threshold consecutive failures for Cooldown; a zero
+// Threshold disables both the breaker and retries.
+type breakerConfig struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// circuitBreaker is shared by every GitHub call so an outage or exhausted rate limit stops
+// them all at once instead of each request retrying into it.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+var githubBreaker = &circuitBreaker{}
+
+// allow reports whether a call may go ahead, and if not, when it may.
+func (b *circuitBreaker) allow(now time.Time) (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.openUntil), b.openUntil
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// failure records a failed call. A rate limit opens the breaker until resetAt; otherwise it
+// opens for cfg.Cooldown once cfg.Threshold calls in a row have failed. After a cooldown the
+// next call is let through, and reopens the breaker if it fails too.
+func (b *circuitBreaker) failure(now time.Time, cfg breakerConfig, resetAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if resetAt.After(b.openUntil) {
+		b.openUntil = resetAt
+	}
+	if b.failures >= cfg.Threshold {
+		if until := now.Add(cfg.Cooldown); until.After(b.openUntil) {
+			b.openUntil = until
+		}
+	}
+}
+
+// githubRateLimitReset returns when a rate-limited response says calls may resume: its
+// Retry-After, else its X-RateLimit-Reset, else a minute from now. ok is false if the
+// response wasn't rate limited.
+func githubRateLimitReset(status int, h http.Header, now time.Time) (time.Time, bool) {
+	limited := status == http.StatusTooManyRequests ||
+		status == http.StatusForbidden && (h.Get("X-RateLimit-Remaining") == "0" || h.Get("Retry-After") != "")
+	if !limited {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.Atoi(h.Get("Retry-After")); err == nil && secs >= 0 {
+		return now.Add(time.Duration(secs) * time.Second), true
+	}
+	if epoch, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		return time.Unix(epoch, 0), true
+	}
+	return now.Add(time.Minute), true
+}
+
+// jitter spreads d over [d/2, 3d/2) so retries from concurrent requests don't line up.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubGithub returns a client with its own breaker against a server that answers with status
+// until it is changed, counting the requests it gets.
+func stubGithub(t *testing.T, limits breakerConfig, status *atomic.Int32, header http.Header) (*githubClient, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(api.Close)
+	gh := newGithubClient(fixBuildConfig{GithubApiUrl: api.URL, GithubBreaker: limits}, "tok")
+	gh.breaker = &circuitBreaker{}
+	return gh, &hits
+}
+
+func TestGithubBreakerOpensAndCloses(t *testing.T) {
+	saved := githubRetryDelays
+	githubRetryDelays = nil
+	defer func() { githubRetryDelays = saved }()
+
+	var status atomic.Int32
+	status.Store(http.StatusBadGateway)
+	gh, hits := stubGithub(t, breakerConfig{Threshold: 3, Cooldown: 100 * time.Millisecond}, &status, nil)
+
+	for i := 0; i < 3; i++ {
+		if code, err := gh.do(http.MethodGet, "/rate", nil, nil); err != nil || code != http.StatusBadGateway {
+			t.Fatalf("call %d: expected the 502 to be returned, got %d, %v", i+1, code, err)
+		}
+	}
+	// Open: calls fail fast without reaching GitHub
+	if _, err := gh.do(http.MethodGet, "/rate", nil, nil); !errors.Is(err, errGithubUnavailable) {
+		t.Fatalf("expected the breaker to be open, got %v", err)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Fatalf("expected 3 requests to reach GitHub, got %d", n)
+	}
+
+	// After the cooldown a trial call goes through, and a success closes the breaker
+	time.Sleep(150 * time.Millisecond)
+	status.Store(http.StatusOK)
+	if code, err := gh.do(http.MethodGet, "/rate", nil, nil); err != nil || code != http.StatusOK {
+		t.Fatalf("expected the trial call to succeed, got %d, %v", code, err)
+	}
+	status.Store(http.StatusBadGateway)
+	for i := 0; i < 2; i++ {
+		gh.do(http.MethodGet, "/rate", nil, nil)
+	}
+	if _, err := gh.do(http.MethodGet, "/rate", nil, nil); errors.Is(err, errGithubUnavailable) {
+		t.Fatal("expected the failure count to reset after a success")
+	}
+}
+
+func TestGithubBreakerReopensAfterFailedTrial(t *testing.T) {
+	saved := githubRetryDelays
+	githubRetryDelays = nil
+	defer func() { githubRetryDelays = saved }()
+
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	gh, _ := stubGithub(t, breakerConfig{Threshold: 2, Cooldown: 50 * time.Millisecond}, &status, nil)
+	gh.do(http.MethodGet, "/rate", nil, nil)
+	gh.do(http.MethodGet, "/rate", nil, nil)
+
+	time.Sleep(80 * time.Millisecond)
+	if _, err := gh.do(http.MethodGet, "/rate", nil, nil); err != nil {
+		t.Fatalf("expected a trial call after the cooldown, got %v", err)
+	}
+	if _, err := gh.do(http.MethodGet, "/rate", nil, nil); !errors.Is(err, errGithubUnavailable) {
+		t.Fatalf("expected a failed trial to reopen the breaker, got %v", err)
+	}
+}
+
+func TestGithubBreakerRateLimit(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	var status atomic.Int32
+	status.Store(http.StatusForbidden)
+	header := http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {strconv.FormatInt(reset, 10)}}
+	gh, hits := stubGithub(t, breakerConfig{Threshold: 5, Cooldown: time.Minute}, &status, header)
+
+	// An exhausted limit opens the breaker at once, until the reset, with no retries
+	if code, _ := gh.do(http.MethodGet, "/rate", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("expected the 403 to be returned, got %d", code)
+	}
+	_, err := gh.do(http.MethodGet, "/rate", nil, nil)
+	if !errors.Is(err, errGithubUnavailable) {
+		t.Fatalf("expected the breaker to be open, got %v", err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected one request to reach GitHub, got %d", n)
+	}
+	if _, until := gh.breaker.allow(time.Now()); until.Unix() != reset {
+		t.Fatalf("expected the breaker to open until the rate limit reset %d, got %d", reset, until.Unix())
+	}
+}
+
+func TestGithubRetriesRespectRetryAfter(t *testing.T) {
+	saved := githubRetryDelays
+	githubRetryDelays = []time.Duration{time.Millisecond}
+	defer func() { githubRetryDelays = saved }()
+
+	// A short Retry-After is waited out and the call retried
+	var hits atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer api.Close()
+	gh := newGithubClient(fixBuildConfig{GithubApiUrl: api.URL, GithubBreaker: breakerConfig{Threshold: 5, Cooldown: time.Minute}}, "tok")
+	gh.breaker = &circuitBreaker{}
+
+	start := time.Now()
+	if code, err := gh.do(http.MethodGet, "/rate", nil, nil); err != nil || code != http.StatusOK {
+		t.Fatalf("expected the retry to succeed, got %d, %v", code, err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Fatalf("expected the retry to wait out Retry-After, waited %v", waited)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < 500*time.Millisecond || d >= 1500*time.Millisecond {
+			t.Fatalf("jitter out of range: %v", d)
+		}
+	}
+}
+
+func TestFixBuildProceedsWithGithubBreakerOpen(t *testing.T) {
+	f := useFakeRunner(t, nil)
+	t.Setenv("FIX_BUILD_SIGNATURE_PRECHECK", "true")
+	var hits atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer api.Close()
+	t.Setenv("FIX_BUILD_GITHUB_API_URL", api.URL)
+
+	prev := githubBreaker
+	githubBreaker = &circuitBreaker{openUntil: time.Now().Add(time.Hour)}
+	defer func() { githubBreaker = prev }()
+
+	rec := postFixBuild(t, fakeRunnerPayload("abc0056"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the fix to go ahead without GitHub, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !f.called("git push origin main") {
+		t.Fatal("expected the fix to be pushed")
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("expected no GitHub calls while the breaker is open, got %d", n)
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repoCache keeps a bare mirror per repo under dir so repeated fixes fetch instead of cloning.
+// Each mirror is guarded by a per-repo lock; workspaces are independent local clones of the
+// mirror (hardlinked objects), so they don't touch the mirror once created.
+type repoCache struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+var fixBuildRepoCache = &repoCache{locks: map[string]*sync.Mutex{}}
+
+func (c *repoCache) lockFor(mirror string) *sync.Mutex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.locks[mirror]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[mirror] = l
+	}
+	return l
+}
+
+// mirrorPath is where repo's mirror lives under dir. Owner and name are sanitized so a payload
+// can't point outside the cache. GitHub repos live at owner/name.git; other providers prefix the
+// owner (GitHub owners can't contain "_", so the two never collide).
+func mirrorPath(dir, provider string, repo FixBuildRepo) string {
+	safe := func(s string) string {
+		s = strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+				return r
+			}
+			return '_'
+		}, strings.ToLower(s))
+		if s = strings.TrimLeft(s, "."); s == "" {
+			s = "_"
+		}
+		return s
+	}
+	owner := repo.Owner
+	if provider != defaultGitProvider {
+		owner = provider + "_" + owner
+	}
+	return filepath.Join(dir, safe(owner), safe(repo.Name)+".git")
+}
+
+// clone populates dest from the cached mirror of repo, creating the mirror from remote on a cold
+// cache and fetching into it on a warm one. dest's origin is left pointing at remote.
+func (c *repoCache) clone(ctx context.Context, dir string, maxRepos int, provider string, repo FixBuildRepo, remote, dest string, env []string, noCheckout bool, timeout time.Duration) error {
+	mirror := mirrorPath(dir, provider, repo)
+	lock := c.lockFor(mirror)
+	lock.Lock()
+	err := c.refreshLocked(ctx, mirror, remote, env, timeout)
+	if err == nil {
+		args := []string{"clone", "-q"}
+		if noCheckout {
+			args = append(args, "--no-checkout")
+		}
+		if out, cloneErr := runCmd(ctx, dest, timeout, "git", append(args, mirror, ".")...); cloneErr != nil {
+			err = fmt.Errorf("git clone from cache: %w\n%s", cloneErr, out)
+		}
+		now := time.Now()
+		_ = os.Chtimes(mirror, now, now)
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if out, err := runCmd(ctx, dest, 10*time.Second, "git", "remote", "set-url", "origin", remote); err != nil {
+		return fmt.Errorf("git remote set-url: %w\n%s", err, out)
+	}
+	c.evict(dir, maxRepos)
+	return nil
+}
+
+// refreshLocked brings the mirror's branches up to date with remote, dropping deleted ones.
+// Credentials are only ever passed on the command line, never stored in the mirror's config.
+func (c *repoCache) refreshLocked(ctx context.Context, mirror, remote string, env []string, timeout time.Duration) error {
+	if _, err := os.Stat(mirror); err == nil {
+		if out, err := runCmdEnv(ctx, mirror, timeout, env, "git", "fetch", "-q", "--prune", remote, "+refs/heads/*:refs/heads/*"); err != nil {
+			return fmt.Errorf("git fetch into cache: %w\n%s", err, out)
+		}
+		return nil
+	}
+
+	// Clone next to the final path and rename, so an interrupted clone never looks like a mirror
+	if err := os.MkdirAll(filepath.Dir(mirror), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(mirror), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if out, err := runCmdEnv(ctx, tmp, timeout, env, "git", "clone", "-q", "--bare", remote, "."); err != nil {
+		return fmt.Errorf("git clone into cache: %w\n%s", err, out)
+	}
+	if out, err := runCmd(ctx, tmp, 10*time.Second, "git", "remote", "remove", "origin"); err != nil {
+		return fmt.Errorf("git remote remove: %w\n%s", err, out)
+	}
+	return os.Rename(tmp, mirror)
+}
+
+// evict removes the least recently used mirrors until at most maxRepos remain (0 = no cap).
+// Mirrors currently in use are skipped.
+func (c *repoCache) evict(dir string, maxRepos int) {
+	if maxRepos <= 0 {
+		return
+	}
+	mirrors, err := filepath.Glob(filepath.Join(dir, "*", "*.git"))
+	if err != nil || len(mirrors) <= maxRepos {
+		return
+	}
+	mtimes := map[string]time.Time{}
+	for _, m := range mirrors {
+		if info, err := os.Stat(m); err == nil {
+			mtimes[m] = info.ModTime()
+		}
+	}
+	sort.Slice(mirrors, func(i, j int) bool { return mtimes[mirrors[i]].Before(mtimes[mirrors[j]]) })
+
+	excess := len(mirrors) - maxRepos
+	for _, m := range mirrors {
+		if excess == 0 {
+			break
+		}
+		lock := c.lockFor(m)
+		if !lock.TryLock() {
+			continue
+		}
+		if err := os.RemoveAll(m); err != nil {
+			log.Printf("[fix_build] evict cached repo %s: %v", m, err)
+		} else {
+			excess--
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRepoCacheColdThenWarm(t *testing.T) {
+	origin, shas := newOriginRepo(t, 2)
+	remote := "file://" + origin
+	cacheDir := t.TempDir()
+	cache := &repoCache{locks: map[string]*sync.Mutex{}}
+	repo := FixBuildRepo{Owner: "Acme", Name: "widgets"}
+
+	// Cold: the mirror is created and the workspace checks out the latest commit
+	ws1 := t.TempDir()
+	if err := cache.clone(context.Background(), cacheDir, 0, "github", repo, remote, ws1, nil, false, time.Minute); err != nil {
+		t.Fatalf("cold clone: %v", err)
+	}
+	mirror := mirrorPath(cacheDir, "github", repo)
+	if _, err := os.Stat(filepath.Join(mirror, "HEAD")); err != nil {
+		t.Fatalf("expected a bare mirror at %s: %v", mirror, err)
+	}
+	if got := gitT(t, mirror, "remote"); got != "" {
+		t.Fatalf("mirror should not keep a remote with credentials, got %q", got)
+	}
+	if got := gitT(t, ws1, "rev-parse", "HEAD"); got != shas[1] {
+		t.Fatalf("cold clone at %s, want %s", got, shas[1])
+	}
+	if got := gitT(t, ws1, "remote", "get-url", "origin"); got != remote {
+		t.Fatalf("workspace origin should be the real remote, got %q", got)
+	}
+
+	// Warm: a new upstream commit is fetched into the existing mirror
+	if err := os.WriteFile(filepath.Join(origin, "file.txt"), []byte("v2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitT(t, origin, "commit", "-q", "-am", "commit 2")
+	newSha := gitT(t, origin, "rev-parse", "HEAD")
+
+	ws2 := t.TempDir()
+	if err := cache.clone(context.Background(), cacheDir, 0, "github", repo, remote, ws2, nil, false, time.Minute); err != nil {
+		t.Fatalf("warm clone: %v", err)
+	}
+	if got := gitT(t, ws2, "rev-parse", "origin/main"); got != newSha {
+		t.Fatalf("warm clone did not fetch the new commit: got %s, want %s", got, newSha)
+	}
+	if got := gitT(t, mirror, "rev-parse", "main"); got != newSha {
+		t.Fatalf("mirror not updated: got %s, want %s", got, newSha)
+	}
+}
+
+func TestRepoCacheConcurrentSameRepo(t *testing.T) {
+	origin, shas := newOriginRepo(t, 3)
+	cacheDir := t.TempDir()
+	cache := &repoCache{locks: map[string]*sync.Mutex{}}
+	repo := FixBuildRepo{Owner: "acme", Name: "widgets"}
+
+	const n = 6
+	dests := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		dests[i] = t.TempDir()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = cache.clone(context.Background(), cacheDir, 0, "github", repo, "file://"+origin, dests[i], nil, false, time.Minute)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatalf("clone %d: %v", i, errs[i])
+		}
+		if got := gitT(t, dests[i], "rev-parse", "HEAD"); got != shas[2] {
+			t.Fatalf("clone %d at %s, want %s", i, got, shas[2])
+		}
+	}
+	gitT(t, mirrorPath(cacheDir, "github", repo), "fsck", "--no-progress")
+}
+
+func TestRepoCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	origin, _ := newOriginRepo(t, 1)
+	cacheDir := t.TempDir()
+	cache := &repoCache{locks: map[string]*sync.Mutex{}}
+
+	repos := []FixBuildRepo{{Owner: "acme", Name: "a"}, {Owner: "acme", Name: "b"}, {Owner: "acme", Name: "c"}}
+	for i, repo := range repos[:2] {
+		if err := cache.clone(context.Background(), cacheDir, 2, "github", repo, "file://"+origin, t.TempDir(), nil, false, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		// Distinct mtimes regardless of filesystem timestamp resolution
+		at := time.Now().Add(time.Duration(i-10) * time.Minute)
+		if err := os.Chtimes(mirrorPath(cacheDir, "github", repo), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.clone(context.Background(), cacheDir, 2, "github", repos[2], "file://"+origin, t.TempDir(), nil, false, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for repo, want := range map[FixBuildRepo]bool{repos[0]: false, repos[1]: true, repos[2]: true} {
+		_, err := os.Stat(mirrorPath(cacheDir, "github", repo))
+		if got := err == nil; got != want {
+			t.Errorf("%s cached=%v, want %v", repo.Name, got, want)
+		}
+	}
+}
+
+func TestMirrorPathStaysInCache(t *testing.T) {
+	dir := t.TempDir()
+	got := mirrorPath(dir, "github", FixBuildRepo{Owner: "..", Name: "../../etc"})
+	if rel, err := filepath.Rel(dir, got); err != nil || strings.HasPrefix(rel, "..") || strings.Count(rel, string(filepath.Separator)) != 1 {
+		t.Fatalf("mirror path %q escapes the cache dir", got)
+	}
+}
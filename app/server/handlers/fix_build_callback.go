@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// FixBuildCallback is POSTed to a payload's callbackUrl when its background job finishes.
+type FixBuildCallback struct {
+	JobId  string            `json:"jobId"`
+	Status string            `json:"status"`
+	Result *FixBuildResponse `json:"result,omitempty"`
+	// Error, ErrorStatus, ErrorCode and ErrorPhase carry what a synchronous request would have got.
+	Error       string `json:"error,omitempty"`
+	ErrorStatus int    `json:"errorStatus,omitempty"`
+	ErrorCode   string `json:"errorCode,omitempty"`
+	ErrorPhase  string `json:"errorPhase,omitempty"`
+}
+
+// fixBuildCallbackSignatureHeader carries "sha256=" + hex HMAC-SHA256 of the body, keyed with
+// FIX_BUILD_HMAC_SECRET, in the same form as GitHub's X-Hub-Signature-256.
+const fixBuildCallbackSignatureHeader = "X-Fix-Build-Signature"
+
+// callbackRetryDelays are the waits between delivery attempts; a var so tests can shorten them.
+var callbackRetryDelays = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+func signCallback(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverFixBuildCallback posts a finished job's outcome to callbackUrl, retrying network
+// errors, 429s and 5xxs. Other responses are final.
+func deliverFixBuildCallback(cfg fixBuildConfig, callbackUrl, jobId string, res *FixBuildResponse, fbErr *fixBuildError) {
+	cb := FixBuildCallback{JobId: jobId, Result: res}
+	if job, ok := fixBuildJobs.get(jobId); ok {
+		cb.Status = job.Status
+	}
+	if fbErr != nil {
+		cb.Error = fbErr.Message
+		cb.ErrorStatus = fbErr.Status
+		cb.ErrorCode = fbErr.Code
+		cb.ErrorPhase = fbErr.Phase
+	}
+	body, err := json.Marshal(cb)
+	if err != nil {
+		log.Printf("[fix_build] job %s: marshal callback: %v", jobId, err)
+		return
+	}
+	signature := signCallback(cfg.HmacSecret, body)
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	for attempt := 0; ; attempt++ {
+		err := postCallback(client, callbackUrl, body, signature)
+		if err == nil {
+			return
+		}
+		if _, retry := err.(retryableCallbackError); !retry || attempt >= len(callbackRetryDelays) {
+			log.Printf("[fix_build] job %s: callback to %s failed after %d attempt(s): %v", jobId, callbackUrl, attempt+1, err)
+			return
+		}
+		time.Sleep(callbackRetryDelays[attempt])
+	}
+}
+
+type retryableCallbackError struct{ error }
+
+func postCallback(client *http.Client, callbackUrl string, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, callbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(fixBuildCallbackSignatureHeader, signature)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return retryableCallbackError{err}
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return retryableCallbackError{fmt.Errorf("callback returned %s", resp.Status)}
+	default:
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+}
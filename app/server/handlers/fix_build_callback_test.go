@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFixBuildCallback(t *testing.T) {
+	root := fakeGithub(t)
+	_, sha := addFakeGithubRepo(t, root, "acme", "async")
+	fakePlandex(t, `[ "$1" = "tell" ] && echo fixed > file.txt
+exit 0
+`)
+	t.Setenv("FIX_BUILD_HMAC_SECRET", "s3cret")
+
+	saved := callbackRetryDelays
+	callbackRetryDelays = []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}
+	defer func() { callbackRetryDelays = saved }()
+
+	var attempts atomic.Int32
+	delivered := make(chan FixBuildCallback, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first delivery fails transiently and must be retried
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get(fixBuildCallbackSignatureHeader), signCallback("s3cret", body); got != want {
+			t.Errorf("bad signature %q, want %q", got, want)
+		}
+		var cb FixBuildCallback
+		if err := json.Unmarshal(body, &cb); err != nil {
+			t.Errorf("decode callback: %v", err)
+		}
+		delivered <- cb
+	}))
+	defer srv.Close()
+
+	rec := postFixBuild(t, FixBuildPayload{
+		Repo:              FixBuildRepo{Owner: "acme", Name: "async"},
+		HeadBranch:        "main",
+		HeadSha:           sha,
+		OutputSummary:     "FAIL",
+		InstallationToken: "tok",
+		CallbackUrl:       srv.URL,
+	})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job FixBuildJob
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case cb := <-delivered:
+		if cb.JobId != job.Id || cb.Status != fixBuildJobSucceeded {
+			t.Fatalf("unexpected callback %+v for job %s", cb, job.Id)
+		}
+		if cb.Result == nil || cb.Result.CommitSha == "" || cb.Error != "" {
+			t.Fatalf("expected a successful result, got %+v", cb)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("callback never delivered")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("expected 2 delivery attempts, got %d", n)
+	}
+}
+
+func TestFixBuildCallbackRequiresSecret(t *testing.T) {
+	t.Setenv("FIX_BUILD_HMAC_SECRET", "")
+	rec := postFixBuild(t, FixBuildPayload{
+		Repo:              FixBuildRepo{Owner: "acme", Name: "async"},
+		HeadBranch:        "main",
+		HeadSha:           "abc1234",
+		OutputSummary:     "FAIL",
+		InstallationToken: "tok",
+		CallbackUrl:       "https://example.com/hook",
+	})
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a signing secret, got %d", rec.Code)
+	}
+}
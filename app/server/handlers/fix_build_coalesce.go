@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalescedFix is one fix that later requests for the same branch and commit join instead of
+// racing it with fixes (and pushes) of their own.
+type coalescedFix struct {
+	// ready is closed once the fix has a job or has failed before starting one; done once it
+	// has a result.
+	ready     chan struct{}
+	done      chan struct{}
+	readyOnce sync.Once
+	doneOnce  sync.Once
+
+	key        string
+	job        *FixBuildJob
+	res        *FixBuildResponse
+	err        *fixBuildError
+	finishedAt time.Time
+	// joined counts the requests that joined this fix.
+	joined int
+}
+
+// fixCoalescer tracks fixes by target while they run and for a window after they finish.
+type fixCoalescer struct {
+	mu       sync.Mutex
+	byTarget map[string]*coalescedFix
+}
+
+var fixBuildCoalescer = &fixCoalescer{byTarget: map[string]*coalescedFix{}}
+
+// coalesceKey identifies the branch and commit a payload fixes, how, and with which
+// credentials.
+func coalesceKey(p FixBuildPayload) string {
+	return strings.ToLower(p.Repo.Owner+"/"+p.Repo.Name) + "/" + p.HeadBranch + "@" + p.HeadSha + "#" + fixVariant(p) + "#" + credentialKey(p)
+}
+
+// credentialKey hashes the credentials a payload would fix with: the installation the server
+// mints tokens for, or else the token, and the deploy key. A request is only handed a fix
+// (or its cached result) made with the same credentials, so it can't get at a repo's code
+// with a token that couldn't have cloned it.
+func credentialKey(p FixBuildPayload) string {
+	cred := "token:" + p.InstallationToken
+	if p.InstallationId != 0 {
+		cred = "installation:" + strconv.FormatInt(p.InstallationId, 10)
+	}
+	sum := sha256.Sum256([]byte(cred + "\nssh:" + p.SshKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// fixVariant hashes the payload options that change what a fix produces or where it goes, so
+// a request only shares a fix (or its cached result) that did what it asked for.
+func fixVariant(p FixBuildPayload) string {
+	opts, _ := json.Marshal(struct {
+		OutputMode      string
+		OpenPullRequest bool
+		BaseBranch      string
+		BranchPrefix    string
+		PushRemote      string
+		PushRemoteUrl   string
+		AllowedPaths    []string
+		DiffLimits      *FixBuildDiffLimits
+	}{p.OutputMode, p.OpenPullRequest, p.BaseBranch, p.BranchPrefix, p.PushRemote, p.PushRemoteUrl, p.AllowedPaths, p.DiffLimits})
+	sum := sha256.Sum256(opts)
+	return hex.EncodeToString(sum[:8])
+}
+
+// join returns the fix running for key, or that succeeded less than window ago, with leader
+// false. Otherwise it registers a new fix for the caller to run and report, with leader true.
+func (c *fixCoalescer) join(key string, window time.Duration) (fix *coalescedFix, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, f := range c.byTarget {
+		if !f.finishedAt.IsZero() && now.Sub(f.finishedAt) >= window {
+			delete(c.byTarget, k)
+		}
+	}
+	if f, ok := c.byTarget[key]; ok {
+		f.joined++
+		return f, false
+	}
+	f := &coalescedFix{key: key, ready: make(chan struct{}), done: make(chan struct{})}
+	c.byTarget[key] = f
+	return f, true
+}
+
+// started publishes the leader's job to joined async requests.
+func (f *coalescedFix) started(job FixBuildJob) {
+	f.readyOnce.Do(func() {
+		f.job = &job
+		close(f.ready)
+	})
+}
+
+// finish publishes the leader's outcome. A failure goes only to the requests already waiting,
+// so a retry gets a fresh attempt.
+func (f *coalescedFix) finish(res *FixBuildResponse, fbErr *fixBuildError) {
+	f.doneOnce.Do(func() {
+		fixBuildCoalescer.mu.Lock()
+		f.res, f.err, f.finishedAt = res, fbErr, time.Now()
+		if fbErr != nil && fixBuildCoalescer.byTarget[f.key] == f {
+			delete(fixBuildCoalescer.byTarget, f.key)
+		}
+		fixBuildCoalescer.mu.Unlock()
+		close(f.done)
+		f.readyOnce.Do(func() { close(f.ready) })
+	})
+}
+
+// serveCoalesced answers a request that joined f. A sync request waits for f's result. An
+// async one gets f's job right away and its own callback when the job finishes.
+func serveCoalesced(w http.ResponseWriter, r *http.Request, f *coalescedFix, payload FixBuildPayload, cfg fixBuildConfig) {
+	includeLogs, _ := strconv.ParseBool(r.URL.Query().Get("includeLogs"))
+	if payload.CallbackUrl == "" {
+		<-f.done
+		if f.err != nil {
+			writeFixBuildError(w, responseLogs(f.err, includeLogs, payload))
+			return
+		}
+		writeFixBuildResponse(w, f.res)
+		return
+	}
+
+	<-f.ready
+	if f.job == nil {
+		// The fix failed before it got a job
+		writeFixBuildError(w, responseLogs(f.err, includeLogs, payload))
+		return
+	}
+	job := *f.job
+	go func() {
+		<-f.done
+		deliverFixBuildCallback(cfg, payload.CallbackUrl, job.Id, f.res, f.err)
+	}()
+	writeFixBuildAccepted(w, cfg, job)
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForJoined waits until n requests have joined the fix for payload's target.
+func waitForJoined(t *testing.T, payload FixBuildPayload, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fixBuildCoalescer.mu.Lock()
+		joined := 0
+		if f, ok := fixBuildCoalescer.byTarget[coalesceKey(payload)]; ok {
+			joined = f.joined
+		}
+		fixBuildCoalescer.mu.Unlock()
+		if joined >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d requests to join, got %d", n, joined)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFixBuildCoalescesConcurrentRequests(t *testing.T) {
+	hold := make(chan struct{})
+	f := useFakeRunner(t, map[string]fakeResponse{"git clone": {hold: hold}})
+	payload := fakeRunnerPayload("eee0063")
+
+	recs := make([]*httptest.ResponseRecorder, 3)
+	var wg sync.WaitGroup
+	for i := range recs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = postFixBuild(t, payload)
+		}(i)
+	}
+	waitForJoined(t, payload, 2)
+	close(hold)
+	wg.Wait()
+
+	var first FixBuildResponse
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d: %s", i+1, rec.Code, rec.Body.String())
+		}
+		var res FixBuildResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = res
+		} else if res.JobId != first.JobId || res.CommitSha != first.CommitSha {
+			t.Fatalf("request %d: expected the shared result %+v, got %+v", i+1, first, res)
+		}
+	}
+	if first.JobId == "" || first.CommitSha != "f1xed00" {
+		t.Fatalf("unexpected result %+v", first)
+	}
+	if n := f.countCalls("git clone"); n != 1 {
+		t.Fatalf("expected one clone, got %d", n)
+	}
+	if n := f.countCalls("git push"); n != 1 {
+		t.Fatalf("expected one push, got %d", n)
+	}
+
+	// A request shortly after gets the same result without another fix
+	payload.Annotations = []FixBuildAnno{{Path: "b.go", StartLine: 1, EndLine: 1, AnnotationLevel: "failure", Message: "another check"}}
+	rec := postFixBuild(t, payload)
+	var res FixBuildResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || res.JobId != first.JobId {
+		t.Fatalf("expected the recent result, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := f.countCalls("git push"); n != 1 {
+		t.Fatalf("expected still one push, got %d", n)
+	}
+}
+
+func TestFixBuildCoalescedFailureIsRetried(t *testing.T) {
+	t.Setenv("FIX_BUILD_COALESCE_WINDOW", "1h")
+	f := useFakeRunner(t, map[string]fakeResponse{"plandex build": {err: &fakeExitError{code: 1}, times: 1}})
+	payload := fakeRunnerPayload("eee1063")
+	if rec := postFixBuild(t, payload); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// A failure isn't handed to later requests; the retry runs its own fix
+	if rec := postFixBuild(t, payload); rec.Code != http.StatusOK {
+		t.Fatalf("expected the retry to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := f.countCalls("git clone"); n != 2 {
+		t.Fatalf("expected two clones, got %d", n)
+	}
+}
+
+func TestFixBuildCoalesceSeparatesOutputModes(t *testing.T) {
+	t.Setenv("FIX_BUILD_COALESCE_WINDOW", "1h")
+	f := useFakeRunner(t, map[string]fakeResponse{"git diff --binary": {out: "diff --git a/file.txt b/file.txt\n"}})
+	payload := fakeRunnerPayload("eee2063")
+	payload.OutputMode = outputPatch
+	if rec := postFixBuild(t, payload); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if f.called("git push") {
+		t.Fatal("expected the patch not to be pushed")
+	}
+
+	// The same commit, now to be pushed, gets a fix of its own rather than the patch
+	payload.OutputMode = ""
+	rec := postFixBuild(t, payload)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res FixBuildResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !f.called("git push") || res.CommitSha == "" || res.Patch != "" {
+		t.Fatalf("expected the second request to push, got %+v", res)
+	}
+}
+
+func TestFixBuildCoalesceRequiresSameCredentials(t *testing.T) {
+	t.Setenv("FIX_BUILD_COALESCE_WINDOW", "1h")
+	f := useFakeRunner(t, nil)
+	payload := fakeRunnerPayload("eee3063")
+	if rec := postFixBuild(t, payload); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Another caller's token doesn't get the first fix's result; it has to run its own
+	payload.InstallationToken = "someone-else"
+	if rec := postFixBuild(t, payload); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := f.countCalls("git clone"); n != 2 {
+		t.Fatalf("expected a clone per token, got %d", n)
+	}
+	if key, other := deriveIdempotencyKey(payload), deriveIdempotencyKey(fakeRunnerPayload("eee3063")); key == other {
+		t.Fatal("expected the derived idempotency key to differ by token")
+	}
+}
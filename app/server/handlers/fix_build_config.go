@@ -0,0 +1,744 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// fixBuildConfig holds server-side settings for /fix_build, read from FIX_BUILD_* env vars.
+type fixBuildConfig struct {
+	RepoTree           bool
+	RepoTreeDepth      int
+	RepoTreeMaxEntries int
+
+	ContextMaxSectionBytes int
+	ContextMaxBytes        int
+	// MaxAnnotations caps how many annotations make it into the context (0 = unlimited).
+	MaxAnnotations int
+
+	DeepenStep      int
+	DeepenMaxRounds int
+
+	// PublicBaseUrl is where callers can reach this server, used to build job status links.
+	PublicBaseUrl string
+
+	GithubApiUrl string
+	// GithubBreaker stops GitHub API calls for a cooldown after repeated failures.
+	GithubBreaker breakerConfig
+	// GithubApp mints installation tokens for payloads that send an installationId; nil when
+	// the server isn't configured as an app.
+	GithubApp *githubApp
+	// SignaturePrecheck makes the server look up whether the branch requires signed commits
+	// and refuse up front, since an unsigned push would only be rejected after the fix runs.
+	SignaturePrecheck bool
+
+	// MaxConcurrency bounds fix attempts running at once across all requests (0 = unlimited).
+	MaxConcurrency          int
+	MaxCandidates           int
+	MaxCandidateParallelism int
+	// MaxAttempts caps the tell/build/verify rounds a payload may ask for per candidate.
+	MaxAttempts int
+	// MaxBatchSize caps the payloads in one /fix_build/batch request.
+	MaxBatchSize int
+	// MaxVerifyRetries caps a payload's verifyRetries; VerifyRetryDelay is the wait before each.
+	MaxVerifyRetries int
+	VerifyRetryDelay time.Duration
+
+	Timeouts phaseTimeouts
+	// MaxPhaseTimeout caps payload timeout overrides.
+	MaxPhaseTimeout time.Duration
+	// MaxJobDuration bounds a whole job, clone to push, across every candidate and attempt
+	// (0 = unlimited).
+	MaxJobDuration time.Duration
+	// UnshallowTimeout bounds fetching full history when a remote refuses a push from a shallow clone.
+	UnshallowTimeout time.Duration
+
+	// DiffLimits abort fixes that change too much; payloads may override them up to DiffLimitCaps.
+	DiffLimits    diffLimits
+	DiffLimitCaps diffLimits
+
+	// UsageRetention is how long per-job usage is kept for cost reporting.
+	UsageRetention time.Duration
+
+	// When every annotation is in GeneratedGlobs and there's a RegenerateCommand (the server's or
+	// the payload's), the fix runs it instead of plandex.
+	SkipGenerated     bool
+	GeneratedGlobs    []string
+	RegenerateCommand []string
+
+	// SkipPatterns identify infrastructure failures (runner OOM, network timeouts) that are
+	// reported as skipped instead of fixed.
+	SkipPatterns []*regexp.Regexp
+
+	// CommandDenylist blocks jobs whose setup, verify, format or regenerate commands match any
+	// of its patterns, as defense in depth for the commands the handler runs on a caller's behalf.
+	CommandDenylist []commandDenyPattern
+	// AllowedCommands, when set, limits those commands to the binaries it names. It's checked
+	// before the denylist, which still applies to the commands it allows.
+	AllowedCommands []string
+
+	// StrictAnnotations rejects malformed annotations with a 400 instead of fixing them up.
+	StrictAnnotations bool
+
+	// RepoRateLimit and GlobalRateLimit throttle how often fixes start, per repo and overall.
+	RepoRateLimit   rateLimit
+	GlobalRateLimit rateLimit
+
+	// IdempotencyTTL is how long a completed fix is replayed for duplicate deliveries.
+	IdempotencyTTL time.Duration
+
+	// CoalesceWindow is how long after a fix succeeds that requests for the same branch and
+	// commit get its result; requests arriving while it runs always join it.
+	CoalesceWindow time.Duration
+
+	// ReverifyGrace is how long an async job's work dir is kept after its fix failed only the
+	// verify step, so /fix_build/reverify can retry the check.
+	ReverifyGrace time.Duration
+
+	// JobLogRetention is how long per-job event logs are kept under the work dir base.
+	JobLogRetention time.Duration
+
+	// StaleWorkDirAge is how old an untracked work dir must be before the sweeper removes it;
+	// it should exceed the longest a job can run.
+	StaleWorkDirAge           time.Duration
+	StaleWorkDirSweepInterval time.Duration
+
+	// AllowedRepos restricts which repos may be fixed (owner/name or owner/* patterns); empty allows all.
+	AllowedRepos []string
+
+	// ProtectedBranches are branch globs fixes are never pushed to directly; they must be opened
+	// as pull requests unless the payload sets allowProtectedPush.
+	ProtectedBranches []string
+
+	// PlandexBin is the plandex CLI to run (FIX_BUILD_PLANDEX_BIN, a path or a name on PATH).
+	// With PlandexMinVersion set, jobs are refused when `plandex version` reports anything older.
+	PlandexBin        string
+	PlandexMinVersion string
+
+	// ModelRoutes pin matching repos to a model pack regardless of the payload.
+	ModelRoutes      []modelRoute
+	DefaultModelPack string
+
+	// HmacSecret signs callback deliveries (X-Fix-Build-Signature: sha256=<hex>).
+	HmacSecret string
+
+	// CacheDir enables a per-repo clone cache (empty = clone fresh every time), holding at most
+	// CacheMaxRepos mirrors (0 = unlimited).
+	CacheDir      string
+	CacheMaxRepos int
+
+	// WorkDir is the base directory for work dirs (empty = system temp dir). New jobs are turned
+	// away while live work dirs use MaxWorkDirBytes or more (0 = unlimited).
+	WorkDir         string
+	MaxWorkDirBytes int64
+
+	// ResourceLimits cap the memory and CPU time of plandex build and verify commands, so one
+	// runaway job can't exhaust the host. Enforced on Linux and in sandboxes only.
+	ResourceLimits resourceLimits
+
+	// AnnotationsUrlHosts are the hosts a payload's annotationsUrl may point at (none = the
+	// option is refused). MaxAnnotationsBytes caps what's fetched from it.
+	AnnotationsUrlHosts []string
+	MaxAnnotationsBytes int64
+
+	// PromptTemplate replaces the default plandex prompt (nil = default).
+	PromptTemplate *template.Template
+
+	// Sandbox runs commands in containers ("docker") instead of on the host (""), invoked with
+	// SandboxCommand and SandboxImage. Repo commands get SandboxNetwork.
+	Sandbox        string
+	SandboxCommand []string
+	SandboxImage   string
+	SandboxNetwork string
+
+	// Bot is the commit identity used when the payload has no author and git has none configured.
+	Bot FixBuildAuthor
+
+	// Signing signs fix commits (FIX_BUILD_SIGNING_KEY, FIX_BUILD_SIGNING_FORMAT gpg or ssh).
+	Signing signingConfig
+
+	// LocalRoot is where payloads may point LocalPath at existing checkouts (empty = disabled).
+	LocalRoot string
+
+	// AllowKeepWorkdir lets payloads set keepWorkdir. Kept dirs hold the repo's code, so leave
+	// it off in production.
+	AllowKeepWorkdir bool
+
+	// JobDir persists job status and results so they survive restarts (empty = memory only).
+	JobDir string
+}
+
+type phaseTimeouts struct {
+	Clone time.Duration
+	Setup time.Duration
+	Tell  time.Duration
+	Build time.Duration
+	Push  time.Duration
+}
+
+func loadFixBuildConfig() (fixBuildConfig, error) {
+	cfg := fixBuildConfig{}
+	var err error
+
+	if cfg.RepoTree, err = envBool("FIX_BUILD_REPO_TREE", false); err != nil {
+		return cfg, err
+	}
+	if cfg.RepoTreeDepth, err = envInt("FIX_BUILD_REPO_TREE_DEPTH", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.RepoTreeMaxEntries, err = envInt("FIX_BUILD_REPO_TREE_MAX_ENTRIES", 200); err != nil {
+		return cfg, err
+	}
+
+	if cfg.ContextMaxSectionBytes, err = envInt("FIX_BUILD_CONTEXT_MAX_SECTION_BYTES", 64<<10); err != nil {
+		return cfg, err
+	}
+	if cfg.ContextMaxBytes, err = envInt("FIX_BUILD_CONTEXT_MAX_BYTES", 256<<10); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxAnnotations, err = envInt("FIX_BUILD_MAX_ANNOTATIONS", 200); err != nil {
+		return cfg, err
+	}
+
+	if cfg.DeepenStep, err = envInt("FIX_BUILD_DEEPEN_STEP", 50); err != nil {
+		return cfg, err
+	}
+	if cfg.DeepenMaxRounds, err = envInt("FIX_BUILD_DEEPEN_MAX_ROUNDS", 10); err != nil {
+		return cfg, err
+	}
+
+	if cfg.PublicBaseUrl, err = envBaseUrl("FIX_BUILD_PUBLIC_BASE_URL"); err != nil {
+		return cfg, err
+	}
+
+	if cfg.GithubApiUrl, err = envBaseUrl("FIX_BUILD_GITHUB_API_URL"); err != nil {
+		return cfg, err
+	}
+	if cfg.GithubApiUrl == "" {
+		cfg.GithubApiUrl = "https://api.github.com"
+	}
+	if cfg.GithubBreaker.Threshold, err = envInt("FIX_BUILD_GITHUB_BREAKER_THRESHOLD", 5); err != nil {
+		return cfg, err
+	}
+	if cfg.GithubBreaker.Cooldown, err = envDuration("FIX_BUILD_GITHUB_BREAKER_COOLDOWN", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.GithubApp, err = loadGithubApp(); err != nil {
+		return cfg, err
+	}
+	if cfg.SignaturePrecheck, err = envBool("FIX_BUILD_SIGNATURE_PRECHECK", true); err != nil {
+		return cfg, err
+	}
+
+	if cfg.MaxConcurrency, err = envInt("FIX_BUILD_MAX_CONCURRENCY", 4); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxCandidates, err = envInt("FIX_BUILD_MAX_CANDIDATES", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxAttempts, err = envInt("FIX_BUILD_MAX_ATTEMPTS", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxCandidateParallelism, err = envInt("FIX_BUILD_MAX_CANDIDATE_PARALLELISM", 2); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxBatchSize, err = envInt("FIX_BUILD_MAX_BATCH_SIZE", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxVerifyRetries, err = envInt("FIX_BUILD_MAX_VERIFY_RETRIES", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.VerifyRetryDelay, err = envDuration("FIX_BUILD_VERIFY_RETRY_DELAY", 5*time.Second); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Timeouts.Clone, err = envDuration("FIX_BUILD_CLONE_TIMEOUT", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.Timeouts.Setup, err = envDuration("FIX_BUILD_SETUP_TIMEOUT", 10*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.Timeouts.Tell, err = envDuration("FIX_BUILD_TELL_TIMEOUT", 15*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.Timeouts.Build, err = envDuration("FIX_BUILD_BUILD_TIMEOUT", 15*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.Timeouts.Push, err = envDuration("FIX_BUILD_PUSH_TIMEOUT", time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxPhaseTimeout, err = envDuration("FIX_BUILD_MAX_PHASE_TIMEOUT", 30*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxJobDuration, err = envDurationOrOff("FIX_BUILD_MAX_JOB_DURATION", 2*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.UnshallowTimeout, err = envDuration("FIX_BUILD_UNSHALLOW_TIMEOUT", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+
+	if cfg.DiffLimits.Files, err = envInt("FIX_BUILD_MAX_CHANGED_FILES", 20); err != nil {
+		return cfg, err
+	}
+	if cfg.DiffLimits.Lines, err = envInt("FIX_BUILD_MAX_CHANGED_LINES", 500); err != nil {
+		return cfg, err
+	}
+	if cfg.DiffLimitCaps.Files, err = envInt("FIX_BUILD_MAX_CHANGED_FILES_CAP", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.DiffLimitCaps.Lines, err = envInt("FIX_BUILD_MAX_CHANGED_LINES_CAP", 5000); err != nil {
+		return cfg, err
+	}
+
+	if cfg.UsageRetention, err = envDuration("FIX_BUILD_USAGE_RETENTION", 30*24*time.Hour); err != nil {
+		return cfg, err
+	}
+
+	if cfg.SkipGenerated, err = envBool("FIX_BUILD_SKIP_GENERATED", true); err != nil {
+		return cfg, err
+	}
+	cfg.GeneratedGlobs = envList("FIX_BUILD_GENERATED_GLOBS", []string{"vendor/**", "**/node_modules/**", "**/*.pb.go", "**/*_generated.go", "**/*.gen.go", "**/zz_generated*.go"})
+	cfg.RegenerateCommand = strings.Fields(os.Getenv("FIX_BUILD_REGENERATE_COMMAND"))
+
+	if cfg.StrictAnnotations, err = envBool("FIX_BUILD_STRICT_ANNOTATIONS", false); err != nil {
+		return cfg, err
+	}
+
+	if cfg.RepoRateLimit.PerHour, err = envInt("FIX_BUILD_REPO_RATE_PER_HOUR", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.RepoRateLimit.Burst, err = envInt("FIX_BUILD_REPO_RATE_BURST", 3); err != nil {
+		return cfg, err
+	}
+	if cfg.GlobalRateLimit.PerHour, err = envInt("FIX_BUILD_GLOBAL_RATE_PER_HOUR", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.GlobalRateLimit.Burst, err = envInt("FIX_BUILD_GLOBAL_RATE_BURST", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.RepoRateLimit.Burst == 0 || cfg.GlobalRateLimit.Burst == 0 {
+		return cfg, fmt.Errorf("invalid FIX_BUILD_*_RATE_BURST: must be at least 1")
+	}
+
+	if cfg.IdempotencyTTL, err = envDuration("FIX_BUILD_IDEMPOTENCY_TTL", time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.CoalesceWindow, err = envDuration("FIX_BUILD_COALESCE_WINDOW", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.ReverifyGrace, err = envDuration("FIX_BUILD_REVERIFY_GRACE", 30*time.Minute); err != nil {
+		return cfg, err
+	}
+	if cfg.JobLogRetention, err = envDuration("FIX_BUILD_JOB_LOG_RETENTION", 24*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.StaleWorkDirAge, err = envDuration("FIX_BUILD_STALE_WORKDIR_AGE", 6*time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.StaleWorkDirSweepInterval, err = envDuration("FIX_BUILD_STALE_WORKDIR_SWEEP_INTERVAL", time.Hour); err != nil {
+		return cfg, err
+	}
+
+	if cfg.SkipPatterns, err = parseSkipPatterns("FIX_BUILD_SKIP_PATTERNS", os.Getenv("FIX_BUILD_SKIP_PATTERNS")); err != nil {
+		return cfg, err
+	}
+
+	if cfg.CommandDenylist, err = parseCommandDenylist("FIX_BUILD_COMMAND_DENYLIST", os.Getenv("FIX_BUILD_COMMAND_DENYLIST")); err != nil {
+		return cfg, err
+	}
+
+	cfg.AllowedCommands = envList("FIX_BUILD_ALLOWED_COMMANDS", nil)
+
+	if cfg.AllowedRepos, err = parseRepoPatterns("FIX_BUILD_ALLOWED_REPOS", envList("FIX_BUILD_ALLOWED_REPOS", nil)); err != nil {
+		return cfg, err
+	}
+
+	// Set but empty means no branch is protected
+	protected := []string{"main", "master"}
+	if _, ok := os.LookupEnv("FIX_BUILD_PROTECTED_BRANCHES"); ok {
+		protected = envList("FIX_BUILD_PROTECTED_BRANCHES", nil)
+	}
+	if cfg.ProtectedBranches, err = parseBranchPatterns("FIX_BUILD_PROTECTED_BRANCHES", protected); err != nil {
+		return cfg, err
+	}
+
+	if cfg.ModelRoutes, err = parseModelRoutes("FIX_BUILD_MODEL_ROUTES", envList("FIX_BUILD_MODEL_ROUTES", nil)); err != nil {
+		return cfg, err
+	}
+	cfg.DefaultModelPack = strings.TrimSpace(os.Getenv("FIX_BUILD_DEFAULT_MODEL_PACK"))
+
+	cfg.PlandexBin = strings.TrimSpace(os.Getenv("FIX_BUILD_PLANDEX_BIN"))
+	if cfg.PlandexBin == "" {
+		cfg.PlandexBin = "plandex"
+	}
+	cfg.PlandexMinVersion = strings.TrimSpace(os.Getenv("FIX_BUILD_PLANDEX_MIN_VERSION"))
+	if cfg.PlandexMinVersion != "" {
+		if _, err := parseVersion(cfg.PlandexMinVersion); err != nil {
+			return cfg, fmt.Errorf("invalid FIX_BUILD_PLANDEX_MIN_VERSION: %w", err)
+		}
+	}
+
+	cfg.HmacSecret = os.Getenv("FIX_BUILD_HMAC_SECRET")
+
+	if v := os.Getenv("FIX_BUILD_PROMPT_TEMPLATE"); strings.TrimSpace(v) != "" {
+		if cfg.PromptTemplate, err = parsePromptTemplate("FIX_BUILD_PROMPT_TEMPLATE", v); err != nil {
+			return cfg, err
+		}
+	}
+
+	switch cfg.Sandbox = strings.TrimSpace(os.Getenv("FIX_BUILD_SANDBOX")); cfg.Sandbox {
+	case "":
+	case "docker":
+		cfg.SandboxCommand = strings.Fields(os.Getenv("FIX_BUILD_SANDBOX_COMMAND"))
+		if len(cfg.SandboxCommand) == 0 {
+			cfg.SandboxCommand = []string{"docker", "run", "--rm"}
+		}
+		if !slices.Contains(cfg.SandboxCommand[1:], "run") {
+			return cfg, fmt.Errorf("invalid FIX_BUILD_SANDBOX_COMMAND %q: must be a container run command, e.g. \"docker run --rm\"", strings.Join(cfg.SandboxCommand, " "))
+		}
+		if cfg.SandboxImage = strings.TrimSpace(os.Getenv("FIX_BUILD_SANDBOX_IMAGE")); cfg.SandboxImage == "" {
+			return cfg, fmt.Errorf("FIX_BUILD_SANDBOX=docker requires FIX_BUILD_SANDBOX_IMAGE")
+		}
+		cfg.SandboxNetwork = strings.TrimSpace(os.Getenv("FIX_BUILD_SANDBOX_NETWORK"))
+		if cfg.SandboxNetwork == "" {
+			cfg.SandboxNetwork = "none"
+		}
+	default:
+		return cfg, fmt.Errorf("invalid FIX_BUILD_SANDBOX %q: must be docker or unset", cfg.Sandbox)
+	}
+
+	cfg.Bot = FixBuildAuthor{Name: "plandex[bot]", Email: "plandex-bot@users.noreply.github.com"}
+	if v := strings.TrimSpace(os.Getenv("FIX_BUILD_BOT_NAME")); v != "" {
+		cfg.Bot.Name = v
+	}
+	if v := strings.TrimSpace(os.Getenv("FIX_BUILD_BOT_EMAIL")); v != "" {
+		cfg.Bot.Email = v
+	}
+
+	cfg.Signing.Key = strings.TrimSpace(os.Getenv("FIX_BUILD_SIGNING_KEY"))
+	cfg.Signing.Format = strings.ToLower(strings.TrimSpace(os.Getenv("FIX_BUILD_SIGNING_FORMAT")))
+	switch cfg.Signing.Format {
+	case "":
+		cfg.Signing.Format = signingGpg
+	case signingGpg, signingSsh:
+	default:
+		return cfg, fmt.Errorf("invalid FIX_BUILD_SIGNING_FORMAT %q: must be gpg or ssh", cfg.Signing.Format)
+	}
+	if cfg.Signing.Format == signingSsh && cfg.Signing.enabled() && !filepath.IsAbs(cfg.Signing.Key) {
+		return cfg, fmt.Errorf("invalid FIX_BUILD_SIGNING_KEY %q: with FIX_BUILD_SIGNING_FORMAT=ssh it must be the absolute path of a private key", cfg.Signing.Key)
+	}
+
+	cfg.JobDir = strings.TrimSpace(os.Getenv("FIX_BUILD_JOB_DIR"))
+
+	cfg.LocalRoot = strings.TrimSpace(os.Getenv("FIX_BUILD_LOCAL_ROOT"))
+	if cfg.AllowKeepWorkdir, err = envBool("FIX_BUILD_ALLOW_KEEP_WORKDIR", false); err != nil {
+		return cfg, err
+	}
+
+	cfg.WorkDir = strings.TrimSpace(os.Getenv("FIX_BUILD_WORKDIR"))
+	maxWorkDirMB, err := envInt("FIX_BUILD_MAX_WORKDIR_MB", 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxWorkDirBytes = int64(maxWorkDirMB) << 20
+
+	maxMemoryMB, err := envInt("FIX_BUILD_MAX_MEMORY_MB", 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ResourceLimits.MemoryBytes = int64(maxMemoryMB) << 20
+	if cfg.ResourceLimits.CPUSeconds, err = envInt("FIX_BUILD_MAX_CPU_SECONDS", 0); err != nil {
+		return cfg, err
+	}
+
+	for _, host := range envList("FIX_BUILD_ANNOTATIONS_URL_HOSTS", nil) {
+		cfg.AnnotationsUrlHosts = append(cfg.AnnotationsUrlHosts, strings.ToLower(host))
+	}
+	maxAnnotationsMB, err := envInt("FIX_BUILD_MAX_ANNOTATIONS_MB", 10)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MaxAnnotationsBytes = int64(maxAnnotationsMB) << 20
+
+	cfg.CacheDir = strings.TrimSpace(os.Getenv("FIX_BUILD_CACHE_DIR"))
+	if cfg.CacheMaxRepos, err = envInt("FIX_BUILD_CACHE_MAX_REPOS", 20); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// ValidateFixBuildConfig checks the FIX_BUILD_* env vars so misconfiguration fails at startup
+// rather than on the first request.
+func ValidateFixBuildConfig() error {
+	_, err := loadFixBuildConfig()
+	return err
+}
+
+// FixBuildServerConfig is the effective /fix_build config as reported by GET /fix_build/config,
+// so callers can see the limits they're held to. Secrets and server paths are never included:
+// the callback secret and signing key only show up as whether they're set.
+type FixBuildServerConfig struct {
+	MaxConcurrency          int `json:"maxConcurrency"`
+	MaxCandidates           int `json:"maxCandidates"`
+	MaxCandidateParallelism int `json:"maxCandidateParallelism"`
+	MaxAttempts             int `json:"maxAttempts"`
+	MaxBatchSize            int `json:"maxBatchSize"`
+	MaxVerifyRetries        int `json:"maxVerifyRetries"`
+
+	Timeouts                FixBuildTimeouts `json:"timeouts"`
+	MaxPhaseTimeoutSeconds  int              `json:"maxPhaseTimeoutSeconds"`
+	MaxJobDurationSeconds   int              `json:"maxJobDurationSeconds"`
+	UnshallowTimeoutSeconds int              `json:"unshallowTimeoutSeconds"`
+
+	DiffLimits    FixBuildDiffLimits `json:"diffLimits"`
+	DiffLimitCaps FixBuildDiffLimits `json:"diffLimitCaps"`
+
+	MaxAnnotations      int      `json:"maxAnnotations"`
+	MaxAnnotationsBytes int64    `json:"maxAnnotationsBytes"`
+	AnnotationsUrlHosts []string `json:"annotationsUrlHosts"`
+	StrictAnnotations   bool     `json:"strictAnnotations"`
+	ContextMaxBytes     int      `json:"contextMaxBytes"`
+
+	AllowedRepos      []string `json:"allowedRepos"`
+	ProtectedBranches []string `json:"protectedBranches"`
+
+	RepoRateLimit   FixBuildRateLimit `json:"repoRateLimit"`
+	GlobalRateLimit FixBuildRateLimit `json:"globalRateLimit"`
+
+	IdempotencyTtlSeconds int `json:"idempotencyTtlSeconds"`
+	CoalesceWindowSeconds int `json:"coalesceWindowSeconds"`
+	ReverifyGraceSeconds  int `json:"reverifyGraceSeconds"`
+
+	MaxMemoryBytes int64 `json:"maxMemoryBytes"`
+	MaxCpuSeconds  int   `json:"maxCpuSeconds"`
+
+	SkipGenerated  bool     `json:"skipGenerated"`
+	GeneratedGlobs []string `json:"generatedGlobs"`
+
+	DefaultModelPack  string `json:"defaultModelPack,omitempty"`
+	PlandexMinVersion string `json:"plandexMinVersion,omitempty"`
+	Sandbox           string `json:"sandbox,omitempty"`
+
+	CallbacksSigned   bool `json:"callbacksSigned"`
+	CommitsSigned     bool `json:"commitsSigned"`
+	SignaturePrecheck bool `json:"signaturePrecheck"`
+	GithubAppEnabled  bool `json:"githubAppEnabled"`
+	LocalPathsEnabled bool `json:"localPathsEnabled"`
+	AllowKeepWorkdir  bool `json:"allowKeepWorkdir"`
+	PersistentJobs    bool `json:"persistentJobs"`
+}
+
+type FixBuildRateLimit struct {
+	PerHour int `json:"perHour"`
+	Burst   int `json:"burst"`
+}
+
+// serverConfig is the part of cfg that's safe to show callers.
+func (cfg fixBuildConfig) serverConfig() FixBuildServerConfig {
+	seconds := func(d time.Duration) int { return int(d / time.Second) }
+	nonNil := func(l []string) []string {
+		if l == nil {
+			return []string{}
+		}
+		return l
+	}
+	return FixBuildServerConfig{
+		MaxConcurrency:          cfg.MaxConcurrency,
+		MaxCandidates:           cfg.MaxCandidates,
+		MaxCandidateParallelism: cfg.MaxCandidateParallelism,
+		MaxAttempts:             cfg.MaxAttempts,
+		MaxBatchSize:            cfg.MaxBatchSize,
+		MaxVerifyRetries:        cfg.MaxVerifyRetries,
+
+		Timeouts: FixBuildTimeouts{
+			CloneSeconds: seconds(cfg.Timeouts.Clone),
+			SetupSeconds: seconds(cfg.Timeouts.Setup),
+			TellSeconds:  seconds(cfg.Timeouts.Tell),
+			BuildSeconds: seconds(cfg.Timeouts.Build),
+			PushSeconds:  seconds(cfg.Timeouts.Push),
+		},
+		MaxPhaseTimeoutSeconds:  seconds(cfg.MaxPhaseTimeout),
+		MaxJobDurationSeconds:   seconds(cfg.MaxJobDuration),
+		UnshallowTimeoutSeconds: seconds(cfg.UnshallowTimeout),
+
+		DiffLimits:    FixBuildDiffLimits{MaxChangedFiles: cfg.DiffLimits.Files, MaxChangedLines: cfg.DiffLimits.Lines},
+		DiffLimitCaps: FixBuildDiffLimits{MaxChangedFiles: cfg.DiffLimitCaps.Files, MaxChangedLines: cfg.DiffLimitCaps.Lines},
+
+		MaxAnnotations:      cfg.MaxAnnotations,
+		MaxAnnotationsBytes: cfg.MaxAnnotationsBytes,
+		AnnotationsUrlHosts: nonNil(cfg.AnnotationsUrlHosts),
+		StrictAnnotations:   cfg.StrictAnnotations,
+		ContextMaxBytes:     cfg.ContextMaxBytes,
+
+		AllowedRepos:      nonNil(cfg.AllowedRepos),
+		ProtectedBranches: nonNil(cfg.ProtectedBranches),
+
+		RepoRateLimit:   FixBuildRateLimit(cfg.RepoRateLimit),
+		GlobalRateLimit: FixBuildRateLimit(cfg.GlobalRateLimit),
+
+		IdempotencyTtlSeconds: seconds(cfg.IdempotencyTTL),
+		CoalesceWindowSeconds: seconds(cfg.CoalesceWindow),
+		ReverifyGraceSeconds:  seconds(cfg.ReverifyGrace),
+
+		MaxMemoryBytes: cfg.ResourceLimits.MemoryBytes,
+		MaxCpuSeconds:  cfg.ResourceLimits.CPUSeconds,
+
+		SkipGenerated:  cfg.SkipGenerated,
+		GeneratedGlobs: nonNil(cfg.GeneratedGlobs),
+
+		DefaultModelPack:  cfg.DefaultModelPack,
+		PlandexMinVersion: cfg.PlandexMinVersion,
+		Sandbox:           cfg.Sandbox,
+
+		CallbacksSigned:   cfg.HmacSecret != "",
+		CommitsSigned:     cfg.Signing.enabled(),
+		SignaturePrecheck: cfg.SignaturePrecheck,
+		GithubAppEnabled:  cfg.GithubApp != nil,
+		LocalPathsEnabled: cfg.LocalRoot != "",
+		AllowKeepWorkdir:  cfg.AllowKeepWorkdir,
+		PersistentJobs:    cfg.JobDir != "",
+	}
+}
+
+// FixBuildConfigHandler reports the effective non-secret /fix_build config.
+func FixBuildConfigHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		log.Printf("[fix_build] load config: %v", err)
+		writeFixBuildError(w, newFixBuildError(http.StatusInternalServerError, "invalid_server_config", "invalid fix_build server config: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cfg.serverConfig())
+}
+
+// resolveTimeouts applies payload overrides to the configured phase timeouts, clamped to the server maximum.
+func resolveTimeouts(cfg fixBuildConfig, overrides *FixBuildTimeouts) phaseTimeouts {
+	t := cfg.Timeouts
+	if overrides == nil {
+		return t
+	}
+	apply := func(dst *time.Duration, seconds int) {
+		if seconds <= 0 {
+			return
+		}
+		d := time.Duration(seconds) * time.Second
+		if cfg.MaxPhaseTimeout > 0 && d > cfg.MaxPhaseTimeout {
+			d = cfg.MaxPhaseTimeout
+		}
+		*dst = d
+	}
+	apply(&t.Clone, overrides.CloneSeconds)
+	apply(&t.Setup, overrides.SetupSeconds)
+	apply(&t.Tell, overrides.TellSeconds)
+	apply(&t.Build, overrides.BuildSeconds)
+	apply(&t.Push, overrides.PushSeconds)
+	return t
+}
+
+// resolveDiffLimits applies payload overrides to the server's diff limits, capped by DiffLimitCaps.
+func resolveDiffLimits(cfg fixBuildConfig, overrides *FixBuildDiffLimits) diffLimits {
+	l := cfg.DiffLimits
+	if overrides == nil {
+		return l
+	}
+	apply := func(dst *int, v, max int) {
+		if v <= 0 {
+			return
+		}
+		if max > 0 && v > max {
+			v = max
+		}
+		*dst = v
+	}
+	apply(&l.Files, overrides.MaxChangedFiles, cfg.DiffLimitCaps.Files)
+	apply(&l.Lines, overrides.MaxChangedLines, cfg.DiffLimitCaps.Lines)
+	return l
+}
+
+func envBool(name string, def bool) (bool, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: %v", name, v, err)
+	}
+	return b, nil
+}
+
+func envInt(name string, def int) (int, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return def, fmt.Errorf("invalid %s %q: must be a non-negative integer", name, v)
+	}
+	return n, nil
+}
+
+// envList reads a comma-separated list, ignoring blank entries.
+func envList(name string, def []string) []string {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	var res []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// envDuration accepts a Go duration ("90s", "10m") or a plain number of seconds.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return def, fmt.Errorf("invalid %s %q: must be a positive duration", name, v)
+	}
+	return d, nil
+}
+
+// envDurationOrOff is envDuration that also accepts 0, for limits 0 turns off.
+func envDurationOrOff(name string, def time.Duration) (time.Duration, error) {
+	if strings.TrimSpace(os.Getenv(name)) == "0" {
+		return 0, nil
+	}
+	return envDuration(name, def)
+}
+
+func envBaseUrl(name string) (string, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return "", nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid %s %q: must be an absolute http(s) URL", name, v)
+	}
+	return strings.TrimRight(v, "/"), nil
+}
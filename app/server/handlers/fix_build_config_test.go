@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadFixBuildConfigTimeouts(t *testing.T) {
+	t.Setenv("FIX_BUILD_CLONE_TIMEOUT", "2m")
+	t.Setenv("FIX_BUILD_TELL_TIMEOUT", "600")
+	t.Setenv("FIX_BUILD_PUSH_TIMEOUT", "45s")
+
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		t.Fatalf("loadFixBuildConfig: %v", err)
+	}
+	want := phaseTimeouts{Clone: 2 * time.Minute, Setup: 10 * time.Minute, Tell: 10 * time.Minute, Build: 15 * time.Minute, Push: 45 * time.Second}
+	if cfg.Timeouts != want {
+		t.Fatalf("want %+v, got %+v", want, cfg.Timeouts)
+	}
+
+	t.Setenv("FIX_BUILD_BUILD_TIMEOUT", "soon")
+	if _, err := loadFixBuildConfig(); err == nil {
+		t.Fatal("expected an invalid duration to be rejected")
+	}
+}
+
+func TestLoadFixBuildConfigMaxJobDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 2 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"0", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("FIX_BUILD_MAX_JOB_DURATION", tt.value)
+		cfg, err := loadFixBuildConfig()
+		if err != nil {
+			t.Fatalf("%q: %v", tt.value, err)
+		}
+		if cfg.MaxJobDuration != tt.want {
+			t.Fatalf("%q: want %v, got %v", tt.value, tt.want, cfg.MaxJobDuration)
+		}
+	}
+
+	t.Setenv("FIX_BUILD_MAX_JOB_DURATION", "-1h")
+	if _, err := loadFixBuildConfig(); err == nil {
+		t.Fatal("expected a negative budget to be rejected")
+	}
+}
+
+func TestResolveTimeouts(t *testing.T) {
+	cfg := fixBuildConfig{
+		Timeouts:        phaseTimeouts{Clone: 5 * time.Minute, Tell: 15 * time.Minute, Build: 15 * time.Minute, Push: time.Minute},
+		MaxPhaseTimeout: 20 * time.Minute,
+	}
+
+	if got := resolveTimeouts(cfg, nil); got != cfg.Timeouts {
+		t.Fatalf("expected defaults without overrides, got %+v", got)
+	}
+
+	got := resolveTimeouts(cfg, &FixBuildTimeouts{CloneSeconds: 60, TellSeconds: 3600})
+	want := phaseTimeouts{Clone: time.Minute, Tell: 20 * time.Minute, Build: 15 * time.Minute, Push: time.Minute}
+	if got != want {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestFixBuildConfigHandler(t *testing.T) {
+	t.Setenv("FIX_BUILD_MAX_CONCURRENCY", "7")
+	t.Setenv("FIX_BUILD_TELL_TIMEOUT", "20m")
+	t.Setenv("FIX_BUILD_ALLOWED_REPOS", "acme/*")
+	t.Setenv("FIX_BUILD_PROTECTED_BRANCHES", "main,release/*")
+	t.Setenv("FIX_BUILD_ANNOTATIONS_URL_HOSTS", "CI.example.com")
+	t.Setenv("FIX_BUILD_MAX_ANNOTATIONS_MB", "2")
+	t.Setenv("FIX_BUILD_HMAC_SECRET", "hmac-s3cret")
+	t.Setenv("FIX_BUILD_SIGNING_KEY", "/keys/signing-s3cret")
+	t.Setenv("FIX_BUILD_WORKDIR", "/srv/fix-build-work")
+
+	rec := httptest.NewRecorder()
+	FixBuildConfigHandler(rec, httptest.NewRequest(http.MethodGet, "/fix_build/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, secret := range []string{"hmac-s3cret", "signing-s3cret", "/srv/fix-build-work"} {
+		if strings.Contains(rec.Body.String(), secret) {
+			t.Fatalf("expected %q to be left out, got %s", secret, rec.Body.String())
+		}
+	}
+
+	var got FixBuildServerConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.MaxConcurrency != 7 || got.Timeouts.TellSeconds != 1200 || got.Timeouts.CloneSeconds != 300 {
+		t.Fatalf("expected the overrides over the defaults, got %+v", got)
+	}
+	if strings.Join(got.AllowedRepos, ",") != "acme/*" || strings.Join(got.ProtectedBranches, ",") != "main,release/*" {
+		t.Fatalf("expected the allowed repos and protected branches, got %v and %v", got.AllowedRepos, got.ProtectedBranches)
+	}
+	if strings.Join(got.AnnotationsUrlHosts, ",") != "ci.example.com" || got.MaxAnnotationsBytes != 2<<20 {
+		t.Fatalf("expected the annotation limits, got %v and %d", got.AnnotationsUrlHosts, got.MaxAnnotationsBytes)
+	}
+	if !got.CallbacksSigned || !got.CommitsSigned {
+		t.Fatalf("expected the secrets to show as set, got %+v", got)
+	}
+
+	t.Setenv("FIX_BUILD_MAX_CONCURRENCY", "many")
+	rec = httptest.NewRecorder()
+	FixBuildConfigHandler(rec, httptest.NewRequest(http.MethodGet, "/fix_build/config", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 for an invalid config, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// contextFileName is written to the checkout root for plandex to read. It is git-excluded so
+// `git add -A` never commits it alongside the fix.
+const contextFileName = "BUILD_FAILURE_CONTEXT.md"
+
+// maxContextPaths caps a payload's contextPaths, which all go on one plandex load command line.
+const maxContextPaths = 50
+
+// validateContextPaths checks that a payload's contextPaths are relative paths inside the repo.
+func validateContextPaths(paths []string) error {
+	if len(paths) > maxContextPaths {
+		return fmt.Errorf("contextPaths has %d paths; the limit is %d", len(paths), maxContextPaths)
+	}
+	for i, p := range paths {
+		if p == "" || !filepath.IsLocal(filepath.FromSlash(p)) {
+			return fmt.Errorf("contextPaths[%d] must be a relative path inside the repo: %q", i, p)
+		}
+	}
+	return nil
+}
+
+// resolveContextPaths checks that each of paths is a file in the checkout, without a symlink
+// leading out of it, and returns them cleaned.
+func resolveContextPaths(workDir string, paths []string) ([]string, error) {
+	root, err := filepath.EvalSymlinks(workDir)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([]string, 0, len(paths))
+	for _, p := range paths {
+		clean := filepath.Clean(filepath.FromSlash(p))
+		real, err := filepath.EvalSymlinks(filepath.Join(root, clean))
+		if err != nil {
+			return nil, fmt.Errorf("context path %s not found in the repo", p)
+		}
+		if rel, err := filepath.Rel(root, real); err != nil || !filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("context path %s resolves outside the repo", p)
+		}
+		if info, err := os.Stat(real); err != nil || !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("context path %s is not a file", p)
+		}
+		resolved = append(resolved, clean)
+	}
+	return resolved, nil
+}
+
+// defaultConventionsFile is where a repo keeps the coding conventions fixes should follow, when
+// the payload doesn't name its own conventionsFile.
+const defaultConventionsFile = ".plandex/CONVENTIONS.md"
+
+// resolveConventionsFile returns the conventions file to load into the plan, cleaned like a
+// context path: path, which must exist, or else the default if the repo has it. "" means none.
+func resolveConventionsFile(workDir, path string) (string, error) {
+	if path == "" {
+		resolved, err := resolveContextPaths(workDir, []string{defaultConventionsFile})
+		if err != nil {
+			return "", nil
+		}
+		return resolved[0], nil
+	}
+	resolved, err := resolveContextPaths(workDir, []string{path})
+	if err != nil {
+		return "", fmt.Errorf("conventionsFile: %v", err)
+	}
+	return resolved[0], nil
+}
+
+// contextOptions carries the optional, server-generated sections of the context file.
+type contextOptions struct {
+	RepoTree string
+	// BaseChanges are the files changed between the payload's baseSha and headSha.
+	BaseChanges []string
+
+	// MaxSectionBytes caps the summary and each annotation's details; MaxTotalBytes caps
+	// the whole file. Zero means unlimited.
+	MaxSectionBytes int
+	MaxTotalBytes   int
+	// MaxAnnotations keeps only the most severe annotations when there are more. Zero means unlimited.
+	MaxAnnotations int
+
+	// VerifyFailure is the output of the last attempt's failed verify, when plandex is retrying.
+	VerifyFailure *verifyFailure
+}
+
+type verifyFailure struct {
+	Attempt int
+	Command []string
+	Output  string
+}
+
+// newContextOptions returns the server's limits for the context file, with no optional sections.
+func newContextOptions(cfg fixBuildConfig) contextOptions {
+	return contextOptions{
+		MaxSectionBytes: cfg.ContextMaxSectionBytes,
+		MaxTotalBytes:   cfg.ContextMaxBytes,
+		MaxAnnotations:  cfg.MaxAnnotations,
+	}
+}
+
+func buildContextContent(p FixBuildPayload, opts contextOptions) string {
+	var b strings.Builder
+	b.WriteString("# Build failure context\n\n")
+	if p.FailingCommand != "" {
+		dir := p.WorkingDirectory
+		if dir == "" {
+			dir = "."
+		}
+		b.WriteString("## Reproduce with\n\n```sh\n")
+		b.WriteString(fmt.Sprintf("cd %s\n%s\n", dir, p.FailingCommand))
+		b.WriteString("```\n\n")
+	}
+	if p.OutputSummary != "" {
+		b.WriteString("## Output summary\n\n")
+		b.WriteString(truncateMiddle(p.OutputSummary, opts.MaxSectionBytes))
+		b.WriteString("\n\n")
+	}
+	if p.CheckRunUrl != "" {
+		b.WriteString("Check run: ")
+		b.WriteString(p.CheckRunUrl)
+		b.WriteString("\n\n")
+	}
+	if p.WorkflowRunUrl != "" {
+		b.WriteString("Workflow run: ")
+		b.WriteString(p.WorkflowRunUrl)
+		b.WriteString("\n\n")
+	}
+	if p.BaseSha != "" {
+		b.WriteString("## Changes under test\n\n")
+		b.WriteString(fmt.Sprintf("The build ran on %s, which changes %s..%s", p.HeadSha, p.BaseSha, p.HeadSha))
+		if len(opts.BaseChanges) == 0 {
+			b.WriteString(".\n\n")
+		} else {
+			b.WriteString(" in these files:\n\n")
+			for _, f := range opts.BaseChanges {
+				b.WriteString("- " + f + "\n")
+			}
+			b.WriteString("\n")
+		}
+	}
+	if len(p.Annotations) > 0 {
+		b.WriteString("## Annotations\n\n")
+		annos, omitted := limitAnnotations(groupAnnotations(p.Annotations), opts.MaxAnnotations)
+		lastPath := ""
+		for i, a := range groupAnnotations(annos) {
+			if i == 0 || a.Path != lastPath {
+				if i > 0 {
+					b.WriteString("\n")
+				}
+				b.WriteString(fmt.Sprintf("### %s\n\n", a.Path))
+				lastPath = a.Path
+			}
+			b.WriteString(fmt.Sprintf("- **%s** (lines %d-%d): %s\n", a.AnnotationLevel, a.StartLine, a.EndLine, a.Message))
+			if a.Title != "" {
+				b.WriteString(fmt.Sprintf("  - %s\n", a.Title))
+			}
+			if a.RawDetails != "" {
+				b.WriteString("  - Details:\n")
+				for _, line := range strings.Split(truncateMiddle(a.RawDetails, opts.MaxSectionBytes), "\n") {
+					b.WriteString("    ")
+					b.WriteString(line)
+					b.WriteString("\n")
+				}
+			}
+		}
+		if omitted > 0 {
+			b.WriteString(fmt.Sprintf("\n_%d additional annotations omitted_\n", omitted))
+		}
+		b.WriteString("\n")
+	}
+	if opts.RepoTree != "" {
+		b.WriteString("## Repo structure\n\n```\n")
+		b.WriteString(opts.RepoTree)
+		b.WriteString("```\n")
+	}
+	if f := opts.VerifyFailure; f != nil {
+		if opts.RepoTree != "" {
+			b.WriteString("\n")
+		}
+		b.WriteString(fmt.Sprintf("## Verify output after attempt %d\n\n", f.Attempt))
+		if len(f.Command) > 0 {
+			b.WriteString(fmt.Sprintf("The fix so far still fails `%s`:\n\n", strings.Join(f.Command, " ")))
+		}
+		b.WriteString("```\n")
+		b.WriteString(strings.TrimRight(truncateMiddle(f.Output, opts.MaxSectionBytes), "\n"))
+		b.WriteString("\n```\n")
+	}
+	return truncateMiddle(b.String(), opts.MaxTotalBytes)
+}
+
+// normalizeAnnotations returns a cleaned copy of annos: levels are lowercased, line numbers below 1
+// are clamped to 1, inverted ranges are swapped and unknown levels become "notice". In strict
+// mode any of those problems is an error instead.
+func normalizeAnnotations(annos []FixBuildAnno, strict bool) ([]FixBuildAnno, error) {
+	res := make([]FixBuildAnno, 0, len(annos))
+	for i, a := range annos {
+		level := strings.ToLower(strings.TrimSpace(a.AnnotationLevel))
+		switch level {
+		case "notice", "warning", "failure":
+		default:
+			if strict {
+				return nil, fmt.Errorf("annotations[%d]: unknown annotation_level %q (want notice, warning or failure)", i, a.AnnotationLevel)
+			}
+			level = "notice"
+		}
+		a.AnnotationLevel = level
+
+		if a.StartLine < 1 || a.EndLine < 1 {
+			if strict {
+				return nil, fmt.Errorf("annotations[%d]: line numbers must be at least 1, got %d-%d", i, a.StartLine, a.EndLine)
+			}
+			a.StartLine, a.EndLine = max(a.StartLine, 1), max(a.EndLine, 1)
+		}
+		if a.EndLine < a.StartLine {
+			if strict {
+				return nil, fmt.Errorf("annotations[%d]: end_line %d is before start_line %d", i, a.EndLine, a.StartLine)
+			}
+			a.StartLine, a.EndLine = a.EndLine, a.StartLine
+		}
+		res = append(res, a)
+	}
+	return res, nil
+}
+
+// annotationSeverity ranks annotation levels so failures sort ahead of warnings and notices.
+func annotationSeverity(level string) int {
+	switch level {
+	case "failure":
+		return 0
+	case "warning":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// groupAnnotations dedupes annotations (GitHub sometimes sends the same one twice) and orders
+// them by path, then severity, then start line, so each file's problems are listed together.
+func groupAnnotations(annos []FixBuildAnno) []FixBuildAnno {
+	type key struct {
+		path      string
+		startLine int
+		endLine   int
+		message   string
+	}
+	seen := map[key]bool{}
+	res := make([]FixBuildAnno, 0, len(annos))
+	for _, a := range annos {
+		k := key{a.Path, a.StartLine, a.EndLine, a.Message}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		res = append(res, a)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if sa, sb := annotationSeverity(a.AnnotationLevel), annotationSeverity(b.AnnotationLevel); sa != sb {
+			return sa < sb
+		}
+		return a.StartLine < b.StartLine
+	})
+	return res
+}
+
+// limitAnnotations keeps at most max annotations, preferring failures over warnings over notices
+// and otherwise keeping the original order, and reports how many were dropped.
+func limitAnnotations(annos []FixBuildAnno, max int) ([]FixBuildAnno, int) {
+	if max <= 0 || len(annos) <= max {
+		return annos, 0
+	}
+	ranked := append([]FixBuildAnno(nil), annos...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return annotationSeverity(ranked[i].AnnotationLevel) < annotationSeverity(ranked[j].AnnotationLevel)
+	})
+	return ranked[:max], len(annos) - max
+}
+
+// truncateMiddle shortens s to at most max bytes by dropping the middle and inserting a
+// marker, since the most useful lines of a CI log are usually at its start and end.
+func truncateMiddle(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+
+	// Size the marker for the worst case so the result never exceeds max.
+	markerLen := len(fmt.Sprintf("\n[...truncated %d bytes...]\n", len(s)))
+	keep := max - markerLen
+	if keep <= 0 {
+		return s[:runeStart(s, max)]
+	}
+
+	head := runeStart(s, keep/2)
+	tail := len(s) - (keep - keep/2)
+	for tail < len(s) && !utf8.RuneStart(s[tail]) {
+		tail++
+	}
+
+	return s[:head] + fmt.Sprintf("\n[...truncated %d bytes...]\n", tail-head) + s[tail:]
+}
+
+// runeStart moves i back to the start of the UTF-8 sequence containing it.
+func runeStart(s string, i int) int {
+	for i > 0 && i < len(s) && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
+
+// listRepoFiles returns tracked and untracked-but-not-ignored paths, so the tree respects .gitignore.
+func listRepoFiles(ctx context.Context, workDir string) ([]string, error) {
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "ls-files", "--cached", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files: %v\n%s", err, out)
+	}
+	var files []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// renderRepoTree renders an indented directory tree of files down to maxDepth levels,
+// listing at most maxEntries entries and noting how many were left out.
+func renderRepoTree(files []string, maxDepth, maxEntries int) string {
+	if maxDepth <= 0 || maxEntries <= 0 {
+		return ""
+	}
+
+	type entry struct {
+		parts []string
+		isDir bool
+	}
+	seen := map[string]bool{}
+	var entries []entry
+	for _, f := range files {
+		parts := strings.Split(strings.Trim(f, "/"), "/")
+		for i := 0; i < len(parts) && i < maxDepth; i++ {
+			isDir := i < len(parts)-1
+			key := strings.Join(parts[:i+1], "/")
+			if isDir {
+				key += "/"
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			entries = append(entries, entry{parts: parts[:i+1], isDir: isDir})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].parts, entries[j].parts
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	var b strings.Builder
+	for i, e := range entries {
+		if i == maxEntries {
+			b.WriteString(fmt.Sprintf("... (%d more entries not shown)\n", len(entries)-maxEntries))
+			break
+		}
+		b.WriteString(strings.Repeat("  ", len(e.parts)-1))
+		b.WriteString(e.parts[len(e.parts)-1])
+		if e.isDir {
+			b.WriteString("/")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// writeContextFile writes content to the context file in workDir and excludes it from git.
+func writeContextFile(ctx context.Context, workDir, content string) error {
+	if err := excludeFromGit(ctx, workDir, contextFileName); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(workDir, contextFileName), []byte(content), 0644)
+}
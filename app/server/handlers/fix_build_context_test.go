@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderRepoTree(t *testing.T) {
+	files := []string{
+		"README.md",
+		"app/server/main.go",
+		"app/server/handlers/fix_build.go",
+		"app/cli/main.go",
+		"docs/index.md",
+	}
+
+	got := renderRepoTree(files, 2, 100)
+	want := "README.md\n" +
+		"app/\n" +
+		"  cli/\n" +
+		"  server/\n" +
+		"docs/\n" +
+		"  index.md\n"
+	if got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestRenderRepoTreeEntryCap(t *testing.T) {
+	var files []string
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		files = append(files, name+".go")
+	}
+
+	got := renderRepoTree(files, 3, 4)
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected 4 entries plus an omission note, got %d lines:\n%s", len(lines), got)
+	}
+	if lines[4] != "... (2 more entries not shown)" {
+		t.Fatalf("unexpected omission note %q", lines[4])
+	}
+}
+
+func TestBuildContextContentRepoTree(t *testing.T) {
+	p := FixBuildPayload{OutputSummary: "tests failed"}
+
+	if got := buildContextContent(p, contextOptions{}); strings.Contains(got, "## Repo structure") {
+		t.Fatalf("repo structure section should be omitted without a tree:\n%s", got)
+	}
+
+	got := buildContextContent(p, contextOptions{RepoTree: "main.go\n"})
+	if !strings.Contains(got, "## Repo structure\n\n```\nmain.go\n```\n") {
+		t.Fatalf("missing repo structure section:\n%s", got)
+	}
+}
+
+func TestTruncateMiddle(t *testing.T) {
+	if got := truncateMiddle("short", 100); got != "short" {
+		t.Fatalf("short input should be untouched, got %q", got)
+	}
+
+	s := "HEAD" + strings.Repeat("x", 10_000) + "TAIL"
+	got := truncateMiddle(s, 200)
+	if len(got) > 200 {
+		t.Fatalf("expected at most 200 bytes, got %d", len(got))
+	}
+	if !strings.HasPrefix(got, "HEAD") || !strings.HasSuffix(got, "TAIL") {
+		t.Fatalf("head and tail should survive truncation:\n%s", got)
+	}
+	if !strings.Contains(got, "[...truncated ") {
+		t.Fatalf("missing truncation marker:\n%s", got)
+	}
+}
+
+func TestBuildContextContentTruncatesHugeSummary(t *testing.T) {
+	p := FixBuildPayload{
+		OutputSummary: "first line\n" + strings.Repeat("stack frame\n", 2_000_000) + "last line",
+		Annotations: []FixBuildAnno{
+			{Path: "a_test.go", StartLine: 1, EndLine: 1, Message: "boom", RawDetails: strings.Repeat("detail\n", 100_000)},
+		},
+	}
+	opts := contextOptions{MaxSectionBytes: 4 << 10, MaxTotalBytes: 16 << 10}
+
+	got := buildContextContent(p, opts)
+	if len(got) > opts.MaxTotalBytes {
+		t.Fatalf("context is %d bytes, want at most %d", len(got), opts.MaxTotalBytes)
+	}
+	if strings.Count(got, "[...truncated ") != 2 {
+		t.Fatalf("expected summary and details to each be truncated:\n%s", got)
+	}
+	if !strings.Contains(got, "first line") || !strings.Contains(got, "last line") {
+		t.Fatal("expected both ends of the summary to survive")
+	}
+
+	opts.MaxSectionBytes = 0
+	got = buildContextContent(p, opts)
+	if len(got) > opts.MaxTotalBytes {
+		t.Fatalf("aggregate cap not applied: %d bytes", len(got))
+	}
+}
+
+func TestBuildContextContentGroupsAnnotations(t *testing.T) {
+	p := FixBuildPayload{
+		Annotations: []FixBuildAnno{
+			{Path: "b.go", StartLine: 9, EndLine: 9, AnnotationLevel: "notice", Message: "unused import"},
+			{Path: "a.go", StartLine: 30, EndLine: 31, AnnotationLevel: "failure", Message: "undefined: foo"},
+			{Path: "b.go", StartLine: 20, EndLine: 20, AnnotationLevel: "failure", Message: "test failed"},
+			{Path: "a.go", StartLine: 5, EndLine: 5, AnnotationLevel: "warning", Message: "shadowed var"},
+			{Path: "b.go", StartLine: 20, EndLine: 20, AnnotationLevel: "failure", Message: "test failed"},
+			{Path: "a.go", StartLine: 10, EndLine: 10, AnnotationLevel: "failure", Message: "mismatched types"},
+		},
+	}
+
+	got := buildContextContent(p, contextOptions{})
+	want := "# Build failure context\n\n" +
+		"## Annotations\n\n" +
+		"### a.go\n\n" +
+		"- **failure** (lines 10-10): mismatched types\n" +
+		"- **failure** (lines 30-31): undefined: foo\n" +
+		"- **warning** (lines 5-5): shadowed var\n" +
+		"\n" +
+		"### b.go\n\n" +
+		"- **failure** (lines 20-20): test failed\n" +
+		"- **notice** (lines 9-9): unused import\n" +
+		"\n"
+	if got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestNormalizeAnnotations(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        FixBuildAnno
+		want      FixBuildAnno
+		strictErr bool
+	}{
+		{
+			name: "valid annotation is unchanged",
+			in:   FixBuildAnno{Path: "a.go", StartLine: 3, EndLine: 5, AnnotationLevel: "failure"},
+			want: FixBuildAnno{Path: "a.go", StartLine: 3, EndLine: 5, AnnotationLevel: "failure"},
+		},
+		{
+			name: "level case is normalized",
+			in:   FixBuildAnno{Path: "a.go", StartLine: 1, EndLine: 1, AnnotationLevel: " Warning "},
+			want: FixBuildAnno{Path: "a.go", StartLine: 1, EndLine: 1, AnnotationLevel: "warning"},
+		},
+		{
+			name:      "inverted range is swapped",
+			in:        FixBuildAnno{Path: "a.go", StartLine: 9, EndLine: 4, AnnotationLevel: "failure"},
+			want:      FixBuildAnno{Path: "a.go", StartLine: 4, EndLine: 9, AnnotationLevel: "failure"},
+			strictErr: true,
+		},
+		{
+			name:      "negative lines are clamped",
+			in:        FixBuildAnno{Path: "a.go", StartLine: -2, EndLine: 7, AnnotationLevel: "failure"},
+			want:      FixBuildAnno{Path: "a.go", StartLine: 1, EndLine: 7, AnnotationLevel: "failure"},
+			strictErr: true,
+		},
+		{
+			name:      "missing lines are clamped",
+			in:        FixBuildAnno{Path: "a.go", AnnotationLevel: "notice"},
+			want:      FixBuildAnno{Path: "a.go", StartLine: 1, EndLine: 1, AnnotationLevel: "notice"},
+			strictErr: true,
+		},
+		{
+			name:      "unknown level becomes notice",
+			in:        FixBuildAnno{Path: "a.go", StartLine: 2, EndLine: 2, AnnotationLevel: "catastrophic"},
+			want:      FixBuildAnno{Path: "a.go", StartLine: 2, EndLine: 2, AnnotationLevel: "notice"},
+			strictErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeAnnotations([]FixBuildAnno{tt.in}, false)
+			if err != nil {
+				t.Fatalf("lenient mode should not fail: %v", err)
+			}
+			if got[0] != tt.want {
+				t.Fatalf("want %+v, got %+v", tt.want, got[0])
+			}
+
+			_, err = normalizeAnnotations([]FixBuildAnno{tt.in}, true)
+			if gotErr := err != nil; gotErr != tt.strictErr {
+				t.Fatalf("strict mode error=%v, want %v (%v)", gotErr, tt.strictErr, err)
+			}
+		})
+	}
+}
+
+func TestBuildContextContentLimitsAnnotations(t *testing.T) {
+	levels := []string{"notice", "warning", "notice", "failure", "notice"}
+	var annos []FixBuildAnno
+	for i := 0; i < 1000; i++ {
+		annos = append(annos, FixBuildAnno{
+			Path:            fmt.Sprintf("pkg%d/file.go", i%7),
+			StartLine:       i + 1,
+			EndLine:         i + 1,
+			AnnotationLevel: levels[i%len(levels)],
+			Message:         fmt.Sprintf("problem %d", i),
+		})
+	}
+
+	// 200 failures, 200 warnings and 600 notices, so the cap keeps every failure plus the first 100 warnings
+	got := buildContextContent(FixBuildPayload{Annotations: annos}, contextOptions{MaxAnnotations: 300})
+	if n := strings.Count(got, "**failure**"); n != 200 {
+		t.Fatalf("expected all 200 failures, got %d", n)
+	}
+	if n := strings.Count(got, "**warning**"); n != 100 {
+		t.Fatalf("expected 100 warnings, got %d", n)
+	}
+	if strings.Contains(got, "**notice**") {
+		t.Fatal("expected notices to be dropped first")
+	}
+	if !strings.Contains(got, "_700 additional annotations omitted_") {
+		t.Fatal("missing omission note")
+	}
+
+	if got := buildContextContent(FixBuildPayload{Annotations: annos}, contextOptions{}); strings.Contains(got, "omitted") {
+		t.Fatal("expected no cap without MaxAnnotations")
+	}
+}
+
+func TestBuildContextContentReproduceSection(t *testing.T) {
+	p := FixBuildPayload{
+		FailingCommand:   "go test ./pkg/...",
+		WorkingDirectory: "services/api",
+		OutputSummary:    "FAIL pkg/foo",
+	}
+	got := buildContextContent(p, contextOptions{})
+	want := "## Reproduce with\n\n```sh\ncd services/api\ngo test ./pkg/...\n```\n"
+	if !strings.Contains(got, want) {
+		t.Fatalf("missing reproduce section:\n%s", got)
+	}
+	if strings.Index(got, "## Reproduce with") > strings.Index(got, "## Output summary") {
+		t.Fatal("expected the reproduce section before the output summary")
+	}
+
+	if got := buildContextContent(FixBuildPayload{OutputSummary: "x"}, contextOptions{}); strings.Contains(got, "Reproduce") {
+		t.Fatal("expected no reproduce section without a failing command")
+	}
+}
+
+func TestBuildContextContentBaseChanges(t *testing.T) {
+	p := FixBuildPayload{HeadSha: "aaa0058", BaseSha: "bbb0058", OutputSummary: "FAIL"}
+	got := buildContextContent(p, contextOptions{BaseChanges: []string{"api/handler.go"}})
+	want := "## Changes under test\n\nThe build ran on aaa0058, which changes bbb0058..aaa0058 in these files:\n\n- api/handler.go\n"
+	if !strings.Contains(got, want) {
+		t.Fatalf("missing changes section:\n%s", got)
+	}
+	if got := buildContextContent(FixBuildPayload{HeadSha: "aaa0058"}, contextOptions{}); strings.Contains(got, "Changes under test") {
+		t.Fatal("expected no changes section without a base")
+	}
+}
+
+func TestBuildContextContentVerifyFailure(t *testing.T) {
+	p := FixBuildPayload{OutputSummary: "FAIL: TestWidget"}
+	got := buildContextContent(p, contextOptions{VerifyFailure: &verifyFailure{Attempt: 1, Command: []string{"sh", "-c", "make test"}, Output: "FAIL: TestGadget\n"}})
+	want := "## Verify output after attempt 1\n\nThe fix so far still fails `sh -c make test`:\n\n```\nFAIL: TestGadget\n```\n"
+	if !strings.HasSuffix(got, want) {
+		t.Fatalf("expected the latest verify output last:\n%s", got)
+	}
+	if got := buildContextContent(p, contextOptions{}); strings.Contains(got, "Verify output") {
+		t.Fatal("expected no verify section on the first attempt")
+	}
+}
+
+func TestValidateContextPaths(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		ok   bool
+	}{
+		{"pkg/widget.go", true},
+		{"./config/app.yaml", true},
+		{"../../etc/passwd", false},
+		{"pkg/../../secret", false},
+		{"/etc/passwd", false},
+		{"", false},
+	} {
+		if err := validateContextPaths([]string{tc.path}); (err == nil) != tc.ok {
+			t.Fatalf("%q: expected ok=%v, got %v", tc.path, tc.ok, err)
+		}
+	}
+}
+
+func TestResolveContextPathsRejectsSymlinkEscape(t *testing.T) {
+	repo, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(repo, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveContextPaths(repo, []string{"link"}); err == nil || !strings.Contains(err.Error(), "outside the repo") {
+		t.Fatalf("expected a symlink out of the repo to be rejected, got %v", err)
+	}
+}
+
+func TestFixBuildContextPaths(t *testing.T) {
+	root := fakeGithub(t)
+	loads := filepath.Join(t.TempDir(), "loads")
+	t.Setenv("FAKE_PLANDEX_LOG", loads)
+	fakePlandex(t, `[ "$1" = "load" ] && echo "$@" >> "$FAKE_PLANDEX_LOG"
+[ "$1" = "tell" ] && echo fixed > file.txt
+exit 0
+`)
+	post := func(name string, paths ...string) (int, FixBuildErrorBody) {
+		_, sha := addFakeGithubRepo(t, root, "acme", name)
+		rec := postFixBuild(t, FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: name}, HeadBranch: "main", HeadSha: sha, OutputSummary: "FAIL", InstallationToken: "tok", ContextPaths: paths})
+		var body FixBuildErrorResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body.Error
+	}
+
+	if code, _ := post("ctx-valid", "file.txt"); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	out, err := os.ReadFile(loads)
+	if err != nil {
+		t.Fatalf("expected plandex load to run: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "load "+contextFileName+" file.txt" {
+		t.Fatalf("expected the context file and file.txt to be loaded, got %q", got)
+	}
+
+	if code, body := post("ctx-missing", "missing.go"); code != http.StatusUnprocessableEntity || body.Code != "context_path_invalid" {
+		t.Fatalf("expected 422 context_path_invalid for a missing file, got %d %+v", code, body)
+	}
+	if code, body := post("ctx-traversal", "../../etc/passwd"); code != http.StatusBadRequest || body.Code != "invalid_payload" {
+		t.Fatalf("expected 400 for a path outside the repo, got %d %+v", code, body)
+	}
+}
+
+// addRepoFile commits a file to a fakeGithub repo's main branch and returns the new head SHA.
+func addRepoFile(t *testing.T, bare, path, content string) string {
+	t.Helper()
+	work := t.TempDir()
+	gitT(t, work, "clone", "-q", bare, ".")
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(work, path)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, path), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitT(t, work, "add", "-A")
+	gitT(t, work, "commit", "-q", "-m", "add "+path)
+	gitT(t, work, "push", "-q", "origin", "HEAD")
+	return gitT(t, work, "rev-parse", "HEAD")
+}
+
+func TestFixBuildConventionsFile(t *testing.T) {
+	root := fakeGithub(t)
+	loads := filepath.Join(t.TempDir(), "loads")
+	t.Setenv("FAKE_PLANDEX_LOG", loads)
+	// Records what plan load brought in, conventions included
+	fakePlandex(t, `[ "$1" = "load" ] && { echo "$@"; shift 2; cat "$@"; } >> "$FAKE_PLANDEX_LOG"
+[ "$1" = "tell" ] && echo fixed > file.txt
+exit 0
+`)
+	tests := []struct {
+		name        string
+		path        string
+		conventions string
+		status      int
+		want        string
+	}{
+		{name: "default", path: ".plandex/CONVENTIONS.md", status: http.StatusOK, want: "load " + contextFileName + " .plandex/CONVENTIONS.md\nUse table-driven tests."},
+		{name: "named", path: "docs/STYLE.md", conventions: "docs/STYLE.md", status: http.StatusOK, want: "load " + contextFileName + " docs/STYLE.md\nUse table-driven tests."},
+		{name: "none", status: http.StatusOK},
+		{name: "named but missing", conventions: "docs/STYLE.md", status: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(loads)
+			name := "conventions-" + strings.ReplaceAll(tt.name, " ", "-")
+			bare, sha := addFakeGithubRepo(t, root, "acme", name)
+			if tt.path != "" {
+				sha = addRepoFile(t, bare, tt.path, "Use table-driven tests.\n")
+			}
+			rec := postFixBuild(t, FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: name}, HeadBranch: "main", HeadSha: sha, OutputSummary: "FAIL", InstallationToken: "tok", ConventionsFile: tt.conventions})
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			out, _ := os.ReadFile(loads)
+			if got := strings.TrimSpace(string(out)); got != tt.want {
+				t.Fatalf("expected plandex load to bring in %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// commandDenyPattern is one FIX_BUILD_COMMAND_DENYLIST entry: a literal substring, or a regex
+// written between slashes.
+type commandDenyPattern struct {
+	text string
+	re   *regexp.Regexp
+}
+
+// parseCommandDenylist parses FIX_BUILD_COMMAND_DENYLIST entries, one per line (like the skip
+// patterns, since commands contain commas). "curl | sh" matches that text anywhere in a
+// command; "/curl .*\| *sh/" is a regex.
+func parseCommandDenylist(name, raw string) ([]commandDenyPattern, error) {
+	var patterns []commandDenyPattern
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		expr := regexp.QuoteMeta(line)
+		if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+			expr = line[1 : len(line)-1]
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", name, line, err)
+		}
+		patterns = append(patterns, commandDenyPattern{text: line, re: re})
+	}
+	return patterns, nil
+}
+
+// payloadCommand is one command the handler would run on a caller's behalf, with the payload
+// field it came from. Shell commands are a single script, run with sh -c.
+type payloadCommand struct {
+	field string
+	argv  []string
+	shell bool
+}
+
+// line is the command with its arguments joined by spaces.
+func (c payloadCommand) line() string {
+	return strings.Join(c.argv, " ")
+}
+
+// payloadCommands lists the setup, verify, format and regenerate commands the handler would run
+// for p. The verifyChangedCommandTemplate is listed as written, since rendering it only adds
+// quoted file names.
+func payloadCommands(p FixBuildPayload) []payloadCommand {
+	var commands []payloadCommand
+	add := func(field string, argv []string, shell bool) {
+		if len(argv) > 0 {
+			commands = append(commands, payloadCommand{field: field, argv: argv, shell: shell})
+		}
+	}
+	for i, c := range p.SetupCommands {
+		add(fmt.Sprintf("setupCommands[%d]", i), c, false)
+	}
+	if len(p.VerifyCommands) > 0 {
+		for i, c := range p.VerifyCommands {
+			add(fmt.Sprintf("verifyCommands[%d]", i), c, false)
+		}
+	} else if p.VerifyCommand != "" {
+		add("verifyCommand", []string{p.VerifyCommand}, true)
+	} else if p.FailingCommand != "" {
+		add("failingCommand", []string{p.FailingCommand}, true)
+	}
+	if p.VerifyChangedOnly {
+		add("verifyChangedCommandTemplate", []string{p.VerifyChangedCommandTemplate}, true)
+	}
+	add("formatCommand", p.FormatCommand, false)
+	add("regenerateCommand", p.RegenerateCommand, false)
+	return commands
+}
+
+// deniedCommand returns the first command the handler would run for p that matches a denylist
+// pattern, naming the field it came from. Commands are matched with their arguments joined by
+// spaces.
+func deniedCommand(denylist []commandDenyPattern, p FixBuildPayload) (field, command string, pattern *commandDenyPattern) {
+	if len(denylist) == 0 {
+		return "", "", nil
+	}
+	for _, c := range payloadCommands(p) {
+		line := c.line()
+		for j := range denylist {
+			if denylist[j].re.MatchString(line) {
+				return c.field, line, &denylist[j]
+			}
+		}
+	}
+	return "", "", nil
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testCommandDenylist = "rm -rf /\ncurl | sh\n/git\\s+push\\s/"
+
+func TestDeniedCommand(t *testing.T) {
+	denylist, err := parseCommandDenylist("FIX_BUILD_COMMAND_DENYLIST", testCommandDenylist)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		payload FixBuildPayload
+		field   string
+		pattern string
+	}{
+		{"setup", FixBuildPayload{SetupCommands: [][]string{{"npm", "ci"}, {"sh", "-c", "curl | sh"}}}, "setupCommands[1]", "curl | sh"},
+		{"verify", FixBuildPayload{VerifyCommand: "make clean && rm -rf / && make test"}, "verifyCommand", "rm -rf /"},
+		{"failing command as verify", FixBuildPayload{FailingCommand: "git  push   origin main"}, "failingCommand", "/git\\s+push\\s/"},
+		{"format", FixBuildPayload{FormatCommand: []string{"rm", "-rf", "/"}}, "formatCommand", "rm -rf /"},
+		{"allowed", FixBuildPayload{SetupCommands: [][]string{{"npm", "ci"}}, VerifyCommand: "rm -rf ./build && go test ./...", FormatCommand: []string{"gofmt", "-w", "."}}, "", ""},
+		{"unused failing command", FixBuildPayload{FailingCommand: "curl | sh", VerifyCommand: "go test ./..."}, "", ""},
+	}
+	for _, tt := range tests {
+		field, _, pattern := deniedCommand(denylist, tt.payload)
+		got := ""
+		if pattern != nil {
+			got = pattern.text
+		}
+		if field != tt.field || got != tt.pattern {
+			t.Fatalf("%s: expected %q denied by %q, got %q by %q", tt.name, tt.field, tt.pattern, field, got)
+		}
+	}
+
+	if _, err := parseCommandDenylist("FIX_BUILD_COMMAND_DENYLIST", "/(unclosed/"); err == nil {
+		t.Fatal("expected an invalid regex to be rejected")
+	}
+}
+
+func TestFixBuildCommandDenylist(t *testing.T) {
+	t.Setenv("FIX_BUILD_COMMAND_DENYLIST", testCommandDenylist)
+
+	f := useFakeRunner(t, nil)
+	p := fakeRunnerPayload("ddd0078")
+	p.VerifyCommand = "curl | sh"
+	rec := postFixBuild(t, p)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"code":"command_denied"`) {
+		t.Fatalf("expected 422 command_denied, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if f.called("git clone") {
+		t.Fatal("expected a denied job to be refused before cloning")
+	}
+
+	f = useFakeRunner(t, nil)
+	p = fakeRunnerPayload("ddd1078")
+	p.VerifyCommand = "go test ./..."
+	if rec := postFixBuild(t, p); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !f.called("sh -c go test ./...") {
+		t.Fatalf("expected the allowed verify command to run; calls were:\n%s", strings.Join(f.calls, "\n"))
+	}
+}
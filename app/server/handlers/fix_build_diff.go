@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FixBuildDiffStats summarizes the fix, as reported by git diff --shortstat.
+type FixBuildDiffStats struct {
+	FilesChanged int `json:"filesChanged"`
+	Insertions   int `json:"insertions"`
+	Deletions    int `json:"deletions"`
+}
+
+// FixBuildDiffLimits are payload overrides of the server's diff-size limits, up to its caps.
+type FixBuildDiffLimits struct {
+	MaxChangedFiles int `json:"maxChangedFiles,omitempty"`
+	MaxChangedLines int `json:"maxChangedLines,omitempty"`
+}
+
+// diffLimits are the effective limits for a fix; zero means unlimited.
+type diffLimits struct {
+	Files int
+	Lines int
+}
+
+var (
+	shortstatFilesRe      = regexp.MustCompile(`(\d+) files? changed`)
+	shortstatInsertionsRe = regexp.MustCompile(`(\d+) insertions?\(\+\)`)
+	shortstatDeletionsRe  = regexp.MustCompile(`(\d+) deletions?\(-\)`)
+)
+
+func parseShortstat(out string) FixBuildDiffStats {
+	n := func(re *regexp.Regexp) int {
+		if m := re.FindStringSubmatch(out); m != nil {
+			v, _ := strconv.Atoi(m[1])
+			return v
+		}
+		return 0
+	}
+	return FixBuildDiffStats{
+		FilesChanged: n(shortstatFilesRe),
+		Insertions:   n(shortstatInsertionsRe),
+		Deletions:    n(shortstatDeletionsRe),
+	}
+}
+
+// stagedDiffStats measures the staged changes against HEAD, i.e. the commit about to be made.
+func stagedDiffStats(ctx context.Context, workDir string) (FixBuildDiffStats, error) {
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "diff", "--cached", "--shortstat")
+	if err != nil {
+		return FixBuildDiffStats{}, fmt.Errorf("git diff --shortstat: %w\n%s", err, out)
+	}
+	return parseShortstat(string(out)), nil
+}
+
+// stagedFiles lists the files the staged fix adds, modifies or deletes. Renames are listed as
+// both paths, since the fix removes one and adds the other.
+func stagedFiles(ctx context.Context, workDir string) ([]string, error) {
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "diff", "--cached", "--name-only", "--no-renames", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("git diff --name-only: %w\n%s", err, out)
+	}
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// binaryMarker follows a binary file's path in ChangedFiles, since it has no lines to count.
+const binaryMarker = " (binary)"
+
+// stagedChanges lists the files the staged fix changes for the response, marking the binary
+// ones (images, compiled assets) that git diff --numstat reports without line counts.
+func stagedChanges(ctx context.Context, workDir string) ([]string, error) {
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "diff", "--cached", "--numstat", "--no-renames", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("git diff --numstat: %w\n%s", err, out)
+	}
+	return parseNumstat(string(out)), nil
+}
+
+// fixPatch is the committed fix as a patch against headSha, for outputMode patch. --binary
+// keeps binary changes in it, so git apply can apply the whole fix.
+func fixPatch(ctx context.Context, workDir, headSha string) (string, error) {
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "diff", "--binary", headSha+"..HEAD")
+	if err != nil {
+		return "", fmt.Errorf("git diff: %w\n%s", err, out)
+	}
+	return string(out), nil
+}
+
+// parseNumstat reads git diff --numstat -z output, "<insertions>\t<deletions>\t<path>" per
+// file, where both counts are "-" for a binary file.
+func parseNumstat(out string) []string {
+	var files []string
+	for _, rec := range strings.Split(out, "\x00") {
+		fields := strings.SplitN(rec, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "-" && fields[1] == "-" {
+			files = append(files, fields[2]+binaryMarker)
+		} else {
+			files = append(files, fields[2])
+		}
+	}
+	return files
+}
+
+// rangeDiffStats measures everything HEAD changes since from, i.e. from..HEAD.
+func rangeDiffStats(ctx context.Context, workDir, from string) (FixBuildDiffStats, error) {
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "diff", "--shortstat", from+"..HEAD")
+	if err != nil {
+		return FixBuildDiffStats{}, fmt.Errorf("git diff --shortstat %s..HEAD: %w\n%s", from, err, out)
+	}
+	return parseShortstat(string(out)), nil
+}
+
+// baseChangesLimit caps how many of a pull request's changed files go in the plandex context.
+const baseChangesLimit = 200
+
+// baseChanges lists the files changed between base and head, capped at limit.
+func baseChanges(ctx context.Context, workDir, base, head string, limit int) ([]string, error) {
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "diff", "--name-only", base, head)
+	if err != nil {
+		return nil, fmt.Errorf("git diff --name-only: %w\n%s", err, out)
+	}
+	files := strings.Fields(string(out))
+	if len(files) > limit {
+		files = append(files[:limit], fmt.Sprintf("(%d more)", len(files)-limit))
+	}
+	return files, nil
+}
+
+// exceeds describes which limit stats go over, or returns "" when within limits. Binary files
+// count towards the file limit only: git's stats give them no lines.
+func (l diffLimits) exceeds(stats FixBuildDiffStats) string {
+	if l.Files > 0 && stats.FilesChanged > l.Files {
+		return fmt.Sprintf("%d files changed (limit %d)", stats.FilesChanged, l.Files)
+	}
+	if lines := stats.Insertions + stats.Deletions; l.Lines > 0 && lines > l.Lines {
+		return fmt.Sprintf("%d lines changed (limit %d)", lines, l.Lines)
+	}
+	return ""
+}
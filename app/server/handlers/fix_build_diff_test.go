@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseShortstat(t *testing.T) {
+	tests := []struct {
+		out  string
+		want FixBuildDiffStats
+	}{
+		{" 3 files changed, 10 insertions(+), 2 deletions(-)\n", FixBuildDiffStats{3, 10, 2}},
+		{" 1 file changed, 1 insertion(+)\n", FixBuildDiffStats{1, 1, 0}},
+		{" 1 file changed, 4 deletions(-)\n", FixBuildDiffStats{1, 0, 4}},
+		{"", FixBuildDiffStats{}},
+	}
+	for _, tt := range tests {
+		if got := parseShortstat(tt.out); got != tt.want {
+			t.Fatalf("parseShortstat(%q): want %+v, got %+v", tt.out, tt.want, got)
+		}
+	}
+}
+
+func TestResolveDiffLimits(t *testing.T) {
+	cfg := fixBuildConfig{DiffLimits: diffLimits{Files: 20, Lines: 500}, DiffLimitCaps: diffLimits{Files: 100, Lines: 5000}}
+	if got := resolveDiffLimits(cfg, nil); got != cfg.DiffLimits {
+		t.Fatalf("expected defaults without overrides, got %+v", got)
+	}
+	got := resolveDiffLimits(cfg, &FixBuildDiffLimits{MaxChangedFiles: 50, MaxChangedLines: 100000})
+	if want := (diffLimits{Files: 50, Lines: 5000}); got != want {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestFixBuildDiffSizeGuard(t *testing.T) {
+	huge := fakeResponse{out: " 30 files changed, 900 insertions(+), 40 deletions(-)\n"}
+
+	t.Run("within limits pushes", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{"git diff --cached --shortstat": {out: " 2 files changed, 5 insertions(+)\n"}})
+		rec := postFixBuild(t, fakeRunnerPayload("fff0001"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var res FixBuildResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.DiffStats == nil || *res.DiffStats != (FixBuildDiffStats{2, 5, 0}) {
+			t.Fatalf("expected diff stats in the response, got %+v", res.DiffStats)
+		}
+		if !f.called("git push") {
+			t.Fatal("expected the fix to be pushed")
+		}
+	})
+
+	t.Run("over limits aborts", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{"git diff --cached --shortstat": huge})
+		rec := postFixBuild(t, fakeRunnerPayload("fff0002"))
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var body FixBuildErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != "diff_too_large" || body.Error.DiffStats == nil || body.Error.DiffStats.FilesChanged != 30 {
+			t.Fatalf("expected diff_too_large with stats, got %+v", body.Error)
+		}
+		if f.called("git commit") || f.called("git push") {
+			t.Fatalf("committed or pushed an oversized fix; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("payload can raise the limits", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{"git diff --cached --shortstat": huge})
+		p := fakeRunnerPayload("fff0003")
+		p.DiffLimits = &FixBuildDiffLimits{MaxChangedFiles: 50, MaxChangedLines: 1000}
+		if rec := postFixBuild(t, p); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !f.called("git push") {
+			t.Fatal("expected the fix to be pushed")
+		}
+	})
+}
+
+func TestFixBuildBaseShaDiffRange(t *testing.T) {
+	t.Run("with baseSha", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{
+			"git diff --cached --shortstat":        {out: " 1 file changed, 2 insertions(+)\n"},
+			"git diff --shortstat bbb0058..HEAD":   {out: " 4 files changed, 30 insertions(+), 3 deletions(-)\n"},
+			"git diff --name-only bbb0058 aaa0058": {out: "api/handler.go\napi/handler_test.go\n"},
+		})
+		p := fakeRunnerPayload("aaa0058")
+		p.BaseSha = "BBB0058"
+		rec := postFixBuild(t, p)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var res FixBuildResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.DiffRange != "bbb0058..HEAD" || res.DiffStats == nil || *res.DiffStats != (FixBuildDiffStats{4, 30, 3}) {
+			t.Fatalf("expected stats for bbb0058..HEAD, got %s %+v", res.DiffRange, res.DiffStats)
+		}
+		if !f.called("git cat-file -e bbb0058^{commit}") {
+			t.Fatalf("expected the base commit to be looked up, got %v", f.calls)
+		}
+		if !f.called("git reset --hard aaa0058") {
+			t.Fatal("expected headSha to stay the reset target")
+		}
+	})
+
+	t.Run("without baseSha", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{"git diff --cached --shortstat": {out: " 1 file changed, 2 insertions(+)\n"}})
+		rec := postFixBuild(t, fakeRunnerPayload("aaa1058"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var res FixBuildResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.DiffRange != "aaa1058..HEAD" || res.DiffStats == nil || *res.DiffStats != (FixBuildDiffStats{1, 2, 0}) {
+			t.Fatalf("expected stats for the fix itself, got %s %+v", res.DiffRange, res.DiffStats)
+		}
+		if f.called("git diff --shortstat") {
+			t.Fatal("expected no range diff without baseSha")
+		}
+	})
+
+	t.Run("invalid baseSha", func(t *testing.T) {
+		useFakeRunner(t, nil)
+		p := fakeRunnerPayload("aaa2058")
+		p.BaseSha = "main~1"
+		if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestParseNumstat(t *testing.T) {
+	out := "3\t1\tpkg/widget.go\x00-\t-\tassets/logo.png\x000\t12\tOLD.md\x00"
+	want := []string{"pkg/widget.go", "assets/logo.png (binary)", "OLD.md"}
+	if got := parseNumstat(out); !slices.Equal(got, want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if got := parseNumstat(""); got != nil {
+		t.Fatalf("expected no files, got %q", got)
+	}
+}
+
+func TestFixBuildBinaryChange(t *testing.T) {
+	root := fakeGithub(t)
+	_, sha := addFakeGithubRepo(t, root, "acme", "assets")
+	fakePlandex(t, `[ "$1" = "tell" ] && { echo fixed > file.txt; printf 'PNG\000\001\002\377' > logo.png; }
+exit 0
+`)
+	p := FixBuildPayload{
+		Repo:              FixBuildRepo{Owner: "acme", Name: "assets"},
+		HeadBranch:        "main",
+		HeadSha:           sha,
+		OutputSummary:     "FAIL",
+		InstallationToken: "tok",
+		DiffLimits:        &FixBuildDiffLimits{MaxChangedLines: 2},
+	}
+	rec := postFixBuild(t, p)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res FixBuildResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"file.txt", "logo.png (binary)"}; !slices.Equal(res.ChangedFiles, want) {
+		t.Fatalf("expected changed files %q, got %q", want, res.ChangedFiles)
+	}
+	// The binary file counts as a file but adds no lines, so the line limit isn't hit
+	if res.DiffStats == nil || res.DiffStats.FilesChanged != 2 || res.DiffStats.Insertions+res.DiffStats.Deletions > 2 {
+		t.Fatalf("expected 2 files and only file.txt's lines, got %+v", res.DiffStats)
+	}
+}
+
+func TestFixBuildPatchOutput(t *testing.T) {
+	root := fakeGithub(t)
+	bare, sha := addFakeGithubRepo(t, root, "acme", "patched")
+	fakePlandex(t, `[ "$1" = "tell" ] && { echo fixed > file.txt; printf 'PNG\000\001\002\377' > logo.png; }
+exit 0
+`)
+	p := FixBuildPayload{
+		Repo:              FixBuildRepo{Owner: "acme", Name: "patched"},
+		HeadBranch:        "main",
+		HeadSha:           sha,
+		OutputSummary:     "FAIL",
+		InstallationToken: "tok",
+		VerifyCommand:     "grep -q fixed file.txt",
+		OutputMode:        outputPatch,
+	}
+	rec := postFixBuild(t, p)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res FixBuildResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Patch == "" || res.CommitSha != "" || !res.Verified {
+		t.Fatalf("expected a verified patch and no commit, got %+v", res)
+	}
+	if head := gitT(t, bare, "rev-parse", "main"); head != sha {
+		t.Fatalf("expected the remote untouched at %s, got %s", sha, head)
+	}
+
+	work := t.TempDir()
+	gitT(t, work, "clone", "-q", bare, ".")
+	patchFile := filepath.Join(t.TempDir(), "fix.patch")
+	if err := os.WriteFile(patchFile, []byte(res.Patch), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitT(t, work, "apply", patchFile)
+	if got, err := os.ReadFile(filepath.Join(work, "file.txt")); err != nil || string(got) != "fixed\n" {
+		t.Fatalf("expected the patch to fix file.txt, got %q (%v)", got, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(work, "logo.png")); err != nil || string(got) != "PNG\x00\x01\x02\xff" {
+		t.Fatalf("expected the patch to add the binary logo.png, got %q (%v)", got, err)
+	}
+
+	t.Run("conflicts with pushing options", func(t *testing.T) {
+		p := fakeRunnerPayload("abc8100")
+		p.OutputMode = outputPatch
+		p.OpenPullRequest = true
+		if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+		p.OpenPullRequest = false
+		p.OutputMode = "upload"
+		if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
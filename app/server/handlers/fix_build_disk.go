@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// diskBudget accounts for the disk used by live work dirs, so new jobs can be turned away
+// before the work dir filesystem fills up.
+type diskBudget struct {
+	mu   sync.Mutex
+	used int64
+}
+
+var fixBuildDisk = &diskBudget{}
+
+// admit reports whether a new job may start under a soft cap of max bytes (0 = unlimited).
+// Jobs already running may take usage past the cap.
+func (d *diskBudget) admit(max int64) bool {
+	if max <= 0 {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.used < max
+}
+
+func (d *diskBudget) add(n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.used += n
+}
+
+func (d *diskBudget) inUse() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.used
+}
+
+// dirSize sums the sizes of the regular files under dir.
+func dirSize(dir string) int64 {
+	var n int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				n += info.Size()
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// workDirBase is where work dirs are created: FIX_BUILD_WORKDIR, or the system temp dir.
+func workDirBase(cfg fixBuildConfig) (string, error) {
+	if cfg.WorkDir == "" {
+		return os.TempDir(), nil
+	}
+	return cfg.WorkDir, os.MkdirAll(cfg.WorkDir, 0755)
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFixBuildWorkDirBase(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "work")
+	t.Setenv("FIX_BUILD_WORKDIR", base)
+	f := useFakeRunner(t, nil)
+
+	rec := postFixBuild(t, fakeRunnerPayload("aaa0039"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	dir, ok := f.calledIn("git clone")
+	if !ok || !strings.HasPrefix(dir, base+string(filepath.Separator)) {
+		t.Fatalf("expected the clone under %s, got %q", base, dir)
+	}
+	if entries := workDirLeftovers(base); len(entries) != 0 {
+		t.Fatalf("expected the work dir to be cleaned up, found %d entries", len(entries))
+	}
+	if used := fixBuildDisk.inUse(); used != 0 {
+		t.Fatalf("expected disk accounting back at 0, got %d", used)
+	}
+}
+
+func TestFixBuildDiskCap(t *testing.T) {
+	t.Setenv("FIX_BUILD_MAX_WORKDIR_MB", "1")
+	f := useFakeRunner(t, nil)
+
+	// Another job is holding 2 MB of work dir
+	fixBuildDisk.add(2 << 20)
+	rec := postFixBuild(t, fakeRunnerPayload("bbb0039"))
+	fixBuildDisk.add(-2 << 20)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"code":"disk_full"`) {
+		t.Fatalf("expected 503 disk_full, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if f.called("git clone") {
+		t.Fatal("expected nothing to be cloned over the cap")
+	}
+
+	// Once the space is released the same request goes through
+	if rec := postFixBuild(t, fakeRunnerPayload("bbb0039")); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 under the cap, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// workDirLeftovers lists what's left in a work dir base besides the job logs, which outlive jobs.
+func workDirLeftovers(base string) []os.DirEntry {
+	entries, _ := os.ReadDir(base)
+	var left []os.DirEntry
+	for _, e := range entries {
+		if e.Name() != jobLogDirName {
+			left = append(left, e)
+		}
+	}
+	return left
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// deniedEnvPrefixes and deniedEnvNames are server variables a payload's env may not override:
+// the server's own config and credentials, git's (which would redirect or reauthenticate the
+// push), and those that change which binaries and libraries run.
+var (
+	deniedEnvPrefixes = []string{"FIX_BUILD_", "GIT_", "PLANDEX_", "DB_", "SMTP_", "LD_", "DYLD_"}
+	deniedEnvNames    = map[string]bool{
+		"PATH": true, "HOME": true, "SHELL": true, "USER": true, "SSH_AUTH_SOCK": true,
+		"GITHUB_TOKEN": true, "GH_TOKEN": true, "GOENV": true, "IS_CLOUD": true, "LOCAL_MODE": true,
+		"OLLAMA_BASE_URL": true, "LITELLM_PROXY_DIR": true, "ECS_CONTAINER_METADATA_URI": true,
+	}
+)
+
+// validatePayloadEnv checks that every name in env is well-formed and not denylisted.
+func validatePayloadEnv(env map[string]string) error {
+	for _, name := range sortedEnvNames(env) {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid env name %q", name)
+		}
+		if envDenied(name) {
+			return fmt.Errorf("env %s can't be set: it's reserved by the server", name)
+		}
+	}
+	return nil
+}
+
+func envDenied(name string) bool {
+	name = strings.ToUpper(name)
+	if deniedEnvNames[name] {
+		return true
+	}
+	for _, prefix := range deniedEnvPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadEnv returns env as NAME=value entries, in a stable order.
+func payloadEnv(env map[string]string) []string {
+	var out []string
+	for _, name := range sortedEnvNames(env) {
+		out = append(out, name+"="+env[name])
+	}
+	return out
+}
+
+func sortedEnvNames(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
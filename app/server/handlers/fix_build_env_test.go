@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestValidatePayloadEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{"none", nil, true},
+		{"ordinary vars", map[string]string{"CI": "true", "NODE_ENV": "test", "STRIPE_API_KEY": "sk_test"}, true},
+		{"PATH", map[string]string{"PATH": "/tmp/evil"}, false},
+		{"HOME", map[string]string{"HOME": "/tmp"}, false},
+		{"git var", map[string]string{"GIT_SSH_COMMAND": "ssh -i other"}, false},
+		{"server config", map[string]string{"FIX_BUILD_HMAC_SECRET": "x"}, false},
+		{"lowercase denied name", map[string]string{"ld_preload": "evil.so"}, false},
+		{"malformed name", map[string]string{"A=B": "c"}, false},
+		{"empty name", map[string]string{"": "c"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePayloadEnv(tt.env); (err == nil) != tt.ok {
+				t.Fatalf("expected ok=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestFixBuildEnvReachesBuildAndVerify(t *testing.T) {
+	f := useFakeRunner(t, nil)
+	payload := fakeRunnerPayload("eee0054")
+	payload.VerifyCommand = "make test"
+	payload.Env = map[string]string{"CI": "true", "NODE_ENV": "test"}
+	rec := postFixBuild(t, payload)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	want := []string{"CI=true", "NODE_ENV=test"}
+	for _, prefix := range []string{"plandex build", "sh -c make test"} {
+		if got := f.envOf(prefix); !slices.Equal(got, want) {
+			t.Fatalf("expected %s to get %v, got %v", prefix, want, got)
+		}
+	}
+	for _, prefix := range []string{"git clone", "plandex tell", "git push"} {
+		if got := f.envOf(prefix); slices.Contains(got, "CI=true") {
+			t.Fatalf("expected %s not to get the payload env, got %v", prefix, got)
+		}
+	}
+}
+
+func TestFixBuildEnvRejectsDenylisted(t *testing.T) {
+	f := useFakeRunner(t, nil)
+	payload := fakeRunnerPayload("eee1054")
+	payload.Env = map[string]string{"CI": "true", "GIT_ASKPASS": "/tmp/steal"}
+	rec := postFixBuild(t, payload)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a denylisted var, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if f.called("git clone") {
+		t.Fatal("expected nothing to run")
+	}
+}
+
+func TestRunVerifyCommandsEnv(t *testing.T) {
+	commands := [][]string{{"sh", "-c", `test "$CI" = true && test "$GREETING" = "hello world"`}}
+	env := payloadEnv(map[string]string{"CI": "true", "GREETING": "hello world"})
+	if out, _, err := runVerifyCommands(context.Background(), t.TempDir(), commands, env, time.Minute); err != nil {
+		t.Fatalf("expected the env to reach the command: %v\n%s", err, out)
+	}
+	if _, _, err := runVerifyCommands(context.Background(), t.TempDir(), commands, nil, time.Minute); err == nil {
+		t.Fatal("expected the command to fail without the env")
+	}
+}
@@ -0,0 +1,606 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errNoRegenChanges = errors.New("regenerate command made no changes to the working tree")
+
+var errBranchGone = errors.New("branch no longer exists on origin")
+
+var errGitLFSMissing = errors.New("repo uses Git LFS but git-lfs is not installed on the server; install git-lfs in the server image or set skipLFS in the payload")
+
+const (
+	cloneShallow  = "shallow"
+	cloneBlobless = "blobless"
+	cloneFull     = "full"
+)
+
+// cloneStrategyArgs returns the git clone flags for a clone strategy ("" means shallow).
+// Blobless clones record origin as a promisor remote, so checkouts fetch missing blobs on demand.
+func cloneStrategyArgs(strategy string) ([]string, bool) {
+	switch strategy {
+	case "", cloneShallow:
+		return []string{"--depth", "50"}, true
+	case cloneBlobless:
+		return []string{"--filter=blob:none"}, true
+	case cloneFull:
+		return nil, true
+	}
+	return nil, false
+}
+
+// shallowClone reports whether a clone strategy truncates history.
+func shallowClone(strategy string) bool {
+	return strategy == "" || strategy == cloneShallow
+}
+
+// hasCommit reports whether sha resolves to a commit in the local clone.
+func hasCommit(ctx context.Context, workDir, sha string) bool {
+	_, err := runCmd(ctx, workDir, 10*time.Second, "git", "cat-file", "-e", sha+"^{commit}")
+	return err == nil
+}
+
+// deepenUntilPresent extends a shallow clone of branch by step commits at a time until sha
+// is reachable, giving up after maxRounds fetches. It returns the number of fetches run.
+func deepenUntilPresent(ctx context.Context, workDir, branch, sha string, step, maxRounds int, timeout time.Duration) (int, error) {
+	rounds := 0
+	for !hasCommit(ctx, workDir, sha) {
+		if rounds >= maxRounds {
+			return rounds, fmt.Errorf("commit %s not found after deepening %d times by %d", sha, rounds, step)
+		}
+		rounds++
+		if out, err := runCmd(ctx, workDir, timeout, "git", "fetch", fmt.Sprintf("--deepen=%d", step), "origin", branch); err != nil {
+			return rounds, fmt.Errorf("git fetch --deepen: %w\n%s", err, out)
+		}
+	}
+	return rounds, nil
+}
+
+// fetchBranch makes origin/branch available for checkout. Shallow clones only carry the default
+// branch, so others are fetched on demand; errBranchGone means origin no longer has it.
+func fetchBranch(ctx context.Context, workDir, branch string, timeout time.Duration) error {
+	if _, err := runCmd(ctx, workDir, 10*time.Second, "git", "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+branch); err == nil {
+		return nil
+	}
+	out, err := runCmd(ctx, workDir, timeout, "git", "ls-remote", "--exit-code", "--heads", "origin", "refs/heads/"+branch)
+	if err != nil {
+		var exitErr interface{ ExitCode() int }
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			return errBranchGone
+		}
+		return fmt.Errorf("git ls-remote: %w\n%s", err, out)
+	}
+	// Track the branch so checkout's origin/<branch> DWIM and later fetches see it
+	if out, err := runCmd(ctx, workDir, 10*time.Second, "git", "remote", "set-branches", "--add", "origin", branch); err != nil {
+		return fmt.Errorf("git remote set-branches: %w\n%s", err, out)
+	}
+	args := append([]string{"fetch"}, shallowFetchArgs(ctx, workDir)...)
+	if out, err := runCmd(ctx, workDir, timeout, "git", append(args, "origin", branch)...); err != nil {
+		return fmt.Errorf("git fetch %s: %w\n%s", branch, err, out)
+	}
+	return nil
+}
+
+// fetchCommit fetches sha by id if the clone doesn't already have it.
+func fetchCommit(ctx context.Context, workDir, sha string, timeout time.Duration) error {
+	if hasCommit(ctx, workDir, sha) {
+		return nil
+	}
+	args := append([]string{"fetch"}, shallowFetchArgs(ctx, workDir)...)
+	if out, err := runCmd(ctx, workDir, timeout, "git", append(args, "origin", sha)...); err != nil {
+		return fmt.Errorf("git fetch %s: %w\n%s", sha, err, out)
+	}
+	return nil
+}
+
+// authFailurePatterns are how git (over HTTPS or SSH) and the hosting providers say the
+// credentials were refused.
+var authFailurePatterns = []string{
+	"authentication failed",
+	"invalid credentials",
+	"invalid username or password",
+	"http basic: access denied",
+	"could not read username",
+	"the requested url returned error: 401",
+	"permission denied (publickey)",
+}
+
+// permissionDeniedPatterns are how they say the credentials were accepted but aren't allowed
+// to do what was asked, e.g. a read-only token pushing or a push to a protected branch.
+var permissionDeniedPatterns = []string{
+	"the requested url returned error: 403",
+	"protected branch hook declined",
+	"you are not allowed to push",
+}
+
+// authFailed reports whether git output says the remote refused the credentials.
+func authFailed(out string) bool {
+	out = strings.ToLower(out)
+	for _, p := range authFailurePatterns {
+		if strings.Contains(out, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionDenied reports whether git output says the remote accepted the credentials but
+// refused the operation.
+func permissionDenied(out string) bool {
+	out = strings.ToLower(out)
+	for _, p := range permissionDeniedPatterns {
+		if strings.Contains(out, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// shallowPushRejected reports whether git push output says the remote won't accept a push from
+// a shallow clone.
+func shallowPushRejected(out []byte) bool {
+	return strings.Contains(string(out), "shallow update not allowed")
+}
+
+// pushNonFastForward reports whether git push output says the remote branch has commits the
+// push doesn't.
+func pushNonFastForward(out []byte) bool {
+	return strings.Contains(string(out), "(fetch first)") || strings.Contains(string(out), "(non-fast-forward)")
+}
+
+// rebaseFix replays the fix commit onto the head branch's current tip, for RebaseOnConflict
+// after rejected, the push's non-fast-forward error. It returns the rebased commit and the tip.
+// A rebase that conflicts is aborted, leaving the fix as it was, and rejected is returned.
+func rebaseFix(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig, rejected *fixBuildError) (string, string, *fixBuildError) {
+	args := append([]string{"fetch"}, shallowFetchArgs(ctx, ws.Dir)...)
+	if out, err := runCmdEnv(ctx, ws.Dir, cfg.Timeouts.Clone, ws.gitEnv, "git", append(args, ws.pushRemote(), payload.HeadBranch)...); err != nil {
+		log.Printf("[fix_build] git fetch %s: %v\n%s", payload.HeadBranch, err, redactOutput(out, payload.InstallationToken))
+		return "", "", gitPhaseError("rebase fetch", fmt.Errorf("%w\n%s", err, out), payload.InstallationToken)
+	}
+	out, err := runCmd(ctx, ws.Dir, 10*time.Second, "git", "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return "", "", phaseError("rebase", fmt.Errorf("git rev-parse FETCH_HEAD: %w\n%s", err, out))
+	}
+	tip := strings.TrimSpace(string(out))
+
+	// Rebasing commits again, so it needs the committer identity and signing commitFix used
+	rebase := []string{"rebase", "--onto", tip, payload.HeadSha}
+	if cfg.Signing.enabled() {
+		rebase = append(cfg.Signing.gitArgs(), "rebase", "--gpg-sign", "--onto", tip, payload.HeadSha)
+	}
+	var identity []string
+	if payload.CommitAuthor != nil {
+		identity = gitIdentityArgs(*payload.CommitAuthor)
+	}
+	out, err = runCmd(ctx, ws.Dir, time.Minute, "git", append(identity, rebase...)...)
+	if err != nil && payload.CommitAuthor == nil && missingGitIdentity(out) {
+		out, err = runCmd(ctx, ws.Dir, time.Minute, "git", append(gitIdentityArgs(cfg.Bot), rebase...)...)
+	}
+	if err != nil {
+		log.Printf("[fix_build] rebase onto %s: %v\n%s", tip, err, out)
+		if aout, aerr := runCmd(ctx, ws.Dir, 30*time.Second, "git", "rebase", "--abort"); aerr != nil {
+			log.Printf("[fix_build] rebase --abort: %v\n%s", aerr, aout)
+		}
+		rejected.Message += fmt.Sprintf("; rebasing the fix onto %s conflicted", shortSha(tip))
+		return "", "", rejected.withLogs(rejected.Logs + "\n" + string(out))
+	}
+
+	out, err = runCmd(ctx, ws.Dir, 10*time.Second, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return "", "", phaseError("rebase", fmt.Errorf("git rev-parse HEAD: %w\n%s", err, out))
+	}
+	log.Printf("[fix_build] rebased the fix onto %s's new tip %s", payload.HeadBranch, tip)
+	return strings.TrimSpace(string(out)), tip, nil
+}
+
+// shallowFetchArgs keeps fetches into a shallow clone shallow; full clones stay full.
+func shallowFetchArgs(ctx context.Context, workDir string) []string {
+	out, err := runCmd(ctx, workDir, 10*time.Second, "git", "rev-parse", "--is-shallow-repository")
+	if err == nil && strings.TrimSpace(string(out)) == "true" {
+		return []string{"--depth", "50"}
+	}
+	return nil
+}
+
+// repoUsesLFS reports whether the checkout's root .gitattributes routes any paths through the LFS filter.
+func repoUsesLFS(workDir string) bool {
+	data, err := os.ReadFile(filepath.Join(workDir, ".gitattributes"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if field == "filter=lfs" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pullLFS replaces LFS pointer files in the checkout with their real content.
+func pullLFS(ctx context.Context, workDir string, timeout time.Duration) error {
+	if _, err := runnerFrom(ctx).LookPath("git-lfs"); err != nil {
+		return errGitLFSMissing
+	}
+	if out, err := runCmd(ctx, workDir, timeout, "git", "lfs", "pull"); err != nil {
+		return fmt.Errorf("git lfs pull: %w\n%s", err, out)
+	}
+	return nil
+}
+
+// hasSubmodules reports whether the checkout declares any git submodules.
+func hasSubmodules(workDir string) bool {
+	_, err := os.Stat(filepath.Join(workDir, ".gitmodules"))
+	return err == nil
+}
+
+// updateSubmodules checks out all submodules recursively. Submodule URLs on the repo's provider
+// are rewritten to carry the token, or to SSH when there is no token; -c settings are inherited
+// by the nested clones git spawns.
+func updateSubmodules(ctx context.Context, workDir string, provider gitProvider, token string, timeout time.Duration) error {
+	var rewrites []string
+	https, ssh := "https://"+provider.Host+"/", "git@"+provider.Host+":"
+	if token != "" {
+		authed := provider.tokenBaseUrl(token)
+		rewrites = []string{
+			"-c", "url." + authed + ".insteadOf=" + https,
+			"-c", "url." + authed + ".insteadOf=" + ssh,
+		}
+	} else {
+		rewrites = []string{"-c", "url." + ssh + ".insteadOf=" + https}
+		// Nested clones don't read the superproject's local config, so pass the key along
+		if out, err := runCmd(ctx, workDir, 10*time.Second, "git", "config", "core.sshCommand"); err == nil {
+			rewrites = append(rewrites, "-c", "core.sshCommand="+strings.TrimSpace(string(out)))
+		}
+	}
+	out, err := runCmd(ctx, workDir, timeout, "git", append(rewrites, "submodule", "update", "--init", "--recursive")...)
+	if err != nil {
+		out = redactOutput(out, token)
+		return fmt.Errorf("git submodule update: %w\n%s", err, out)
+	}
+	return nil
+}
+
+// sparseCheckoutPaths returns the requested sparse directories plus the directory of every
+// annotated file and context file, so the failing code is always present. Root-level files
+// are always included by cone-mode sparse checkout.
+func sparseCheckoutPaths(p FixBuildPayload) []string {
+	seen := map[string]bool{}
+	var paths []string
+	add := func(dir string) {
+		dir = strings.Trim(filepath.ToSlash(filepath.Clean(dir)), "/")
+		if dir == "" || dir == "." || seen[dir] {
+			return
+		}
+		seen[dir] = true
+		paths = append(paths, dir)
+	}
+	for _, sp := range p.SparsePaths {
+		add(sp)
+	}
+	for _, a := range p.Annotations {
+		add(filepath.Dir(a.Path))
+	}
+	for _, cp := range p.ContextPaths {
+		add(filepath.Dir(cp))
+	}
+	conventions := p.ConventionsFile
+	if conventions == "" {
+		conventions = defaultConventionsFile
+	}
+	add(filepath.Dir(conventions))
+	return paths
+}
+
+// setSparseCheckout restricts the working tree to paths (cone mode) before the branch is checked out.
+func setSparseCheckout(ctx context.Context, workDir string, paths []string) error {
+	args := append([]string{"sparse-checkout", "set", "--cone", "--"}, paths...)
+	if out, err := runCmd(ctx, workDir, 30*time.Second, "git", args...); err != nil {
+		return fmt.Errorf("git sparse-checkout set: %v\n%s", err, out)
+	}
+	return nil
+}
+
+// normalizeLineEndings keeps plandex's edits from turning into whole-file diffs from line
+// endings. Modified files whose only change is line endings are restored and returned as noise.
+// Files with real edits get the endings the repo wants for them: their eol attribute from
+// .gitattributes, core.autocrlf/core.eol for files marked text, or else the ending the original
+// used throughout. Files marked -text, or whose original mixes endings, are left as they are.
+func normalizeLineEndings(ctx context.Context, workDir string) ([]string, error) {
+	// Without safecrlf off, git warns about the very files this is for, in the output
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "-c", "core.safecrlf=false", "diff", "--name-only", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("git diff --name-only: %w\n%s", err, out)
+	}
+	var paths []string
+	for _, path := range strings.Split(string(out), "\x00") {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	attrs, err := lineEndingAttrs(ctx, workDir, paths)
+	if err != nil {
+		return nil, err
+	}
+	configured := configuredEol(ctx, workDir)
+
+	var noise []string
+	for _, path := range paths {
+		orig, err := runCmd(ctx, workDir, 10*time.Second, "git", "show", "HEAD:"+path)
+		if err != nil {
+			continue
+		}
+		full := filepath.Join(workDir, path)
+		cur, err := os.ReadFile(full)
+		if err != nil {
+			// Deleted files have nothing to normalize
+			continue
+		}
+		if bytes.IndexByte(orig, 0) >= 0 || bytes.IndexByte(cur, 0) >= 0 {
+			continue
+		}
+
+		if bytes.Equal(toLF(orig), toLF(cur)) {
+			if err := os.WriteFile(full, orig, 0644); err != nil {
+				return noise, err
+			}
+			noise = append(noise, path)
+			continue
+		}
+		var want []byte
+		switch wantedEol(attrs[path], configured, orig) {
+		case "lf":
+			want = toLF(cur)
+		case "crlf":
+			want = bytes.ReplaceAll(toLF(cur), []byte("\n"), []byte("\r\n"))
+		default:
+			continue
+		}
+		if !bytes.Equal(want, cur) {
+			if err := os.WriteFile(full, want, 0644); err != nil {
+				return noise, err
+			}
+		}
+	}
+	return noise, nil
+}
+
+// eolAttrs are a file's eol and text attributes, as git check-attr reports them (e.g. "crlf",
+// "set", "unset", "auto", "unspecified").
+type eolAttrs struct {
+	eol, text string
+}
+
+// lineEndingAttrs looks up the eol and text attributes of paths.
+func lineEndingAttrs(ctx context.Context, workDir string, paths []string) (map[string]eolAttrs, error) {
+	out, err := runCmd(ctx, workDir, 10*time.Second, "git", append([]string{"check-attr", "-z", "eol", "text", "--"}, paths...)...)
+	if err != nil {
+		return nil, fmt.Errorf("git check-attr: %w\n%s", err, out)
+	}
+	attrs := map[string]eolAttrs{}
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		a := attrs[fields[i]]
+		switch fields[i+1] {
+		case "eol":
+			a.eol = fields[i+2]
+		case "text":
+			a.text = fields[i+2]
+		}
+		attrs[fields[i]] = a
+	}
+	return attrs, nil
+}
+
+// configuredEol is the ending git's config gives text files in the work tree, "lf" or "crlf",
+// or "" when it leaves that to the platform.
+func configuredEol(ctx context.Context, workDir string) string {
+	if out, err := runCmd(ctx, workDir, 10*time.Second, "git", "config", "--get", "core.autocrlf"); err == nil {
+		switch strings.TrimSpace(string(out)) {
+		case "true":
+			return "crlf"
+		case "input":
+			return "lf"
+		}
+	}
+	if out, err := runCmd(ctx, workDir, 10*time.Second, "git", "config", "--get", "core.eol"); err == nil {
+		if eol := strings.TrimSpace(string(out)); eol == "lf" || eol == "crlf" {
+			return eol
+		}
+	}
+	return ""
+}
+
+// wantedEol is the ending, "lf" or "crlf", a changed file should have, or "" to leave it be.
+func wantedEol(a eolAttrs, configured string, orig []byte) string {
+	switch {
+	case a.text == "unset":
+		return ""
+	case a.eol == "lf" || a.eol == "crlf":
+		return a.eol
+	case (a.text == "set" || a.text == "auto") && configured != "":
+		return configured
+	}
+	return fileEol(orig)
+}
+
+// fileEol is the ending every line of b uses, or "" if it mixes them or has no lines.
+func fileEol(b []byte) string {
+	lines, crlf := bytes.Count(b, []byte("\n")), bytes.Count(b, []byte("\r\n"))
+	switch {
+	case lines == 0:
+		return ""
+	case crlf == lines:
+		return "crlf"
+	case crlf == 0:
+		return "lf"
+	}
+	return ""
+}
+
+func toLF(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+}
+
+// scrubRemoteCredentials strips the userinfo from every remote URL in the clone, so a kept work
+// dir doesn't hold the installation token.
+func scrubRemoteCredentials(ctx context.Context, workDir string) error {
+	out, err := runCmd(ctx, workDir, 10*time.Second, "git", "remote")
+	if err != nil {
+		return fmt.Errorf("git remote: %w\n%s", err, out)
+	}
+	for _, name := range strings.Fields(string(out)) {
+		out, err := runCmd(ctx, workDir, 10*time.Second, "git", "remote", "get-url", name)
+		if err != nil {
+			return fmt.Errorf("git remote get-url %s: %w\n%s", name, err, out)
+		}
+		u, err := url.Parse(strings.TrimSpace(string(out)))
+		if err != nil || u.User == nil {
+			continue
+		}
+		u.User = nil
+		if out, err := runCmd(ctx, workDir, 10*time.Second, "git", "remote", "set-url", name, u.String()); err != nil {
+			return fmt.Errorf("git remote set-url %s: %w\n%s", name, err, out)
+		}
+	}
+	return nil
+}
+
+// excludeUntracked excludes every file and directory that is currently untracked, so output of
+// commands run before the fix is never staged with it.
+func excludeUntracked(ctx context.Context, workDir string) error {
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "ls-files", "--others", "--exclude-standard", "--directory", "-z")
+	if err != nil {
+		return fmt.Errorf("git ls-files: %w\n%s", err, out)
+	}
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p == "" {
+			continue
+		}
+		if err := excludeFromGit(ctx, workDir, strings.TrimSuffix(p, "/")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// excludeFromGit adds a root-anchored pattern for path to the clone's info/exclude file so
+// untracked scratch files are never staged.
+func excludeFromGit(ctx context.Context, workDir, path string) error {
+	out, err := runCmd(ctx, workDir, 10*time.Second, "git", "rev-parse", "--git-path", "info/exclude")
+	if err != nil {
+		return fmt.Errorf("git rev-parse --git-path: %w\n%s", err, out)
+	}
+	excludePath := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(excludePath) {
+		excludePath = filepath.Join(workDir, excludePath)
+	}
+	if err := os.MkdirAll(filepath.Dir(excludePath), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(excludePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "\n/%s\n", path); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// regenerate runs a code generator in the checkout and checks that it changed something.
+func regenerate(ctx context.Context, workDir string, command []string, timeout time.Duration) error {
+	if out, err := runCmd(ctx, workDir, timeout, command[0], command[1:]...); err != nil {
+		return fmt.Errorf("%s: %w\n%s", strings.Join(command, " "), err, out)
+	}
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "status", "--porcelain")
+	if err != nil {
+		return fmt.Errorf("git status: %w\n%s", err, out)
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		return errNoRegenChanges
+	}
+	return nil
+}
+
+// missingGitIdentity reports whether git commit output says no committer identity is configured.
+func missingGitIdentity(out []byte) bool {
+	return bytes.Contains(out, []byte("Please tell me who you are")) || bytes.Contains(out, []byte("unable to auto-detect email address"))
+}
+
+// commitFix commits the staged fix as author when one is given, and otherwise as whoever git is
+// configured as, falling back to bot on servers where git has no identity at all. The commit is
+// signed when signing is configured.
+func commitFix(ctx context.Context, workDir, msg string, author *FixBuildAuthor, bot FixBuildAuthor, signing signingConfig) ([]byte, error) {
+	commit := []string{"commit", "-m", msg}
+	if signing.enabled() {
+		commit = append(signing.gitArgs(), "commit", "-S", "-m", msg)
+	}
+	var args []string
+	if author != nil {
+		args = gitIdentityArgs(*author)
+	}
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", append(args, commit...)...)
+	if err != nil && author == nil && missingGitIdentity(out) {
+		log.Printf("[fix_build] git has no identity configured; committing as %s <%s>", bot.Name, bot.Email)
+		out, err = runCmd(ctx, workDir, 30*time.Second, "git", append(gitIdentityArgs(bot), commit...)...)
+	}
+	return out, err
+}
+
+// gitIdentityArgs makes a git command commit as a.
+func gitIdentityArgs(a FixBuildAuthor) []string {
+	return []string{"-c", "user.name=" + a.Name, "-c", "user.email=" + a.Email}
+}
+
+// formatOutputLimit caps formatter and verify command output echoed back to the caller.
+const formatOutputLimit = 8 << 10
+
+// runFormatter runs the payload's format command in the checkout. On failure the error carries
+// the command's output so the caller can see what the formatter rejected.
+func runFormatter(ctx context.Context, workDir string, command []string, timeout time.Duration) error {
+	out, err := runCmd(ctx, workDir, timeout, command[0], command[1:]...)
+	if err != nil {
+		return fmt.Errorf("format command %s failed: %w\n%s", strings.Join(command, " "), err, truncateMiddle(string(out), formatOutputLimit))
+	}
+	return nil
+}
+
+// runVerifyCommands runs commands in dir in order, stopping at the first failure. It returns the
+// combined output of every command run, each under a "$ command" header, and the index of the
+// command that failed. env is added to each command's environment.
+func runVerifyCommands(ctx context.Context, dir string, commands [][]string, env []string, timeout time.Duration) (string, int, error) {
+	return runCommands(ctx, dir, "verify", commands, env, timeout)
+}
+
+// runCommands is runVerifyCommands for any kind of command, named by kind in errors.
+func runCommands(ctx context.Context, dir, kind string, commands [][]string, env []string, timeout time.Duration) (string, int, error) {
+	var all strings.Builder
+	for i, command := range commands {
+		out, err := runCmdEnv(ctx, dir, timeout, env, command[0], command[1:]...)
+		fmt.Fprintf(&all, "$ %s\n%s\n", strings.Join(command, " "), truncateMiddle(string(out), formatOutputLimit))
+		if err != nil {
+			return all.String(), i, fmt.Errorf("%s command %d of %d (%s) failed: %w\n%s", kind, i+1, len(commands), strings.Join(command, " "), err, truncateMiddle(string(out), formatOutputLimit))
+		}
+	}
+	return all.String(), -1, nil
+}
@@ -0,0 +1,497 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gitT runs git in dir with a fixed identity and fails the test on error.
+func gitT(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "init.defaultBranch=main"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newOriginRepo creates a repo on branch main with n commits and returns its path and
+// the commit SHAs, oldest first.
+func newOriginRepo(t *testing.T, n int) (string, []string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	dir := t.TempDir()
+	gitT(t, dir, "init", "-q")
+	var shas []string
+	for i := 0; i < n; i++ {
+		if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(fmt.Sprintf("v%d\n", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		gitT(t, dir, "add", "-A")
+		gitT(t, dir, "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+		shas = append(shas, gitT(t, dir, "rev-parse", "HEAD"))
+	}
+	return dir, shas
+}
+
+func TestDeepenUntilPresent(t *testing.T) {
+	origin, shas := newOriginRepo(t, 12)
+	clone := t.TempDir()
+	gitT(t, clone, "clone", "-q", "--depth", "1", "file://"+origin, ".")
+
+	target := shas[2]
+	if hasCommit(context.Background(), clone, target) {
+		t.Fatal("target commit should be missing from the shallow clone")
+	}
+
+	rounds, err := deepenUntilPresent(context.Background(), clone, "main", target, 3, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("deepenUntilPresent: %v", err)
+	}
+	// Depth 1 reaches shas[11]; each round adds 3, so shas[2] arrives on the third round.
+	if rounds != 3 {
+		t.Fatalf("expected 3 deepen rounds, got %d", rounds)
+	}
+	if !hasCommit(context.Background(), clone, target) {
+		t.Fatal("target commit should be reachable after deepening")
+	}
+}
+
+func TestDeepenUntilPresentGivesUp(t *testing.T) {
+	origin, shas := newOriginRepo(t, 12)
+	clone := t.TempDir()
+	gitT(t, clone, "clone", "-q", "--depth", "1", "file://"+origin, ".")
+
+	rounds, err := deepenUntilPresent(context.Background(), clone, "main", shas[0], 1, 2, time.Minute)
+	if err == nil {
+		t.Fatal("expected an error when the cap is reached")
+	}
+	if rounds != 2 {
+		t.Fatalf("expected 2 deepen rounds before giving up, got %d", rounds)
+	}
+}
+
+func TestRepoUsesLFS(t *testing.T) {
+	origin, _ := newOriginRepo(t, 1)
+	if repoUsesLFS(origin) {
+		t.Fatal("repo without .gitattributes should not need LFS")
+	}
+
+	attrs := "# large assets\n*.png filter=lfs diff=lfs merge=lfs -text\n"
+	if err := os.WriteFile(filepath.Join(origin, ".gitattributes"), []byte(attrs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitT(t, origin, "add", "-A")
+	gitT(t, origin, "commit", "-q", "-m", "track pngs with lfs")
+
+	clone := t.TempDir()
+	gitT(t, clone, "clone", "-q", "file://"+origin, ".")
+	if !repoUsesLFS(clone) {
+		t.Fatal("expected LFS to be detected from .gitattributes")
+	}
+}
+
+func TestPullLFSWithoutGitLFS(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if err := pullLFS(context.Background(), t.TempDir(), time.Minute); err != errGitLFSMissing {
+		t.Fatalf("expected errGitLFSMissing, got %v", err)
+	}
+}
+
+func TestUpdateSubmodules(t *testing.T) {
+	// Submodule clones refuse file:// remotes by default.
+	t.Setenv("GIT_ALLOW_PROTOCOL", "file")
+
+	sub, _ := newOriginRepo(t, 1)
+	origin, _ := newOriginRepo(t, 1)
+	gitT(t, origin, "submodule", "add", "-q", "file://"+sub, "vendor/sub")
+	gitT(t, origin, "commit", "-q", "-m", "add submodule")
+
+	clone := t.TempDir()
+	gitT(t, clone, "clone", "-q", "file://"+origin, ".")
+	if !hasSubmodules(clone) {
+		t.Fatal("expected .gitmodules to be detected")
+	}
+	if _, err := os.Stat(filepath.Join(clone, "vendor/sub/file.txt")); err == nil {
+		t.Fatal("submodule should not be populated before update")
+	}
+
+	if err := updateSubmodules(context.Background(), clone, gitProviders["github"], "tok", time.Minute); err != nil {
+		t.Fatalf("updateSubmodules: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(clone, "vendor/sub/file.txt")); err != nil {
+		t.Fatalf("submodule content missing after update: %v", err)
+	}
+}
+
+func TestSparseCheckout(t *testing.T) {
+	origin, _ := newOriginRepo(t, 1)
+	for _, f := range []string{"services/api/main.go", "services/web/app.ts", "libs/util/util.go", "docs/readme.md"} {
+		path := filepath.Join(origin, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitT(t, origin, "add", "-A")
+	gitT(t, origin, "commit", "-q", "-m", "monorepo layout")
+
+	p := FixBuildPayload{
+		SparsePaths: []string{"services/api/"},
+		Annotations: []FixBuildAnno{{Path: "libs/util/util.go"}, {Path: "libs/util/util.go"}},
+	}
+	paths := sparseCheckoutPaths(p)
+	// .plandex holds the default conventions file
+	if strings.Join(paths, ",") != "services/api,libs/util,.plandex" {
+		t.Fatalf("unexpected sparse paths %v", paths)
+	}
+
+	clone := t.TempDir()
+	gitT(t, clone, "clone", "-q", "--no-checkout", "file://"+origin, ".")
+	if err := setSparseCheckout(context.Background(), clone, paths); err != nil {
+		t.Fatalf("setSparseCheckout: %v", err)
+	}
+	gitT(t, clone, "checkout", "-q", "main")
+
+	for f, want := range map[string]bool{
+		"file.txt":             true,
+		"services/api/main.go": true,
+		"libs/util/util.go":    true,
+		"services/web/app.ts":  false,
+		"docs/readme.md":       false,
+	} {
+		_, err := os.Stat(filepath.Join(clone, f))
+		if got := err == nil; got != want {
+			t.Errorf("%s present=%v, want %v", f, got, want)
+		}
+	}
+}
+
+func TestSparsePathsValidated(t *testing.T) {
+	p := FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: "widgets"}, HeadBranch: "main", HeadSha: "abc1234", InstallationToken: "tok", SparsePaths: []string{"services/api/", "libs"}}
+	if fbErr := validateFixBuildPayload(p, fixBuildConfig{}); fbErr != nil {
+		t.Fatalf("expected relative sparse paths to be accepted, got %v", fbErr)
+	}
+	for _, sp := range []string{"", "/etc", "../outside", "services/../../outside"} {
+		p.SparsePaths = []string{"services/api", sp}
+		fbErr := validateFixBuildPayload(p, fixBuildConfig{})
+		if fbErr == nil || fbErr.Status != http.StatusBadRequest || fbErr.Code != "invalid_payload" {
+			t.Fatalf("%q: expected 400 invalid_payload, got %v", sp, fbErr)
+		}
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	origin, _ := newOriginRepo(t, 1)
+	crlf := "line one\r\nline two\r\nline three\r\n"
+	for _, f := range []string{"noise.txt", "edited.txt"} {
+		if err := os.WriteFile(filepath.Join(origin, f), []byte(crlf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitT(t, origin, "add", "-A")
+	gitT(t, origin, "commit", "-q", "-m", "crlf files")
+
+	// One file only loses its CRs; the other gets a real edit along with LF endings.
+	if err := os.WriteFile(filepath.Join(origin, "noise.txt"), []byte("line one\nline two\nline three\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(origin, "edited.txt"), []byte("line one\nline 2\nline three\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	noise, err := normalizeLineEndings(context.Background(), origin)
+	if err != nil {
+		t.Fatalf("normalizeLineEndings: %v", err)
+	}
+	if len(noise) != 1 || noise[0] != "noise.txt" {
+		t.Fatalf("expected noise.txt to be reported as line-ending noise, got %v", noise)
+	}
+
+	if status := gitT(t, origin, "status", "--porcelain"); status != "M edited.txt" {
+		t.Fatalf("expected only edited.txt to remain modified, got %q", status)
+	}
+	numstat := gitT(t, origin, "diff", "--numstat", "edited.txt")
+	if !strings.HasPrefix(numstat, "1\t1\t") {
+		t.Fatalf("expected a one-line diff after restoring CRLF, got %q", numstat)
+	}
+}
+
+func TestNormalizeLineEndingsAttributes(t *testing.T) {
+	origin, _ := newOriginRepo(t, 1)
+	files := map[string]string{
+		".gitattributes": "lf.txt eol=lf\n",
+		"lf.txt":         "one\ntwo\nthree\n",
+		// Mostly LF with one CRLF line, so no single ending is the file's own
+		"mixed.txt": "one\ntwo\nthree\r\n",
+	}
+	for f, content := range files {
+		if err := os.WriteFile(filepath.Join(origin, f), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitT(t, origin, "add", "-A")
+	gitT(t, origin, "commit", "-q", "-m", "attributes")
+
+	edits := map[string]string{
+		"lf.txt":    "one\r\n2\r\nthree\r\n",
+		"mixed.txt": "one\n2\nthree\r\n",
+	}
+	for f, content := range edits {
+		if err := os.WriteFile(filepath.Join(origin, f), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	noise, err := normalizeLineEndings(context.Background(), origin)
+	if err != nil {
+		t.Fatalf("normalizeLineEndings: %v", err)
+	}
+	if len(noise) != 0 {
+		t.Fatalf("expected no noise, got %v", noise)
+	}
+	if got, _ := os.ReadFile(filepath.Join(origin, "lf.txt")); string(got) != "one\n2\nthree\n" {
+		t.Fatalf("expected lf.txt back on LF per .gitattributes, got %q", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(origin, "mixed.txt")); string(got) != edits["mixed.txt"] {
+		t.Fatalf("expected mixed.txt left as plandex wrote it, got %q", got)
+	}
+	for _, f := range []string{"lf.txt", "mixed.txt"} {
+		if numstat := gitT(t, origin, "diff", "--numstat", f); !strings.HasPrefix(numstat, "1\t1\t") {
+			t.Fatalf("expected a one-line diff for %s, got %q", f, numstat)
+		}
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	origin, _ := newOriginRepo(t, 1)
+
+	if err := regenerate(context.Background(), origin, []string{"true"}, time.Minute); err != errNoRegenChanges {
+		t.Fatalf("expected errNoRegenChanges for a no-op generator, got %v", err)
+	}
+
+	gen := []string{"sh", "-c", "echo 'package api' > service.pb.go"}
+	if err := regenerate(context.Background(), origin, gen, time.Minute); err != nil {
+		t.Fatalf("regenerate: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(origin, "service.pb.go")); err != nil {
+		t.Fatalf("expected generated file: %v", err)
+	}
+}
+
+func TestContextFileNotCommitted(t *testing.T) {
+	src, _ := newOriginRepo(t, 1)
+	origin := t.TempDir()
+	gitT(t, origin, "clone", "-q", "--bare", src, ".")
+
+	clone := t.TempDir()
+	gitT(t, clone, "clone", "-q", "file://"+origin, ".")
+	gitT(t, clone, "config", "user.name", "test")
+	gitT(t, clone, "config", "user.email", "test@example.com")
+
+	if err := writeContextFile(context.Background(), clone, "## Summary\nboom\n"); err != nil {
+		t.Fatalf("writeContextFile: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(clone, "file.txt"), []byte("fixed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := &fixWorkspace{Dir: clone}
+	res, fbErr := finishFix(context.Background(), ws, FixBuildPayload{HeadBranch: "main"}, fixBuildConfig{Timeouts: phaseTimeouts{Push: time.Minute}})
+	if fbErr != nil {
+		t.Fatalf("finishFix: %v", fbErr)
+	}
+
+	files := gitT(t, origin, "ls-tree", "-r", "--name-only", res.CommitSha)
+	if files != "file.txt" {
+		t.Fatalf("expected only file.txt in the pushed tree, got %q", files)
+	}
+}
+
+func TestSetupOutputNotCommitted(t *testing.T) {
+	src, _ := newOriginRepo(t, 1)
+	origin := t.TempDir()
+	gitT(t, origin, "clone", "-q", "--bare", src, ".")
+
+	clone := t.TempDir()
+	gitT(t, clone, "clone", "-q", "file://"+origin, ".")
+	gitT(t, clone, "config", "user.name", "test")
+	gitT(t, clone, "config", "user.email", "test@example.com")
+
+	ws := &fixWorkspace{Dir: clone}
+	payload := FixBuildPayload{HeadBranch: "main", SetupCommands: [][]string{{"sh", "-c", "mkdir -p node_modules/dep && touch node_modules/dep/index.js setup.log"}}}
+	if fbErr := runSetup(context.Background(), ws, payload, fixBuildConfig{Timeouts: phaseTimeouts{Setup: time.Minute}}); fbErr != nil {
+		t.Fatalf("runSetup: %v", fbErr)
+	}
+	if err := os.WriteFile(filepath.Join(clone, "file.txt"), []byte("fixed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, fbErr := finishFix(context.Background(), ws, payload, fixBuildConfig{Timeouts: phaseTimeouts{Push: time.Minute}})
+	if fbErr != nil {
+		t.Fatalf("finishFix: %v", fbErr)
+	}
+	files := gitT(t, origin, "ls-tree", "-r", "--name-only", res.CommitSha)
+	if files != "file.txt" {
+		t.Fatalf("expected only file.txt in the pushed tree, got %q", files)
+	}
+}
+
+func TestFinishFixFormatCommand(t *testing.T) {
+	setup := func(t *testing.T) (string, *fixWorkspace) {
+		src, _ := newOriginRepo(t, 1)
+		origin := t.TempDir()
+		gitT(t, origin, "clone", "-q", "--bare", src, ".")
+		clone := t.TempDir()
+		gitT(t, clone, "clone", "-q", "file://"+origin, ".")
+		gitT(t, clone, "config", "user.name", "test")
+		gitT(t, clone, "config", "user.email", "test@example.com")
+		if err := os.WriteFile(filepath.Join(clone, "file.txt"), []byte("fixed\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return origin, &fixWorkspace{Dir: clone}
+	}
+	cfg := fixBuildConfig{Timeouts: phaseTimeouts{Build: time.Minute, Push: time.Minute}}
+
+	t.Run("formatter changes are committed", func(t *testing.T) {
+		origin, ws := setup(t)
+		payload := FixBuildPayload{
+			HeadBranch:    "main",
+			FormatCommand: []string{"sh", "-c", "tr a-z A-Z < file.txt > file.tmp && mv file.tmp file.txt"},
+		}
+		res, fbErr := finishFix(context.Background(), ws, payload, cfg)
+		if fbErr != nil {
+			t.Fatalf("finishFix: %v", fbErr)
+		}
+		if got := gitT(t, origin, "show", res.CommitSha+":file.txt"); got != "FIXED" {
+			t.Fatalf("expected the formatted file to be committed, got %q", got)
+		}
+	})
+
+	t.Run("failing formatter aborts the commit", func(t *testing.T) {
+		origin, ws := setup(t)
+		before := gitT(t, origin, "rev-parse", "main")
+		payload := FixBuildPayload{
+			HeadBranch:    "main",
+			FormatCommand: []string{"sh", "-c", "echo 'file.txt:1: unexpected token' >&2; exit 3"},
+		}
+		_, fbErr := finishFix(context.Background(), ws, payload, cfg)
+		if fbErr == nil || fbErr.Status != http.StatusUnprocessableEntity {
+			t.Fatalf("expected a 422 from the failing formatter, got %v", fbErr)
+		}
+		if !strings.Contains(fbErr.Message, "file.txt:1: unexpected token") {
+			t.Fatalf("expected formatter output in the error, got %q", fbErr.Message)
+		}
+		if got := gitT(t, ws.Dir, "rev-parse", "HEAD"); got != before {
+			t.Fatal("nothing should be committed when formatting fails")
+		}
+		if got := gitT(t, origin, "rev-parse", "main"); got != before {
+			t.Fatal("nothing should be pushed when formatting fails")
+		}
+	})
+}
+
+func TestCommitFixWithoutGitIdentity(t *testing.T) {
+	src, _ := newOriginRepo(t, 1)
+	clone := t.TempDir()
+	gitT(t, clone, "clone", "-q", "file://"+src, ".")
+
+	// Strip every source of an identity, as on a minimal server image
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "user.useConfigOnly")
+	t.Setenv("GIT_CONFIG_VALUE_0", "true")
+	for _, v := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL", "EMAIL"} {
+		t.Setenv(v, "")
+		os.Unsetenv(v)
+	}
+
+	bot := FixBuildAuthor{Name: "fix-bot", Email: "fix-bot@example.com"}
+	commit := func(t *testing.T, author *FixBuildAuthor) string {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(clone, "file.txt"), []byte(t.Name()+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := runCmd(context.Background(), clone, time.Minute, "git", "add", "-A"); err != nil {
+			t.Fatalf("git add: %v\n%s", err, out)
+		}
+		if out, err := commitFix(context.Background(), clone, "fix", author, bot, signingConfig{}); err != nil {
+			t.Fatalf("commitFix: %v\n%s", err, out)
+		}
+		out, err := runCmd(context.Background(), clone, time.Minute, "git", "log", "-1", "--format=%an <%ae> / %cn <%ce>")
+		if err != nil {
+			t.Fatalf("git log: %v\n%s", err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	t.Run("falls back to the bot identity", func(t *testing.T) {
+		if got, want := commit(t, nil), "fix-bot <fix-bot@example.com> / fix-bot <fix-bot@example.com>"; got != want {
+			t.Fatalf("want %q, got %q", want, got)
+		}
+	})
+
+	t.Run("payload author wins", func(t *testing.T) {
+		author := &FixBuildAuthor{Name: "Dev", Email: "dev@example.com"}
+		if got, want := commit(t, author), "Dev <dev@example.com> / Dev <dev@example.com>"; got != want {
+			t.Fatalf("want %q, got %q", want, got)
+		}
+	})
+}
+
+func TestAuthFailed(t *testing.T) {
+	tests := []struct {
+		out  string
+		want bool
+	}{
+		{"fatal: Authentication failed for 'https://github.com/acme/widgets.git/'", true},
+		{"remote: HTTP Basic: Access denied", true},
+		{"fatal: could not read Username for 'https://github.com': terminal prompts disabled", true},
+		{"fatal: unable to access 'https://github.com/acme/widgets.git/': The requested URL returned error: 401", true},
+		{"git@github.com: Permission denied (publickey).", true},
+		{"fatal: unable to access 'https://github.com/acme/widgets.git/': The requested URL returned error: 403", false},
+		{"fatal: unable to access 'https://github.com/acme/widgets.git/': The requested URL returned error: 500", false},
+		{"! [rejected] main -> main (fetch first)", false},
+	}
+	for _, tt := range tests {
+		if got := authFailed(tt.out); got != tt.want {
+			t.Fatalf("authFailed(%q) = %v, want %v", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestPermissionDenied(t *testing.T) {
+	tests := []struct {
+		out  string
+		want bool
+	}{
+		{"remote: Permission to acme/widgets.git denied to app.\nfatal: unable to access 'https://github.com/acme/widgets.git/': The requested URL returned error: 403", true},
+		{"remote: GitLab: You are not allowed to push code to protected branches on this project.", true},
+		{"! [remote rejected] main -> main (protected branch hook declined)", true},
+		{"fatal: Authentication failed for 'https://github.com/acme/widgets.git/'", false},
+		{"! [rejected] main -> main (fetch first)", false},
+	}
+	for _, tt := range tests {
+		if got := permissionDenied(tt.out); got != tt.want {
+			t.Fatalf("permissionDenied(%q) = %v, want %v", tt.out, got, tt.want)
+		}
+	}
+}
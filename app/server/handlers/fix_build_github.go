@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// githubClient is a minimal GitHub REST client authenticated with the payload's installation token.
+// Every call goes through the shared breaker.
+type githubClient struct {
+	baseUrl string
+	token   string
+	http    *http.Client
+	breaker *circuitBreaker
+	limits  breakerConfig
+}
+
+func newGithubClient(cfg fixBuildConfig, token string) *githubClient {
+	return &githubClient{
+		baseUrl: cfg.GithubApiUrl,
+		token:   token,
+		http:    &http.Client{Timeout: 30 * time.Second},
+		breaker: githubBreaker,
+		limits:  cfg.GithubBreaker,
+	}
+}
+
+// do sends a request to path (relative to the API base) and decodes a 2xx JSON response
+// into out. Non-2xx responses are returned as a status code with a nil error. Network errors,
+// 5xxs and rate limits are retried with jittered backoff (waiting out short rate limits) and
+// count against the breaker; while it is open, do fails with errGithubUnavailable.
+func (c *githubClient) do(method, path string, body, out interface{}) (int, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return 0, fmt.Errorf("marshal request: %v", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if c.limits.Threshold > 0 {
+			if ok, until := c.breaker.allow(time.Now()); !ok {
+				return 0, fmt.Errorf("%w; retry after %s", errGithubUnavailable, until.UTC().Format(time.RFC3339))
+			}
+		}
+		status, header, err := c.send(method, path, data, out)
+		if c.limits.Threshold <= 0 {
+			return status, err
+		}
+		now := time.Now()
+		resetAt, limited := githubRateLimitReset(status, header, now)
+		if !limited && status != 0 && status < 500 {
+			c.breaker.success()
+			return status, err
+		}
+		c.breaker.failure(now, c.limits, resetAt)
+		if attempt >= len(githubRetryDelays) {
+			return status, err
+		}
+		wait := jitter(githubRetryDelays[attempt])
+		if limited {
+			if wait = resetAt.Sub(now); wait > maxGithubRetryWait {
+				return status, err
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// send makes a single request; a zero status means it never got a response.
+func (c *githubClient) send(method, path string, data []byte, out interface{}) (int, http.Header, error) {
+	var reqBody io.Reader
+	if data != nil {
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.baseUrl+path, reqBody)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, resp.Header, nil
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, resp.Header, fmt.Errorf("decode response: %v", err)
+		}
+	}
+	return resp.StatusCode, resp.Header, nil
+}
+
+func githubRepoPath(repo FixBuildRepo) string {
+	return "/repos/" + url.PathEscape(repo.Owner) + "/" + url.PathEscape(repo.Name)
+}
+
+// requiresSignedCommits reports whether pushes to branch must be signed, checking both
+// repository rulesets (readable with read access) and classic branch protection (which
+// needs admin access, so a 403/404 there is treated as "not required").
+func (c *githubClient) requiresSignedCommits(repo FixBuildRepo, branch string) (bool, error) {
+	var rules []struct {
+		Type string `json:"type"`
+	}
+	status, err := c.do(http.MethodGet, githubRepoPath(repo)+"/rules/branches/"+url.PathEscape(branch), nil, &rules)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusOK {
+		for _, rule := range rules {
+			if rule.Type == "required_signatures" {
+				return true, nil
+			}
+		}
+	}
+
+	var sigs struct {
+		Enabled bool `json:"enabled"`
+	}
+	status, err = c.do(http.MethodGet, githubRepoPath(repo)+"/branches/"+url.PathEscape(branch)+"/protection/required_signatures", nil, &sigs)
+	if err != nil {
+		return false, err
+	}
+	return status == http.StatusOK && sigs.Enabled, nil
+}
+
+// openPullRequest opens a pull request from head into base and returns its URL. If one is
+// already open from head, that one is returned instead.
+func (c *githubClient) openPullRequest(repo FixBuildRepo, head, base, title, body string) (string, error) {
+	var pr struct {
+		HtmlUrl string `json:"html_url"`
+	}
+	req := map[string]string{"title": title, "head": head, "base": base, "body": body}
+	status, err := c.do(http.MethodPost, githubRepoPath(repo)+"/pulls", req, &pr)
+	if err != nil {
+		return "", err
+	}
+	if status == http.StatusCreated {
+		return pr.HtmlUrl, nil
+	}
+	if status != http.StatusUnprocessableEntity {
+		return "", fmt.Errorf("create pull request: GitHub returned %d", status)
+	}
+
+	// 422 covers both an existing pull request and a bad base branch
+	var open []struct {
+		HtmlUrl string `json:"html_url"`
+	}
+	query := url.Values{"head": {repo.Owner + ":" + head}, "base": {base}, "state": {"open"}}
+	status, err = c.do(http.MethodGet, githubRepoPath(repo)+"/pulls?"+query.Encode(), nil, &open)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK || len(open) == 0 {
+		return "", fmt.Errorf("create pull request: GitHub rejected the request (422); check that base branch %q exists", base)
+	}
+	return open[0].HtmlUrl, nil
+}
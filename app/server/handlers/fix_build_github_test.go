@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignaturePrecheckRejectsSignedBranch(t *testing.T) {
+	var gotAuth string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/repos/acme/widgets/rules/branches/main":
+			w.Write([]byte(`[{"type":"pull_request"},{"type":"required_signatures"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	cfg := fixBuildConfig{GithubApiUrl: api.URL, SignaturePrecheck: true}
+	payload := FixBuildPayload{
+		Repo:              FixBuildRepo{Owner: "acme", Name: "widgets"},
+		HeadBranch:        "main",
+		HeadSha:           "abc1234",
+		InstallationToken: "tok",
+	}
+
+	_, fbErr := runFixBuild(context.Background(), payload, cfg)
+	if fbErr == nil || fbErr.Status != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412, got %+v", fbErr)
+	}
+	if gotAuth != "Bearer tok" {
+		t.Fatalf("expected installation token auth, got %q", gotAuth)
+	}
+}
+
+func TestRequiresSignedCommits(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/acme/widgets/rules/branches/feature":
+			w.Write([]byte(`[]`))
+		case "/repos/acme/widgets/branches/legacy/protection/required_signatures":
+			w.Write([]byte(`{"enabled":true}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	gh := newGithubClient(fixBuildConfig{GithubApiUrl: api.URL}, "tok")
+	repo := FixBuildRepo{Owner: "acme", Name: "widgets"}
+
+	for branch, want := range map[string]bool{"feature": false, "legacy": true} {
+		got, err := gh.requiresSignedCommits(repo, branch)
+		if err != nil {
+			t.Fatalf("%s: %v", branch, err)
+		}
+		if got != want {
+			t.Fatalf("%s: want %v, got %v", branch, want, got)
+		}
+	}
+}
+
+func TestFixBuildOpenPullRequest(t *testing.T) {
+	var created map[string]string
+	existing := false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/acme/widgets/pulls":
+			if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+				t.Errorf("decode pull request: %v", err)
+			}
+			if existing {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"html_url":"https://github.com/acme/widgets/pull/7"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/acme/widgets/pulls":
+			if r.URL.Query().Get("head") != "acme:plandex-fix/ddd0422" {
+				t.Errorf("unexpected head filter %q", r.URL.Query().Get("head"))
+			}
+			w.Write([]byte(`[{"html_url":"https://github.com/acme/widgets/pull/6"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	post := func(t *testing.T, sha string, responses map[string]fakeResponse, configure func(*FixBuildPayload)) (*fakeRunner, FixBuildResponse) {
+		t.Helper()
+		t.Setenv("FIX_BUILD_GITHUB_API_URL", api.URL)
+		f := useFakeRunner(t, responses)
+		p := fakeRunnerPayload(sha)
+		p.HeadBranch = "feature"
+		p.OpenPullRequest = true
+		configure(&p)
+		rec := postFixBuild(t, p)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var res FixBuildResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return f, res
+	}
+
+	t.Run("new pull request", func(t *testing.T) {
+		f, res := post(t, "ddd0421", nil, func(p *FixBuildPayload) {
+			p.BaseBranch = "main"
+			p.PrTitle = "Fix the widget build"
+		})
+		if !f.called("git push origin HEAD:refs/heads/plandex-fix/ddd0421") {
+			t.Fatalf("fix branch not pushed; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+		if f.called("git push origin feature") {
+			t.Fatal("head branch should not be pushed when opening a pull request")
+		}
+		if created["head"] != "plandex-fix/ddd0421" || created["base"] != "main" || created["title"] != "Fix the widget build" {
+			t.Fatalf("unexpected pull request: %+v", created)
+		}
+		if res.Branch != "plandex-fix/ddd0421" || res.PullRequestUrl != "https://github.com/acme/widgets/pull/7" {
+			t.Fatalf("unexpected response: %+v", res)
+		}
+	})
+
+	t.Run("base defaults to head branch and existing pull request is reused", func(t *testing.T) {
+		existing = true
+		defer func() { existing = false }()
+		_, res := post(t, "ddd0422", nil, func(p *FixBuildPayload) {})
+		if created["base"] != "feature" || created["title"] == "" {
+			t.Fatalf("unexpected pull request: %+v", created)
+		}
+		if res.PullRequestUrl != "https://github.com/acme/widgets/pull/6" {
+			t.Fatalf("expected the existing pull request, got %+v", res)
+		}
+	})
+
+	t.Run("custom prefix", func(t *testing.T) {
+		f, res := post(t, "ddd0424", nil, func(p *FixBuildPayload) {
+			p.BranchPrefix = "ci/autofix-"
+		})
+		if !f.called("git push origin HEAD:refs/heads/ci/autofix-ddd0424") || res.Branch != "ci/autofix-ddd0424" || created["head"] != "ci/autofix-ddd0424" {
+			t.Fatalf("expected the prefixed branch, got %+v; calls were:\n%s", res, strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("collision adds a suffix", func(t *testing.T) {
+		f, res := post(t, "ddd0425", map[string]fakeResponse{
+			"git ls-remote --heads origin refs/heads/plandex-fix/ddd0425*": {out: "abc0000\trefs/heads/plandex-fix/ddd0425\nabc0001\trefs/heads/plandex-fix/ddd0425-2\nabc0002\trefs/heads/plandex-fix/ddd0425-old\n"},
+		}, func(p *FixBuildPayload) {})
+		if !f.called("git push origin HEAD:refs/heads/plandex-fix/ddd0425-3") || res.Branch != "plandex-fix/ddd0425-3" || created["head"] != "plandex-fix/ddd0425-3" {
+			t.Fatalf("expected the first free suffix, got %+v; calls were:\n%s", res, strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("invalid prefix", func(t *testing.T) {
+		useFakeRunner(t, nil)
+		for _, prefix := range []string{"-fix/", "fix..", "fix bot/", "fix:"} {
+			p := fakeRunnerPayload("ddd0426")
+			p.OpenPullRequest = true
+			p.BranchPrefix = prefix
+			if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+				t.Fatalf("%q: expected 400, got %d: %s", prefix, rec.Code, rec.Body.String())
+			}
+		}
+	})
+
+	t.Run("requires github", func(t *testing.T) {
+		useFakeRunner(t, nil)
+		p := fakeRunnerPayload("ddd0423")
+		p.OpenPullRequest = true
+		p.Provider = "gitlab"
+		if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
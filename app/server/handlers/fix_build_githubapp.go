@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// githubApp is the GitHub App the server mints installation tokens as, for payloads that send
+// an installationId instead of a token.
+type githubApp struct {
+	Id  int64
+	Key *rsa.PrivateKey
+}
+
+// tokenRefreshMargin is how long before an installation token expires it is replaced before a
+// push or pull request. Minted tokens last an hour, so only jobs that run long get a new one.
+const tokenRefreshMargin = 10 * time.Minute
+
+// loadGithubApp reads FIX_BUILD_GITHUB_APP_ID and FIX_BUILD_GITHUB_APP_KEY (the path of the
+// app's PEM private key). Neither set leaves the server without an app.
+func loadGithubApp() (*githubApp, error) {
+	rawId := strings.TrimSpace(os.Getenv("FIX_BUILD_GITHUB_APP_ID"))
+	keyPath := strings.TrimSpace(os.Getenv("FIX_BUILD_GITHUB_APP_KEY"))
+	if rawId == "" && keyPath == "" {
+		return nil, nil
+	}
+	if rawId == "" || keyPath == "" {
+		return nil, fmt.Errorf("FIX_BUILD_GITHUB_APP_ID and FIX_BUILD_GITHUB_APP_KEY must be set together")
+	}
+	id, err := strconv.ParseInt(rawId, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("invalid FIX_BUILD_GITHUB_APP_ID %q: must be a positive integer", rawId)
+	}
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FIX_BUILD_GITHUB_APP_KEY: %v", err)
+	}
+	key, err := parseRSAPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FIX_BUILD_GITHUB_APP_KEY %q: %v", keyPath, err)
+	}
+	return &githubApp{Id: id, Key: key}, nil
+}
+
+// parseRSAPrivateKey parses a PEM RSA key in PKCS#1 (what GitHub hands out) or PKCS#8 form.
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("not a PKCS#1 or PKCS#8 private key")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA private key")
+	}
+	return key, nil
+}
+
+// jwt signs a short-lived RS256 JWT identifying the app. It's backdated a minute to allow for
+// clock drift, and GitHub rejects any that last over ten minutes.
+func (a *githubApp) jwt(now time.Time) (string, error) {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.Id,
+	})
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.Key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// createInstallationToken exchanges the app JWT the client is authenticated with for a token
+// for installationId, returning it with its expiry.
+func (c *githubClient) createInstallationToken(installationId int64) (string, time.Time, error) {
+	var tok struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	status, err := c.do(http.MethodPost, "/app/installations/"+strconv.FormatInt(installationId, 10)+"/access_tokens", nil, &tok)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if status != http.StatusCreated || tok.Token == "" {
+		return "", time.Time{}, fmt.Errorf("create installation token: GitHub returned %d", status)
+	}
+	return tok.Token, tok.ExpiresAt, nil
+}
+
+// mintInstallationToken sets payload's installation token to a new one minted for its
+// installationId.
+func mintInstallationToken(payload *FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	jwt, err := cfg.GithubApp.jwt(time.Now())
+	if err != nil {
+		return newFixBuildError(http.StatusInternalServerError, "token_mint_failed", "signing the GitHub App JWT failed: %v", err)
+	}
+	token, expiresAt, err := newGithubClient(cfg, jwt).createInstallationToken(payload.InstallationId)
+	if err != nil {
+		log.Printf("[fix_build] mint installation token: %v", err)
+		return newFixBuildError(http.StatusBadGateway, "token_mint_failed", "minting a token for installation %d failed: %v", payload.InstallationId, err)
+	}
+	payload.InstallationToken = token
+	payload.tokenExpiresAt = expiresAt
+	return nil
+}
+
+// refreshInstallationToken replaces a minted token that's about to expire, in the payload and
+// in ws's remote URLs, so a push at the end of a long job doesn't fail on a dead token.
+// Tokens the caller sent are left alone.
+func refreshInstallationToken(ctx context.Context, ws *fixWorkspace, payload *FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	if payload.InstallationId == 0 || cfg.GithubApp == nil || time.Until(payload.tokenExpiresAt) > tokenRefreshMargin {
+		return nil
+	}
+	old := payload.InstallationToken
+	if fbErr := mintInstallationToken(payload, cfg); fbErr != nil {
+		return fbErr.inPhase("push")
+	}
+	log.Printf("[fix_build] refreshed the installation token, which expires at %s", payload.tokenExpiresAt.UTC().Format(time.RFC3339))
+	ws.log.addToken(payload.InstallationToken)
+	ws.remote = swapUrlToken(ws.remote, old, payload.InstallationToken)
+	ws.push = swapUrlToken(ws.push, old, payload.InstallationToken)
+	if ws.local {
+		// A local checkout's own remotes were never given the token
+		return nil
+	}
+	if err := swapRemoteTokens(ctx, ws.Dir, old, payload.InstallationToken); err != nil {
+		log.Printf("[fix_build] refresh remote credentials: %v", err)
+		return phaseError("push", redactToken(redactToken(err, old), payload.InstallationToken))
+	}
+	return nil
+}
+
+// swapRemoteTokens points every remote of workDir that authenticates with old at the same URL
+// with token instead.
+func swapRemoteTokens(ctx context.Context, workDir, old, token string) error {
+	out, err := runCmd(ctx, workDir, 10*time.Second, "git", "remote")
+	if err != nil {
+		return fmt.Errorf("git remote: %w\n%s", err, out)
+	}
+	for _, name := range strings.Fields(string(out)) {
+		out, err := runCmd(ctx, workDir, 10*time.Second, "git", "remote", "get-url", name)
+		if err != nil {
+			return fmt.Errorf("git remote get-url %s: %w\n%s", name, err, out)
+		}
+		current := strings.TrimSpace(string(out))
+		swapped := swapUrlToken(current, old, token)
+		if swapped == current {
+			continue
+		}
+		if out, err := runCmd(ctx, workDir, 10*time.Second, "git", "remote", "set-url", name, swapped); err != nil {
+			return fmt.Errorf("git remote set-url %s: %w\n%s", name, err, out)
+		}
+	}
+	return nil
+}
+
+// swapUrlToken replaces old with token as the password of an https URL. Anything else,
+// including remote names, is returned unchanged.
+func swapUrlToken(raw, old, token string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.User == nil {
+		return raw
+	}
+	if password, ok := u.User.Password(); !ok || password != old {
+		return raw
+	}
+	u.User = url.UserPassword(u.User.Username(), token)
+	return u.String()
+}
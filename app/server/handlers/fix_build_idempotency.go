@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// fixBuildIdempotency remembers in-flight and recently completed requests so webhook
+// redeliveries don't trigger a second clone and commit for the same failure.
+var fixBuildIdempotency = &idempotencyCache{entries: map[string]*idempotencyEntry{}}
+
+type idempotencyEntry struct {
+	done    bool
+	res     *FixBuildResponse
+	expires time.Time
+}
+
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+// begin claims key for a new request, for up to ttl in case the request is lost before it
+// completes or abandons the key. If the key is already claimed it returns the cached response
+// of a completed request, or inFlight for one that is still running.
+func (c *idempotencyCache) begin(key string, ttl time.Duration) (cached *FixBuildResponse, inFlight bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	if e, ok := c.entries[key]; ok {
+		if !e.done {
+			return nil, true
+		}
+		return e.res, false
+	}
+	c.entries[key] = &idempotencyEntry{expires: now.Add(ttl)}
+	return nil, false
+}
+
+// complete caches a successful response for replays within ttl.
+func (c *idempotencyCache) complete(key string, res *FixBuildResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &idempotencyEntry{done: true, res: res, expires: time.Now().Add(ttl)}
+}
+
+// abandon releases a key whose request failed, so a redelivery can try again.
+func (c *idempotencyCache) abandon(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && !e.done {
+		delete(c.entries, key)
+	}
+}
+
+// deriveIdempotencyKey identifies a failure by repo, commit and annotations, and the fix by
+// fixVariant and credentialKey, for callers that don't send an Idempotency-Key header.
+func deriveIdempotencyKey(p FixBuildPayload) string {
+	annos, _ := json.Marshal(groupAnnotations(p.Annotations))
+	h := sha256.New()
+	h.Write([]byte(p.Repo.Owner + "/" + p.Repo.Name + "@" + p.HeadSha + "\n" + fixVariant(p) + "\n" + credentialKey(p) + "\n"))
+	h.Write(annos)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyCacheConcurrentDuplicates(t *testing.T) {
+	c := &idempotencyCache{entries: map[string]*idempotencyEntry{}}
+
+	var mu sync.Mutex
+	claimed, rejected := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, inFlight := c.begin("key", time.Hour)
+			mu.Lock()
+			defer mu.Unlock()
+			if inFlight {
+				rejected++
+			} else {
+				claimed++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if claimed != 1 || rejected != 19 {
+		t.Fatalf("expected exactly one claim, got %d claimed and %d rejected", claimed, rejected)
+	}
+}
+
+func TestIdempotencyCacheReplayAndAbandon(t *testing.T) {
+	c := &idempotencyCache{entries: map[string]*idempotencyEntry{}}
+
+	c.begin("done", time.Hour)
+	c.complete("done", &FixBuildResponse{Ok: true, CommitSha: "abc"}, time.Hour)
+	cached, inFlight := c.begin("done", time.Hour)
+	if inFlight || cached == nil || cached.CommitSha != "abc" {
+		t.Fatalf("expected cached replay, got %+v inFlight=%v", cached, inFlight)
+	}
+
+	c.begin("failed", time.Hour)
+	c.abandon("failed")
+	if cached, inFlight := c.begin("failed", time.Hour); cached != nil || inFlight {
+		t.Fatal("an abandoned key should be claimable again")
+	}
+
+	c.begin("expired", time.Hour)
+	c.complete("expired", &FixBuildResponse{Ok: true}, -time.Second)
+	if cached, _ := c.begin("expired", time.Hour); cached != nil {
+		t.Fatal("an expired result should not be replayed")
+	}
+
+	// A request lost before completing or abandoning its key doesn't pin it forever
+	c.begin("lost", -time.Second)
+	if cached, inFlight := c.begin("lost", time.Hour); cached != nil || inFlight {
+		t.Fatal("an expired claim should be claimable again")
+	}
+}
+
+func TestFixBuildHandlerIdempotency(t *testing.T) {
+	payload := FixBuildPayload{
+		Repo:              FixBuildRepo{Owner: "acme", Name: "widgets"},
+		HeadBranch:        "feature",
+		HeadSha:           "abc1234",
+		InstallationToken: "tok",
+		Annotations:       []FixBuildAnno{{Path: "a.go", StartLine: 1, EndLine: 1, AnnotationLevel: "failure", Message: "boom"}},
+	}
+	body, _ := json.Marshal(payload)
+	post := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/fix_build", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		FixBuildHandler(rec, req)
+		return rec
+	}
+
+	fixBuildIdempotency.begin("in-flight", time.Hour)
+	defer fixBuildIdempotency.abandon("in-flight")
+	if rec := post("in-flight"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for an in-flight key, got %d", rec.Code)
+	}
+
+	derived := deriveIdempotencyKey(payload)
+	fixBuildIdempotency.begin(derived, time.Hour)
+	fixBuildIdempotency.complete(derived, &FixBuildResponse{Ok: true, CommitSha: "def5678", JobId: "job-1"}, time.Hour)
+	rec := post("")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 replay, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res FixBuildResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.CommitSha != "def5678" || res.JobId != "job-1" {
+		t.Fatalf("expected the cached response, got %+v", res)
+	}
+}
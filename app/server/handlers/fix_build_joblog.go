@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// jobLogDirName is where per-job event logs are kept under the work dir base. Unlike work dirs
+// (plandex-fix-build-*) it isn't removed on shutdown; logs expire after FIX_BUILD_JOB_LOG_RETENTION.
+const jobLogDirName = "fix-build-job-logs"
+
+// jobLog writes one job's events as JSON lines, so a fix can be reconstructed after the fact
+// without picking it out of the interleaved server log. The payload's credentials are masked
+// in everything written. A nil jobLog discards events.
+type jobLog struct {
+	mu      sync.Mutex
+	f       *os.File
+	path    string
+	secrets []string
+	// archive collects the commands' full output; nil if it couldn't be created.
+	archive *logArchive
+}
+
+type jobLogEvent struct {
+	Time    time.Time         `json:"time"`
+	Event   string            `json:"event"`
+	Payload *FixBuildPayload  `json:"payload,omitempty"`
+	Command []string          `json:"command,omitempty"`
+	Dir     string            `json:"dir,omitempty"`
+	Phase   string            `json:"phase,omitempty"`
+	Seconds float64           `json:"seconds,omitempty"`
+	Exit    *int              `json:"exitCode,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Code    string            `json:"code,omitempty"`
+	Result  *FixBuildResponse `json:"result,omitempty"`
+}
+
+// jobLogPath maps a job id to its log file; ids that aren't UUIDs are rejected.
+func jobLogPath(cfg fixBuildConfig, id string) (string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", errors.New("invalid job id")
+	}
+	base, err := workDirBase(cfg)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, jobLogDirName, strings.ToLower(id)+".jsonl"), nil
+}
+
+// jobLogPrune throttles removal of expired logs to once a minute.
+var jobLogPrune struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// openJobLog creates the log for a job, removing expired logs now and then.
+func openJobLog(cfg fixBuildConfig, id string, p FixBuildPayload) (*jobLog, error) {
+	path, err := jobLogPath(cfg, id)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	jobLogPrune.mu.Lock()
+	due := time.Since(jobLogPrune.last) >= time.Minute
+	if due {
+		jobLogPrune.last = time.Now()
+	}
+	jobLogPrune.mu.Unlock()
+	if due {
+		pruneJobLogs(dir, time.Now().Add(-cfg.JobLogRetention))
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &jobLog{f: f, path: path}
+	if p.InstallationToken != "" {
+		l.secrets = append(l.secrets, tokenForms(p.InstallationToken)...)
+	}
+	if p.SshKey != "" {
+		l.secrets = append(l.secrets, p.SshKey)
+	}
+	if archivePath, err := jobLogArchivePath(cfg, id); err == nil {
+		if l.archive, err = openLogArchive(archivePath); err != nil {
+			// The event log is still worth having without the output
+			log.Printf("[fix_build] log archive: %v", err)
+		}
+	}
+	return l, nil
+}
+
+// addToken masks a token the job got after its log was opened, such as a refreshed
+// installation token.
+func (l *jobLog) addToken(token string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.secrets = append(l.secrets, tokenForms(token)...)
+}
+
+func pruneJobLogs(dir string, cutoff time.Time) {
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && !e.IsDir() && info.ModTime().Before(cutoff) {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				log.Printf("[fix_build] prune job log: %v", err)
+			}
+		}
+	}
+}
+
+func (l *jobLog) write(ev jobLogEvent) {
+	if l == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data = l.mask(data)
+	if l.f != nil {
+		_, _ = l.f.Write(append(data, '\n'))
+	}
+}
+
+// mask replaces the job's secrets in data. l.mu must be held.
+func (l *jobLog) mask(data []byte) []byte {
+	for _, s := range l.secrets {
+		// Mask both the raw secret and its JSON-escaped form (e.g. a key's newlines)
+		quoted, _ := json.Marshal(s)
+		data = bytes.ReplaceAll(data, quoted[1:len(quoted)-1], []byte("***"))
+		data = bytes.ReplaceAll(data, []byte(s), []byte("***"))
+	}
+	return data
+}
+
+// payload records the request, with its credentials and env values masked.
+func (l *jobLog) payload(p FixBuildPayload) {
+	if p.InstallationToken != "" {
+		p.InstallationToken = "***"
+	}
+	if p.SshKey != "" {
+		p.SshKey = "***"
+	}
+	if len(p.Env) > 0 {
+		env := make(map[string]string, len(p.Env))
+		for k := range p.Env {
+			env[k] = "***"
+		}
+		p.Env = env
+	}
+	l.write(jobLogEvent{Event: "payload", Payload: &p})
+}
+
+func (l *jobLog) command(dir string, command []string, out []byte, took time.Duration, err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.archive != nil {
+		l.archive.command(dir, l.mask([]byte(strings.Join(command, " "))), l.mask(out), took, err)
+	}
+	l.mu.Unlock()
+
+	ev := jobLogEvent{Event: "command", Command: command, Dir: dir, Seconds: took.Seconds()}
+	var exitErr interface{ ExitCode() int }
+	switch {
+	case err == nil:
+		code := 0
+		ev.Exit = &code
+	case errors.As(err, &exitErr):
+		code := exitErr.ExitCode()
+		ev.Exit = &code
+		ev.Error = err.Error()
+	default:
+		ev.Error = err.Error()
+	}
+	l.write(ev)
+}
+
+func (l *jobLog) phase(phase string, took time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.archive != nil {
+		l.archive.phase(phase, took)
+	}
+	l.mu.Unlock()
+	l.write(jobLogEvent{Event: "phase", Phase: phase, Seconds: took.Seconds()})
+}
+
+func (l *jobLog) result(res *FixBuildResponse, fbErr *fixBuildError) {
+	ev := jobLogEvent{Event: "result", Result: res}
+	if fbErr != nil {
+		ev.Error = fbErr.Message
+		ev.Code = fbErr.Code
+		ev.Phase = fbErr.Phase
+	}
+	l.write(ev)
+}
+
+// close stops the log; later events are dropped.
+func (l *jobLog) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		_ = l.f.Close()
+		l.f = nil
+	}
+	if l.archive != nil {
+		l.archive.close()
+		l.archive = nil
+	}
+}
+
+type jobLogKey struct{}
+
+func withJobLog(ctx context.Context, l *jobLog) context.Context {
+	return context.WithValue(ctx, jobLogKey{}, l)
+}
+
+// jobLogFrom returns the log for the job ctx belongs to, or nil.
+func jobLogFrom(ctx context.Context) *jobLog {
+	l, _ := ctx.Value(jobLogKey{}).(*jobLog)
+	return l
+}
+
+// loggingRunner records every command it runs, with its exit code and duration, in a job log.
+type loggingRunner struct {
+	inner Runner
+	log   *jobLog
+}
+
+func (r loggingRunner) Run(ctx context.Context, dir string, timeout time.Duration, env []string, name string, args ...string) ([]byte, error) {
+	start := time.Now()
+	out, err := r.inner.Run(ctx, dir, timeout, env, name, args...)
+	r.log.command(dir, append([]string{name}, args...), out, time.Since(start), err)
+	return out, err
+}
+
+func (r loggingRunner) LookPath(name string) (string, error) {
+	return r.inner.LookPath(name)
+}
+
+// FixBuildLogHandler handles GET /fix_build/status/{jobId}/log, returning the job's event log
+// as JSON lines.
+func FixBuildLogHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		http.Error(w, "invalid fix_build server config", http.StatusInternalServerError)
+		return
+	}
+	path, err := jobLogPath(cfg, mux.Vars(r)["jobId"])
+	if err != nil {
+		http.Error(w, "job log not found", http.StatusNotFound)
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		http.Error(w, "job log not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	_, _ = w.Write(data)
+}
+
+// logCommands routes ctx's commands through its job log, if it has one.
+func logCommands(ctx context.Context) context.Context {
+	if l := jobLogFrom(ctx); l != nil {
+		return withRunner(ctx, loggingRunner{inner: runnerFrom(ctx), log: l})
+	}
+	return ctx
+}
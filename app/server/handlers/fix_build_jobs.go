@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	fixBuildJobRunning   = "running"
+	fixBuildJobSucceeded = "succeeded"
+	fixBuildJobFailed    = "failed"
+	fixBuildJobCancelled = "cancelled"
+)
+
+var (
+	errJobNotFound = errors.New("job not found")
+	errJobFinished = errors.New("job already finished")
+)
+
+// fixBuildJobRetention is how long finished jobs stay queryable via the status endpoint, both
+// in memory and in the persistent job store.
+const fixBuildJobRetention = 24 * time.Hour
+
+// FixBuildJob is the state of a single /fix_build run, as returned by the status endpoint.
+type FixBuildJob struct {
+	Id         string            `json:"jobId"`
+	Repo       FixBuildRepo      `json:"repo"`
+	HeadBranch string            `json:"headBranch"`
+	HeadSha    string            `json:"headSha"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	Result     *FixBuildResponse `json:"result,omitempty"`
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+	// LogFile is the job's structured event log, kept for FIX_BUILD_JOB_LOG_RETENTION.
+	LogFile string `json:"logFile,omitempty"`
+
+	// cancel stops the job's commands; nil once the job has finished.
+	cancel context.CancelFunc
+}
+
+// fixBuildJobStore tracks jobs for the status endpoint. Jobs and usage history have separate
+// locks, reads share an RWMutex, and callers only ever get copies, so nothing slow (JSON
+// encoding, network writes) happens while a lock is held.
+type fixBuildJobStore struct {
+	mu         sync.RWMutex
+	jobs       map[string]*FixBuildJob
+	lastPruned time.Time
+
+	usageMu sync.Mutex
+	usage   []fixBuildUsageRecord
+}
+
+var fixBuildJobs = &fixBuildJobStore{jobs: map[string]*FixBuildJob{}}
+
+type jobIdKey struct{}
+
+// jobIdFrom returns the id of the job ctx belongs to.
+func jobIdFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(jobIdKey{}).(string)
+	return id, ok
+}
+
+// start registers a running job and returns it with the context its work should run under.
+func (s *fixBuildJobStore) start(p FixBuildPayload) (FixBuildJob, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &FixBuildJob{
+		Id:         uuid.New().String(),
+		Repo:       p.Repo,
+		HeadBranch: p.HeadBranch,
+		HeadSha:    p.HeadSha,
+		Status:     fixBuildJobRunning,
+		StartedAt:  time.Now(),
+		cancel:     cancel,
+	}
+	ctx = context.WithValue(ctx, jobIdKey{}, job.Id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maybePruneLocked()
+	s.jobs[job.Id] = job
+	return job.snapshot(), ctx
+}
+
+// setLogFile records where a job's event log is being written.
+func (s *fixBuildJobStore) setLogFile(id, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		job.LogFile = path
+	}
+}
+
+func (s *fixBuildJobStore) finish(id string, res *FixBuildResponse, fbErr *fixBuildError) {
+	// Copy the result outside the lock so later changes by the caller can't race with readers
+	var result *FixBuildResponse
+	if res != nil {
+		r := *res
+		result = &r
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	if job.cancel != nil {
+		job.cancel()
+		job.cancel = nil
+	}
+	if job.Status == fixBuildJobCancelled {
+		return
+	}
+	job.FinishedAt = &now
+	if fbErr != nil {
+		job.Status = fixBuildJobFailed
+		job.Error = fbErr.Message
+		return
+	}
+	job.Status = fixBuildJobSucceeded
+	job.Error = ""
+	job.Result = result
+}
+
+// cancel marks a running job cancelled and cancels its context, which kills any command it is
+// running; the job's own cleanup then removes its work dir.
+func (s *fixBuildJobStore) cancel(id string) (FixBuildJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return FixBuildJob{}, errJobNotFound
+	}
+	if job.Status != fixBuildJobRunning {
+		return job.snapshot(), errJobFinished
+	}
+	now := time.Now()
+	job.Status = fixBuildJobCancelled
+	job.FinishedAt = &now
+	if job.cancel != nil {
+		job.cancel()
+	}
+	return job.snapshot(), nil
+}
+
+// cancelRunning cancels every running job and returns how many there were.
+func (s *fixBuildJobStore) cancelRunning() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for _, job := range s.jobs {
+		if job.Status != fixBuildJobRunning {
+			continue
+		}
+		job.Status = fixBuildJobCancelled
+		job.FinishedAt = &now
+		if job.cancel != nil {
+			job.cancel()
+		}
+		n++
+	}
+	return n
+}
+
+func (s *fixBuildJobStore) get(id string) (FixBuildJob, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return FixBuildJob{}, false
+	}
+	return job.snapshot(), true
+}
+
+// maybePruneLocked drops expired jobs, at most once a minute so busy periods don't pay
+// for a full scan on every start.
+func (s *fixBuildJobStore) maybePruneLocked() {
+	now := time.Now()
+	if now.Sub(s.lastPruned) < time.Minute {
+		return
+	}
+	s.lastPruned = now
+	cutoff := now.Add(-fixBuildJobRetention)
+	for id, job := range s.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// snapshot returns a copy of the job that shares no mutable state with the store.
+func (j *FixBuildJob) snapshot() FixBuildJob {
+	cp := *j
+	cp.cancel = nil
+	if j.FinishedAt != nil {
+		t := *j.FinishedAt
+		cp.FinishedAt = &t
+	}
+	if j.Result != nil {
+		r := *j.Result
+		cp.Result = &r
+	}
+	return cp
+}
+
+// fixBuildJobUrl returns the public status URL for a job, or "" when no public base URL is configured.
+func fixBuildJobUrl(cfg fixBuildConfig, jobId string) string {
+	if cfg.PublicBaseUrl == "" {
+		return ""
+	}
+	return cfg.PublicBaseUrl + "/fix_build/status/" + jobId
+}
+
+// fixBuildLogsUrl is where a job's log archive can be downloaded, if PublicBaseUrl is set.
+func fixBuildLogsUrl(cfg fixBuildConfig, jobId string) string {
+	if cfg.PublicBaseUrl == "" {
+		return ""
+	}
+	return cfg.PublicBaseUrl + "/fix_build/logs/" + jobId
+}
+
+// FixBuildStatusHandler handles GET /fix_build/status/{jobId}.
+func FixBuildStatusHandler(w http.ResponseWriter, r *http.Request) {
+	jobId := mux.Vars(r)["jobId"]
+
+	job, ok := fixBuildJobs.get(jobId)
+	if !ok {
+		// Jobs from before a restart are only in the persistent store
+		cfg, err := loadFixBuildConfig()
+		if err == nil {
+			job, ok = loadPersistedJob(cfg, jobId)
+		}
+	}
+	if !ok {
+		writeFixBuildError(w, newFixBuildError(http.StatusNotFound, "job_not_found", "job %s not found", jobId))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// FixBuildCancelHandler handles POST /fix_build/cancel/{jobId}.
+func FixBuildCancelHandler(w http.ResponseWriter, r *http.Request) {
+	jobId := mux.Vars(r)["jobId"]
+
+	job, err := fixBuildJobs.cancel(jobId)
+	switch {
+	case errors.Is(err, errJobNotFound):
+		writeFixBuildError(w, newFixBuildError(http.StatusNotFound, "job_not_found", "job %s not found", jobId))
+		return
+	case errors.Is(err, errJobFinished):
+		writeFixBuildError(w, newFixBuildError(http.StatusConflict, "job_finished", "job %s already %s", jobId, job.Status))
+		return
+	}
+	log.Printf("[fix_build] job %s cancelled", jobId)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
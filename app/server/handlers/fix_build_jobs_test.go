@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFixBuildJobUrl(t *testing.T) {
+	t.Setenv("FIX_BUILD_PUBLIC_BASE_URL", "https://plandex.example.com/")
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		t.Fatalf("loadFixBuildConfig: %v", err)
+	}
+
+	if got, want := fixBuildJobUrl(cfg, "abc"), "https://plandex.example.com/fix_build/status/abc"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if got := fixBuildJobUrl(fixBuildConfig{}, "abc"); got != "" {
+		t.Fatalf("expected no job URL without a base URL, got %q", got)
+	}
+}
+
+func TestValidateFixBuildConfigRejectsBadBaseUrl(t *testing.T) {
+	for _, v := range []string{"plandex.example.com", "ftp://plandex.example.com", "https://"} {
+		t.Setenv("FIX_BUILD_PUBLIC_BASE_URL", v)
+		if err := ValidateFixBuildConfig(); err == nil {
+			t.Fatalf("expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestFixBuildStatusHandler(t *testing.T) {
+	job, _ := fixBuildJobs.start(FixBuildPayload{Repo: FixBuildRepo{Owner: "o", Name: "r"}, HeadSha: "abc1234"})
+	fixBuildJobs.finish(job.Id, &FixBuildResponse{Ok: true, CommitSha: "def5678"}, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fix_build/status/{jobId}", FixBuildStatusHandler)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fix_build/status/"+job.Id, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var got FixBuildJob
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != fixBuildJobSucceeded || got.Result == nil || got.Result.CommitSha != "def5678" {
+		t.Fatalf("unexpected job state: %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fix_build/status/missing", nil))
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), `"code":"job_not_found"`) {
+		t.Fatalf("expected 404 job_not_found for unknown job, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// Run with -race: workers start and finish jobs while readers poll status and usage.
+func TestFixBuildJobStoreConcurrentAccess(t *testing.T) {
+	s := &fixBuildJobStore{jobs: map[string]*FixBuildJob{}}
+	repo := FixBuildRepo{Owner: "acme", Name: "widgets"}
+
+	ids := make(chan string, 400)
+	var writers, readers sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 50; i++ {
+				job, _ := s.start(FixBuildPayload{Repo: repo, HeadSha: "abc1234"})
+				ids <- job.Id
+				res := &FixBuildResponse{Ok: true, CommitSha: "def"}
+				s.finish(job.Id, res, nil)
+				res.CommitSha = "mutated after finish"
+				s.recordUsage(job, FixBuildUsage{InputTokens: 1}, time.Now(), time.Hour)
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	for r := 0; r < 8; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case id := <-ids:
+					if job, ok := s.get(id); ok && job.Result != nil && job.Result.CommitSha != "def" {
+						t.Errorf("reader saw a result mutated after finish: %q", job.Result.CommitSha)
+					}
+				default:
+					s.aggregateUsage(repo, nil, nil)
+				}
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	if got := s.aggregateUsage(repo, nil, nil); got.Jobs != 400 {
+		t.Fatalf("expected 400 usage records, got %d", got.Jobs)
+	}
+}
+
+func TestFixBuildCancelHandler(t *testing.T) {
+	root := fakeGithub(t)
+	_, sha := addFakeGithubRepo(t, root, "acme", "cancel-me")
+	// Work dirs go here so the test can check they're cleaned up
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	// plandex tell starts a child that keeps touching a heartbeat file until killed
+	beat := filepath.Join(t.TempDir(), "beat")
+	fakePlandex(t, `if [ "$1" = "tell" ]; then
+  (while :; do date +%s%N > "`+beat+`"; sleep 0.05; done) &
+  wait
+fi
+`)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fix_build", FixBuildHandler)
+	router.HandleFunc("/fix_build/cancel/{jobId}", FixBuildCancelHandler)
+
+	body, _ := json.Marshal(FixBuildPayload{
+		Repo:              FixBuildRepo{Owner: "acme", Name: "cancel-me"},
+		HeadBranch:        "main",
+		HeadSha:           sha,
+		OutputSummary:     "FAIL",
+		InstallationToken: "tok",
+	})
+	fixRec := httptest.NewRecorder()
+	fixDone := make(chan struct{})
+	go func() {
+		defer close(fixDone)
+		req := httptest.NewRequest(http.MethodPost, "/fix_build", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(fixRec, req)
+	}()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if _, err := os.Stat(beat); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			<-fixDone
+			t.Fatalf("fake plandex never started: %d %s", fixRec.Code, fixRec.Body.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var jobId string
+	fixBuildJobs.mu.RLock()
+	for id, job := range fixBuildJobs.jobs {
+		if job.Repo.Name == "cancel-me" && job.Status == fixBuildJobRunning {
+			jobId = id
+		}
+	}
+	fixBuildJobs.mu.RUnlock()
+	if jobId == "" {
+		t.Fatal("running job not found in store")
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/fix_build/cancel/"+jobId, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from cancel, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case <-fixDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("fix request did not return after cancel")
+	}
+	if fixRec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 from the cancelled fix, got %d: %s", fixRec.Code, fixRec.Body.String())
+	}
+
+	// The whole process group is gone, so the heartbeat stops
+	before, _ := os.ReadFile(beat)
+	time.Sleep(300 * time.Millisecond)
+	after, _ := os.ReadFile(beat)
+	if !bytes.Equal(before, after) {
+		t.Fatal("plandex child process still running after cancel")
+	}
+
+	if job, _ := fixBuildJobs.get(jobId); job.Status != fixBuildJobCancelled || job.FinishedAt == nil {
+		t.Fatalf("expected job to be cancelled, got %+v", job)
+	}
+	if entries := workDirLeftovers(tmp); len(entries) != 0 {
+		t.Fatalf("expected work dir to be cleaned up, found %d entries", len(entries))
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/fix_build/cancel/"+jobId, nil))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), `"code":"job_finished"`) {
+		t.Fatalf("expected 409 job_finished cancelling a finished job, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/fix_build/cancel/missing", nil))
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), `"code":"job_not_found"`) {
+		t.Fatalf("expected 404 job_not_found for unknown job, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestFileJobStore(t *testing.T) {
+	store := fileJobStore{Dir: filepath.Join(t.TempDir(), "jobs")}
+	job, _ := (&fixBuildJobStore{jobs: map[string]*FixBuildJob{}}).start(FixBuildPayload{Repo: FixBuildRepo{Owner: "o", Name: "r"}})
+
+	if _, ok, err := store.Load(job.Id); ok || err != nil {
+		t.Fatalf("expected no job before saving, got ok=%v err=%v", ok, err)
+	}
+	if err := store.Save(job); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	job.Status = fixBuildJobSucceeded
+	job.Result = &FixBuildResponse{Ok: true, CommitSha: "def5678"}
+	if err := store.Save(job); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	got, ok, err := store.Load(job.Id)
+	if err != nil || !ok {
+		t.Fatalf("Load: ok=%v err=%v", ok, err)
+	}
+	if got.Status != fixBuildJobSucceeded || got.Result == nil || got.Result.CommitSha != "def5678" {
+		t.Fatalf("expected the latest save, got %+v", got)
+	}
+
+	if _, ok, _ := store.Load("../../etc/passwd"); ok {
+		t.Fatal("expected a non-UUID id to be rejected")
+	}
+
+	// Prune keeps recent jobs and drops old ones
+	if err := store.Prune(time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if _, ok, _ := store.Load(job.Id); !ok {
+		t.Fatal("recent job was pruned")
+	}
+	if err := store.Prune(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if _, ok, _ := store.Load(job.Id); ok {
+		t.Fatal("expected the old job to be pruned")
+	}
+}
+
+func TestFixBuildStatusSurvivesRestart(t *testing.T) {
+	t.Setenv("FIX_BUILD_JOB_DIR", t.TempDir())
+	useFakeRunner(t, nil)
+
+	rec := postFixBuild(t, fakeRunnerPayload("aaa0036"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res FixBuildResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a restart by forgetting the in-memory job
+	fixBuildJobs.mu.Lock()
+	delete(fixBuildJobs.jobs, res.JobId)
+	fixBuildJobs.mu.Unlock()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/fix_build/status/{jobId}", FixBuildStatusHandler)
+	status := httptest.NewRecorder()
+	router.ServeHTTP(status, httptest.NewRequest(http.MethodGet, "/fix_build/status/"+res.JobId, nil))
+	if status.Code != http.StatusOK {
+		t.Fatalf("expected 200 from the persisted job, got %d: %s", status.Code, status.Body.String())
+	}
+	var job FixBuildJob
+	if err := json.Unmarshal(status.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != fixBuildJobSucceeded || job.Result == nil || job.Result.CommitSha != res.CommitSha {
+		t.Fatalf("unexpected persisted job: %+v", job)
+	}
+
+	// A job that was still running when the server went down is reported as failed
+	cfg, _ := loadFixBuildConfig()
+	running, _ := (&fixBuildJobStore{jobs: map[string]*FixBuildJob{}}).start(FixBuildPayload{})
+	persistJob(cfg, running)
+	if got, ok := loadPersistedJob(cfg, running.Id); !ok || got.Status != fixBuildJobFailed {
+		t.Fatalf("expected an interrupted job to be reported as failed, got %+v", got)
+	}
+}
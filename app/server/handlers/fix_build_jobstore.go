@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// JobStore persists jobs so their status survives a server restart.
+type JobStore interface {
+	// Save records the job's current state, replacing any earlier save.
+	Save(job FixBuildJob) error
+	// Load returns a saved job; ok is false if there is none.
+	Load(id string) (job FixBuildJob, ok bool, err error)
+	// Prune deletes jobs last saved before cutoff.
+	Prune(cutoff time.Time) error
+}
+
+// fileJobStore keeps one JSON file per job in Dir.
+type fileJobStore struct {
+	Dir string
+}
+
+// jobStoreFor returns the persistent store configured by FIX_BUILD_JOB_DIR, or nil if jobs are
+// only kept in memory.
+func jobStoreFor(cfg fixBuildConfig) JobStore {
+	if cfg.JobDir == "" {
+		return nil
+	}
+	return fileJobStore{Dir: cfg.JobDir}
+}
+
+// path maps a job id to its file. Ids are UUIDs; anything else (e.g. a crafted status URL) is rejected.
+func (s fileJobStore) path(id string) (string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", fmt.Errorf("invalid job id %q", id)
+	}
+	return filepath.Join(s.Dir, strings.ToLower(id)+".json"), nil
+}
+
+// Save writes the job to a temp file and renames it into place, so readers never see a partial file.
+func (s fileJobStore) Save(job FixBuildJob) error {
+	path, err := s.path(job.Id)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.Dir, ".job-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s fileJobStore) Load(id string) (FixBuildJob, bool, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return FixBuildJob{}, false, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return FixBuildJob{}, false, nil
+	}
+	if err != nil {
+		return FixBuildJob{}, false, err
+	}
+	var job FixBuildJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return FixBuildJob{}, false, fmt.Errorf("decode %s: %v", path, err)
+	}
+	return job, true, nil
+}
+
+func (s fileJobStore) Prune(cutoff time.Time) error {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.Dir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobStorePrune throttles pruning of the persistent store to once an hour.
+var jobStorePrune struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// persistJob saves job to the configured store, if any, pruning expired jobs now and then.
+// Failures are logged: the in-memory store still has the job.
+func persistJob(cfg fixBuildConfig, job FixBuildJob) {
+	store := jobStoreFor(cfg)
+	if store == nil {
+		return
+	}
+	if err := store.Save(job); err != nil {
+		log.Printf("[fix_build] persist job %s: %v", job.Id, err)
+	}
+
+	jobStorePrune.mu.Lock()
+	due := time.Since(jobStorePrune.last) >= time.Hour
+	if due {
+		jobStorePrune.last = time.Now()
+	}
+	jobStorePrune.mu.Unlock()
+	if due {
+		if err := store.Prune(time.Now().Add(-fixBuildJobRetention)); err != nil {
+			log.Printf("[fix_build] prune job store: %v", err)
+		}
+	}
+}
+
+// loadPersistedJob looks a job up in the configured store. A job saved as running that this
+// process doesn't know about was cut off by a restart, so it's reported as failed.
+func loadPersistedJob(cfg fixBuildConfig, id string) (FixBuildJob, bool) {
+	store := jobStoreFor(cfg)
+	if store == nil {
+		return FixBuildJob{}, false
+	}
+	job, ok, err := store.Load(id)
+	if err != nil {
+		log.Printf("[fix_build] load job %s: %v", id, err)
+		return FixBuildJob{}, false
+	}
+	if ok && job.Status == fixBuildJobRunning {
+		job.Status = fixBuildJobFailed
+		job.Error = "interrupted by a server restart"
+	}
+	return job, ok
+}
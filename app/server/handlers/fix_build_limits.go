@@ -0,0 +1,67 @@
+package handlers
+
+import "sync"
+
+// fixBuildLimiter bounds how many fix attempts run at once across all requests. The limit is
+// passed on each acquire so it follows the current config.
+type fixBuildLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	inUse  int
+	maxUse int // high-water mark, for tests
+}
+
+func newFixBuildLimiter() *fixBuildLimiter {
+	l := &fixBuildLimiter{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+var fixBuildSlots = newFixBuildLimiter()
+
+// acquire blocks until fewer than max slots are in use. A max of zero means unlimited.
+func (l *fixBuildLimiter) acquire(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for max > 0 && l.inUse >= max {
+		l.cond.Wait()
+	}
+	l.inUse++
+	if l.inUse > l.maxUse {
+		l.maxUse = l.inUse
+	}
+}
+
+func (l *fixBuildLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inUse--
+	l.cond.Broadcast()
+}
+
+type candidateResult struct {
+	ws  *fixWorkspace
+	err *fixBuildError
+}
+
+// runCandidates calls attempt for candidates 0..n-1, at most parallelism at a time, and
+// returns the results in candidate order.
+func runCandidates(n, parallelism int, attempt func(i int) candidateResult) []candidateResult {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	results := make([]candidateResult, n)
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = attempt(i)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
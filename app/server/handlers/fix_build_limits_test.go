@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateFixBuildPayloadCandidates(t *testing.T) {
+	cfg := fixBuildConfig{MaxCandidates: 3}
+	p := FixBuildPayload{
+		Repo:              FixBuildRepo{Owner: "acme", Name: "widgets"},
+		HeadBranch:        "main",
+		HeadSha:           "abc1234",
+		InstallationToken: "tok",
+	}
+
+	for _, n := range []int{0, 1, 3} {
+		p.Candidates = n
+		if fbErr := validateFixBuildPayload(p, cfg); fbErr != nil {
+			t.Fatalf("candidates=%d: unexpected error %v", n, fbErr)
+		}
+	}
+	for _, n := range []int{-1, 4, 100} {
+		p.Candidates = n
+		fbErr := validateFixBuildPayload(p, cfg)
+		if fbErr == nil || fbErr.Status != http.StatusBadRequest {
+			t.Fatalf("candidates=%d: expected 400, got %v", n, fbErr)
+		}
+	}
+}
+
+func TestRunCandidatesBoundsParallelism(t *testing.T) {
+	var running, peak int32
+	results := runCandidates(6, 2, func(i int) candidateResult {
+		cur := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if cur <= old || atomic.CompareAndSwapInt32(&peak, old, cur) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		if i == 4 {
+			return candidateResult{err: newFixBuildError(http.StatusInternalServerError, "candidate_failed", "candidate %d failed", i)}
+		}
+		return candidateResult{ws: &fixWorkspace{Dir: "ws"}}
+	})
+
+	if peak > 2 {
+		t.Fatalf("expected at most 2 candidates at once, saw %d", peak)
+	}
+	if len(results) != 6 || results[4].err == nil || results[3].ws == nil {
+		t.Fatalf("results not returned in candidate order: %+v", results)
+	}
+}
+
+func TestFixBuildLimiterBoundsConcurrency(t *testing.T) {
+	l := newFixBuildLimiter()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.acquire(3)
+			time.Sleep(5 * time.Millisecond)
+			l.release()
+		}()
+	}
+	wg.Wait()
+
+	if l.maxUse > 3 {
+		t.Fatalf("expected at most 3 slots in use, saw %d", l.maxUse)
+	}
+	if l.inUse != 0 {
+		t.Fatalf("expected all slots released, %d still in use", l.inUse)
+	}
+}
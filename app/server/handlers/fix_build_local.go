@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localCheckoutLocks serializes jobs on the same local checkout, each holding its path's lock
+// from newFixWorkspace until cleanup.
+var localCheckoutLocks = &localLocks{locks: map[string]*sync.Mutex{}}
+
+type localLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (l *localLocks) lockFor(dir string) *sync.Mutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m, ok := l.locks[dir]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[dir] = m
+	}
+	return m
+}
+
+// resolveLocalPath checks that path is a git checkout inside root and returns it with symlinks
+// resolved, so a link can't lead the fix outside the root.
+func resolveLocalPath(root, path string) (string, error) {
+	if root == "" {
+		return "", fmt.Errorf("localPath is not enabled on this server; set FIX_BUILD_LOCAL_ROOT")
+	}
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("localPath must be absolute")
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("FIX_BUILD_LOCAL_ROOT: %v", err)
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("localPath: %v", err)
+	}
+	if rel, err := filepath.Rel(realRoot, real); err != nil || rel == "." || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("localPath %s is not inside FIX_BUILD_LOCAL_ROOT", path)
+	}
+	if _, err := os.Stat(filepath.Join(real, ".git")); err != nil {
+		return "", fmt.Errorf("localPath %s is not a git checkout", path)
+	}
+	return real, nil
+}
+
+// prepareLocalCheckout readies an existing checkout for the fix in place of a clone: it must have
+// no changes the reset would clobber (or the commit would sweep up), and the head branch is
+// fetched from the payload's remote so the checkout's own remotes and credentials aren't needed.
+func prepareLocalCheckout(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	out, err := runCmd(ctx, ws.Dir, 30*time.Second, "git", "status", "--porcelain")
+	if err != nil {
+		log.Printf("[fix_build] local status: %v\n%s", err, out)
+		return newFixBuildError(http.StatusInternalServerError, "checkout_failed", "git status failed: %v", err).inPhase("checkout").withLogs(string(out))
+	}
+	if dirty := strings.TrimSpace(string(out)); dirty != "" {
+		return newFixBuildError(http.StatusConflict, "local_path_dirty", "localPath has uncommitted changes that the fix would overwrite:\n%s", truncateMiddle(dirty, 2<<10)).inPhase("checkout")
+	}
+	// Remember where the checkout was, so a failed fix can put it back
+	head, err := runCmd(ctx, ws.Dir, 10*time.Second, "git", "rev-parse", "HEAD")
+	if err != nil {
+		log.Printf("[fix_build] local head: %v\n%s", err, head)
+		return newFixBuildError(http.StatusInternalServerError, "checkout_failed", "git rev-parse failed: %v", err).inPhase("checkout").withLogs(string(head))
+	}
+	ws.localHead = strings.TrimSpace(string(head))
+	// Detached when this fails
+	if branch, err := runCmd(ctx, ws.Dir, 10*time.Second, "git", "symbolic-ref", "-q", "--short", "HEAD"); err == nil {
+		ws.localBranch = strings.TrimSpace(string(branch))
+	}
+
+	refspec := "+refs/heads/" + payload.HeadBranch + ":refs/remotes/origin/" + payload.HeadBranch
+	if out, err := runCmdEnv(ctx, ws.Dir, cfg.Timeouts.Clone, ws.gitEnv, "git", "fetch", ws.remote, refspec); err != nil {
+		err = redactToken(fmt.Errorf("git fetch: %w\n%s", err, out), payload.InstallationToken)
+		log.Printf("[fix_build] local fetch: %v", err)
+		return gitPhaseError("fetch", err, payload.InstallationToken)
+	}
+	return nil
+}
+
+// restoreLocalCheckout puts a local checkout back on the branch and commit it was on before the
+// job, and removes the untracked files the job created. The checkout was clean when the job
+// began, so nothing of the owner's is lost; ignored files such as build output are left alone.
+func restoreLocalCheckout(ws *fixWorkspace) error {
+	ctx := context.Background()
+	checkout := []string{"git", "checkout", "-q", "-f", "--detach", ws.localHead}
+	if ws.localBranch != "" {
+		checkout = []string{"git", "checkout", "-q", "-f", "-B", ws.localBranch, ws.localHead}
+	}
+	for _, args := range [][]string{checkout, {"git", "reset", "-q", "--hard", ws.localHead}, {"git", "clean", "-fdq"}} {
+		if out, err := runCmd(ctx, ws.Dir, 30*time.Second, args[0], args[1:]...); err != nil {
+			return fmt.Errorf("%s: %w\n%s", strings.Join(args[:2], " "), err, out)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFixBuildLocalPath(t *testing.T) {
+	root := fakeGithub(t)
+	fakePlandex(t, `[ "$1" = "tell" ] && echo fixed > file.txt
+exit 0
+`)
+	localRoot := t.TempDir()
+	t.Setenv("FIX_BUILD_LOCAL_ROOT", localRoot)
+
+	// newLocal clones a fresh fakeGithub repo into the local root, as a CI runner would have
+	newLocal := func(t *testing.T, name string) (bare, sha, dir string) {
+		t.Helper()
+		bare, sha = addFakeGithubRepo(t, root, "acme", name)
+		dir = filepath.Join(localRoot, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		gitT(t, dir, "clone", "-q", bare, ".")
+		return bare, sha, dir
+	}
+	payload := func(name, sha, dir string) FixBuildPayload {
+		return FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: name}, HeadBranch: "main", HeadSha: sha, OutputSummary: "FAIL", InstallationToken: "tok", LocalPath: dir}
+	}
+
+	t.Run("clean checkout is fixed in place", func(t *testing.T) {
+		bare, sha, dir := newLocal(t, "local-clean")
+		rec := postFixBuild(t, payload("local-clean", sha, dir))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if parent := gitT(t, bare, "rev-parse", "main^"); parent != sha {
+			t.Fatalf("expected the fix pushed on top of %s, got parent %s", sha, parent)
+		}
+		if got := gitT(t, dir, "rev-parse", "HEAD"); got != gitT(t, bare, "rev-parse", "main") {
+			t.Fatal("expected the local checkout to hold the pushed fix")
+		}
+		if _, err := os.Stat(filepath.Join(dir, contextFileName)); !os.IsNotExist(err) {
+			t.Fatalf("expected the context file to be cleaned up, got %v", err)
+		}
+	})
+
+	t.Run("dirty checkout is refused", func(t *testing.T) {
+		bare, sha, dir := newLocal(t, "local-dirty")
+		if err := os.WriteFile(filepath.Join(dir, "wip.txt"), []byte("work in progress\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rec := postFixBuild(t, payload("local-dirty", sha, dir))
+		if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "local_path_dirty") {
+			t.Fatalf("expected 409 local_path_dirty, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if _, err := os.Stat(filepath.Join(dir, "wip.txt")); err != nil {
+			t.Fatalf("uncommitted work was touched: %v", err)
+		}
+		if got := gitT(t, bare, "rev-parse", "main"); got != sha {
+			t.Fatal("nothing should be pushed from a dirty checkout")
+		}
+	})
+
+	t.Run("failed fix leaves the checkout as it was", func(t *testing.T) {
+		bare, sha, dir := newLocal(t, "local-failed")
+		p := payload("local-failed", sha, dir)
+		p.VerifyCommand = "echo scratch > stray.txt; exit 1"
+		rec := postFixBuild(t, p)
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "verify_failed") {
+			t.Fatalf("expected 422 verify_failed, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if got := gitT(t, dir, "rev-parse", "HEAD"); got != sha {
+			t.Fatalf("expected the checkout reset to %s, got %s", sha, got)
+		}
+		if status := gitT(t, dir, "status", "--porcelain"); status != "" {
+			t.Fatalf("expected a clean checkout after the failed fix, got:\n%s", status)
+		}
+
+		rec = postFixBuild(t, payload("local-failed", sha, dir))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected the next fix to succeed, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if parent := gitT(t, bare, "rev-parse", "main^"); parent != sha {
+			t.Fatalf("expected the fix pushed on top of %s, got parent %s", sha, parent)
+		}
+	})
+
+	t.Run("paths outside the root are refused", func(t *testing.T) {
+		outside := t.TempDir()
+		gitT(t, outside, "init", "-q")
+		link := filepath.Join(localRoot, "escape")
+		if err := os.Symlink(outside, link); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []string{outside, link, localRoot, filepath.Join(localRoot, "..", filepath.Base(outside)), "relative/path"} {
+			rec := postFixBuild(t, payload("local-outside", "abc1234", dir))
+			if rec.Code != http.StatusForbidden {
+				t.Fatalf("%s: expected 403, got %d: %s", dir, rec.Code, rec.Body.String())
+			}
+		}
+
+		t.Setenv("FIX_BUILD_LOCAL_ROOT", "")
+		_, sha, dir := newLocal(t, "local-disabled")
+		if rec := postFixBuild(t, payload("local-disabled", sha, dir)); rec.Code != http.StatusForbidden {
+			t.Fatalf("expected 403 without FIX_BUILD_LOCAL_ROOT, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// logArchive is the gzipped full output of a job's commands, for post-mortems that need more
+// than the snippets in error responses. It's written alongside the job's event log, masked the
+// same way before compression, under a temporary name that's only renamed into place once the
+// job is over, so a download is never cut short. It expires with the event log.
+type logArchive struct {
+	f    *os.File
+	gz   *gzip.Writer
+	path string
+}
+
+// jobLogArchivePath maps a job id to its log archive.
+func jobLogArchivePath(cfg fixBuildConfig, id string) (string, error) {
+	path, err := jobLogPath(cfg, id)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(path, ".jsonl") + ".log.gz", nil
+}
+
+// openLogArchive starts the archive at path. A reverified job's output is added to what it
+// already has, as a second gzip member, which gunzip reads as one stream.
+func openLogArchive(path string) (*logArchive, error) {
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if prev, err := os.Open(path); err == nil {
+		_, err = io.Copy(f, prev)
+		prev.Close()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &logArchive{f: f, gz: gzip.NewWriter(f), path: path}, nil
+}
+
+// command appends a command's masked command line and output, with how it ended.
+func (a *logArchive) command(dir string, line, out []byte, took time.Duration, err error) {
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	fmt.Fprintf(a.gz, "$ %s\n  (in %s)\n", line, dir)
+	if len(out) > 0 {
+		a.gz.Write(out)
+		if out[len(out)-1] != '\n' {
+			a.gz.Write([]byte{'\n'})
+		}
+	}
+	fmt.Fprintf(a.gz, "[%s, %.2fs]\n\n", status, took.Seconds())
+}
+
+// phase marks the end of a phase, closing the section of the commands run in it.
+func (a *logArchive) phase(phase string, took time.Duration) {
+	fmt.Fprintf(a.gz, "=== %s finished in %.2fs ===\n\n", phase, took.Seconds())
+}
+
+// close finishes the archive and puts it in place.
+func (a *logArchive) close() {
+	err := a.gz.Close()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(a.path+".tmp", a.path)
+	}
+	if err != nil {
+		log.Printf("[fix_build] log archive: %v", err)
+		_ = os.Remove(a.path + ".tmp")
+	}
+}
+
+// FixBuildLogArchiveHandler handles GET /fix_build/logs/{jobId}, returning the finished job's
+// full command output as a gzip file.
+func FixBuildLogArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		http.Error(w, "invalid fix_build server config", http.StatusInternalServerError)
+		return
+	}
+	jobId := mux.Vars(r)["jobId"]
+	path, err := jobLogArchivePath(cfg, jobId)
+	if err != nil {
+		http.Error(w, "job logs not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if job, ok := fixBuildJobs.get(jobId); ok && job.Status == fixBuildJobRunning {
+			http.Error(w, "job is still running; its logs are available once it finishes", http.StatusConflict)
+			return
+		}
+		http.Error(w, "job logs not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	_, _ = io.Copy(w, f)
+}
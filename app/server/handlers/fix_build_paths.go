@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"path"
+	"strings"
+)
+
+// matchPathGlob matches a slash-separated repo path against a glob where "*" matches within
+// one segment and a "**" segment matches any number of segments.
+func matchPathGlob(pattern, name string) bool {
+	return matchGlobParts(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(name, "/"), "/"))
+}
+
+func matchGlobParts(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchGlobParts(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], parts[0]); err != nil || !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if matchPathGlob(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filesOutside returns the files that match none of globs.
+func filesOutside(globs, files []string) []string {
+	var outside []string
+	for _, f := range files {
+		if !matchAnyGlob(globs, f) {
+			outside = append(outside, f)
+		}
+	}
+	return outside
+}
+
+// allAnnotationsGenerated reports whether every annotated file is generated or vendored code,
+// which should be fixed by re-running the generator rather than by hand edits.
+func allAnnotationsGenerated(annos []FixBuildAnno, globs []string) bool {
+	if len(annos) == 0 || len(globs) == 0 {
+		return false
+	}
+	for _, a := range annos {
+		if !matchAnyGlob(globs, a.Path) {
+			return false
+		}
+	}
+	return true
+}
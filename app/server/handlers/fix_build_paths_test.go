@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestMatchPathGlob(t *testing.T) {
+	tcs := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"vendor/**", "vendor/github.com/pkg/errors/errors.go", true},
+		{"vendor/**", "internal/vendor/x.go", false},
+		{"**/*.pb.go", "api/v1/service.pb.go", true},
+		{"**/*.pb.go", "service.pb.go", true},
+		{"**/*.pb.go", "api/v1/service.go", false},
+		{"**/node_modules/**", "web/node_modules/react/index.js", true},
+		{"src/*.ts", "src/app.ts", true},
+		{"src/*.ts", "src/lib/app.ts", false},
+	}
+
+	for _, tc := range tcs {
+		if got := matchPathGlob(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("matchPathGlob(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAllAnnotationsGenerated(t *testing.T) {
+	globs := []string{"vendor/**", "**/*.pb.go"}
+
+	generated := []FixBuildAnno{{Path: "api/service.pb.go"}, {Path: "vendor/x/y.go"}}
+	if !allAnnotationsGenerated(generated, globs) {
+		t.Fatal("expected generated-only annotations to be detected")
+	}
+
+	mixed := append(generated, FixBuildAnno{Path: "server/handler.go"})
+	if allAnnotationsGenerated(mixed, globs) {
+		t.Fatal("a hand-written file should disable the regenerate path")
+	}
+
+	if allAnnotationsGenerated(nil, globs) {
+		t.Fatal("no annotations should not count as generated")
+	}
+}
+
+func TestFixBuildAllowedPaths(t *testing.T) {
+	t.Run("in scope", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{
+			"git diff --cached --name-only": {out: "pkg/widget_test.go\x00testdata/golden.json\x00"},
+		})
+		payload := fakeRunnerPayload("ddd0064")
+		payload.AllowedPaths = []string{"**/*_test.go", "testdata/**"}
+		if rec := postFixBuild(t, payload); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !f.called("git push origin main") {
+			t.Fatal("expected the fix to be pushed")
+		}
+	})
+
+	t.Run("out of scope", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{
+			"git diff --cached --name-only": {out: "pkg/widget.go\x00pkg/widget_test.go\x00go.mod\x00"},
+		})
+		payload := fakeRunnerPayload("ddd1064")
+		payload.AllowedPaths = []string{"**/*_test.go"}
+		rec := postFixBuild(t, payload)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var body FixBuildErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != "path_not_allowed" || len(body.Error.DisallowedPaths) != 2 || body.Error.DisallowedPaths[0] != "pkg/widget.go" || body.Error.DisallowedPaths[1] != "go.mod" {
+			t.Fatalf("expected the out-of-scope files to be reported, got %+v", body.Error)
+		}
+		if f.called("git commit") || f.called("git push") {
+			t.Fatal("expected an out-of-scope fix to be neither committed nor pushed")
+		}
+	})
+
+	t.Run("invalid glob", func(t *testing.T) {
+		useFakeRunner(t, nil)
+		payload := fakeRunnerPayload("ddd2064")
+		payload.AllowedPaths = []string{"pkg/[a-"}
+		if rec := postFixBuild(t, payload); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// plandexStateDirs are the project dirs the plandex CLI looks for (and creates) in its working
+// directory; .plandex-dev-v2 is used when PLANDEX_ENV=development.
+var plandexStateDirs = []string{".plandex-v2", ".plandex-dev-v2"}
+
+// plandexHomeDirs maps each project dir to the CLI's per-user home dir, under $HOME, that
+// tracks the current plan for projects using it.
+var plandexHomeDirs = map[string]string{".plandex-v2": ".plandex-home-v2", ".plandex-dev-v2": ".plandex-home-dev-v2"}
+
+// plandexConfigPaths are the repo-level plandex settings a repo may commit.
+var plandexConfigPaths = append([]string{".plandexignore"}, plandexStateDirs...)
+
+const (
+	autonomyConservative = "conservative"
+	autonomyStandard     = "standard"
+	autonomyAggressive   = "aggressive"
+)
+
+// autonomyArgs returns the extra plandex tell and build flags for an autonomy level ("" means
+// standard). Conservative runs plandex at its basic autonomy, so it neither loads context nor
+// applies or executes anything on its own and the verify commands gate the fix; standard leaves
+// plandex's defaults; aggressive gives it full autonomy, auto-applying and debugging failing
+// commands for up to 3 tries.
+func autonomyArgs(level string) (tell, build []string, ok bool) {
+	switch level {
+	case autonomyConservative:
+		return []string{"--basic"}, []string{"--basic"}, true
+	case "", autonomyStandard:
+		return nil, nil, true
+	case autonomyAggressive:
+		return []string{"--full", "--debug=3"}, []string{"--full"}, true
+	}
+	return nil, nil, false
+}
+
+// trackedPlandexConfig returns the plandex config paths committed in the checkout.
+func trackedPlandexConfig(ctx context.Context, workDir string) ([]string, error) {
+	args := append([]string{"ls-files", "--"}, plandexConfigPaths...)
+	out, err := runCmd(ctx, workDir, 10*time.Second, "git", args...)
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files: %w\n%s", err, out)
+	}
+	var tracked []string
+	seen := map[string]bool{}
+	for _, f := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if f == "" {
+			continue
+		}
+		top := strings.SplitN(f, "/", 2)[0]
+		if !seen[top] {
+			seen[top] = true
+			tracked = append(tracked, top)
+		}
+	}
+	return tracked, nil
+}
+
+// prepareRepoPlandexConfig readies the checkout for plandex. The state dirs plandex writes are
+// git-excluded so they're never committed, and with ignore set any committed config is moved
+// out of the checkout (into stashDir) so plandex runs with server defaults. It returns the
+// tracked config paths, which restoreRepoPlandexConfig puts back before committing.
+func prepareRepoPlandexConfig(ctx context.Context, workDir, stashDir string, ignore bool) ([]string, error) {
+	for _, dir := range plandexStateDirs {
+		if err := excludeFromGit(ctx, workDir, dir); err != nil {
+			return nil, err
+		}
+	}
+	tracked, err := trackedPlandexConfig(ctx, workDir)
+	if err != nil || !ignore {
+		return tracked, err
+	}
+	for _, p := range tracked {
+		if err := os.Rename(filepath.Join(workDir, p), filepath.Join(stashDir, p)); err != nil {
+			return tracked, err
+		}
+	}
+	return tracked, nil
+}
+
+// restoreRepoPlandexConfig resets committed plandex config to HEAD, undoing both a stash and any
+// state plandex wrote into it, so the fix commit never touches it.
+func restoreRepoPlandexConfig(ctx context.Context, workDir string, tracked []string) error {
+	if len(tracked) == 0 {
+		return nil
+	}
+	args := append([]string{"checkout", "HEAD", "--"}, tracked...)
+	if out, err := runCmd(ctx, workDir, 30*time.Second, "git", args...); err != nil {
+		return fmt.Errorf("git checkout plandex config: %w\n%s", err, out)
+	}
+	return nil
+}
+
+var plandexPlanIdRe = regexp.MustCompile(`(?i)\bplan(?:[ _]?id)?\s*[:=]\s*([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})\b`)
+
+// plandexPlanId returns the id of the plan plandex tell worked on, or "" if it can't be found.
+// It is taken from the command's output when printed there, and otherwise from the CLI's
+// current-plan state for the checkout's project.
+func plandexPlanId(workDir string, out []byte) string {
+	if m := plandexPlanIdRe.FindSubmatch(out); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	type idByAccount map[string]*struct {
+		Id string `json:"id"`
+	}
+	readIds := func(path string) idByAccount {
+		var ids idByAccount
+		if data, err := os.ReadFile(path); err == nil {
+			_ = json.Unmarshal(data, &ids)
+		}
+		return ids
+	}
+	for _, dir := range plandexStateDirs {
+		for account, project := range readIds(filepath.Join(workDir, dir, "projects-v2.json")) {
+			if project == nil || project.Id == "" || strings.ContainsAny(project.Id, `/\.`) {
+				continue
+			}
+			plans := readIds(filepath.Join(home, plandexHomeDirs[dir], project.Id, "current-plans-v2.json"))
+			if plan := plans[account]; plan != nil && plan.Id != "" {
+				return plan.Id
+			}
+		}
+	}
+	return ""
+}
+
+// fixSummaryLimit caps the plandex summary returned to callers and added to the commit body.
+const fixSummaryLimit = 4 << 10
+
+// plandexSummary returns plandex's plain-text summary of the current plan, or "" if there is none.
+// It's informational, so failures are only logged.
+func plandexSummary(ctx context.Context, bin, workDir string) string {
+	out, err := runCmd(ctx, workDir, time.Minute, bin, "summary", "--plain")
+	if err != nil {
+		log.Printf("[fix_build] plandex summary: %v\n%s", err, out)
+		return ""
+	}
+	summary := strings.TrimSpace(string(out))
+	if strings.Contains(summary, "No summary available") {
+		return ""
+	}
+	return truncateMiddle(summary, fixSummaryLimit)
+}
+
+var versionRe = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// parseVersion returns the numeric components of the first dotted version in s, e.g. [2 1 6]
+// for "plandex 2.1.6+build".
+func parseVersion(s string) ([]int, error) {
+	m := versionRe.FindString(s)
+	if m == "" {
+		return nil, fmt.Errorf("no version number in %q", s)
+	}
+	var v []int
+	for _, part := range strings.Split(m, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q: %w", m, err)
+		}
+		v = append(v, n)
+	}
+	return v, nil
+}
+
+// compareVersions compares versions component by component, with missing components as 0.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkPlandexVersion fails if the plandex CLI at bin reports a version older than min, so an
+// incompatible CLI is never used silently.
+func checkPlandexVersion(ctx context.Context, bin, min string) error {
+	want, err := parseVersion(min)
+	if err != nil {
+		return err
+	}
+	out, err := runCmd(ctx, "", 10*time.Second, bin, "version")
+	if err != nil {
+		return fmt.Errorf("%s version failed: %w\n%s", bin, err, out)
+	}
+	got, err := parseVersion(string(out))
+	if err != nil {
+		return fmt.Errorf("%s version: %w", bin, err)
+	}
+	if compareVersions(got, want) < 0 {
+		return fmt.Errorf("plandex CLI %s is version %s, older than the required %s (FIX_BUILD_PLANDEX_MIN_VERSION)", bin, versionRe.FindString(string(out)), min)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// addPlandexConfig commits a repo-level plandex config to the bare repo's default branch.
+func addPlandexConfig(t *testing.T, bare string) string {
+	t.Helper()
+	work := t.TempDir()
+	gitT(t, work, "clone", "-q", bare, ".")
+	if err := os.MkdirAll(filepath.Join(work, ".plandex-v2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, ".plandex-v2", "settings.json"), []byte(`{"modelPack":"repo-pack"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitT(t, work, "add", "-A")
+	gitT(t, work, "commit", "-q", "-m", "add plandex config")
+	gitT(t, work, "push", "-q", "origin", "HEAD")
+	return gitT(t, work, "rev-parse", "HEAD")
+}
+
+func TestFixBuildRepoPlandexConfig(t *testing.T) {
+	root := fakeGithub(t)
+	t.Setenv("FIX_BUILD_DEFAULT_MODEL_PACK", "server-pack")
+
+	// plandex logs what config it sees, then scribbles on its state dir like the real CLI does
+	logFile := filepath.Join(t.TempDir(), "plandex.log")
+	fakePlandex(t, `case "$1" in
+set-model) echo "set-model $2" >> "`+logFile+`" ;;
+tell)
+  if [ -f .plandex-v2/settings.json ]; then echo "tell saw $(cat .plandex-v2/settings.json)" >> "`+logFile+`"; else echo "tell saw none" >> "`+logFile+`"; fi
+  echo '{"modelPack":"changed"}' > .plandex-v2/settings.json 2>/dev/null || mkdir -p .plandex-v2
+  echo state > .plandex-v2/plan.json
+  echo fixed > fix.txt
+  ;;
+esac
+exit 0
+`)
+
+	for _, tc := range []struct {
+		name   string
+		ignore bool
+		want   string
+	}{
+		{"respected", false, `tell saw {"modelPack":"repo-pack"}`},
+		{"ignored", true, "set-model server-pack\ntell saw none"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Remove(logFile)
+			repoName := "configured-" + tc.name
+			bare, _ := addFakeGithubRepo(t, root, "acme", repoName)
+			sha := addPlandexConfig(t, bare)
+
+			rec := postFixBuild(t, FixBuildPayload{
+				Repo:              FixBuildRepo{Owner: "acme", Name: repoName},
+				HeadBranch:        "main",
+				HeadSha:           sha,
+				OutputSummary:     "FAIL",
+				InstallationToken: "tok",
+				IgnoreRepoConfig:  tc.ignore,
+			})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			log, _ := os.ReadFile(logFile)
+			if got := strings.TrimSpace(string(log)); got != tc.want {
+				t.Fatalf("unexpected plandex calls:\nwant %q\ngot  %q", tc.want, got)
+			}
+			// The fix commit leaves the committed config alone and doesn't pick up plandex's state
+			if changed := gitT(t, bare, "diff", "--name-only", sha, "main"); changed != "fix.txt" {
+				t.Fatalf("expected only fix.txt in the fix commit, got %q", changed)
+			}
+		})
+	}
+}
+
+func TestPlandexPlanId(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	const planId = "5b0c2f3e-8d1a-4c6b-9e7f-0a1b2c3d4e5f"
+
+	t.Run("from output", func(t *testing.T) {
+		out := "⚡️ Started new plan fix-build\nPlan ID: " + strings.ToUpper(planId) + "\n🏗️ Building...\n"
+		if got := plandexPlanId(t.TempDir(), []byte(out)); got != planId {
+			t.Fatalf("want %q, got %q", planId, got)
+		}
+	})
+
+	t.Run("from current plan state", func(t *testing.T) {
+		workDir := t.TempDir()
+		write := func(path, content string) {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write(filepath.Join(workDir, ".plandex-v2", "projects-v2.json"), `{"user-1":{"id":"project-1"}}`)
+		write(filepath.Join(home, ".plandex-home-v2", "project-1", "current-plans-v2.json"), `{"user-1":{"id":"`+planId+`"}}`)
+
+		out := "⚡️ Started new plan fix-build and set it to current plan\n"
+		if got := plandexPlanId(workDir, []byte(out)); got != planId {
+			t.Fatalf("want %q, got %q", planId, got)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if got := plandexPlanId(t.TempDir(), []byte("plan: not-a-uuid\n")); got != "" {
+			t.Fatalf("expected no plan id, got %q", got)
+		}
+	})
+
+	t.Run("returned in the response", func(t *testing.T) {
+		useFakeRunner(t, map[string]fakeResponse{"plandex tell": {out: "Plan ID: " + planId + "\n"}})
+		rec := postFixBuild(t, fakeRunnerPayload("aaa0047"))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"planId":"`+planId+`"`) {
+			t.Fatalf("expected the plan id in the response, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestFixBuildSummary(t *testing.T) {
+	t.Run("added to the response and commit body", func(t *testing.T) {
+		summary := "Guarded the nil config in widget.Load, which the new test exercises."
+		f := useFakeRunner(t, map[string]fakeResponse{"plandex summary": {out: "\n" + summary + "\n"}})
+		rec := postFixBuild(t, fakeRunnerPayload("aaa0050"))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"fixSummary":"`+summary+`"`) {
+			t.Fatalf("expected the summary in the response, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !f.called("git commit -m fix: resolve failing test from CI\n\n" + summary) {
+			t.Fatalf("expected the summary in the commit body; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("none available", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{"plandex summary": {out: "🤷‍♂️ No summary available\n\n"}})
+		rec := postFixBuild(t, fakeRunnerPayload("bbb0050"))
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "fixSummary") {
+			t.Fatalf("expected no summary, got %d: %s", rec.Code, rec.Body.String())
+		}
+		for _, c := range f.calls {
+			if strings.HasPrefix(c, "git commit") && strings.Contains(c, "\n") {
+				t.Fatalf("expected a one-line commit message, got %q", c)
+			}
+		}
+	})
+}
+
+func TestFixBuildPlandexBin(t *testing.T) {
+	bin := "/opt/plandex-2/bin/plandex"
+	t.Setenv("FIX_BUILD_PLANDEX_BIN", bin)
+	f := useFakeRunner(t, nil)
+	if rec := postFixBuild(t, fakeRunnerPayload("bbb0074")); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !f.called(bin+" tell") || !f.called(bin+" build") {
+		t.Fatalf("expected plandex to run from %s; calls were:\n%s", bin, strings.Join(f.calls, "\n"))
+	}
+	if f.called("plandex ") {
+		t.Fatal("expected no plandex from PATH")
+	}
+}
+
+func TestFixBuildPlandexMinVersion(t *testing.T) {
+	t.Setenv("FIX_BUILD_PLANDEX_MIN_VERSION", "2.1")
+	tests := []struct {
+		sha, version string
+		ok           bool
+	}{
+		{"ccc0074", "2.1.6", true},
+		{"ccc1074", "Plandex CLI version 2.10.0", true},
+		{"ccc2074", "2.0.9", false},
+		{"ccc3074", "1.9.3", false},
+	}
+	for _, tt := range tests {
+		f := useFakeRunner(t, map[string]fakeResponse{"plandex version": {out: tt.version + "\n"}})
+		rec := postFixBuild(t, fakeRunnerPayload(tt.sha))
+		if tt.ok {
+			if rec.Code != http.StatusOK {
+				t.Fatalf("version %s: expected 200, got %d: %s", tt.version, rec.Code, rec.Body.String())
+			}
+			continue
+		}
+		if rec.Code != http.StatusNotImplemented || !strings.Contains(rec.Body.String(), `"code":"plandex_version_unsupported"`) {
+			t.Fatalf("version %s: expected 501 plandex_version_unsupported, got %d: %s", tt.version, rec.Code, rec.Body.String())
+		}
+		if f.called("git clone") {
+			t.Fatalf("version %s: expected the job to be refused before cloning", tt.version)
+		}
+	}
+
+	t.Setenv("FIX_BUILD_PLANDEX_MIN_VERSION", "latest")
+	if _, err := loadFixBuildConfig(); err == nil {
+		t.Fatal("expected an unparseable minimum version to be rejected")
+	}
+}
+
+func TestFixBuildAutonomy(t *testing.T) {
+	tests := []struct {
+		autonomy string
+		sha      string
+		tell     string
+		build    string
+	}{
+		{"", "ccc0096", "--skip-menu", "plandex build --skip-menu"},
+		{"conservative", "ccc1096", "--skip-menu --basic", "plandex build --skip-menu --basic"},
+		{"standard", "ccc2096", "--skip-menu", "plandex build --skip-menu"},
+		{"aggressive", "ccc3096", "--skip-menu --full --debug=3", "plandex build --skip-menu --full"},
+	}
+	for _, tt := range tests {
+		f := useFakeRunner(t, nil)
+		p := fakeRunnerPayload(tt.sha)
+		p.Autonomy = tt.autonomy
+		if rec := postFixBuild(t, p); rec.Code != http.StatusOK {
+			t.Fatalf("%q: expected 200, got %d: %s", tt.autonomy, rec.Code, rec.Body.String())
+		}
+		i := slices.IndexFunc(f.calls, func(c string) bool { return strings.HasPrefix(c, "plandex tell ") })
+		if i < 0 || !strings.HasSuffix(f.calls[i], " "+tt.tell) || !slices.Contains(f.calls, tt.build) {
+			t.Fatalf("%q: expected tell ending %q and %q; calls were:\n%s", tt.autonomy, tt.tell, tt.build, strings.Join(f.calls, "\n"))
+		}
+	}
+
+	useFakeRunner(t, nil)
+	p := fakeRunnerPayload("ccc4096")
+	p.Autonomy = "yolo"
+	if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown autonomy, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
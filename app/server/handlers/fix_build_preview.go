@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// FixBuildPreview is what a fix for a payload would start from, without running it.
+type FixBuildPreview struct {
+	// Context is the BUILD_FAILURE_CONTEXT.md plandex would be given. Sections that need a
+	// checkout (the repo tree and a baseSha's changed files) are left out.
+	Context string `json:"context"`
+	// Prompt is the rendered prompt for plandex tell.
+	Prompt string `json:"prompt"`
+	// Annotations are the payload's annotations after normalization.
+	Annotations []FixBuildAnno `json:"annotations"`
+}
+
+// FixBuildPreviewHandler handles POST /fix_build/preview: it takes a /fix_build payload and
+// returns the context file and prompt a fix would use, doing no git or plandex work.
+func FixBuildPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	payload, cfg, ok := decodeFixBuildRequest(w, r)
+	if !ok {
+		return
+	}
+	prompt, err := renderFixPrompt(cfg, payload)
+	if err != nil {
+		log.Printf("[fix_build] render prompt: %v", err)
+		writeFixBuildError(w, newFixBuildError(http.StatusInternalServerError, "prompt_failed", "failed to render prompt: %v", err).inPhase("prompt"))
+		return
+	}
+	annos := payload.Annotations
+	if annos == nil {
+		annos = []FixBuildAnno{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(FixBuildPreview{
+		Context:     buildContextContent(payload, newContextOptions(cfg)),
+		Prompt:      prompt,
+		Annotations: annos,
+	})
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func postFixBuildPreview(t *testing.T, payload FixBuildPayload) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/fix_build/preview", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	FixBuildPreviewHandler(rec, req)
+	return rec
+}
+
+func TestFixBuildPreviewMatchesRun(t *testing.T) {
+	root := fakeGithub(t)
+	_, sha := addFakeGithubRepo(t, root, "acme", "preview")
+	captured := filepath.Join(t.TempDir(), "context.md")
+	t.Setenv("FAKE_PLANDEX_CONTEXT", captured)
+	fakePlandex(t, `[ "$1" = "tell" ] && cp `+contextFileName+` "$FAKE_PLANDEX_CONTEXT" && echo fixed > file.txt
+exit 0
+`)
+	// Small limits so both section and total truncation kick in
+	t.Setenv("FIX_BUILD_CONTEXT_MAX_SECTION_BYTES", "300")
+	t.Setenv("FIX_BUILD_CONTEXT_MAX_BYTES", "900")
+
+	long := strings.Repeat("undefined: frobnicate ", 40)
+	payload := FixBuildPayload{
+		Repo:              FixBuildRepo{Owner: "acme", Name: "preview"},
+		HeadBranch:        "main",
+		HeadSha:           sha,
+		InstallationToken: "tok",
+		Annotations: []FixBuildAnno{
+			{Path: "a.go", StartLine: 9, EndLine: 3, AnnotationLevel: "FAILURE", Message: long},
+			{Path: "b.go", StartLine: 1, EndLine: 1, AnnotationLevel: "Warning", Message: long},
+			{Path: "c.go", StartLine: 2, EndLine: 2, AnnotationLevel: "failure", Message: long},
+		},
+	}
+
+	rec := postFixBuildPreview(t, payload)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var preview FixBuildPreview
+	if err := json.Unmarshal(rec.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(captured); err == nil {
+		t.Fatal("expected the preview to run no plandex commands")
+	}
+	if preview.Prompt == "" {
+		t.Fatal("expected the rendered prompt")
+	}
+	if len(preview.Annotations) != 3 {
+		t.Fatalf("expected 3 annotations, got %+v", preview.Annotations)
+	}
+	if a := preview.Annotations[0]; a.AnnotationLevel != "failure" || a.StartLine != 3 || a.EndLine != 9 {
+		t.Fatalf("expected the annotation to be normalized, got %+v", a)
+	}
+	if !strings.Contains(preview.Context, "truncated") {
+		t.Fatalf("expected the context to be truncated:\n%s", preview.Context)
+	}
+
+	if rec := postFixBuild(t, payload); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from the run, got %d: %s", rec.Code, rec.Body.String())
+	}
+	written, err := os.ReadFile(captured)
+	if err != nil {
+		t.Fatalf("expected plandex tell to run: %v", err)
+	}
+	if string(written) != preview.Context {
+		t.Fatalf("preview differs from the context file the run wrote\npreview:\n%s\nrun:\n%s", preview.Context, written)
+	}
+}
+
+func TestFixBuildPreviewRejectsInvalidPayload(t *testing.T) {
+	rec := postFixBuildPreview(t, FixBuildPayload{Repo: FixBuildRepo{Owner: "acme"}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
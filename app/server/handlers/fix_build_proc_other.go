@@ -0,0 +1,12 @@
+//go:build !unix
+
+package handlers
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills cmd itself where process groups aren't available.
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
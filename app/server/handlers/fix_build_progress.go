@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// prProgress keeps a single comment on the pull request a fix is for up to date with the job's
+// phase, so reviewers watching it see more than silence until the fix lands. It's best-effort:
+// a failed API call is logged and ends the updates, never the fix.
+type prProgress struct {
+	mu          sync.Mutex
+	gh          *githubClient
+	token       string
+	repo        FixBuildRepo
+	headBranch  string
+	headSha     string
+	checkRunUrl string
+	pr          int
+	commentId   int64
+	status      string
+	done        bool
+}
+
+// newPrProgress returns the progress comment for payload, or nil when it has no check run to
+// link back to or no GitHub token to comment with. The pull request is payload's prNumber, or
+// looked up from headSha on the first update.
+func newPrProgress(payload FixBuildPayload, cfg fixBuildConfig) *prProgress {
+	if payload.CheckRunUrl == "" || payload.InstallationToken == "" || providerName(payload) != "github" {
+		return nil
+	}
+	return &prProgress{
+		gh:          newGithubClient(cfg, payload.InstallationToken),
+		token:       payload.InstallationToken,
+		repo:        payload.Repo,
+		headBranch:  payload.HeadBranch,
+		headSha:     payload.HeadSha,
+		checkRunUrl: payload.CheckRunUrl,
+		pr:          payload.PrNumber,
+	}
+}
+
+type prProgressKey struct{}
+
+func withPrProgress(ctx context.Context, p *prProgress) context.Context {
+	return context.WithValue(ctx, prProgressKey{}, p)
+}
+
+// prProgressFrom returns the progress comment for the job ctx belongs to, or nil.
+func prProgressFrom(ctx context.Context) *prProgress {
+	p, _ := ctx.Value(prProgressKey{}).(*prProgress)
+	return p
+}
+
+// update sets the comment's status, creating the comment the first time.
+func (p *prProgress) update(status string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(status)
+}
+
+// finish sets the comment's final status from the job's outcome. A job that ends before its
+// first update, e.g. one skipped up front, doesn't get a comment.
+func (p *prProgress) finish(res *FixBuildResponse, fbErr *fixBuildError) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.commentId == 0 {
+		return
+	}
+	switch {
+	case fbErr != nil:
+		p.set(fmt.Sprintf("Couldn't fix the build: %s", fbErr.Message))
+	case res.Skipped:
+		p.set(fmt.Sprintf("Skipped: %s", res.SkipReason))
+	case res.PullRequestUrl != "":
+		p.set(fmt.Sprintf("Opened fix `%s` as %s", shortSha(res.CommitSha), res.PullRequestUrl))
+	case res.Patch != "":
+		p.set("Returned the fix as a patch")
+	case res.CommitSha == "":
+		p.set("Finished without changes")
+	default:
+		p.set(fmt.Sprintf("Pushed fix `%s`", shortSha(res.CommitSha)))
+	}
+}
+
+func (p *prProgress) set(status string) {
+	if p.done || status == p.status {
+		return
+	}
+	if err := p.post(status); err != nil {
+		log.Printf("[fix_build] progress comment: %v", redactToken(err, p.token))
+		p.done = true
+		return
+	}
+	p.status = status
+}
+
+func (p *prProgress) post(status string) error {
+	if p.pr == 0 {
+		pr, err := p.gh.pullRequestFor(p.repo, p.headBranch, p.headSha)
+		if err != nil {
+			return err
+		}
+		if pr == 0 {
+			return fmt.Errorf("no open pull request for %s at %s", p.headBranch, shortSha(p.headSha))
+		}
+		p.pr = pr
+	}
+	body := fmt.Sprintf("**Plandex build fix** for [the failing check](%s) at `%s`\n\n%s", p.checkRunUrl, shortSha(p.headSha), status)
+	body = string(redactOutput([]byte(body), p.token))
+	if p.commentId == 0 {
+		id, err := p.gh.createIssueComment(p.repo, p.pr, body)
+		p.commentId = id
+		return err
+	}
+	return p.gh.editIssueComment(p.repo, p.commentId, body)
+}
+
+// shortSha abbreviates a commit SHA for display.
+func shortSha(sha string) string {
+	return sha[:min(7, len(sha))]
+}
+
+// pullRequestFor returns the number of the open pull request from branch that contains sha,
+// or 0 if there isn't one.
+func (c *githubClient) pullRequestFor(repo FixBuildRepo, branch, sha string) (int, error) {
+	var prs []struct {
+		Number int    `json:"number"`
+		State  string `json:"state"`
+		Head   struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+	}
+	status, err := c.do(http.MethodGet, githubRepoPath(repo)+"/commits/"+sha+"/pulls", nil, &prs)
+	if err != nil {
+		return 0, err
+	}
+	if status != http.StatusOK {
+		return 0, fmt.Errorf("list pull requests for %s: GitHub returned %d", shortSha(sha), status)
+	}
+	for _, pr := range prs {
+		if pr.State == "open" && pr.Head.Ref == branch {
+			return pr.Number, nil
+		}
+	}
+	return 0, nil
+}
+
+// createIssueComment comments on pull request (or issue) number, returning the comment's id.
+func (c *githubClient) createIssueComment(repo FixBuildRepo, number int, body string) (int64, error) {
+	var comment struct {
+		Id int64 `json:"id"`
+	}
+	status, err := c.do(http.MethodPost, githubRepoPath(repo)+"/issues/"+strconv.Itoa(number)+"/comments", map[string]string{"body": body}, &comment)
+	if err != nil {
+		return 0, err
+	}
+	if status != http.StatusCreated || comment.Id == 0 {
+		return 0, fmt.Errorf("create comment on #%d: GitHub returned %d", number, status)
+	}
+	return comment.Id, nil
+}
+
+// editIssueComment replaces comment id's body.
+func (c *githubClient) editIssueComment(repo FixBuildRepo, id int64, body string) error {
+	status, err := c.do(http.MethodPatch, githubRepoPath(repo)+"/issues/comments/"+strconv.FormatInt(id, 10), map[string]string{"body": body}, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("edit comment %d: GitHub returned %d", id, status)
+	}
+	return nil
+}
+
+// attemptStatus is the progress status for plandex's attempt n of maxAttempts.
+func attemptStatus(n, maxAttempts int) string {
+	if maxAttempts <= 1 {
+		return "Generating fix…"
+	}
+	return fmt.Sprintf("Generating fix (attempt %d of %d)…", n, maxAttempts)
+}
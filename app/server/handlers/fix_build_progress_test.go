@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCommentApi serves GitHub's issue comment endpoints for acme/widgets, recording each
+// version of the comment's body.
+type fakeCommentApi struct {
+	mu      sync.Mutex
+	creates int
+	bodies  []string
+	// pulls answers the commits/{sha}/pulls lookup.
+	pulls string
+}
+
+func useCommentApi(t *testing.T) *fakeCommentApi {
+	t.Helper()
+	api := &fakeCommentApi{pulls: "[]"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		var req struct {
+			Body string `json:"body"`
+		}
+		switch {
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/repos/acme/widgets/commits/"):
+			w.Write([]byte(api.pulls))
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/acme/widgets/issues/12/comments":
+			json.NewDecoder(r.Body).Decode(&req)
+			api.creates++
+			api.bodies = append(api.bodies, req.Body)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":99}`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/repos/acme/widgets/issues/comments/99":
+			json.NewDecoder(r.Body).Decode(&req)
+			api.bodies = append(api.bodies, req.Body)
+			w.Write([]byte(`{"id":99}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("FIX_BUILD_GITHUB_API_URL", srv.URL)
+	return api
+}
+
+// statuses is the status under the heading of each version of the comment.
+func (api *fakeCommentApi) statuses() []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	var statuses []string
+	for _, b := range api.bodies {
+		_, status, _ := strings.Cut(b, "\n\n")
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func progressPayload(sha string) FixBuildPayload {
+	p := fakeRunnerPayload(sha)
+	p.CheckRunUrl = "https://github.com/acme/widgets/runs/1"
+	p.VerifyCommand = "go test ./..."
+	return p
+}
+
+func TestFixBuildProgressComment(t *testing.T) {
+	t.Run("edited per phase", func(t *testing.T) {
+		api := useCommentApi(t)
+		useFakeRunner(t, nil)
+		p := progressPayload("ccc0093")
+		p.PrNumber = 12
+		if rec := postFixBuild(t, p); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if api.creates != 1 {
+			t.Fatalf("expected the comment created once, got %d", api.creates)
+		}
+		want := []string{"Cloning…", "Generating fix…", "Verifying…", "Pushed fix `f1xed00`"}
+		if got := api.statuses(); !slices.Equal(got, want) {
+			t.Fatalf("expected statuses %q, got %q", want, got)
+		}
+		if body := api.bodies[0]; !strings.Contains(body, "(https://github.com/acme/widgets/runs/1)") || !strings.Contains(body, "`ccc0093`") {
+			t.Fatalf("expected the comment to link the check run and sha, got %q", body)
+		}
+	})
+
+	t.Run("derived pull request", func(t *testing.T) {
+		api := useCommentApi(t)
+		api.pulls = `[{"number":3,"state":"closed","head":{"ref":"main"}},{"number":12,"state":"open","head":{"ref":"main"}}]`
+		useFakeRunner(t, map[string]fakeResponse{
+			"sh -c go test ./...": {out: "--- FAIL: TestWidget", err: &fakeExitError{code: 1}},
+		})
+		rec := postFixBuild(t, progressPayload("ccc1093"))
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422, got %d: %s", rec.Code, rec.Body.String())
+		}
+		statuses := api.statuses()
+		if api.creates != 1 || !strings.HasPrefix(statuses[len(statuses)-1], "Couldn't fix the build: ") {
+			t.Fatalf("expected one comment ending with the failure, got %d: %q", api.creates, statuses)
+		}
+	})
+
+	t.Run("best-effort", func(t *testing.T) {
+		api := useCommentApi(t)
+		f := useFakeRunner(t, nil)
+		rec := postFixBuild(t, progressPayload("ccc2093"))
+		if rec.Code != http.StatusOK || !f.called("git push") {
+			t.Fatalf("expected the fix pushed without a pull request to comment on, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if api.creates != 0 {
+			t.Fatalf("expected no comment, got %d", api.creates)
+		}
+	})
+}
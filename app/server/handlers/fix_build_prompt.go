@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const defaultFixPrompt = "Fix the failing test(s) or build. Read BUILD_FAILURE_CONTEXT.md for the failure output and annotations. Apply minimal changes, then run the failing test or build command to verify it passes. Do not create a new branch or open a PR."
+
+// testFixPrompt is the default prompt for a payload scoped to one failing test by testName.
+const testFixPrompt = "Fix the failing test `%s`. Read BUILD_FAILURE_CONTEXT.md for the failure output and annotations. Apply minimal changes to make that test pass, then run it to verify. Do not create a new branch or open a PR."
+
+// retryFixPrompt follows up in the same plan when a fix didn't pass verification; the new
+// failure output has been added to the context file.
+const retryFixPrompt = "The fix didn't pass verification. Read the latest failure output at the end of BUILD_FAILURE_CONTEXT.md and keep fixing. Apply minimal changes. Do not create a new branch or open a PR."
+
+// promptSummaryLimit caps the output summary substituted into a prompt, since the prompt is
+// passed to plandex on the command line. The full summary is in the context file.
+const promptSummaryLimit = 4 << 10
+
+// promptData is what prompt templates can reference, e.g. {{.Repo}} or {{.FailingFiles}}.
+type promptData struct {
+	Repo          string
+	HeadBranch    string
+	HeadSha       string
+	FailingFiles  string
+	OutputSummary string
+	ContextFile   string
+	// TestName is the payload's testName, or "" when the fix isn't scoped to one test.
+	TestName string
+}
+
+func newPromptData(p FixBuildPayload) promptData {
+	var files []string
+	seen := map[string]bool{}
+	for _, a := range p.Annotations {
+		path := filepath.ToSlash(a.Path)
+		if path != "" && !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	return promptData{
+		Repo:          p.Repo.Owner + "/" + p.Repo.Name,
+		HeadBranch:    p.HeadBranch,
+		HeadSha:       p.HeadSha,
+		FailingFiles:  strings.Join(files, ", "),
+		OutputSummary: truncateMiddle(p.OutputSummary, promptSummaryLimit),
+		ContextFile:   contextFileName,
+		TestName:      p.TestName,
+	}
+}
+
+// parsePromptTemplate parses a prompt template and renders it against sample data, so
+// references to unknown fields are caught up front rather than on a fix.
+func parsePromptTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	sample := newPromptData(FixBuildPayload{
+		Repo:          FixBuildRepo{Owner: "owner", Name: "repo"},
+		HeadBranch:    "main",
+		HeadSha:       "0000000",
+		OutputSummary: "summary",
+		Annotations:   []FixBuildAnno{{Path: "main.go"}},
+		TestName:      "TestSample",
+	})
+	if err := tmpl.Execute(&strings.Builder{}, sample); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// renderFixPrompt renders the payload's prompt template, else the server's, else the default prompt.
+func renderFixPrompt(cfg fixBuildConfig, p FixBuildPayload) (string, error) {
+	tmpl := cfg.PromptTemplate
+	if p.PromptTemplate != "" {
+		var err error
+		if tmpl, err = parsePromptTemplate("promptTemplate", p.PromptTemplate); err != nil {
+			return "", err
+		}
+	}
+	if tmpl == nil {
+		if p.TestName != "" {
+			return fmt.Sprintf(testFixPrompt, p.TestName), nil
+		}
+		return defaultFixPrompt, nil
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, newPromptData(p)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
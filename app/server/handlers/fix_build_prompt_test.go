@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRenderFixPrompt(t *testing.T) {
+	payload := FixBuildPayload{
+		Repo:          FixBuildRepo{Owner: "acme", Name: "widgets"},
+		HeadBranch:    "main",
+		HeadSha:       "abc1234",
+		OutputSummary: "2 tests failed",
+		Annotations: []FixBuildAnno{
+			{Path: "pkg/a.go", AnnotationLevel: "failure"},
+			{Path: "pkg/b.go", AnnotationLevel: "failure"},
+			{Path: "pkg/a.go", AnnotationLevel: "warning"},
+		},
+	}
+
+	if got, err := renderFixPrompt(fixBuildConfig{}, payload); err != nil || got != defaultFixPrompt {
+		t.Fatalf("expected the default prompt without a template, got %q (%v)", got, err)
+	}
+
+	t.Setenv("FIX_BUILD_PROMPT_TEMPLATE", "Corrige {{.Repo}}: {{.FailingFiles}} ({{.OutputSummary}}). Voir {{.ContextFile}}.")
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		t.Fatalf("loadFixBuildConfig: %v", err)
+	}
+	got, err := renderFixPrompt(cfg, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Corrige acme/widgets: pkg/a.go, pkg/b.go (2 tests failed). Voir BUILD_FAILURE_CONTEXT.md."; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+
+	// The payload's template wins over the server's
+	payload.PromptTemplate = "Fix {{.HeadBranch}}@{{.HeadSha}}"
+	if got, err := renderFixPrompt(cfg, payload); err != nil || got != "Fix main@abc1234" {
+		t.Fatalf("expected the payload template, got %q (%v)", got, err)
+	}
+}
+
+func TestBadPromptTemplatesRejected(t *testing.T) {
+	for _, tmpl := range []string{"Fix {{.Repo", "Fix {{.Nope}}", "{{template \"missing\"}}"} {
+		t.Setenv("FIX_BUILD_PROMPT_TEMPLATE", tmpl)
+		if err := ValidateFixBuildConfig(); err == nil || !strings.Contains(err.Error(), "FIX_BUILD_PROMPT_TEMPLATE") {
+			t.Fatalf("%q: expected a FIX_BUILD_PROMPT_TEMPLATE error, got %v", tmpl, err)
+		}
+
+		p := FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: "widgets"}, HeadBranch: "main", HeadSha: "abc1234", InstallationToken: "tok", PromptTemplate: tmpl}
+		if fbErr := validateFixBuildPayload(p, fixBuildConfig{}); fbErr == nil || fbErr.Status != http.StatusBadRequest {
+			t.Fatalf("%q: expected 400 for the payload template, got %v", tmpl, fbErr)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// gitProvider describes how to reach repos on a hosting provider.
+type gitProvider struct {
+	Host string
+	// TokenUser is the username that goes with an access token in an HTTPS clone URL.
+	TokenUser string
+}
+
+const defaultGitProvider = "github"
+
+var gitProviders = map[string]gitProvider{
+	"github":    {Host: "github.com", TokenUser: "x-access-token"},
+	"gitlab":    {Host: "gitlab.com", TokenUser: "oauth2"},
+	"bitbucket": {Host: "bitbucket.org", TokenUser: "x-token-auth"},
+}
+
+// providerName returns the payload's provider, defaulting to GitHub.
+func providerName(p FixBuildPayload) string {
+	if p.Provider == "" {
+		return defaultGitProvider
+	}
+	return p.Provider
+}
+
+// providerFor looks up the payload's provider; ok is false for an unknown one.
+func providerFor(p FixBuildPayload) (gitProvider, bool) {
+	g, ok := gitProviders[providerName(p)]
+	return g, ok
+}
+
+// tokenBaseUrl is the HTTPS URL prefix that authenticates with token, e.g.
+// https://oauth2:<token>@gitlab.com/. The token is escaped, so refresh tokens and PATs with
+// characters like / + = still authenticate.
+func (g gitProvider) tokenBaseUrl(token string) string {
+	u := url.URL{Scheme: "https", User: url.UserPassword(g.TokenUser, token), Host: g.Host, Path: "/"}
+	return u.String()
+}
+
+func (g gitProvider) httpsUrl(token string, repo FixBuildRepo) string {
+	owner, name := url.PathEscape(repo.Owner), url.PathEscape(repo.Name)
+	u := url.URL{
+		Scheme:  "https",
+		User:    url.UserPassword(g.TokenUser, token),
+		Host:    g.Host,
+		Path:    "/" + repo.Owner + "/" + repo.Name + ".git",
+		RawPath: "/" + owner + "/" + name + ".git",
+	}
+	return u.String()
+}
+
+// tokenForms are the ways token can show up in command output: as is, and escaped the way it is
+// in a clone URL.
+func tokenForms(token string) []string {
+	escaped := strings.TrimPrefix(url.UserPassword("", token).String(), ":")
+	if escaped == token {
+		return []string{token}
+	}
+	return []string{token, escaped}
+}
+
+func (g gitProvider) sshUrl(repo FixBuildRepo) string {
+	return fmt.Sprintf("git@%s:%s/%s.git", g.Host, repo.Owner, repo.Name)
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit is a token bucket refilling PerHour tokens an hour up to Burst. A zero PerHour
+// means unlimited.
+type rateLimit struct {
+	PerHour int
+	Burst   int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill tops the bucket up for the time since it was last used. New buckets start full.
+func (b *tokenBucket) refill(limit rateLimit, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else {
+		b.tokens += now.Sub(b.last).Hours() * float64(limit.PerHour)
+	}
+	b.tokens = math.Min(b.tokens, float64(limit.Burst))
+	b.last = now
+}
+
+// wait is how long until the bucket has a whole token.
+func (b *tokenBucket) wait(limit rateLimit) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / float64(limit.PerHour) * float64(time.Hour))
+}
+
+// fixBuildRateLimiter throttles fixes per repo and across the server, so a CI config that
+// calls /fix_build on every push can't queue up a stream of expensive runs. Limits are
+// passed on each call so they follow the current config.
+type fixBuildRateLimiter struct {
+	mu         sync.Mutex
+	repos      map[string]*tokenBucket
+	global     tokenBucket
+	lastPruned time.Time
+	now        func() time.Time
+}
+
+func newFixBuildRateLimiter() *fixBuildRateLimiter {
+	return &fixBuildRateLimiter{repos: map[string]*tokenBucket{}, now: time.Now}
+}
+
+var fixBuildRates = newFixBuildRateLimiter()
+
+// allow takes a token from repo's bucket and the global one if both have one. Otherwise
+// nothing is taken and it returns how long to wait before retrying.
+func (l *fixBuildRateLimiter) allow(repo FixBuildRepo, perRepo, global rateLimit) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.maybePruneLocked(perRepo, now)
+
+	var wait time.Duration
+	var repoBucket *tokenBucket
+	if perRepo.PerHour > 0 {
+		key := strings.ToLower(repo.Owner + "/" + repo.Name)
+		if repoBucket = l.repos[key]; repoBucket == nil {
+			repoBucket = &tokenBucket{}
+			l.repos[key] = repoBucket
+		}
+		repoBucket.refill(perRepo, now)
+		wait = repoBucket.wait(perRepo)
+	}
+	if global.PerHour > 0 {
+		l.global.refill(global, now)
+		if w := l.global.wait(global); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	if repoBucket != nil {
+		repoBucket.tokens--
+	}
+	if global.PerHour > 0 {
+		l.global.tokens--
+	}
+	return true, 0
+}
+
+// maybePruneLocked drops buckets that have refilled completely, which behave the same as no
+// bucket, at most once a minute.
+func (l *fixBuildRateLimiter) maybePruneLocked(perRepo rateLimit, now time.Time) {
+	if now.Sub(l.lastPruned) < time.Minute {
+		return
+	}
+	l.lastPruned = now
+	for key, b := range l.repos {
+		if perRepo.PerHour <= 0 || b.tokens+now.Sub(b.last).Hours()*float64(perRepo.PerHour) >= float64(perRepo.Burst) {
+			delete(l.repos, key)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFixBuildRateLimiter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newFixBuildRateLimiter()
+	l.now = func() time.Time { return now }
+	perRepo := rateLimit{PerHour: 6, Burst: 2}
+	widgets := FixBuildRepo{Owner: "acme", Name: "widgets"}
+	gadgets := FixBuildRepo{Owner: "acme", Name: "gadgets"}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(widgets, perRepo, rateLimit{}); !ok {
+			t.Fatalf("request %d within the burst was limited", i)
+		}
+	}
+	ok, wait := l.allow(widgets, perRepo, rateLimit{})
+	if ok || wait != 10*time.Minute {
+		t.Fatalf("expected a 10m wait past the burst, got ok=%v wait=%v", ok, wait)
+	}
+	if ok, _ := l.allow(gadgets, perRepo, rateLimit{}); !ok {
+		t.Fatal("another repo should have its own bucket")
+	}
+
+	now = now.Add(10 * time.Minute)
+	if ok, _ := l.allow(widgets, perRepo, rateLimit{}); !ok {
+		t.Fatal("expected a token after refilling")
+	}
+
+	// The global bucket applies across repos, and a denied request takes no per-repo token
+	global := rateLimit{PerHour: 1, Burst: 1}
+	if ok, _ := l.allow(FixBuildRepo{Owner: "acme", Name: "a"}, rateLimit{}, global); !ok {
+		t.Fatal("first request should pass the global limit")
+	}
+	if ok, wait := l.allow(gadgets, perRepo, global); ok || wait != time.Hour {
+		t.Fatalf("expected the global limit to apply, got ok=%v wait=%v", ok, wait)
+	}
+	if ok, _ := l.allow(gadgets, perRepo, rateLimit{}); !ok {
+		t.Fatal("a globally limited request should not use up the repo's bucket")
+	}
+}
+
+func TestFixBuildRateLimitedRequests(t *testing.T) {
+	useFakeRunner(t, nil)
+	t.Setenv("FIX_BUILD_REPO_RATE_PER_HOUR", "1")
+	t.Setenv("FIX_BUILD_REPO_RATE_BURST", "1")
+
+	post := func(name, sha string) (int, string) {
+		p := fakeRunnerPayload(sha)
+		p.Repo.Name = name
+		rec := postFixBuild(t, p)
+		return rec.Code, rec.Header().Get("Retry-After")
+	}
+
+	if code, _ := post("rate-limited", "aaa0044"); code != http.StatusOK {
+		t.Fatalf("expected the first fix to run, got %d", code)
+	}
+	code, retryAfter := post("rate-limited", "bbb0044")
+	if code != http.StatusTooManyRequests || retryAfter == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %q", code, retryAfter)
+	}
+	if code, _ := post("rate-unaffected", "ccc0044"); code != http.StatusOK {
+		t.Fatalf("expected another repo to be unaffected, got %d", code)
+	}
+}
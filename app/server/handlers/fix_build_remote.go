@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// defaultPushRemoteName is the remote added for a payload's pushRemoteUrl when it doesn't name one.
+const defaultPushRemoteName = "plandex-push"
+
+var (
+	remoteNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	// scpRemotePattern matches scp-style SSH remotes such as git@github.com:acme/widgets.git.
+	scpRemotePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/-]`)
+)
+
+// validatePushRemote checks the payload's push target. URLs are limited to HTTPS, and to SSH
+// when a deploy key is supplied; git's other transports (file, ext::) could read or run
+// anything on the server.
+func validatePushRemote(p FixBuildPayload) error {
+	if p.PushRemote != "" && !remoteNamePattern.MatchString(p.PushRemote) {
+		return fmt.Errorf("invalid pushRemote %q: must be a plain remote name", p.PushRemote)
+	}
+	if p.PushRemoteUrl == "" {
+		return nil
+	}
+	if p.OpenPullRequest {
+		return fmt.Errorf("pushRemoteUrl can't be combined with openPullRequest")
+	}
+	if p.PushRemote == "origin" {
+		return fmt.Errorf("pushRemote origin is the clone source; name the remote for pushRemoteUrl something else")
+	}
+	if scpRemotePattern.MatchString(p.PushRemoteUrl) {
+		if p.SshKey == "" {
+			return fmt.Errorf("an SSH pushRemoteUrl needs sshKey")
+		}
+		return nil
+	}
+	u, err := url.Parse(p.PushRemoteUrl)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid pushRemoteUrl %q", p.PushRemoteUrl)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "ssh":
+		if p.SshKey == "" {
+			return fmt.Errorf("an SSH pushRemoteUrl needs sshKey")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid pushRemoteUrl %q: must be an https or ssh URL", p.PushRemoteUrl)
+}
+
+// authenticatedPushUrl adds the payload's token to an HTTPS pushRemoteUrl without credentials
+// of its own, the same way the clone URL carries it.
+func authenticatedPushUrl(p FixBuildPayload) string {
+	u, err := url.Parse(p.PushRemoteUrl)
+	if err != nil || u.Scheme != "https" || u.User != nil || p.InstallationToken == "" {
+		return p.PushRemoteUrl
+	}
+	g, _ := providerFor(p)
+	u.User = url.UserPassword(g.TokenUser, p.InstallationToken)
+	return u.String()
+}
+
+// setupPushRemote points ws's pushes at the payload's pushRemote/pushRemoteUrl, if any. A URL
+// is added to a fresh clone as a remote; a local checkout's config is left alone and the URL
+// is pushed to directly.
+func setupPushRemote(ctx context.Context, ws *fixWorkspace, p FixBuildPayload) error {
+	if p.PushRemoteUrl == "" {
+		ws.push = p.PushRemote
+		return nil
+	}
+	pushUrl := authenticatedPushUrl(p)
+	if ws.local {
+		ws.push = pushUrl
+		return nil
+	}
+	name := p.PushRemote
+	if name == "" {
+		name = defaultPushRemoteName
+	}
+	if out, err := runCmd(ctx, ws.Dir, 10*time.Second, "git", "remote", "add", name, pushUrl); err != nil {
+		return redactToken(fmt.Errorf("git remote add %s: %w\n%s", name, err, out), p.InstallationToken)
+	}
+	ws.push = name
+	return nil
+}
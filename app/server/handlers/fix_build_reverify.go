@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// retainedFix is an async job's fixed checkout that failed only its verify commands, kept for
+// POST /fix_build/reverify/{jobId} to retry the check without re-running plandex.
+type retainedFix struct {
+	ws      *fixWorkspace
+	payload FixBuildPayload
+	cfg     fixBuildConfig
+	timer   *time.Timer
+}
+
+type retainedFixes struct {
+	mu    sync.Mutex
+	byJob map[string]*retainedFix
+}
+
+var fixBuildRetained = &retainedFixes{byJob: map[string]*retainedFix{}}
+
+// retain keeps ws for jobId until grace passes or it is taken, replacing (and cleaning up) any
+// checkout already kept for the job.
+func (r *retainedFixes) retain(jobId string, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig, grace time.Duration) {
+	fix := &retainedFix{ws: ws, payload: payload, cfg: cfg}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prev := r.byJob[jobId]; prev != nil {
+		prev.timer.Stop()
+		prev.ws.cleanup()
+	}
+	fix.timer = time.AfterFunc(grace, func() { r.expire(jobId, fix) })
+	r.byJob[jobId] = fix
+}
+
+// expire cleans up fix if it is still the checkout kept for jobId.
+func (r *retainedFixes) expire(jobId string, fix *retainedFix) {
+	r.mu.Lock()
+	if r.byJob[jobId] != fix {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.byJob, jobId)
+	r.mu.Unlock()
+	log.Printf("[fix_build] reverify grace period for job %s expired", jobId)
+	fix.ws.cleanup()
+}
+
+// take removes and returns the checkout kept for jobId; the caller then owns its cleanup.
+func (r *retainedFixes) take(jobId string) (*retainedFix, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fix, ok := r.byJob[jobId]
+	if !ok {
+		return nil, false
+	}
+	fix.timer.Stop()
+	delete(r.byJob, jobId)
+	return fix, true
+}
+
+// reverifiable reports whether a failed candidate's checkout should be kept for a reverify:
+// only async jobs are eligible, since a sync caller has no job to come back to.
+func reverifiable(payload FixBuildPayload, res candidateResult) bool {
+	return payload.CallbackUrl != "" && res.ws != nil && res.err != nil && res.err.Code == "verify_failed"
+}
+
+// FixBuildReverifyHandler handles POST /fix_build/reverify/{jobId}: it re-runs the verify
+// commands against a failed async job's retained checkout and, if they now pass, commits and
+// pushes the fix as the job's result. A checkout that still fails is kept for another grace period.
+func FixBuildReverifyHandler(w http.ResponseWriter, r *http.Request) {
+	jobId := mux.Vars(r)["jobId"]
+
+	fix, ok := fixBuildRetained.take(jobId)
+	if !ok {
+		writeFixBuildError(w, newFixBuildError(http.StatusNotFound, "not_reverifiable", "job %s has no checkout kept for reverify; only async jobs that failed verification are kept, for FIX_BUILD_REVERIFY_GRACE", jobId))
+		return
+	}
+	if !fixBuildLifecycle.enter() {
+		fixBuildRetained.retain(jobId, fix.ws, fix.payload, fix.cfg, fix.cfg.ReverifyGrace)
+		writeFixBuildError(w, newFixBuildError(http.StatusServiceUnavailable, "shutting_down", "server is shutting down; retry later"))
+		return
+	}
+	defer fixBuildLifecycle.leave()
+	log.Printf("[fix_build] reverifying job %s", jobId)
+
+	ctx := context.Background()
+	jl, err := openJobLog(fix.cfg, jobId, fix.payload)
+	if err != nil {
+		log.Printf("[fix_build] job log: %v", err)
+	} else {
+		defer jl.close()
+		ctx = withJobLog(ctx, jl)
+	}
+	res, fbErr := reverifyFix(ctx, fix)
+	jl.result(res, fbErr)
+	jl.close()
+	if fbErr != nil {
+		if fbErr.Code == "verify_failed" {
+			fixBuildRetained.retain(jobId, fix.ws, fix.payload, fix.cfg, fix.cfg.ReverifyGrace)
+		} else {
+			fix.ws.cleanup()
+		}
+		includeLogs, _ := strconv.ParseBool(r.URL.Query().Get("includeLogs"))
+		writeFixBuildError(w, responseLogs(fbErr, includeLogs, fix.payload))
+		return
+	}
+	fix.ws.cleanup()
+
+	res.JobId = jobId
+	res.JobUrl = fixBuildJobUrl(fix.cfg, jobId)
+	if jl != nil {
+		res.LogFile = jl.path
+		res.LogsUrl = fixBuildLogsUrl(fix.cfg, jobId)
+	}
+	fixBuildJobs.finish(jobId, res, nil)
+	if finished, ok := fixBuildJobs.get(jobId); ok {
+		persistJob(fix.cfg, finished)
+	}
+	// The callback already reported the failure; tell it the job succeeded after all
+	go deliverFixBuildCallback(fix.cfg, fix.payload.CallbackUrl, jobId, res, nil)
+	writeFixBuildResponse(w, res)
+}
+
+// reverifyFix runs the retained checkout's verify commands and, if they pass, finishes the fix.
+func reverifyFix(ctx context.Context, fix *retainedFix) (*FixBuildResponse, *fixBuildError) {
+	sandbox, err := sandboxFor(fix.cfg)
+	if err != nil {
+		log.Printf("[fix_build] sandbox: %v", err)
+		return nil, newFixBuildError(http.StatusInternalServerError, "workspace_failed", "failed to set up sandbox: %v", err).inPhase("workspace")
+	}
+	if sandbox != nil {
+		ctx = withRunner(ctx, sandbox)
+	}
+	ctx = logCommands(ctx)
+	fix.ws.log = jobLogFrom(ctx)
+	// Report only this attempt's timings
+	fix.ws.timings = nil
+	if fbErr := timedVerifyFix(ctx, fix.ws, fix.payload, fix.cfg); fbErr != nil {
+		return nil, fbErr
+	}
+	res, fbErr := finishFix(ctx, fix.ws, fix.payload, fix.cfg)
+	fix.ws.finished = fbErr == nil
+	if res != nil {
+		res.Timings = fix.ws.timings
+		res.Verified = fix.ws.verified
+	}
+	return res, fbErr
+}
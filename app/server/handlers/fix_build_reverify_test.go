@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// startFailingVerifyJob posts an async fix whose verify command fails and waits for the job to
+// finish, returning the job id and the callbacks delivered for it.
+func startFailingVerifyJob(t *testing.T, f *fakeRunner, sha string) (string, chan FixBuildCallback) {
+	t.Helper()
+	t.Setenv("FIX_BUILD_HMAC_SECRET", "s3cret")
+	f.responses["sh -c make test"] = fakeResponse{out: "FAIL: TestWidget", err: &fakeExitError{code: 1}}
+
+	callbacks := make(chan FixBuildCallback, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cb FixBuildCallback
+		_ = json.NewDecoder(r.Body).Decode(&cb)
+		callbacks <- cb
+	}))
+	t.Cleanup(srv.Close)
+
+	payload := fakeRunnerPayload(sha)
+	payload.VerifyCommand = "make test"
+	payload.CallbackUrl = srv.URL
+	rec := postFixBuild(t, payload)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job FixBuildJob
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if fix, ok := fixBuildRetained.take(job.Id); ok {
+			fix.ws.cleanup()
+		}
+	})
+
+	select {
+	case cb := <-callbacks:
+		if cb.Status != fixBuildJobFailed {
+			t.Fatalf("expected the job to fail verification, got %+v", cb)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("job never finished")
+	}
+	return job.Id, callbacks
+}
+
+func postReverify(jobId string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/fix_build/reverify/{jobId}", FixBuildReverifyHandler)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/fix_build/reverify/"+jobId, nil))
+	return rec
+}
+
+func TestFixBuildReverifyPasses(t *testing.T) {
+	f := useFakeRunner(t, nil)
+	jobId, callbacks := startFailingVerifyJob(t, f, "abc0055")
+	if f.called("git push") {
+		t.Fatal("pushed a fix that failed verification")
+	}
+
+	// The flake clears up
+	delete(f.responses, "sh -c make test")
+	rec := postReverify(jobId)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res FixBuildResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.CommitSha != "f1xed00" || res.JobId != jobId {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	if !f.called("git push origin main") {
+		t.Fatal("expected the fix to be pushed")
+	}
+	if job, _ := fixBuildJobs.get(jobId); job.Status != fixBuildJobSucceeded || job.Error != "" {
+		t.Fatalf("expected the job to be marked succeeded, got %+v", job)
+	}
+	select {
+	case cb := <-callbacks:
+		if cb.Status != fixBuildJobSucceeded {
+			t.Fatalf("expected a success callback, got %+v", cb)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("success callback never delivered")
+	}
+
+	// The checkout is gone once the fix is pushed
+	if rec := postReverify(jobId); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 reverifying a finished fix, got %d", rec.Code)
+	}
+}
+
+func TestFixBuildReverifyStillFails(t *testing.T) {
+	f := useFakeRunner(t, nil)
+	jobId, _ := startFailingVerifyJob(t, f, "abc1055")
+
+	// Still failing, and the checkout is kept for another try each time
+	for i := 0; i < 2; i++ {
+		rec := postReverify(jobId)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("attempt %d: expected 422, got %d: %s", i+1, rec.Code, rec.Body.String())
+		}
+		var body FixBuildErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != "verify_failed" {
+			t.Fatalf("expected verify_failed, got %+v", body.Error)
+		}
+	}
+	if f.called("git push") {
+		t.Fatal("pushed a fix that still fails verification")
+	}
+	if job, _ := fixBuildJobs.get(jobId); job.Status != fixBuildJobFailed {
+		t.Fatalf("expected the job to stay failed, got %+v", job)
+	}
+}
+
+func TestFixBuildReverifyNeedsRetainedCheckout(t *testing.T) {
+	useFakeRunner(t, map[string]fakeResponse{
+		"sh -c make test": {out: "FAIL: TestWidget", err: &fakeExitError{code: 1}},
+	})
+	// A sync request has nobody to come back for the checkout, so it isn't kept
+	payload := fakeRunnerPayload("abc2055")
+	payload.VerifyCommand = "make test"
+	if rec := postFixBuild(t, payload); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", rec.Code, rec.Body.String())
+	}
+	fixBuildRetained.mu.Lock()
+	retained := len(fixBuildRetained.byJob)
+	fixBuildRetained.mu.Unlock()
+	if retained != 0 {
+		t.Fatalf("expected no retained checkout for a sync job, got %d", retained)
+	}
+	if rec := postReverify("missing"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown job, got %d", rec.Code)
+	}
+}
+
+func TestRetainedFixesExpire(t *testing.T) {
+	dir := t.TempDir()
+	fixBuildRetained.retain("expiring", &fixWorkspace{Dir: dir}, FixBuildPayload{}, fixBuildConfig{}, 10*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("retained checkout never cleaned up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := fixBuildRetained.take("expiring"); ok {
+		t.Fatal("expected the expired checkout to be gone")
+	}
+}
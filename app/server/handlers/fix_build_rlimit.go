@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// resourceLimits cap what a single command may use; zero means unlimited.
+type resourceLimits struct {
+	MemoryBytes int64
+	CPUSeconds  int
+}
+
+func (l resourceLimits) enabled() bool {
+	return l.MemoryBytes > 0 || l.CPUSeconds > 0
+}
+
+type resourceLimitsKey struct{}
+
+// withResourceLimits makes commands run under ctx subject to limits.
+func withResourceLimits(ctx context.Context, limits resourceLimits) context.Context {
+	return context.WithValue(ctx, resourceLimitsKey{}, limits)
+}
+
+// resourceLimitsFrom returns the limits for commands run under ctx.
+func resourceLimitsFrom(ctx context.Context) resourceLimits {
+	limits, _ := ctx.Value(resourceLimitsKey{}).(resourceLimits)
+	return limits
+}
+
+// ErrResourceLimit is returned (wrapped) by runCmd when a command is killed for exceeding its
+// memory or CPU limit.
+var ErrResourceLimit = errors.New("command exceeded its resource limit")
+
+type resourceLimitError struct {
+	// Resource is "memory" or "cpu".
+	Resource string
+	Limits   resourceLimits
+}
+
+func (e *resourceLimitError) Error() string {
+	if e.Resource == "cpu" {
+		return fmt.Sprintf("command exceeded its cpu limit of %ds (FIX_BUILD_MAX_CPU_SECONDS)", e.Limits.CPUSeconds)
+	}
+	return fmt.Sprintf("command exceeded its memory limit of %dMB (FIX_BUILD_MAX_MEMORY_MB)", e.Limits.MemoryBytes>>20)
+}
+
+func (e *resourceLimitError) Unwrap() error {
+	return ErrResourceLimit
+}
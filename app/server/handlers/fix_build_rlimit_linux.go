@@ -0,0 +1,124 @@
+//go:build linux
+
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// memoryPollInterval is how often a limited command's memory use is checked.
+var memoryPollInterval = 200 * time.Millisecond
+
+// limitedCommand returns how to run name under limits. CPU time is capped with RLIMIT_CPU, set
+// by a shell that then execs name, so the cap is in place before name runs and is inherited by
+// everything it spawns.
+func limitedCommand(name string, args []string, limits resourceLimits) (string, []string) {
+	if limits.CPUSeconds <= 0 {
+		return name, args
+	}
+	// The kernel sends SIGXCPU at the soft limit and SIGKILL a second later
+	script := fmt.Sprintf(`ulimit -S -t %d && { ulimit -H -t %d 2>/dev/null; exec "$0" "$@"; }`, limits.CPUSeconds, limits.CPUSeconds+1)
+	return "/bin/sh", append([]string{"-c", script, name}, args...)
+}
+
+// limitProcess watches cmd, which has just started, and returns a func to call once it has
+// exited that reports a limit it was killed for. Memory is the resident size of cmd's whole
+// process group, polled and killed once it's over the limit, so the cap is best-effort: a
+// process can go over for up to a poll interval, and one that leaves the group escapes it. An
+// RLIMIT_AS cap would be exact, but it also counts the address space runtimes like node and
+// the JVM reserve up front and never touch.
+func limitProcess(cmd *exec.Cmd, limits resourceLimits) func(*os.ProcessState) error {
+	var killed atomic.Bool
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	if limits.MemoryBytes > 0 {
+		go func() {
+			defer close(stopped)
+			ticker := time.NewTicker(memoryPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+				if groupRSS(cmd.Process.Pid) > limits.MemoryBytes {
+					killed.Store(true)
+					killProcessGroup(cmd)
+					return
+				}
+			}
+		}()
+	} else {
+		close(stopped)
+	}
+
+	return func(state *os.ProcessState) error {
+		close(stop)
+		<-stopped
+		if killed.Load() {
+			return &resourceLimitError{Resource: "memory", Limits: limits}
+		}
+		if limits.CPUSeconds > 0 && state != nil && cpuLimitHit(state, limits.CPUSeconds) {
+			return &resourceLimitError{Resource: "cpu", Limits: limits}
+		}
+		return nil
+	}
+}
+
+// cpuLimitHit reports whether a process was killed by the kernel for using its CPU time.
+func cpuLimitHit(state *os.ProcessState, seconds int) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	switch status.Signal() {
+	case syscall.SIGXCPU:
+		return true
+	case syscall.SIGKILL:
+		return state.UserTime()+state.SystemTime() >= time.Duration(seconds)*time.Second
+	}
+	return false
+}
+
+// groupRSS sums the resident memory of every process in process group pgid.
+func groupRSS(pgid int) int64 {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	group := strconv.Itoa(pgid)
+	pageSize := int64(os.Getpagesize())
+	var total int64
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The command name can hold spaces and parens, so fields are counted from the last ')':
+		// state, ppid, pgrp, ... with rss the 22nd
+		i := bytes.LastIndexByte(stat, ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) < 22 || fields[2] != group {
+			continue
+		}
+		if pages, err := strconv.ParseInt(fields[21], 10, 64); err == nil {
+			total += pages * pageSize
+		}
+	}
+	return total
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFixBuildVerifyMemoryLimit(t *testing.T) {
+	useFakeRunner(t, map[string]fakeResponse{"sh -c": {real: true}})
+	t.Setenv("FIX_BUILD_MAX_MEMORY_MB", "16")
+	payload := fakeRunnerPayload("ccc0082")
+	// tail holds its whole input while it waits for the end of the line, well past the limit
+	payload.VerifyCommand = "(head -c 67108864 /dev/zero; sleep 30) | tail"
+
+	start := time.Now()
+	rec := postFixBuild(t, payload)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body FixBuildErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != "verify_resource_exceeded" || body.Error.Phase != "verify" {
+		t.Fatalf("expected verify_resource_exceeded in the verify phase, got %s in %q: %s", body.Error.Code, body.Error.Phase, body.Error.Message)
+	}
+	if took := time.Since(start); took > 20*time.Second {
+		t.Fatalf("expected the command to be killed once over the limit, took %v", took)
+	}
+}
+
+func TestExecRunnerCPULimit(t *testing.T) {
+	ctx := withResourceLimits(context.Background(), resourceLimits{CPUSeconds: 1})
+	_, err := execRunner{}.Run(ctx, "", time.Minute, nil, "sh", "-c", "while :; do :; done")
+	var limitErr *resourceLimitError
+	if !errors.As(err, &limitErr) || limitErr.Resource != "cpu" {
+		t.Fatalf("expected a cpu limit error, got %v", err)
+	}
+
+	_, err = execRunner{}.Run(ctx, "", time.Minute, nil, "sh", "-c", "exit 3")
+	if errors.Is(err, ErrResourceLimit) {
+		t.Fatalf("expected an ordinary failure under the limit, got %v", err)
+	}
+
+	// The limit is set before the command runs, not raced in after it starts
+	out, err := execRunner{}.Run(ctx, "", time.Minute, nil, "sh", "-c", "ulimit -S -t; ulimit -H -t")
+	if err != nil || strings.Fields(string(out))[0] != "1" || strings.Fields(string(out))[1] != "2" {
+		t.Fatalf("expected the command to start with a 1s soft and 2s hard cpu limit, got %q (%v)", out, err)
+	}
+}
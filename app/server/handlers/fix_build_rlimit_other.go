@@ -0,0 +1,18 @@
+//go:build !linux
+
+package handlers
+
+import (
+	"os"
+	"os/exec"
+)
+
+// limitedCommand runs name as it is where resource limits aren't supported.
+func limitedCommand(name string, args []string, limits resourceLimits) (string, []string) {
+	return name, args
+}
+
+// limitProcess is a no-op where resource limits aren't supported; commands run unlimited.
+func limitProcess(cmd *exec.Cmd, limits resourceLimits) func(*os.ProcessState) error {
+	return func(*os.ProcessState) error { return nil }
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// modelRoute pins repos matching Pattern (an owner/name glob, e.g. "acme/*") to a model pack.
+type modelRoute struct {
+	Pattern   string
+	ModelPack string
+}
+
+// parseModelRoutes parses "pattern=pack" entries. Order matters: the first matching route wins.
+func parseModelRoutes(name string, entries []string) ([]modelRoute, error) {
+	var routes []modelRoute
+	for _, e := range entries {
+		pattern, pack, ok := strings.Cut(e, "=")
+		pattern, pack = strings.TrimSpace(pattern), strings.TrimSpace(pack)
+		if !ok || pattern == "" || pack == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: must be owner/name-pattern=model-pack", name, e)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", name, pattern, err)
+		}
+		routes = append(routes, modelRoute{Pattern: strings.ToLower(pattern), ModelPack: pack})
+	}
+	return routes, nil
+}
+
+// routedModelPack returns the model pack pinned to repo, if any.
+func routedModelPack(routes []modelRoute, repo FixBuildRepo) (string, bool) {
+	full := strings.ToLower(repo.Owner + "/" + repo.Name)
+	for _, r := range routes {
+		if ok, _ := path.Match(r.Pattern, full); ok {
+			return r.ModelPack, true
+		}
+	}
+	return "", false
+}
+
+// resolveModelPack picks the model pack for a fix: a route for the repo always wins, then the
+// payload's modelPack, then the server default. A routed repo can't be overridden from the
+// payload, so sensitive repos never reach a disallowed provider.
+func resolveModelPack(cfg fixBuildConfig, p FixBuildPayload) (string, *fixBuildError) {
+	if pack, ok := routedModelPack(cfg.ModelRoutes, p.Repo); ok {
+		if p.ModelPack != "" && p.ModelPack != pack {
+			return "", newFixBuildError(http.StatusForbidden, "model_pack_forbidden", "repo %s/%s is pinned to a model pack by server config; modelPack override not allowed", p.Repo.Owner, p.Repo.Name)
+		}
+		return pack, nil
+	}
+	if p.ModelPack != "" {
+		return p.ModelPack, nil
+	}
+	return cfg.DefaultModelPack, nil
+}
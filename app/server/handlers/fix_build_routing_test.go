@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResolveModelPack(t *testing.T) {
+	t.Setenv("FIX_BUILD_MODEL_ROUTES", "acme/secret-*=onprem-strict, acme/*=onprem, Other/Widgets=cloud-cheap")
+	t.Setenv("FIX_BUILD_DEFAULT_MODEL_PACK", "default-pack")
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		t.Fatalf("loadFixBuildConfig: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		repo    FixBuildRepo
+		payload string
+		want    string
+		status  int
+	}{
+		{"first matching route wins", FixBuildRepo{Owner: "acme", Name: "secret-sauce"}, "", "onprem-strict", 0},
+		{"owner wildcard", FixBuildRepo{Owner: "acme", Name: "api"}, "", "onprem", 0},
+		{"case-insensitive match", FixBuildRepo{Owner: "other", Name: "widgets"}, "", "cloud-cheap", 0},
+		{"payload matching the route is allowed", FixBuildRepo{Owner: "acme", Name: "api"}, "onprem", "onprem", 0},
+		{"payload override rejected for routed repo", FixBuildRepo{Owner: "acme", Name: "api"}, "cloud-cheap", "", http.StatusForbidden},
+		{"unrouted repo uses payload", FixBuildRepo{Owner: "someone", Name: "thing"}, "cloud-cheap", "cloud-cheap", 0},
+		{"unrouted repo falls back to default", FixBuildRepo{Owner: "someone", Name: "thing"}, "", "default-pack", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, fbErr := resolveModelPack(cfg, FixBuildPayload{Repo: tt.repo, ModelPack: tt.payload})
+			if tt.status != 0 {
+				if fbErr == nil || fbErr.Status != tt.status {
+					t.Fatalf("expected status %d, got %v", tt.status, fbErr)
+				}
+				return
+			}
+			if fbErr != nil {
+				t.Fatalf("unexpected error: %v", fbErr)
+			}
+			if got != tt.want {
+				t.Fatalf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseModelRoutesRejectsBadEntries(t *testing.T) {
+	for _, v := range []string{"acme/*", "=pack", "acme/[=pack"} {
+		t.Setenv("FIX_BUILD_MODEL_ROUTES", v)
+		if err := ValidateFixBuildConfig(); err == nil {
+			t.Fatalf("expected %q to be rejected", v)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Runner executes the external commands (git, plandex, formatters) a fix shells out to.
+type Runner interface {
+	// Run runs name in dir with env added to the server's environment and returns its
+	// combined output, killing it when timeout elapses or ctx is cancelled.
+	Run(ctx context.Context, dir string, timeout time.Duration, env []string, name string, args ...string) ([]byte, error)
+	// LookPath resolves name to an executable, like exec.LookPath.
+	LookPath(name string) (string, error)
+}
+
+// fixBuildRunner is the Runner the handler uses; tests swap in a fake.
+var fixBuildRunner Runner = execRunner{}
+
+// execRunner runs real processes.
+type execRunner struct{}
+
+// Run starts the command and everything it spawns in their own process group, so a timeout or
+// cancellation kills the whole tree. The whole tree is also held to ctx's resource limits.
+func (execRunner) Run(ctx context.Context, dir string, timeout time.Duration, env []string, name string, args ...string) ([]byte, error) {
+	limits := resourceLimitsFrom(ctx)
+	name, args = limitedCommand(name, args, limits)
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	setProcessGroup(cmd)
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	// Start before spawning the waiter so cmd.Process is set before the timeout path reads it
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	stopLimits := limitProcess(cmd, limits)
+	done := make(chan struct{})
+	var err error
+	go func() {
+		err = cmd.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		if limitErr := stopLimits(cmd.ProcessState); err != nil && limitErr != nil {
+			return buf.Bytes(), limitErr
+		}
+		return buf.Bytes(), err
+	case <-timer.C:
+		killProcessGroup(cmd)
+		<-done
+		stopLimits(nil)
+		return buf.Bytes(), &cmdTimeoutError{Timeout: timeout}
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		stopLimits(nil)
+		return buf.Bytes(), ctx.Err()
+	}
+}
+
+func (execRunner) LookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sandboxRunner runs every command of a fix in a throwaway container instead of on the host,
+// so a repo's build and test scripts don't run with the server's privileges. Work dirs (and
+// the clone cache) are mounted at the same paths, so dirs and arguments need no rewriting.
+// The image must provide git, plandex and whatever the repo's builds need.
+type sandboxRunner struct {
+	// inner starts the container CLI on the host.
+	inner Runner
+	// Command is the container invocation up to its options, e.g. ["docker", "run", "--rm"]
+	// or ["sudo", "podman", "run", "--rm"].
+	Command []string
+	Image   string
+	// Network is the container network for repo commands. git and plandex always get the
+	// default network, since they must reach the remote and the plandex server.
+	Network string
+	Mounts  []string
+}
+
+// sandboxNetworked are commands that need network access whatever the sandbox's network.
+var sandboxNetworked = map[string]bool{"git": true, "plandex": true}
+
+// containerArgs returns the full container CLI invocation for running name in dir.
+func (s sandboxRunner) containerArgs(container, dir string, limits resourceLimits, env []string, name string, args ...string) []string {
+	cmd := append([]string{}, s.Command[1:]...)
+	cmd = append(cmd, "--name", container)
+	if limits.MemoryBytes > 0 {
+		cmd = append(cmd, "--memory", fmt.Sprintf("%d", limits.MemoryBytes))
+	}
+	if limits.CPUSeconds > 0 {
+		cmd = append(cmd, "--ulimit", fmt.Sprintf("cpu=%d:%d", limits.CPUSeconds, limits.CPUSeconds+1))
+	}
+	if uid, gid := os.Getuid(), os.Getgid(); uid >= 0 {
+		// Files written to the mounts stay owned by the server, so cleanup can remove them
+		cmd = append(cmd, "--user", fmt.Sprintf("%d:%d", uid, gid))
+	}
+	if s.Network != "" && !sandboxNetworked[filepath.Base(name)] {
+		cmd = append(cmd, "--network", s.Network)
+	}
+	for _, m := range s.Mounts {
+		cmd = append(cmd, "-v", m+":"+m)
+	}
+	if dir != "" {
+		cmd = append(cmd, "-w", dir)
+	}
+	for _, e := range append([]string{"GIT_TERMINAL_PROMPT=0"}, env...) {
+		cmd = append(cmd, "-e", e)
+	}
+	cmd = append(cmd, s.Image, name)
+	return append(cmd, args...)
+}
+
+func (s sandboxRunner) Run(ctx context.Context, dir string, timeout time.Duration, env []string, name string, args ...string) ([]byte, error) {
+	container := "plandex-fix-build-" + uuid.New().String()
+	// The container enforces the limits; the CLI on the host isn't held to them
+	limits := resourceLimitsFrom(ctx)
+	out, err := s.inner.Run(withResourceLimits(ctx, resourceLimits{}), dir, timeout, nil, s.Command[0], s.containerArgs(container, dir, limits, env, name, args...)...)
+	var exitErr interface{ ExitCode() int }
+	if limits.MemoryBytes > 0 && errors.As(err, &exitErr) && exitErr.ExitCode() == 137 {
+		// The container's init was SIGKILLed, which under a memory limit is the OOM killer
+		return out, &resourceLimitError{Resource: "memory", Limits: limits}
+	}
+	var timeoutErr *cmdTimeoutError
+	if errors.As(err, &timeoutErr) || ctx.Err() != nil {
+		// Killing the CLI doesn't stop the container, so remove it explicitly
+		rm := append(s.cli(), "rm", "-f", container)
+		if rmOut, rmErr := s.inner.Run(context.Background(), "", 30*time.Second, nil, rm[0], rm[1:]...); rmErr != nil {
+			return out, fmt.Errorf("%w (removing container %s also failed: %v\n%s)", err, container, rmErr, rmOut)
+		}
+	}
+	return out, err
+}
+
+// cli is Command up to its "run" subcommand.
+func (s sandboxRunner) cli() []string {
+	for i, arg := range s.Command {
+		if arg == "run" {
+			return append([]string{}, s.Command[:i]...)
+		}
+	}
+	return []string{s.Command[0]}
+}
+
+// LookPath checks for name inside the image rather than on the host.
+func (s sandboxRunner) LookPath(name string) (string, error) {
+	out, err := s.Run(context.Background(), "", time.Minute, nil, "sh", "-c", `command -v "$0"`, name)
+	path := strings.TrimSpace(string(out))
+	if err != nil || path == "" {
+		return "", fmt.Errorf("%s not found in sandbox image %s", name, s.Image)
+	}
+	return path, nil
+}
+
+type runnerKey struct{}
+
+// withRunner makes commands run under ctx use r instead of fixBuildRunner.
+func withRunner(ctx context.Context, r Runner) context.Context {
+	return context.WithValue(ctx, runnerKey{}, r)
+}
+
+// runnerFrom returns the Runner for commands run under ctx.
+func runnerFrom(ctx context.Context) Runner {
+	if r, ok := ctx.Value(runnerKey{}).(Runner); ok {
+		return r
+	}
+	return fixBuildRunner
+}
+
+// sandboxFor wraps fixBuildRunner in the configured sandbox, or returns nil when sandboxing is off.
+func sandboxFor(cfg fixBuildConfig) (Runner, error) {
+	if cfg.Sandbox == "" {
+		return nil, nil
+	}
+	base, err := workDirBase(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mounts := []string{base}
+	if cfg.CacheDir != "" {
+		mounts = append(mounts, cfg.CacheDir)
+	}
+	if cfg.Signing.enabled() && cfg.Signing.Format == signingSsh {
+		// git commit signs inside the container
+		mounts = append(mounts, cfg.Signing.Key)
+	}
+	return sandboxRunner{
+		inner:   fixBuildRunner,
+		Command: cfg.SandboxCommand,
+		Image:   cfg.SandboxImage,
+		Network: cfg.SandboxNetwork,
+		Mounts:  mounts,
+	}, nil
+}
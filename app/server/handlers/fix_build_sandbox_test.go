@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSandboxRunnerWrapsCommands(t *testing.T) {
+	t.Setenv("FIX_BUILD_SANDBOX", "docker")
+	t.Setenv("FIX_BUILD_SANDBOX_COMMAND", "sudo podman run --rm --read-only")
+	t.Setenv("FIX_BUILD_SANDBOX_IMAGE", "fixer:latest")
+	t.Setenv("FIX_BUILD_WORKDIR", t.TempDir())
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		t.Fatalf("loadFixBuildConfig: %v", err)
+	}
+	f := useFakeRunner(t, map[string]fakeResponse{
+		"sudo podman run --rm --read-only --name plandex-fix-build-": {out: "ok"},
+	})
+	r, err := sandboxFor(cfg)
+	if err != nil || r == nil {
+		t.Fatalf("sandboxFor: %v", err)
+	}
+
+	user := ""
+	if uid := os.Getuid(); uid >= 0 {
+		user = fmt.Sprintf(" --user %d:%d", uid, os.Getgid())
+	}
+	dir := cfg.WorkDir + "/plandex-fix-build-1/services/api"
+	mount := fmt.Sprintf(" -v %s:%s -w %s", cfg.WorkDir, cfg.WorkDir, dir)
+	name := containerNamePattern
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		env  []string
+		want string
+	}{
+		{"repo commands get the sandbox network", []string{"sh", "-c", "make test"}, nil,
+			"sudo podman run --rm --read-only" + name + user + " --network none" + mount + " -e GIT_TERMINAL_PROMPT=0 fixer:latest sh -c make test"},
+		{"git keeps network access", []string{"git", "push", "origin", "main"}, []string{"GIT_SSH_COMMAND=ssh -i key"},
+			"sudo podman run --rm --read-only" + name + user + mount + " -e GIT_TERMINAL_PROMPT=0 -e GIT_SSH_COMMAND=ssh -i key fixer:latest git push origin main"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f.calls = nil
+			out, err := r.Run(context.Background(), dir, time.Minute, tc.env, tc.args[0], tc.args[1:]...)
+			if err != nil || string(out) != "ok" {
+				t.Fatalf("Run: %q %v", out, err)
+			}
+			if len(f.calls) != 1 || !matchCall(tc.want, f.calls[0]) {
+				t.Fatalf("unexpected call:\n got: %v\nwant: %s", f.calls, tc.want)
+			}
+		})
+	}
+
+	t.Run("timed out containers are removed", func(t *testing.T) {
+		f.calls = nil
+		f.responses["sudo podman run"] = fakeResponse{err: &cmdTimeoutError{Timeout: time.Second}}
+		delete(f.responses, "sudo podman run --rm --read-only --name plandex-fix-build-")
+		if _, err := r.Run(context.Background(), dir, time.Second, nil, "plandex", "tell", "fix it"); err == nil {
+			t.Fatal("expected the timeout to be returned")
+		}
+		if len(f.calls) != 2 || !strings.HasPrefix(f.calls[1], "sudo podman rm -f plandex-fix-build-") {
+			t.Fatalf("expected the container to be removed, calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+}
+
+// matchCall compares a recorded call against want, whose container name is a pattern.
+func matchCall(want, got string) bool {
+	parts := strings.SplitN(want, containerNamePattern, 2)
+	re := "^" + regexp.QuoteMeta(parts[0]) + containerNamePattern + regexp.QuoteMeta(parts[1]) + "$"
+	return regexp.MustCompile(re).MatchString(got)
+}
+
+const containerNamePattern = ` --name plandex-fix-build-[0-9a-f-]{36}`
+
+func TestSandboxConfig(t *testing.T) {
+	for _, tc := range []struct {
+		env map[string]string
+		ok  bool
+	}{
+		{map[string]string{}, true},
+		{map[string]string{"FIX_BUILD_SANDBOX": "docker", "FIX_BUILD_SANDBOX_IMAGE": "fixer"}, true},
+		{map[string]string{"FIX_BUILD_SANDBOX": "docker"}, false},
+		{map[string]string{"FIX_BUILD_SANDBOX": "docker", "FIX_BUILD_SANDBOX_IMAGE": "fixer", "FIX_BUILD_SANDBOX_COMMAND": "docker"}, false},
+		{map[string]string{"FIX_BUILD_SANDBOX": "vm"}, false},
+	} {
+		for _, k := range []string{"FIX_BUILD_SANDBOX", "FIX_BUILD_SANDBOX_IMAGE", "FIX_BUILD_SANDBOX_COMMAND"} {
+			t.Setenv(k, tc.env[k])
+		}
+		if err := ValidateFixBuildConfig(); (err == nil) != tc.ok {
+			t.Fatalf("%v: expected ok=%v, got %v", tc.env, tc.ok, err)
+		}
+	}
+
+	t.Setenv("FIX_BUILD_SANDBOX", "")
+	cfg, _ := loadFixBuildConfig()
+	if r, err := sandboxFor(cfg); r != nil || err != nil {
+		t.Fatalf("expected no sandbox by default, got %v %v", r, err)
+	}
+}
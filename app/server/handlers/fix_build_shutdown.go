@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fixBuildLifecycle tracks in-flight jobs so shutdown can drain them.
+var fixBuildLifecycle = &jobLifecycle{}
+
+type jobLifecycle struct {
+	mu       sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
+}
+
+// enter registers a new job, or returns false once shutdown has begun.
+func (l *jobLifecycle) enter() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining {
+		return false
+	}
+	l.inFlight.Add(1)
+	return true
+}
+
+func (l *jobLifecycle) leave() {
+	l.inFlight.Done()
+}
+
+// ShutdownFixBuild stops /fix_build from accepting jobs (new requests get 503) and waits for
+// in-flight jobs until ctx is done, then cancels whatever is left and waits for it to clean up.
+// Leftover work dirs from earlier crashes are removed last. It returns ctx's error if jobs had
+// to be cancelled.
+func ShutdownFixBuild(ctx context.Context) error {
+	fixBuildLifecycle.mu.Lock()
+	fixBuildLifecycle.draining = true
+	fixBuildLifecycle.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		fixBuildLifecycle.inFlight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+		log.Println("[fix_build] all jobs finished")
+	case <-ctx.Done():
+		err = ctx.Err()
+		n := fixBuildJobs.cancelRunning()
+		log.Printf("[fix_build] shutdown deadline reached; cancelled %d job(s)", n)
+		// Cancelled jobs kill their commands and remove their work dirs on the way out
+		<-done
+	}
+
+	removeStaleWorkDirs()
+	return err
+}
+
+// removeStaleWorkDirs deletes fix_build work dirs left behind by a crash. Only safe once no jobs are running.
+func removeStaleWorkDirs() {
+	base := os.TempDir()
+	if cfg, err := loadFixBuildConfig(); err == nil && cfg.WorkDir != "" {
+		base = cfg.WorkDir
+	}
+	dirs, _ := filepath.Glob(filepath.Join(base, workDirPrefix+"*"))
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("[fix_build] remove stale work dir: %v", err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startDrainableJob posts a fix whose plandex tell runs until release is created (or forever if
+// release is ""), and waits until tell has started.
+func startDrainableJob(t *testing.T, name, release string) <-chan int {
+	t.Helper()
+	root := fakeGithub(t)
+	_, sha := addFakeGithubRepo(t, root, "acme", name)
+	started := filepath.Join(t.TempDir(), "started")
+	wait := "while :; do sleep 0.05; done"
+	if release != "" {
+		wait = `while [ ! -f "` + release + `" ]; do sleep 0.05; done; echo fixed > fix.txt`
+	}
+	fakePlandex(t, `if [ "$1" = "tell" ]; then
+  touch "`+started+`"
+  `+wait+`
+fi
+`)
+
+	codes := make(chan int, 1)
+	go func() {
+		codes <- postFixBuild(t, FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: name}, HeadBranch: "main", HeadSha: sha, OutputSummary: "FAIL", InstallationToken: "tok"}).Code
+	}()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if _, err := os.Stat(started); err == nil {
+			return codes
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("fake plandex never started")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func resetFixBuildLifecycle(t *testing.T) {
+	t.Cleanup(func() {
+		fixBuildLifecycle.mu.Lock()
+		fixBuildLifecycle.draining = false
+		fixBuildLifecycle.mu.Unlock()
+	})
+}
+
+func TestShutdownFixBuildDrainsInFlightJobs(t *testing.T) {
+	resetFixBuildLifecycle(t)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	release := filepath.Join(t.TempDir(), "release")
+	codes := startDrainableJob(t, "drain-me", release)
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- ShutdownFixBuild(context.Background()) }()
+	for {
+		fixBuildLifecycle.mu.Lock()
+		draining := fixBuildLifecycle.draining
+		fixBuildLifecycle.mu.Unlock()
+		if draining {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec := postFixBuild(t, FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: "late"}, HeadBranch: "main", HeadSha: "abc1234", OutputSummary: "FAIL", InstallationToken: "tok"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while draining, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown returned before the in-flight job finished: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(release, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := <-codes; code != http.StatusOK {
+		t.Fatalf("expected the in-flight job to finish with 200, got %d", code)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("expected a clean drain, got %v", err)
+	}
+}
+
+func TestShutdownFixBuildCancelsAfterDeadline(t *testing.T) {
+	resetFixBuildLifecycle(t)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	// A leftover from an earlier crash
+	if err := os.Mkdir(filepath.Join(tmp, "plandex-fix-build-stale"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	codes := startDrainableJob(t, "stuck", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := ShutdownFixBuild(ctx); err == nil {
+		t.Fatal("expected shutdown to report that jobs were cancelled")
+	}
+	if code := <-codes; code != http.StatusConflict {
+		t.Fatalf("expected the stuck job to be cancelled with 409, got %d", code)
+	}
+	if entries := workDirLeftovers(tmp); len(entries) != 0 {
+		t.Fatalf("expected temp dirs to be cleaned up, found %d entries", len(entries))
+	}
+}
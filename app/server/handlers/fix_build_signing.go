@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	signingGpg = "gpg"
+	signingSsh = "ssh"
+)
+
+// signingConfig signs fix commits so they can be pushed to branches that require signatures.
+// Key is a GPG key id or fingerprint from the server's keyring, or with Format ssh the path to
+// a private key without a passphrase. An empty Key disables signing.
+type signingConfig struct {
+	Key    string
+	Format string
+}
+
+func (s signingConfig) enabled() bool {
+	return s.Key != ""
+}
+
+// gitArgs are the git options that make commit -S sign with the key.
+func (s signingConfig) gitArgs() []string {
+	format := "openpgp"
+	if s.Format == signingSsh {
+		format = "ssh"
+	}
+	return []string{"-c", "gpg.format=" + format, "-c", "user.signingkey=" + s.Key}
+}
+
+// checkSigningKey makes sure the key can sign without a prompt, so a bad key fails the request
+// before the fix is made rather than at commit time.
+func checkSigningKey(ctx context.Context, s signingConfig) error {
+	var out []byte
+	var err error
+	if s.Format == signingSsh {
+		out, err = runCmd(ctx, "", 10*time.Second, "ssh-keygen", "-y", "-P", "", "-f", s.Key)
+	} else {
+		out, err = runCmd(ctx, "", 10*time.Second, "gpg", "--batch", "--list-secret-keys", s.Key)
+	}
+	if err != nil {
+		return fmt.Errorf("signing key %s is not usable: %w\n%s", s.Key, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// signingFailed reports whether git commit output says the commit couldn't be signed.
+func signingFailed(out []byte) bool {
+	return strings.Contains(string(out), "failed to sign")
+}
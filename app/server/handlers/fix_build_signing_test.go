@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFixBuildSignsCommits(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not available")
+	}
+	root := fakeGithub(t)
+	fakePlandex(t, `[ "$1" = "tell" ] && echo fixed > fix.txt
+exit 0
+`)
+	key := filepath.Join(t.TempDir(), "signing")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "fix-build-test", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v\n%s", err, out)
+	}
+	t.Setenv("FIX_BUILD_SIGNING_KEY", key)
+	t.Setenv("FIX_BUILD_SIGNING_FORMAT", "ssh")
+
+	bare, sha := addFakeGithubRepo(t, root, "acme", "signed")
+	rec := postFixBuild(t, FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: "signed"}, HeadBranch: "main", HeadSha: sha, OutputSummary: "FAIL", InstallationToken: "tok"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	pub, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := filepath.Join(t.TempDir(), "allowed_signers")
+	if err := os.WriteFile(signers, []byte("test@example.com "+string(pub)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("git", "-C", bare, "-c", "gpg.ssh.allowedSignersFile="+signers, "verify-commit", "-v", "main").CombinedOutput()
+	if err != nil {
+		t.Fatalf("expected the pushed fix to carry a valid signature: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Good \"git\" signature") {
+		t.Fatalf("unexpected verify-commit output:\n%s", out)
+	}
+}
+
+func TestFixBuildSigningKeyUnusable(t *testing.T) {
+	f := useFakeRunner(t, map[string]fakeResponse{
+		"ssh-keygen -y": {out: "Load key \"/keys/missing\": No such file or directory", err: &fakeExitError{code: 255}},
+	})
+	t.Setenv("FIX_BUILD_SIGNING_KEY", "/keys/missing")
+	t.Setenv("FIX_BUILD_SIGNING_FORMAT", "ssh")
+
+	rec := postFixBuild(t, fakeRunnerPayload("ddd0061"))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body FixBuildErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != "signing_key_unusable" || body.Error.Phase != "signing" {
+		t.Fatalf("expected signing_key_unusable, got %+v", body.Error)
+	}
+	if f.called("git clone") || f.called("plandex tell") {
+		t.Fatal("expected no fix to be attempted with an unusable signing key")
+	}
+}
+
+func TestLoadFixBuildConfigSigning(t *testing.T) {
+	tests := []struct {
+		key, format string
+		ok          bool
+	}{
+		{"", "", true},
+		{"ABCDEF0123456789", "", true},
+		{"ABCDEF0123456789", "GPG", true},
+		{"/keys/signing", "ssh", true},
+		{"keys/signing", "ssh", false},
+		{"ABCDEF0123456789", "x509", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("FIX_BUILD_SIGNING_KEY", tt.key)
+		t.Setenv("FIX_BUILD_SIGNING_FORMAT", tt.format)
+		if _, err := loadFixBuildConfig(); (err == nil) != tt.ok {
+			t.Fatalf("key %q format %q: expected ok=%v, got %v", tt.key, tt.format, tt.ok, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// parseSkipPatterns compiles FIX_BUILD_SKIP_PATTERNS-style regexes, one per line (regexes can
+// contain commas, so the usual comma-separated list doesn't work here).
+func parseSkipPatterns(name, raw string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", name, line, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+func matchingPattern(patterns []*regexp.Regexp, s string) *regexp.Regexp {
+	for _, re := range patterns {
+		if s != "" && re.MatchString(s) {
+			return re
+		}
+	}
+	return nil
+}
+
+// infraFailureReason returns why the failure looks like an infrastructure problem not worth a
+// code fix, or "" if it doesn't. It needs a skip pattern to match the output summary or an
+// annotation, and no failure annotation left unexplained by the patterns.
+func infraFailureReason(p FixBuildPayload, patterns []*regexp.Regexp) string {
+	if len(patterns) == 0 {
+		return ""
+	}
+	var reason string
+	if re := matchingPattern(patterns, p.OutputSummary); re != nil {
+		reason = fmt.Sprintf("output summary matches skip pattern %q", re.String())
+	}
+	for _, a := range p.Annotations {
+		re := matchingPattern(patterns, a.Message)
+		if re == nil {
+			re = matchingPattern(patterns, a.Title)
+		}
+		if re == nil {
+			if a.AnnotationLevel == "failure" {
+				// A real failure alongside the infra noise is still worth fixing
+				return ""
+			}
+			continue
+		}
+		if reason == "" {
+			reason = fmt.Sprintf("annotation on %s matches skip pattern %q", a.Path, re.String())
+		}
+	}
+	return reason
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+const testSkipPatterns = "(?i)no space left on device\n(?i)(connection|i/o) timed? ?out\nexit code 137"
+
+func TestInfraFailureReason(t *testing.T) {
+	patterns, err := parseSkipPatterns("FIX_BUILD_SKIP_PATTERNS", testSkipPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		payload FixBuildPayload
+		skip    bool
+	}{
+		{"infra summary", FixBuildPayload{OutputSummary: "npm ERR! connection timed out"}, true},
+		{"infra annotation", FixBuildPayload{Annotations: []FixBuildAnno{{Path: ".github", AnnotationLevel: "failure", Message: "Process completed with exit code 137."}}}, true},
+		{"infra summary with a notice", FixBuildPayload{OutputSummary: "No space left on device", Annotations: []FixBuildAnno{{Path: "a.go", AnnotationLevel: "notice", Message: "deprecated"}}}, true},
+		{"real failure alongside infra noise", FixBuildPayload{OutputSummary: "connection timed out", Annotations: []FixBuildAnno{{Path: "a_test.go", AnnotationLevel: "failure", Message: "expected 2, got 3"}}}, false},
+		{"real test failure", FixBuildPayload{OutputSummary: "FAIL: TestAdd", Annotations: []FixBuildAnno{{Path: "a_test.go", AnnotationLevel: "failure", Message: "expected 2, got 3"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := infraFailureReason(tt.payload, patterns); (got != "") != tt.skip {
+				t.Fatalf("expected skip=%v, got reason %q", tt.skip, got)
+			}
+		})
+	}
+
+	if got := infraFailureReason(FixBuildPayload{OutputSummary: "connection timed out"}, nil); got != "" {
+		t.Fatalf("expected nothing skipped without patterns, got %q", got)
+	}
+	if _, err := parseSkipPatterns("FIX_BUILD_SKIP_PATTERNS", "ok\n(unclosed"); err == nil {
+		t.Fatal("expected an invalid regex to be rejected")
+	}
+}
+
+func TestFixBuildSkipsInfraFailures(t *testing.T) {
+	t.Setenv("FIX_BUILD_SKIP_PATTERNS", testSkipPatterns)
+
+	t.Run("infra failure is skipped without cloning", func(t *testing.T) {
+		f := useFakeRunner(t, nil)
+		p := fakeRunnerPayload("aaa0037")
+		p.OutputSummary = "Error: The runner ran out of disk: No space left on device"
+		rec := postFixBuild(t, p)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var res FixBuildResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Ok || !res.Skipped || res.SkipReason == "" {
+			t.Fatalf("expected a skipped result with a reason, got %+v", res)
+		}
+		if len(f.calls) != 0 {
+			t.Fatalf("expected no commands, got %v", f.calls)
+		}
+	})
+
+	t.Run("test failure proceeds", func(t *testing.T) {
+		f := useFakeRunner(t, nil)
+		p := fakeRunnerPayload("bbb0037")
+		p.OutputSummary = "--- FAIL: TestAdd"
+		p.Annotations = []FixBuildAnno{{Path: "add_test.go", StartLine: 3, EndLine: 3, AnnotationLevel: "failure", Message: "expected 2, got 3"}}
+		rec := postFixBuild(t, p)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !f.called("git clone") || !f.called("git push") {
+			t.Fatal("expected the fix to run")
+		}
+	})
+}
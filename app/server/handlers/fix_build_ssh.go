@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeSSHKey writes a deploy key to a fresh 0700 dir under base, outside the checkout so plandex
+// never sees it, and returns the dir and the key path. The caller removes the dir.
+func writeSSHKey(base, key string) (string, string, error) {
+	dir, err := makeWorkDir(base, workDirPrefix+"key-*")
+	if err != nil {
+		return "", "", err
+	}
+	keyPath := filepath.Join(dir, "id")
+	// ssh rejects keys without a trailing newline
+	if !strings.HasSuffix(key, "\n") {
+		key += "\n"
+	}
+	if err := os.WriteFile(keyPath, []byte(key), 0600); err != nil {
+		removeWorkDir(dir)
+		return "", "", err
+	}
+	return dir, keyPath, nil
+}
+
+// sshCommand is the GIT_SSH_COMMAND for authenticating with keyPath. Host keys are pinned on
+// first use in a known_hosts file next to the key rather than the server user's ~/.ssh.
+func sshCommand(keyPath string) string {
+	knownHosts := filepath.Join(filepath.Dir(keyPath), "known_hosts")
+	return fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o UserKnownHostsFile=%s -o StrictHostKeyChecking=accept-new",
+		shellQuote(keyPath), shellQuote(knownHosts))
+}
+
+// cloneRemote is the URL to clone the payload's repo from: SSH when a deploy key is supplied,
+// otherwise HTTPS with the provider's token scheme. The provider must already be validated.
+func cloneRemote(p FixBuildPayload) string {
+	g, _ := providerFor(p)
+	if p.SshKey != "" {
+		return g.sshUrl(p.Repo)
+	}
+	return g.httpsUrl(p.InstallationToken, p.Repo)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
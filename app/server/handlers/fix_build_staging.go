@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// untrackedFiles lists the untracked files in the checkout that .gitignore (and info/exclude)
+// don't cover, i.e. the new files `git add -A` would stage.
+func untrackedFiles(ctx context.Context, workDir string) ([]string, error) {
+	out, err := runCmd(ctx, workDir, 30*time.Second, "git", "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files: %w\n%s", err, out)
+	}
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// recordArtifacts runs verify and remembers the untracked files it left behind (coverage
+// reports, binaries), which are build output rather than part of the fix.
+func recordArtifacts(ctx context.Context, ws *fixWorkspace, verify func() *fixBuildError) *fixBuildError {
+	before, err := untrackedFiles(ctx, ws.Dir)
+	if err != nil {
+		log.Printf("[fix_build] list untracked files: %v", err)
+		return verify()
+	}
+	fbErr := verify()
+	after, err := untrackedFiles(ctx, ws.Dir)
+	if err != nil {
+		log.Printf("[fix_build] list untracked files: %v", err)
+		return fbErr
+	}
+	seen := map[string]bool{}
+	for _, f := range before {
+		seen[f] = true
+	}
+	for _, f := range after {
+		if !seen[f] {
+			if ws.artifacts == nil {
+				ws.artifacts = map[string]bool{}
+			}
+			ws.artifacts[f] = true
+		}
+	}
+	return fbErr
+}
+
+// untrackedToLeaveOut returns the new files that mustn't be committed with the fix: those
+// verification created, and with stageTrackedOnly every new file outside newPaths. With
+// failOnUntracked, finding any fails the fix instead.
+func untrackedToLeaveOut(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload) ([]string, *fixBuildError) {
+	if len(ws.artifacts) == 0 && !payload.StageTrackedOnly {
+		return nil, nil
+	}
+	files, err := untrackedFiles(ctx, ws.Dir)
+	if err != nil {
+		log.Printf("[fix_build] untracked files: %v", err)
+		return nil, newFixBuildError(http.StatusInternalServerError, "git_add_failed", "listing untracked files failed: %v", err).inPhase("git_add").withLogs(err.Error())
+	}
+	var leaveOut []string
+	for _, f := range files {
+		if matchAnyGlob(payload.NewPaths, f) {
+			continue
+		}
+		if payload.StageTrackedOnly || ws.artifacts[f] {
+			leaveOut = append(leaveOut, f)
+		}
+	}
+	if len(leaveOut) > 0 && payload.FailOnUntracked {
+		log.Printf("[fix_build] unexpected untracked files: %s", strings.Join(leaveOut, ", "))
+		fbErr := newFixBuildError(http.StatusUnprocessableEntity, "untracked_files", "fix not pushed: %d untracked file(s) would have been committed with it", len(leaveOut)).inPhase("git_add")
+		fbErr.UntrackedFiles = leaveOut
+		return nil, fbErr
+	}
+	return leaveOut, nil
+}
+
+// unstage takes files back out of the index after `git add -A`, in chunks to keep command
+// lines short when a build left a whole tree behind.
+func unstage(ctx context.Context, workDir string, files []string) error {
+	const chunk = 100
+	for i := 0; i < len(files); i += chunk {
+		args := []string{"reset", "-q", "--"}
+		for _, f := range files[i:min(i+chunk, len(files))] {
+			args = append(args, ":(literal)"+f)
+		}
+		if out, err := runCmd(ctx, workDir, 30*time.Second, "git", args...); err != nil {
+			return fmt.Errorf("git reset: %w\n%s", err, out)
+		}
+	}
+	return nil
+}
+
+// leftOutWarning summarizes files left out of the commit, naming the first few.
+func leftOutWarning(files []string) string {
+	const shown = 5
+	names := strings.Join(files[:min(shown, len(files))], ", ")
+	if len(files) > shown {
+		names += fmt.Sprintf(" and %d more", len(files)-shown)
+	}
+	return fmt.Sprintf("left %d untracked file(s) out of the commit: %s", len(files), names)
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// useArtifactRunner fakes a fix where plandex adds pkg/new.go and the verify command then
+// writes coverage.out.
+func useArtifactRunner(t *testing.T) *fakeRunner {
+	t.Helper()
+	return useFakeRunner(t, map[string]fakeResponse{
+		"git ls-files --others --exclude-standard -z": {out: "pkg/new.go\x00", times: 1},
+		"git ls-files --others":                       {out: "coverage.out\x00pkg/new.go\x00"},
+	})
+}
+
+func TestFixBuildLeavesOutVerifyArtifacts(t *testing.T) {
+	tests := []struct {
+		name     string
+		sha      string
+		tracked  bool
+		newPaths []string
+		leftOut  []string
+	}{
+		{name: "artifacts", sha: "ccc0084", leftOut: []string{"coverage.out"}},
+		{name: "artifact allowed by newPaths", sha: "ccc1084", newPaths: []string{"*.out"}},
+		{name: "tracked only", sha: "ccc2084", tracked: true, leftOut: []string{"coverage.out", "pkg/new.go"}},
+		{name: "tracked only with newPaths", sha: "ccc3084", tracked: true, newPaths: []string{"pkg/**"}, leftOut: []string{"coverage.out"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useArtifactRunner(t)
+			payload := fakeRunnerPayload(tt.sha)
+			payload.VerifyCommand = "go test -coverprofile=coverage.out ./..."
+			payload.StageTrackedOnly = tt.tracked
+			payload.NewPaths = tt.newPaths
+
+			rec := postFixBuild(t, payload)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var res FixBuildResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+
+			var unstaged []string
+			for _, c := range f.calls {
+				if rest, ok := strings.CutPrefix(c, "git reset -q -- "); ok {
+					for _, p := range strings.Fields(rest) {
+						unstaged = append(unstaged, strings.TrimPrefix(p, ":(literal)"))
+					}
+				}
+			}
+			slices.Sort(unstaged)
+			if !slices.Equal(unstaged, tt.leftOut) {
+				t.Fatalf("expected %v left out of the commit, got %v", tt.leftOut, unstaged)
+			}
+			warned := slices.ContainsFunc(res.Warnings, func(w string) bool { return strings.Contains(w, "untracked") })
+			if warned != (len(tt.leftOut) > 0) {
+				t.Fatalf("expected a warning only when files were left out, got %v", res.Warnings)
+			}
+			if !f.called("git push") {
+				t.Fatal("expected the fix to be pushed")
+			}
+		})
+	}
+}
+
+func TestFixBuildFailOnUntracked(t *testing.T) {
+	f := useArtifactRunner(t)
+	payload := fakeRunnerPayload("ccc4084")
+	payload.VerifyCommand = "go test -coverprofile=coverage.out ./..."
+	payload.FailOnUntracked = true
+
+	rec := postFixBuild(t, payload)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body FixBuildErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != "untracked_files" || !slices.Equal(body.Error.UntrackedFiles, []string{"coverage.out"}) {
+		t.Fatalf("expected coverage.out reported, got %+v", body.Error)
+	}
+	if f.called("git commit") || f.called("git push") {
+		t.Fatal("expected nothing committed or pushed")
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const workDirPrefix = "plandex-fix-build-"
+
+// liveWorkDirs tracks the work dirs this process is using, so a sweep never removes one out from
+// under a long-running job.
+var liveWorkDirs = &workDirTracker{dirs: map[string]struct{}{}}
+
+type workDirTracker struct {
+	mu   sync.Mutex
+	dirs map[string]struct{}
+}
+
+func (t *workDirTracker) track(dir string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dirs[filepath.Clean(dir)] = struct{}{}
+}
+
+func (t *workDirTracker) untrack(dir string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.dirs, filepath.Clean(dir))
+}
+
+func (t *workDirTracker) has(dir string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.dirs[filepath.Clean(dir)]
+	return ok
+}
+
+// makeWorkDir creates a tracked temp dir under base; pattern must start with workDirPrefix.
+func makeWorkDir(base, pattern string) (string, error) {
+	dir, err := os.MkdirTemp(base, pattern)
+	if err != nil {
+		return "", err
+	}
+	liveWorkDirs.track(dir)
+	return dir, nil
+}
+
+// removeWorkDir removes a dir created by makeWorkDir and stops tracking it.
+func removeWorkDir(dir string) error {
+	defer liveWorkDirs.untrack(dir)
+	return os.RemoveAll(dir)
+}
+
+// SweepStaleWorkDirs removes the plandex-fix-build-* dirs under base that were last modified
+// more than maxAge ago and aren't in use by this process, such as those left by a crash. It
+// returns the dirs it removed.
+func SweepStaleWorkDirs(base string, maxAge time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	var removed []string
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), workDirPrefix) {
+			continue
+		}
+		dir := filepath.Join(base, e.Name())
+		info, err := e.Info()
+		if err != nil || !info.ModTime().Before(cutoff) || liveWorkDirs.has(dir) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("[fix_build] sweep stale work dir: %v", err)
+			continue
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+// StartFixBuildSweeper sweeps stale work dirs once now and then every
+// FIX_BUILD_STALE_WORKDIR_SWEEP_INTERVAL until ctx is done.
+func StartFixBuildSweeper(ctx context.Context) error {
+	cfg, err := loadFixBuildConfig()
+	if err != nil {
+		return err
+	}
+	sweep := func() {
+		base, err := workDirBase(cfg)
+		if err != nil {
+			log.Printf("[fix_build] sweep stale work dirs: %v", err)
+			return
+		}
+		removed, err := SweepStaleWorkDirs(base, cfg.StaleWorkDirAge)
+		if err != nil {
+			log.Printf("[fix_build] sweep stale work dirs: %v", err)
+		}
+		if len(removed) > 0 {
+			log.Printf("[fix_build] removed %d stale work dir(s)", len(removed))
+		}
+	}
+	sweep()
+	go func() {
+		ticker := time.NewTicker(cfg.StaleWorkDirSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweep()
+			}
+		}
+	}()
+	return nil
+}
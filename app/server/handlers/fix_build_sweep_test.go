@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweepStaleWorkDirs(t *testing.T) {
+	base := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+	mkdir := func(name string, mtime time.Time) string {
+		dir := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Join(dir, "repo"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	stale := mkdir(workDirPrefix+"stale", old)
+	staleKey := mkdir(workDirPrefix+"key-stale", old)
+	fresh := mkdir(workDirPrefix+"fresh", time.Now())
+	inFlight := mkdir(workDirPrefix+"in-flight", old)
+	other := mkdir("unrelated", old)
+	liveWorkDirs.track(inFlight)
+	defer liveWorkDirs.untrack(inFlight)
+
+	removed, err := SweepStaleWorkDirs(base, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(removed)
+	if want := []string{staleKey, stale}; len(removed) != 2 || removed[0] != want[0] || removed[1] != want[1] {
+		t.Fatalf("expected %v removed, got %v", want, removed)
+	}
+	for _, dir := range []string{stale, staleKey} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed", dir)
+		}
+	}
+	for _, dir := range []string{fresh, inFlight, other} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Fatalf("expected %s to be kept: %v", dir, err)
+		}
+	}
+}
+
+func TestMakeWorkDirTracksUntilRemoved(t *testing.T) {
+	dir, err := makeWorkDir(t.TempDir(), workDirPrefix+"*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !liveWorkDirs.has(dir) {
+		t.Fatal("expected a new work dir to be tracked")
+	}
+	if err := removeWorkDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if liveWorkDirs.has(dir) {
+		t.Fatal("expected a removed work dir to be untracked")
+	}
+}
+
+func TestFixBuildKeepWorkdir(t *testing.T) {
+	root := fakeGithub(t)
+	base := t.TempDir()
+	t.Setenv("FIX_BUILD_WORKDIR", base)
+	fakePlandex(t, `[ "$1" = "tell" ] && echo fixed > file.txt
+exit 0
+`)
+	post := func(name string, keep bool) *httptest.ResponseRecorder {
+		_, sha := addFakeGithubRepo(t, root, "acme", name)
+		return postFixBuild(t, FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: name}, HeadBranch: "main", HeadSha: sha, OutputSummary: "FAIL", InstallationToken: "tok", KeepWorkdir: keep})
+	}
+
+	if rec := post("keep-disabled", true); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without FIX_BUILD_ALLOW_KEEP_WORKDIR, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	t.Setenv("FIX_BUILD_ALLOW_KEEP_WORKDIR", "true")
+	rec := post("keep", true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res FixBuildResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(res.WorkDir) != base {
+		t.Fatalf("expected the kept work dir under %s, got %q", base, res.WorkDir)
+	}
+	if got := gitT(t, res.WorkDir, "show", "HEAD:file.txt"); got != "fixed" {
+		t.Fatalf("expected the fixed checkout to survive the handler, got %q", got)
+	}
+	if got := gitT(t, res.WorkDir, "remote", "get-url", "origin"); strings.Contains(got, "tok") {
+		t.Fatalf("expected the token to be scrubbed from the kept clone, got %q", got)
+	}
+
+	if rec := post("no-keep", false); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"workDir"`) {
+		t.Fatalf("expected no workDir without keepWorkdir, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The sweep reclaims the kept dir once it's old enough
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(res.WorkDir, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SweepStaleWorkDirs(base, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(res.WorkDir); !os.IsNotExist(err) {
+		t.Fatalf("expected the sweep to remove the kept work dir, got %v", err)
+	}
+}
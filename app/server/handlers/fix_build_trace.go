@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fixBuildTracerName is the instrumentation scope /fix_build spans are reported under.
+const fixBuildTracerName = "plandex-server/handlers/fix_build"
+
+// fixBuildTracerProvider supplies the tracer for /fix_build spans; tests swap in their own. The
+// global provider is a no-op until the server registers one with an exporter, so tracing costs
+// nothing when it isn't configured.
+var fixBuildTracerProvider = otel.GetTracerProvider
+
+func fixBuildTracer() trace.Tracer {
+	return fixBuildTracerProvider().Tracer(fixBuildTracerName)
+}
+
+// startRequestSpan starts the root span for a /fix_build request, continuing the trace the
+// caller propagated in its traceparent header, if any.
+func startRequestSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return fixBuildTracer().Start(ctx, "fix_build", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.path", r.URL.Path),
+	))
+}
+
+// payloadSpanAttributes identify the commit a span's work is for.
+func payloadSpanAttributes(p FixBuildPayload) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("fix_build.repo", p.Repo.Owner+"/"+p.Repo.Name),
+		attribute.String("fix_build.head_branch", p.HeadBranch),
+		attribute.String("fix_build.head_sha", p.HeadSha),
+	}
+}
+
+// startPhaseSpan starts a child span for one phase of a fix. Commands run under the returned
+// context are recorded on it.
+func startPhaseSpan(ctx context.Context, phase string) (context.Context, trace.Span) {
+	return fixBuildTracer().Start(ctx, "fix_build."+phase, trace.WithAttributes(attribute.String("fix_build.phase", phase)))
+}
+
+// endPhaseSpan records fbErr, if any, on span and ends it. It returns fbErr so a failing phase
+// can end its span as it returns.
+func endPhaseSpan(span trace.Span, fbErr *fixBuildError) *fixBuildError {
+	recordSpanError(span, fbErr)
+	span.End()
+	return fbErr
+}
+
+// recordSpanError marks span as failed with fbErr's code and phase. A nil fbErr leaves it as is.
+func recordSpanError(span trace.Span, fbErr *fixBuildError) {
+	if fbErr == nil {
+		return
+	}
+	span.SetAttributes(attribute.String("fix_build.error.code", fbErr.Code), attribute.Int("fix_build.error.status", fbErr.Status))
+	if fbErr.Phase != "" {
+		span.SetAttributes(attribute.String("fix_build.error.phase", fbErr.Phase))
+	}
+	span.RecordError(errors.New(fbErr.Message))
+	span.SetStatus(codes.Error, fbErr.Code)
+}
+
+// traceCommand records a finished command as an event on ctx's span, with its exit status. Only
+// the executable and subcommand are recorded: the rest of the arguments can carry prompts and
+// credentials.
+func traceCommand(ctx context.Context, name string, args []string, took time.Duration, err error) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("fix_build.command", commandLabel(name, args)),
+		attribute.Float64("fix_build.command.seconds", took.Seconds()),
+	}
+	var exitErr interface{ ExitCode() int }
+	switch {
+	case err == nil:
+		attrs = append(attrs, attribute.Int("fix_build.command.exit_code", 0))
+	case errors.As(err, &exitErr):
+		attrs = append(attrs, attribute.Int("fix_build.command.exit_code", exitErr.ExitCode()))
+	}
+	if err != nil {
+		attrs = append(attrs, attribute.String("fix_build.command.error", err.Error()))
+	}
+	span.AddEvent("command", trace.WithAttributes(attrs...))
+}
+
+// commandLabel is name's base followed by its subcommand, e.g. "git push" for
+// git -c k=v push https://token@host/repo, or just the base when there is none.
+func commandLabel(name string, args []string) string {
+	label := filepath.Base(name)
+	for len(args) >= 2 && (args[0] == "-c" || args[0] == "-C") {
+		args = args[2:]
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") || strings.Contains(args[0], "://") {
+		return label
+	}
+	return label + " " + args[0]
+}
+
+// statusWriter remembers the status a handler responded with, for its span.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// endRequestSpan records the response status on a request's root span and ends it. Server
+// errors mark the span as failed; client errors are the caller's and don't.
+func endRequestSpan(span trace.Span, w *statusWriter) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
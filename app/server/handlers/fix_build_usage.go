@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// plandex doesn't print usage in a stable, machine-readable form, so these patterns accept the
+// common shapes ("Input tokens: 12,345", "12345 prompt tokens", "Total cost: $0.42") and
+// parsing gives up (nil usage) rather than guessing when none match.
+var (
+	usageInputRe  = regexp.MustCompile(`(?i)(?:\b(?:input|prompt)[ _]tokens[ \t]*[:=][ \t]*([\d,]+)|([\d,]+)[ \t]+(?:input|prompt)[ \t]+tokens)`)
+	usageOutputRe = regexp.MustCompile(`(?i)(?:\b(?:output|completion)[ _]tokens[ \t]*[:=][ \t]*([\d,]+)|([\d,]+)[ \t]+(?:output|completion)[ \t]+tokens)`)
+	usageCostRe   = regexp.MustCompile(`(?i)\b(?:cost|spent)\b[^$\n]{0,40}\$[ \t]*(\d[\d,]*(?:\.\d+)?)`)
+)
+
+// parsePlandexUsage extracts token counts and cost from one plandex command's output. When a
+// value is printed more than once (running totals), the last one wins.
+func parsePlandexUsage(out string) *FixBuildUsage {
+	var u FixBuildUsage
+	found := false
+	lastInt := func(re *regexp.Regexp, dst *int) {
+		for _, m := range re.FindAllStringSubmatch(out, -1) {
+			v := m[1]
+			if v == "" {
+				v = m[2]
+			}
+			if n, err := strconv.Atoi(strings.ReplaceAll(v, ",", "")); err == nil {
+				*dst = n
+				found = true
+			}
+		}
+	}
+	lastInt(usageInputRe, &u.InputTokens)
+	lastInt(usageOutputRe, &u.OutputTokens)
+	for _, m := range usageCostRe.FindAllStringSubmatch(out, -1) {
+		if f, err := strconv.ParseFloat(strings.ReplaceAll(m[1], ",", ""), 64); err == nil {
+			u.CostUsd = f
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &u
+}
+
+// usageMeter totals usage across the plandex commands of a job, including every candidate.
+type usageMeter struct {
+	mu    sync.Mutex
+	total *FixBuildUsage
+}
+
+func (m *usageMeter) add(u *FixBuildUsage) {
+	if u == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.total == nil {
+		m.total = &FixBuildUsage{}
+	}
+	m.total.InputTokens += u.InputTokens
+	m.total.OutputTokens += u.OutputTokens
+	m.total.CostUsd += u.CostUsd
+}
+
+// result returns the total, or nil if no command's usage could be parsed.
+func (m *usageMeter) result() *FixBuildUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.total == nil {
+		return nil
+	}
+	u := *m.total
+	return &u
+}
+
+type fixBuildUsageRecord struct {
+	JobId string
+	Repo  FixBuildRepo
+	At    time.Time
+	Usage FixBuildUsage
+}
+
+// FixBuildUsageReport is the aggregated usage for one repo over a time range.
+type FixBuildUsageReport struct {
+	Repo         FixBuildRepo `json:"repo"`
+	From         *time.Time   `json:"from,omitempty"`
+	To           *time.Time   `json:"to,omitempty"`
+	Jobs         int          `json:"jobs"`
+	InputTokens  int          `json:"inputTokens"`
+	OutputTokens int          `json:"outputTokens"`
+	CostUsd      float64      `json:"costUsd"`
+}
+
+// recordUsage adds a job's usage to the history, dropping records older than retention.
+func (s *fixBuildJobStore) recordUsage(job FixBuildJob, usage FixBuildUsage, at time.Time, retention time.Duration) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+
+	if retention > 0 {
+		cutoff := at.Add(-retention)
+		kept := s.usage[:0]
+		for _, rec := range s.usage {
+			if !rec.At.Before(cutoff) {
+				kept = append(kept, rec)
+			}
+		}
+		s.usage = kept
+	}
+	s.usage = append(s.usage, fixBuildUsageRecord{JobId: job.Id, Repo: job.Repo, At: at, Usage: usage})
+}
+
+// aggregateUsage sums usage for repo over [from, to); nil bounds are open.
+func (s *fixBuildJobStore) aggregateUsage(repo FixBuildRepo, from, to *time.Time) FixBuildUsageReport {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+
+	report := FixBuildUsageReport{Repo: repo, From: from, To: to}
+	for _, rec := range s.usage {
+		if rec.Repo != repo {
+			continue
+		}
+		if (from != nil && rec.At.Before(*from)) || (to != nil && !rec.At.Before(*to)) {
+			continue
+		}
+		report.Jobs++
+		report.InputTokens += rec.Usage.InputTokens
+		report.OutputTokens += rec.Usage.OutputTokens
+		report.CostUsd += rec.Usage.CostUsd
+	}
+	return report
+}
+
+// FixBuildUsageHandler handles GET /fix_build/usage/{owner}/{name}?from=&to= (RFC 3339 bounds).
+func FixBuildUsageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repo := FixBuildRepo{Owner: vars["owner"], Name: vars["name"]}
+
+	var bounds [2]*time.Time
+	for i, param := range []string{"from", "to"} {
+		v := r.URL.Query().Get(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid "+param+": must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		bounds[i] = &t
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(fixBuildJobs.aggregateUsage(repo, bounds[0], bounds[1]))
+}
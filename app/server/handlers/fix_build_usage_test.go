@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAggregateUsage(t *testing.T) {
+	s := &fixBuildJobStore{jobs: map[string]*FixBuildJob{}}
+	widgets := FixBuildRepo{Owner: "acme", Name: "widgets"}
+	gadgets := FixBuildRepo{Owner: "acme", Name: "gadgets"}
+	day := func(d int) time.Time { return time.Date(2026, 3, d, 12, 0, 0, 0, time.UTC) }
+
+	s.recordUsage(FixBuildJob{Id: "1", Repo: widgets}, FixBuildUsage{InputTokens: 100, OutputTokens: 10, CostUsd: 0.5}, day(1), 0)
+	s.recordUsage(FixBuildJob{Id: "2", Repo: widgets}, FixBuildUsage{InputTokens: 200, OutputTokens: 20, CostUsd: 1.25}, day(5), 0)
+	s.recordUsage(FixBuildJob{Id: "3", Repo: gadgets}, FixBuildUsage{InputTokens: 999, OutputTokens: 99, CostUsd: 9}, day(5), 0)
+	s.recordUsage(FixBuildJob{Id: "4", Repo: widgets}, FixBuildUsage{InputTokens: 400, OutputTokens: 40, CostUsd: 2}, day(10), 0)
+
+	all := s.aggregateUsage(widgets, nil, nil)
+	if all.Jobs != 3 || all.InputTokens != 700 || all.OutputTokens != 70 || math.Abs(all.CostUsd-3.75) > 1e-9 {
+		t.Fatalf("unexpected totals: %+v", all)
+	}
+
+	from, to := day(2), day(10)
+	ranged := s.aggregateUsage(widgets, &from, &to)
+	if ranged.Jobs != 1 || ranged.InputTokens != 200 {
+		t.Fatalf("expected only the day-5 job in [day 2, day 10), got %+v", ranged)
+	}
+}
+
+func TestRecordUsageRetention(t *testing.T) {
+	s := &fixBuildJobStore{jobs: map[string]*FixBuildJob{}}
+	repo := FixBuildRepo{Owner: "acme", Name: "widgets"}
+	now := time.Now()
+
+	s.recordUsage(FixBuildJob{Id: "old", Repo: repo}, FixBuildUsage{CostUsd: 1}, now.Add(-48*time.Hour), time.Hour)
+	s.recordUsage(FixBuildJob{Id: "new", Repo: repo}, FixBuildUsage{CostUsd: 2}, now, time.Hour)
+
+	if got := s.aggregateUsage(repo, nil, nil); got.Jobs != 1 || got.CostUsd != 2 {
+		t.Fatalf("expected the expired record to be dropped, got %+v", got)
+	}
+}
+
+func TestFixBuildUsageHandler(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/fix_build/usage/{owner}/{name}", FixBuildUsageHandler)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fix_build/usage/acme/widgets?from=2026-01-01T00:00:00Z", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var report FixBuildUsageReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Repo.Name != "widgets" || report.From == nil {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fix_build/usage/acme/widgets?to=yesterday", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad bound, got %d", rec.Code)
+	}
+}
+
+func TestParsePlandexUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want *FixBuildUsage
+	}{
+		{
+			name: "summary block",
+			out: `🚀 Plan fix-ci complete
+Input tokens: 12,345
+Output tokens: 2,100
+Total cost: $0.4213
+`,
+			want: &FixBuildUsage{InputTokens: 12345, OutputTokens: 2100, CostUsd: 0.4213},
+		},
+		{
+			name: "inline counts and running totals",
+			out: `Reply 1 used 8000 prompt tokens, 900 completion tokens
+Reply 2 used 15200 prompt tokens, 1800 completion tokens
+💸 Spent on plan: $ 0.31
+`,
+			want: &FixBuildUsage{InputTokens: 15200, OutputTokens: 1800, CostUsd: 0.31},
+		},
+		{
+			name: "cost only",
+			out:  "Build finished. Estimated cost $1,204.50 this month\n",
+			want: &FixBuildUsage{CostUsd: 1204.5},
+		},
+		{
+			name: "no usage printed",
+			out:  "✅ Applied changes to 2 files\n",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parsePlandexUsage(tt.out)
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Fatalf("want %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFixBuildResponseIncludesUsage(t *testing.T) {
+	root := fakeGithub(t)
+	_, sha := addFakeGithubRepo(t, root, "acme", "metered")
+	fakePlandex(t, `case "$1" in
+tell) echo fixed > file.txt; echo "Input tokens: 1,000"; echo "Output tokens: 200"; echo "Total cost: \$0.05" ;;
+build) echo "Input tokens: 500"; echo "Output tokens: 50"; echo "Total cost: \$0.01" ;;
+esac
+`)
+
+	rec := postFixBuild(t, FixBuildPayload{Repo: FixBuildRepo{Owner: "acme", Name: "metered"}, HeadBranch: "main", HeadSha: sha, OutputSummary: "FAIL", InstallationToken: "tok"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res FixBuildResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Usage == nil || res.Usage.InputTokens != 1500 || res.Usage.OutputTokens != 250 || math.Abs(res.Usage.CostUsd-0.06) > 1e-9 {
+		t.Fatalf("expected tell and build usage to be summed, got %+v", res.Usage)
+	}
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// validateProbeRef is the branch the push check pretends to delete. It doesn't exist, and the
+// push is a dry run, so nothing on the remote changes either way.
+const validateProbeRef = "refs/heads/plandex-fix/validate-probe"
+
+// FixBuildAccess is whether a payload's credentials would let a fix clone the repo and push
+// the fix.
+type FixBuildAccess struct {
+	// Ok is set when both would be permitted.
+	Ok    bool `json:"ok"`
+	Clone bool `json:"clone"`
+	Push  bool `json:"push"`
+	// BranchExists is whether headBranch is on the remote; a fix for a deleted branch recreates it.
+	BranchExists bool `json:"branchExists"`
+	// Reasons explain the checks that failed, with credentials masked.
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// FixBuildValidateHandler handles POST /fix_build/validate: it takes a /fix_build payload and
+// checks that its token or deploy key can read the repo and push to it, without doing any fix,
+// so a caller can fail fast instead of at the push.
+func FixBuildValidateHandler(w http.ResponseWriter, r *http.Request) {
+	payload, cfg, ok := decodeFixBuildRequest(w, r)
+	if !ok {
+		return
+	}
+	// Nothing is checked out, so there's nothing to keep
+	payload.KeepWorkdir = false
+	ws, err := newFixWorkspace(cfg, payload)
+	if err != nil {
+		log.Printf("[fix_build] validate workspace: %v", err)
+		writeFixBuildError(w, newFixBuildError(http.StatusInternalServerError, "workspace_failed", "failed to create work dir").inPhase("workspace"))
+		return
+	}
+	defer ws.cleanup()
+
+	access, err := checkAccess(r.Context(), ws, payload, cfg)
+	if err != nil {
+		log.Printf("[fix_build] validate: %v", err)
+		writeFixBuildError(w, phaseError("validate", redactToken(err, payload.InstallationToken)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(access)
+}
+
+// checkAccess lists headBranch on the clone remote, which needs read access, and dry-runs a
+// push to the push remote, which makes the remote check for write access without changing
+// anything. ws is an empty work dir, or the payload's local checkout.
+func checkAccess(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) (FixBuildAccess, error) {
+	var access FixBuildAccess
+	var env []string
+	if ws.keyDir != "" {
+		env = []string{"GIT_SSH_COMMAND=" + sshCommand(filepath.Join(ws.keyDir, "id"))}
+	}
+	if !ws.local {
+		// git push needs a repo to run in, even one with no commits
+		if out, err := runCmd(ctx, ws.Dir, 10*time.Second, "git", "init", "-q"); err != nil {
+			return access, fmt.Errorf("git init: %w\n%s", err, out)
+		}
+	}
+	reason := func(check string, out []byte) string {
+		return fmt.Sprintf("%s: %s", check, strings.TrimSpace(string(redactOutput(out, payload.InstallationToken))))
+	}
+
+	out, err := runCmdEnv(ctx, ws.Dir, cfg.Timeouts.Clone, env, "git", "ls-remote", "--heads", cloneRemote(payload), "refs/heads/"+payload.HeadBranch)
+	if err == nil {
+		access.Clone = true
+		access.BranchExists = strings.TrimSpace(string(out)) != ""
+	} else {
+		access.Reasons = append(access.Reasons, reason("clone", out))
+	}
+
+	target := cloneRemote(payload)
+	if payload.PushRemoteUrl != "" {
+		target = authenticatedPushUrl(payload)
+	}
+	out, err = runCmdEnv(ctx, ws.Dir, cfg.Timeouts.Push, env, "git", "push", "--dry-run", target, ":"+validateProbeRef)
+	// Deleting a branch that isn't there fails only once the remote has let the push in
+	if err == nil || strings.Contains(string(out), "remote ref does not exist") {
+		access.Push = true
+	} else {
+		access.Reasons = append(access.Reasons, reason("push", out))
+	}
+
+	access.Ok = access.Clone && access.Push
+	return access, nil
+}
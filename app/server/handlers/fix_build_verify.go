@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// verifyChangedData is what verifyChangedCommandTemplate can reference. Both fields are
+// space-separated and shell-quoted, relative to the payload's WorkingDirectory.
+type verifyChangedData struct {
+	// ChangedFiles are the files the fix changed, e.g. 'pkg/a/a.go' 'pkg/b/b_test.go'.
+	ChangedFiles string
+	// ChangedPackages are the directories holding them, e.g. './pkg/a' './pkg/b'.
+	ChangedPackages string
+}
+
+// parseVerifyChangedTemplate parses a verifyChangedCommandTemplate and renders it against sample
+// data, so references to unknown fields are caught up front rather than on a fix.
+func parseVerifyChangedTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("verifyChangedCommandTemplate").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verifyChangedCommandTemplate: %v", err)
+	}
+	if err := tmpl.Execute(&strings.Builder{}, verifyChangedData{ChangedFiles: "'main.go'", ChangedPackages: "'.'"}); err != nil {
+		return nil, fmt.Errorf("invalid verifyChangedCommandTemplate: %v", err)
+	}
+	return tmpl, nil
+}
+
+// changedFiles lists the files the fix changed in the working tree, tracked or new, without
+// deletions. Paths are relative to the repo root.
+func changedFiles(ctx context.Context, workDir string) ([]string, error) {
+	var files []string
+	for _, args := range [][]string{
+		{"diff", "--name-only", "--no-renames", "--diff-filter=d", "-z", "HEAD"},
+		{"ls-files", "--others", "--exclude-standard", "-z"},
+	} {
+		out, err := runCmd(ctx, workDir, 30*time.Second, "git", args...)
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w\n%s", args[0], err, out)
+		}
+		for _, f := range strings.Split(string(out), "\x00") {
+			if f != "" {
+				files = append(files, f)
+			}
+		}
+	}
+	return files, nil
+}
+
+// newVerifyChangedData maps repo-relative changed files to workingDir. ok is false when there
+// are none, or any falls outside workingDir, since a scoped command couldn't cover it.
+func newVerifyChangedData(files []string, workingDir string) (verifyChangedData, bool) {
+	if len(files) == 0 {
+		return verifyChangedData{}, false
+	}
+	root := path.Clean(filepath.ToSlash(workingDir))
+	seenFile, seenPkg := map[string]bool{}, map[string]bool{}
+	var rels, pkgs []string
+	for _, f := range files {
+		rel := path.Clean(f)
+		if root != "." {
+			if !strings.HasPrefix(rel, root+"/") {
+				return verifyChangedData{}, false
+			}
+			rel = strings.TrimPrefix(rel, root+"/")
+		}
+		if !seenFile[rel] {
+			seenFile[rel] = true
+			rels = append(rels, rel)
+		}
+		pkg := "./" + path.Dir(rel)
+		if path.Dir(rel) == "." {
+			pkg = "."
+		}
+		if !seenPkg[pkg] {
+			seenPkg[pkg] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	sort.Strings(rels)
+	sort.Strings(pkgs)
+	quote := func(items []string) string {
+		quoted := make([]string, len(items))
+		for i, s := range items {
+			quoted[i] = shellQuote(s)
+		}
+		return strings.Join(quoted, " ")
+	}
+	return verifyChangedData{ChangedFiles: quote(rels), ChangedPackages: quote(pkgs)}, true
+}
+
+// changedVerifyCommands renders the payload's verifyChangedCommandTemplate for the files the fix
+// changed. ok is false, and the full verify commands should run instead, when the changes don't
+// map cleanly onto it.
+func changedVerifyCommands(ctx context.Context, workDir string, payload FixBuildPayload) ([][]string, bool) {
+	tmpl, err := parseVerifyChangedTemplate(payload.VerifyChangedCommandTemplate)
+	if err != nil {
+		log.Printf("[fix_build] verify changed: %v", err)
+		return nil, false
+	}
+	files, err := changedFiles(ctx, workDir)
+	if err != nil {
+		log.Printf("[fix_build] verify changed: %v", err)
+		return nil, false
+	}
+	data, ok := newVerifyChangedData(files, payload.WorkingDirectory)
+	if !ok {
+		log.Printf("[fix_build] changes don't map onto verifyChangedCommandTemplate; running the full verify")
+		return nil, false
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		log.Printf("[fix_build] verify changed: %v", err)
+		return nil, false
+	}
+	return [][]string{{"sh", "-c", b.String()}}, true
+}
+
+// testRunners are the test runners a verify command can be narrowed to one test for, by the
+// command prefix that runs them and the flag that selects tests by name ("" for a positional
+// filter).
+var testRunners = []struct {
+	prefix []string
+	flag   string
+}{
+	{[]string{"go", "test"}, "-run"},
+	{[]string{"pytest"}, "-k"},
+	{[]string{"python", "-m", "pytest"}, "-k"},
+	{[]string{"python3", "-m", "pytest"}, "-k"},
+	{[]string{"jest"}, "-t"},
+	{[]string{"npx", "jest"}, "-t"},
+	{[]string{"vitest"}, "-t"},
+	{[]string{"npx", "vitest"}, "-t"},
+	{[]string{"cargo", "test"}, ""},
+}
+
+// shellMetachars mark a shell command as more than one plain command, which a selector can't
+// safely be appended to.
+const shellMetachars = ";&|<>()$`\\\n"
+
+// validateTestSelection checks a payload's testName and testSelector.
+func validateTestSelection(name, selector string) error {
+	if selector != "" && name == "" {
+		return fmt.Errorf("testSelector requires testName")
+	}
+	if strings.ContainsAny(name, "\r\n") || strings.ContainsAny(selector, "\r\n") {
+		return fmt.Errorf("testName and testSelector must be a single line")
+	}
+	if strings.HasPrefix(selector, "-") || (selector == "" && strings.HasPrefix(name, "-")) {
+		return fmt.Errorf("testSelector must not start with '-'")
+	}
+	return nil
+}
+
+// testSelector is what selects the payload's failing test in its test runner.
+func testSelector(p FixBuildPayload) string {
+	if p.TestSelector != "" {
+		return p.TestSelector
+	}
+	return p.TestName
+}
+
+// testRunnerFlag returns the selector flag for the test runner args run, if it's a known one.
+func testRunnerFlag(args []string) (string, bool) {
+	for _, r := range testRunners {
+		if len(args) >= len(r.prefix) && slices.Equal(args[:len(r.prefix)], r.prefix) {
+			return r.flag, true
+		}
+	}
+	return "", false
+}
+
+// scopeToTest narrows one verify command to the tests matching selector. ok is false when it
+// doesn't run a known test runner, or is a shell command more complex than a single call.
+func scopeToTest(command []string, selector string) ([]string, bool) {
+	if len(command) == 3 && command[0] == "sh" && command[1] == "-c" {
+		script := command[2]
+		if strings.ContainsAny(script, shellMetachars) {
+			return nil, false
+		}
+		flag, ok := testRunnerFlag(strings.Fields(script))
+		if !ok {
+			return nil, false
+		}
+		if flag != "" {
+			script += " " + flag
+		}
+		return []string{"sh", "-c", script + " " + shellQuote(selector)}, true
+	}
+	flag, ok := testRunnerFlag(command)
+	if !ok {
+		return nil, false
+	}
+	scoped := slices.Clone(command)
+	if flag != "" {
+		scoped = append(scoped, flag)
+	}
+	return append(scoped, selector), true
+}
+
+// testVerifyCommands narrows the test runs among commands to the tests matching selector,
+// leaving any other checks as they are. ok is false when none of them could be narrowed.
+func testVerifyCommands(commands [][]string, selector string) ([][]string, bool) {
+	scoped := make([][]string, len(commands))
+	narrowedAny := false
+	for i, command := range commands {
+		if narrowed, ok := scopeToTest(command, selector); ok {
+			scoped[i], narrowedAny = narrowed, true
+		} else {
+			scoped[i] = command
+		}
+	}
+	return scoped, narrowedAny
+}
+
+// scopedVerifyCommands is the payload's verify commands, narrowed to its testName if it has one
+// and they can be.
+func scopedVerifyCommands(p FixBuildPayload) [][]string {
+	commands := verifyCommands(p)
+	if p.TestName == "" {
+		return commands
+	}
+	scoped, ok := testVerifyCommands(commands, testSelector(p))
+	if !ok {
+		log.Printf("[fix_build] no verify command runs a known test runner; running the full verify for %s", p.TestName)
+		return commands
+	}
+	return scoped
+}
+
+// retryVerifyFix runs verifyFix on ws, re-running a failed verification up to the payload's
+// verifyRetries times. A pass on a retry is recorded in ws and warned about as a likely flake;
+// failing every run is reported with how many there were.
+func retryVerifyFix(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	ws.verifyRetries = 0
+	for retry := 0; ; retry++ {
+		fbErr := verifyFix(ctx, ws.Dir, payload, cfg)
+		if fbErr == nil {
+			ws.verifyRetries = retry
+			if retry > 0 {
+				log.Printf("[fix_build] verify passed on retry %d of %d; the check may be flaky", retry, payload.VerifyRetries)
+			}
+			return nil
+		}
+		if fbErr.Code != "verify_failed" || payload.VerifyRetries == 0 {
+			return fbErr
+		}
+		if retry >= payload.VerifyRetries {
+			fbErr.VerifyRuns = retry + 1
+			fbErr.Message = fmt.Sprintf("failed all %d verify runs: %s", retry+1, fbErr.Message)
+			return fbErr
+		}
+		log.Printf("[fix_build] verify failed; retrying (%d of %d)", retry+1, payload.VerifyRetries)
+		select {
+		case <-ctx.Done():
+			return phaseError("verify", ctx.Err())
+		case <-time.After(cfg.VerifyRetryDelay):
+		}
+	}
+}
+
+// alreadyFixedUpstream is the skip reason when CheckAlreadyFixed finds the verify commands pass
+// on the head branch's tip.
+const alreadyFixedUpstream = "already fixed upstream"
+
+// checkAlreadyFixed runs the verify commands on the head branch's tip, for CheckAlreadyFixed,
+// when it's a descendant of headSha. A pass is reported as an already_fixed error, which the job
+// turns into a skip; otherwise ws is put back on headSha and the fix goes ahead.
+func checkAlreadyFixed(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	out, err := runCmd(ctx, ws.Dir, 10*time.Second, "git", "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+payload.HeadBranch)
+	tip := strings.TrimSpace(string(out))
+	if err != nil || tip == "" || strings.HasPrefix(tip, payload.HeadSha) {
+		return nil
+	}
+	if _, err := runCmd(ctx, ws.Dir, 30*time.Second, "git", "merge-base", "--is-ancestor", payload.HeadSha, tip); err != nil {
+		log.Printf("[fix_build] %s has moved to %s, which doesn't contain %s; fixing %s", payload.HeadBranch, tip, payload.HeadSha, payload.HeadSha)
+		return nil
+	}
+	if out, err := runCmd(ctx, ws.Dir, 30*time.Second, "git", "reset", "--hard", tip); err != nil {
+		log.Printf("[fix_build] reset to branch tip: %v\n%s", err, out)
+		return newFixBuildError(http.StatusInternalServerError, "reset_failed", "reset to the branch tip failed: %v", err).inPhase("already_fixed").withLogs(string(out))
+	}
+
+	vctx, span := startPhaseSpan(withResourceLimits(ctx, cfg.ResourceLimits), "already_fixed")
+	_, _, verr := runVerifyCommands(vctx, filepath.Join(ws.Dir, payload.WorkingDirectory), scopedVerifyCommands(payload), payloadEnv(payload.Env), cfg.Timeouts.Build)
+	if vctx.Err() != nil {
+		return endPhaseSpan(span, phaseError("already_fixed", verr))
+	}
+	span.SetAttributes(attribute.Bool("fix_build.already_fixed", verr == nil))
+	span.End()
+	if verr == nil {
+		return newFixBuildError(http.StatusOK, "already_fixed", "%s: the verify commands pass on %s's tip %s", alreadyFixedUpstream, payload.HeadBranch, tip).inPhase("already_fixed")
+	}
+	log.Printf("[fix_build] still failing on %s's tip %s: %v", payload.HeadBranch, tip, verr)
+
+	// Undo the tip's run: its output isn't part of the fix
+	if out, err := runCmd(ctx, ws.Dir, 30*time.Second, "git", "reset", "--hard", payload.HeadSha); err != nil {
+		log.Printf("[fix_build] reset to sha: %v\n%s", err, out)
+		return newFixBuildError(http.StatusInternalServerError, "reset_failed", "reset failed: %v", err).inPhase("already_fixed").withLogs(string(out))
+	}
+	if err := excludeUntracked(ctx, ws.Dir); err != nil {
+		log.Printf("[fix_build] exclude already-fixed output: %v", err)
+		return phaseError("already_fixed", err)
+	}
+	return nil
+}
+
+// failureNotReproduced is the skip reason when ConfirmFailureFirst finds the verify commands
+// already pass.
+const failureNotReproduced = "failure did not reproduce"
+
+// confirmFailure runs the verify commands on ws's clean checkout, for ConfirmFailureFirst. A
+// pass is reported as a failure_not_reproduced error, which the job turns into a skip. Any
+// failure, including a timeout, means the failure reproduced and the fix can go ahead.
+func confirmFailure(ctx context.Context, ws *fixWorkspace, payload FixBuildPayload, cfg fixBuildConfig) *fixBuildError {
+	ctx, span := startPhaseSpan(withResourceLimits(ctx, cfg.ResourceLimits), "confirm")
+	_, _, err := runVerifyCommands(ctx, filepath.Join(ws.Dir, payload.WorkingDirectory), scopedVerifyCommands(payload), payloadEnv(payload.Env), cfg.Timeouts.Build)
+	if ctx.Err() != nil {
+		return endPhaseSpan(span, phaseError("confirm", err))
+	}
+	span.SetAttributes(attribute.Bool("fix_build.reproduced", err != nil))
+	span.End()
+	if err == nil {
+		return newFixBuildError(http.StatusOK, "failure_not_reproduced", "%s: the verify commands pass on the clean checkout", failureNotReproduced).inPhase("confirm")
+	}
+	log.Printf("[fix_build] failure reproduced: %v", err)
+	// Like setup's, what the failing run left behind isn't part of the fix
+	if err := excludeUntracked(ctx, ws.Dir); err != nil {
+		log.Printf("[fix_build] exclude confirm output: %v", err)
+		return phaseError("confirm", err)
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNewVerifyChangedData(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      []string
+		workingDir string
+		ok         bool
+		want       verifyChangedData
+	}{
+		{"repo root", []string{"pkg/b/b_test.go", "pkg/a/a.go", "main.go", "pkg/a/a_test.go"}, "", true,
+			verifyChangedData{ChangedFiles: "'main.go' 'pkg/a/a.go' 'pkg/a/a_test.go' 'pkg/b/b_test.go'", ChangedPackages: "'.' './pkg/a' './pkg/b'"}},
+		{"working directory", []string{"services/api/handler.go"}, "services/api", true,
+			verifyChangedData{ChangedFiles: "'handler.go'", ChangedPackages: "'.'"}},
+		{"outside working directory", []string{"services/api/handler.go", "lib/util.go"}, "services/api", false, verifyChangedData{}},
+		{"no changes", nil, "", false, verifyChangedData{}},
+	}
+	for _, tt := range tests {
+		got, ok := newVerifyChangedData(tt.files, tt.workingDir)
+		if ok != tt.ok || got != tt.want {
+			t.Fatalf("%s: want %+v (ok %v), got %+v (ok %v)", tt.name, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestFixBuildVerifyChangedOnly(t *testing.T) {
+	payload := func(sha string) FixBuildPayload {
+		p := fakeRunnerPayload(sha)
+		p.VerifyCommand = "go test ./..."
+		p.VerifyChangedOnly = true
+		p.VerifyChangedCommandTemplate = "go test {{.ChangedPackages}} # {{.ChangedFiles}}"
+		return p
+	}
+
+	t.Run("templated with the changed files", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{
+			"git diff --name-only --no-renames --diff-filter=d -z HEAD": {out: "pkg/a/a.go\x00pkg/a/a_test.go\x00"},
+			"git ls-files --others": {out: "pkg/b/new_test.go\x00"},
+		})
+		if rec := postFixBuild(t, payload("ddd0075")); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		want := "sh -c go test './pkg/a' './pkg/b' # 'pkg/a/a.go' 'pkg/a/a_test.go' 'pkg/b/new_test.go'"
+		if !f.called(want) {
+			t.Fatalf("expected %q; calls were:\n%s", want, strings.Join(f.calls, "\n"))
+		}
+		if f.called("sh -c go test ./...") {
+			t.Fatal("expected the full verify command not to run")
+		}
+	})
+
+	t.Run("falls back to the full verify", func(t *testing.T) {
+		f := useFakeRunner(t, nil)
+		if rec := postFixBuild(t, payload("ddd1075")); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !f.called("sh -c go test ./...") {
+			t.Fatalf("expected the full verify command without changed files; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("rejects an invalid template", func(t *testing.T) {
+		useFakeRunner(t, nil)
+		p := payload("ddd2075")
+		p.VerifyChangedCommandTemplate = "go test {{.Packages}}"
+		if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestTestVerifyCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands [][]string
+		ok       bool
+		want     [][]string
+	}{
+		{"go test via sh", [][]string{{"sh", "-c", "go test ./..."}}, true,
+			[][]string{{"sh", "-c", "go test ./... -run '^TestParse$'"}}},
+		{"pytest argv with a lint step", [][]string{{"ruff", "check", "."}, {"python", "-m", "pytest", "tests"}}, true,
+			[][]string{{"ruff", "check", "."}, {"python", "-m", "pytest", "tests", "-k", "^TestParse$"}}},
+		{"cargo positional", [][]string{{"cargo", "test", "--workspace"}}, true,
+			[][]string{{"cargo", "test", "--workspace", "^TestParse$"}}},
+		{"shell pipeline", [][]string{{"sh", "-c", "go test ./... | tee out.txt"}}, false, nil},
+		{"unknown runner", [][]string{{"sh", "-c", "make test"}}, false, nil},
+	}
+	for _, tt := range tests {
+		got, ok := testVerifyCommands(tt.commands, "^TestParse$")
+		if ok != tt.ok || (ok && !slices.EqualFunc(got, tt.want, slices.Equal[[]string])) {
+			t.Fatalf("%s: want %q (ok %v), got %q (ok %v)", tt.name, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestFixBuildTestName(t *testing.T) {
+	t.Run("scopes the prompt and verify", func(t *testing.T) {
+		f := useFakeRunner(t, nil)
+		p := fakeRunnerPayload("ddd0077")
+		p.VerifyCommand = "go test ./..."
+		p.TestName = "TestParse"
+		if rec := postFixBuild(t, p); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !f.called("plandex tell Fix the failing test `TestParse`.") {
+			t.Fatalf("expected the test in the prompt; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+		if !f.called("sh -c go test ./... -run 'TestParse'") {
+			t.Fatalf("expected verify to run only the test; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("uses the selector for argv commands", func(t *testing.T) {
+		f := useFakeRunner(t, nil)
+		p := fakeRunnerPayload("ddd1077")
+		p.VerifyCommands = [][]string{{"pytest", "tests"}}
+		p.TestName = "test_parse_dates"
+		p.TestSelector = "parse_dates and not slow"
+		if rec := postFixBuild(t, p); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if !f.called("plandex tell Fix the failing test `test_parse_dates`.") {
+			t.Fatalf("expected the test name in the prompt; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+		if !f.called("pytest tests -k parse_dates and not slow") {
+			t.Fatalf("expected verify to select the test; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("rejects a selector without a name", func(t *testing.T) {
+		useFakeRunner(t, nil)
+		p := fakeRunnerPayload("ddd2077")
+		p.TestSelector = "TestParse"
+		if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestFixBuildConfirmFailureFirst(t *testing.T) {
+	payload := func(sha string) FixBuildPayload {
+		p := fakeRunnerPayload(sha)
+		p.FailingCommand = "go test ./..."
+		p.ConfirmFailureFirst = true
+		return p
+	}
+
+	t.Run("reproduces", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{
+			"sh -c go test ./...": {out: "--- FAIL: TestParse", err: &fakeExitError{code: 1}, times: 1},
+		})
+		rec := postFixBuild(t, payload("bbb0080"))
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"skipped":true`) {
+			t.Fatalf("expected a fix, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if f.countCalls("sh -c go test ./...") != 2 || !f.called("plandex tell") || !f.called("git push") {
+			t.Fatalf("expected the failure confirmed, fixed, verified and pushed; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("does not reproduce", func(t *testing.T) {
+		f := useFakeRunner(t, nil)
+		rec := postFixBuild(t, payload("bbb1080"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var res FixBuildResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Ok || !res.Skipped || res.SkipReason != failureNotReproduced {
+			t.Fatalf("expected a skip for a failure that didn't reproduce, got %+v", res)
+		}
+		if f.called("plandex") || f.called("git push") {
+			t.Fatalf("expected no fix or push; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("needs a command", func(t *testing.T) {
+		useFakeRunner(t, nil)
+		p := payload("bbb2080")
+		p.FailingCommand = ""
+		if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestFixBuildCheckAlreadyFixed(t *testing.T) {
+	payload := func(sha string) FixBuildPayload {
+		p := fakeRunnerPayload(sha)
+		p.FailingCommand = "go test ./..."
+		p.CheckAlreadyFixed = true
+		return p
+	}
+	const tip = "7ip0000"
+	tipRef := "git rev-parse --verify --quiet refs/remotes/origin/main"
+
+	t.Run("already fixed", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{tipRef: {out: tip + "\n"}})
+		rec := postFixBuild(t, payload("fff0091"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var res FixBuildResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Ok || !res.Skipped || res.SkipReason != alreadyFixedUpstream {
+			t.Fatalf("expected a skip for a failure fixed on the branch, got %+v", res)
+		}
+		if !f.called("git merge-base --is-ancestor fff0091 "+tip) || !f.called("git reset --hard "+tip) {
+			t.Fatalf("expected the branch tip checked; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+		if f.called("plandex") || f.called("git push") {
+			t.Fatalf("expected no fix or push; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("still failing", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{
+			tipRef:                {out: tip + "\n"},
+			"sh -c go test ./...": {out: "--- FAIL: TestParse", err: &fakeExitError{code: 1}, times: 1},
+		})
+		rec := postFixBuild(t, payload("fff1091"))
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"skipped":true`) {
+			t.Fatalf("expected a fix, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if f.countCalls("git reset --hard fff1091") != 2 || !f.called("plandex tell") || !f.called("git push") {
+			t.Fatalf("expected headSha restored, fixed and pushed; calls were:\n%s", strings.Join(f.calls, "\n"))
+		}
+	})
+
+	t.Run("tip elsewhere", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{
+			tipRef:           {out: tip + "\n"},
+			"git merge-base": {err: &fakeExitError{code: 1}},
+		})
+		rec := postFixBuild(t, payload("fff2091"))
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"skipped":true`) {
+			t.Fatalf("expected a fix, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if f.called("git reset --hard " + tip) {
+			t.Fatal("expected a tip that doesn't contain headSha left alone")
+		}
+	})
+
+	t.Run("needs a command", func(t *testing.T) {
+		useFakeRunner(t, nil)
+		p := payload("fff3091")
+		p.FailingCommand = ""
+		if rec := postFixBuild(t, p); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestFixBuildVerifyRetries(t *testing.T) {
+	t.Setenv("FIX_BUILD_VERIFY_RETRY_DELAY", "10ms")
+	tests := []struct {
+		name    string
+		sha     string
+		retries int
+		status  int
+	}{
+		{name: "passes on retry", sha: "eee0088", retries: 2, status: http.StatusOK},
+		{name: "retries off", sha: "eee1088", status: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Flaky: fails the first run only
+			f := useFakeRunner(t, map[string]fakeResponse{
+				"sh -c make test": {out: "FAIL: TestWidget (timeout)", err: &fakeExitError{code: 1}, times: 1},
+			})
+			payload := fakeRunnerPayload(tt.sha)
+			payload.VerifyCommand = "make test"
+			payload.VerifyRetries = tt.retries
+			rec := postFixBuild(t, payload)
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				if f.called("git push") || f.countCalls("sh -c make test") != 1 {
+					t.Fatal("expected one verify run and nothing pushed")
+				}
+				return
+			}
+			var res FixBuildResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.VerifyRetries != 1 || !slices.ContainsFunc(res.Warnings, func(w string) bool { return strings.Contains(w, "flaky") }) {
+				t.Fatalf("expected a pass on the first retry flagged as flaky, got %+v", res)
+			}
+			if n := f.countCalls("plandex tell"); n != 1 {
+				t.Fatalf("expected only verify re-run, got %d tells", n)
+			}
+			if !f.called("git push") {
+				t.Fatal("expected the fix to be pushed")
+			}
+		})
+	}
+}
+
+func TestFixBuildVerifyFailsEveryRetry(t *testing.T) {
+	t.Setenv("FIX_BUILD_VERIFY_RETRY_DELAY", "10ms")
+	f := useFakeRunner(t, map[string]fakeResponse{
+		"sh -c make test": {out: "FAIL: TestWidget", err: &fakeExitError{code: 1}},
+	})
+	payload := fakeRunnerPayload("eee2088")
+	payload.VerifyCommand = "make test"
+	payload.VerifyRetries = 2
+	rec := postFixBuild(t, payload)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body FixBuildErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != "verify_failed" || body.Error.VerifyRuns != 3 || f.countCalls("sh -c make test") != 3 {
+		t.Fatalf("expected 3 failed verify runs, got %+v", body.Error)
+	}
+
+	payload = fakeRunnerPayload("eee3088")
+	payload.VerifyRetries = 4
+	if rec := postFixBuild(t, payload); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 above FIX_BUILD_MAX_VERIFY_RETRIES, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestFixBuildVerified(t *testing.T) {
+	failed := fakeResponse{out: "--- FAIL: TestWidget", err: &fakeExitError{code: 1}}
+	tests := []struct {
+		name      string
+		sha       string
+		verify    string
+		push      bool
+		responses map[string]fakeResponse
+		verified  bool
+		warning   string
+	}{
+		{name: "verify passes", sha: "ccc0095", verify: "make test", verified: true},
+		{name: "nothing to verify", sha: "ccc1095"},
+		{name: "verify fails, pushed anyway", sha: "ccc2095", verify: "make test", push: true, responses: map[string]fakeResponse{"sh -c make test": failed}, warning: "pushed without passing verification: "},
+		{name: "build fails, pushed anyway", sha: "ccc3095", verify: "make test", push: true, responses: map[string]fakeResponse{"plandex build": failed}, warning: "pushed without passing verification: plandex build failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := useFakeRunner(t, tt.responses)
+			p := fakeRunnerPayload(tt.sha)
+			p.VerifyCommand = tt.verify
+			p.PushUnverified = tt.push
+			rec := postFixBuild(t, p)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var res FixBuildResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Verified != tt.verified || !f.called("git push") {
+				t.Fatalf("expected the fix pushed with verified %v, got %+v", tt.verified, res)
+			}
+			// An unverified push has to say so, not just leave the field out
+			var fields map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+				t.Fatal(err)
+			}
+			if v, ok := fields["verified"]; !ok || v != tt.verified {
+				t.Fatalf("expected \"verified\": %v in the response, got %s", tt.verified, rec.Body.String())
+			}
+			warned := slices.ContainsFunc(res.Warnings, func(w string) bool { return tt.warning != "" && strings.HasPrefix(w, tt.warning) })
+			if warned != (tt.warning != "") {
+				t.Fatalf("expected a warning starting %q, got %v", tt.warning, res.Warnings)
+			}
+		})
+	}
+
+	t.Run("not pushed without pushUnverified", func(t *testing.T) {
+		f := useFakeRunner(t, map[string]fakeResponse{"sh -c make test": {out: "--- FAIL: TestWidget", err: &fakeExitError{code: 1}}})
+		p := fakeRunnerPayload("ccc4095")
+		p.VerifyCommand = "make test"
+		if rec := postFixBuild(t, p); rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("expected 422, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if f.called("git push") {
+			t.Fatal("expected an unverified fix not to be pushed")
+		}
+	})
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"plandex-server/handlers"
 	"plandex-server/model"
 	"plandex-server/routes"
 	"plandex-server/setup"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -27,6 +30,20 @@ func main() {
 		model.ShutdownLiteLLMServer()
 	})
 
+	if err := handlers.ValidateFixBuildConfig(); err != nil {
+		log.Fatalf("Invalid fix_build config: %v", err)
+	}
+	if err := handlers.StartFixBuildSweeper(context.Background()); err != nil {
+		log.Fatalf("Failed to start fix_build work dir sweeper: %v", err)
+	}
+	setup.RegisterShutdownHook(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+		if err := handlers.ShutdownFixBuild(ctx); err != nil {
+			log.Printf("fix_build jobs cancelled at shutdown: %v", err)
+		}
+	})
+
 	r := mux.NewRouter()
 	routes.AddHealthRoutes(r)
 	routes.AddApiRoutes(r)
@@ -30,7 +30,19 @@ func EnsureHandlePlandex() {
 func AddHealthRoutes(r *mux.Router) {
 	EnsureHandlePlandex()
 
-	HandlePlandexFn(r, "/fix_build", false, handlers.FixBuildHandler).Methods("POST")
+	// These check the method themselves, so other methods get a JSON 405 with Allow rather
+	// than mux's plain-text one
+	HandlePlandexFn(r, "/fix_build", false, handlers.FixBuildHandler)
+	HandlePlandexFn(r, "/fix_build/preview", false, handlers.FixBuildPreviewHandler)
+	HandlePlandexFn(r, "/fix_build/validate", false, handlers.FixBuildValidateHandler)
+	HandlePlandexFn(r, "/fix_build/batch", false, handlers.FixBuildBatchHandler)
+	HandlePlandexFn(r, "/fix_build/config", false, handlers.FixBuildConfigHandler).Methods("GET")
+	HandlePlandexFn(r, "/fix_build/status/{jobId}", false, handlers.FixBuildStatusHandler).Methods("GET")
+	HandlePlandexFn(r, "/fix_build/status/{jobId}/log", false, handlers.FixBuildLogHandler).Methods("GET")
+	HandlePlandexFn(r, "/fix_build/logs/{jobId}", false, handlers.FixBuildLogArchiveHandler).Methods("GET")
+	HandlePlandexFn(r, "/fix_build/usage/{owner}/{name}", false, handlers.FixBuildUsageHandler).Methods("GET")
+	HandlePlandexFn(r, "/fix_build/cancel/{jobId}", false, handlers.FixBuildCancelHandler).Methods("POST")
+	HandlePlandexFn(r, "/fix_build/reverify/{jobId}", false, handlers.FixBuildReverifyHandler).Methods("POST")
 
 	HandlePlandexFn(r, "/health", false, func(w http.ResponseWriter, r *http.Request) {
 		_, apiErr := hooks.ExecHook(hooks.HealthCheck, hooks.HookParams{})
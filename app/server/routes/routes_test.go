@@ -0,0 +1,34 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFixBuildMethodNotAllowed(t *testing.T) {
+	RegisterHandlePlandex(func(router *mux.Router, path string, isStreaming bool, handler PlandexHandler) *mux.Route {
+		return router.HandleFunc(path, handler)
+	})
+	r := mux.NewRouter()
+	AddHealthRoutes(r)
+
+	for _, path := range []string{"/fix_build", "/fix_build/preview", "/fix_build/validate", "/fix_build/batch"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+			t.Fatalf("%s: expected 405 with Allow: POST, got %d with Allow %q", path, rec.Code, rec.Header().Get("Allow"))
+		}
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != "method_not_allowed" {
+			t.Fatalf("%s: expected a JSON method_not_allowed error, got %q", path, rec.Body.String())
+		}
+	}
+}